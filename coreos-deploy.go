@@ -22,6 +22,7 @@ func init() {
 func main() {
 	opts := &server.Options{}
 	var showVersion bool
+	var newToken, newTokenRole string
 
 	flag.StringVar(&opts.Name, "N", "", "Name of the server.")
 	flag.StringVar(&opts.Name, "name", "", "Name of the server.")
@@ -37,22 +38,78 @@ func main() {
 	flag.IntVar(&opts.ProfPort, "profiler_port", server.DefaultProfPort, "Profiler port to listen on.")
 	flag.IntVar(&opts.MaxProcs, "X", server.DefaultMaxProcs, "Maximum processor cores to use.")
 	flag.IntVar(&opts.MaxProcs, "procs", server.DefaultMaxProcs, "Maximum processor cores to use.")
-	flag.StringVar(&opts.Etcd2Endpoint, "T", server.DefaultEtcd2Endpoint, "IP address and port to the etcd2 service.")
-	flag.StringVar(&opts.Etcd2Endpoint, "etcd2_endpoint", server.DefaultEtcd2Endpoint, "IP address and port to the etcd2 service.")
+	flag.StringVar(&opts.Etcd2Endpoint, "T", server.DefaultEtcd2Endpoint, "Comma list of etcd2 IP:port or URLs.")
+	flag.StringVar(&opts.Etcd2Endpoint, "etcd2_endpoint", server.DefaultEtcd2Endpoint, "Comma list of etcd2 IP:port or URLs.")
+	flag.StringVar(&opts.Etcd2CAFile, "etcd2_ca", "", "PEM file of CAs used to verify etcd2.")
+	flag.StringVar(&opts.Etcd2CertFile, "etcd2_cert", "", "PEM client certificate file for etcd2.")
+	flag.StringVar(&opts.Etcd2KeyFile, "etcd2_key", "", "PEM client private key file for etcd2.")
+	flag.StringVar(&opts.Etcd2Username, "etcd2_username", "", "Basic auth user name for etcd2.")
+	flag.StringVar(&opts.Etcd2Password, "etcd2_password", "", "Basic auth password for etcd2.")
+	flag.DurationVar(&opts.Etcd2Timeout, "etcd2_timeout", server.DefaultEtcd2Timeout, "Timeout of each etcd2 request.")
+	flag.DurationVar(&opts.Etcd2DialTimeout, "etcd2_dial_timeout", server.DefaultEtcd2Dial,
+		"Timeout to connect to an etcd2 member.")
+	flag.DurationVar(&opts.Etcd2SyncInterval, "etcd2_sync_interval", 0, "How often to refresh the etcd2 members.")
 	flag.StringVar(&opts.DSN, "D", "", "DSN connection string.")
 	flag.StringVar(&opts.DSN, "dsn", "", "DSN connection string.")
+	flag.StringVar(&opts.SecretKeyFile, "secret_key_file", "", "File containing the hex key used to encrypt secrets.")
+	flag.StringVar(&opts.RedactHeaders, "log_redact_headers", server.DefaultLogRedactHeaders,
+		"Comma list of headers to redact in the request log.")
+	flag.StringVar(&opts.RedactPaths, "log_redact_paths", "", "Comma list of JSON body paths to redact in the request log.")
+	flag.IntVar(&opts.LogBodyMax, "log_body_max", server.DefaultLogBodyMax, "Maximum body bytes in the request log.")
+	flag.StringVar(&opts.LogFormat, "log_format", logger.FormatText, "Output format of the log: text or json.")
+	flag.StringVar(&opts.LogSinks, "log_sinks", "", "Comma list of KIND[:TARGET][@LEVEL] log sinks.")
+	flag.IntVar(&opts.AuthCacheTTL, "auth_cache_ttl", server.DefaultAuthCacheTTL, "Seconds to cache a valid token.")
+	flag.IntVar(&opts.AuthCacheNegTTL, "auth_cache_neg_ttl", server.DefaultAuthCacheNegTTL,
+		"Seconds to cache an invalid token.")
+	flag.StringVar(&opts.JWTKeySet, "jwt_jwks", "", "File or URL of the JWKS used to validate JWT bearer tokens.")
+	flag.StringVar(&opts.JWTAudience, "jwt_audience", "", "Required audience of JWT bearer tokens.")
+	flag.StringVar(&opts.JWTIssuer, "jwt_issuer", "", "Required issuer of JWT bearer tokens.")
+	flag.StringVar(&opts.JWTRoleClaim, "jwt_role_claim", server.DefaultJWTRoleClaim, "JWT claim holding the role(s).")
+	flag.StringVar(&opts.JWTServiceClaim, "jwt_service_claim", server.DefaultJWTServiceClaim,
+		"JWT claim holding the service name glob.")
+	flag.StringVar(&opts.TLSCert, "tls_cert", "", "PEM certificate file to serve https.")
+	flag.StringVar(&opts.TLSKey, "tls_key", "", "PEM private key file to serve https.")
+	flag.StringVar(&opts.TLSClientCA, "tls_client_ca", "", "PEM file of CAs used to verify client certificates.")
+	flag.BoolVar(&opts.TLSRequireClientCert, "tls_require_client_cert", false, "Require a client certificate.")
+	flag.StringVar(&opts.ApprovalRules, "approval_rules", "", "Comma list of ENV[/SERVICE_GLOB]=COUNT approval rules.")
+	flag.DurationVar(&opts.ApprovalTTL, "approval_ttl", server.DefaultApprovalTTL, "How long a deploy may await approval.")
+	flag.StringVar(&opts.SlackTargets, "slack_targets", "", "Comma list of ENV=URL|CHANNEL slack notification targets.")
+	flag.StringVar(&opts.SlackToken, "slack_token", "", "Slack bot token used to post to channels.")
+	flag.StringVar(&opts.TraceOTLPEndpoint, "trace_otlp_endpoint", "", "OTLP/HTTP collector URL to export spans to.")
+	flag.StringVar(&opts.TraceFile, "trace_file", "", "File to append spans to as JSON.")
 	flag.BoolVar(&opts.Debug, "d", false, "Enable debugging output.")
 	flag.BoolVar(&opts.Debug, "debug", false, "Enable debugging output.")
+	flag.StringVar(&newToken, "create_token", "", "Create an API token with this name, print it, then exit.")
+	flag.StringVar(&newTokenRole, "create_token_role", server.RoleAdmin, "Role of the token made by --create_token.")
 	flag.BoolVar(&showVersion, "V", false, "Show version.")
 	flag.BoolVar(&showVersion, "version", false, "Show version.")
 	flag.Usage = server.PrintUsageAndExit
 	flag.Parse()
 
+	// Log entries as text or JSON.
+	if err := log.SetFormat(opts.LogFormat); err != nil {
+		log.Emergencyf(err.Error())
+	}
+
+	// Log to stdout, syslog or files.
+	if opts.LogSinks != "" {
+		sinks, levels, err := logger.OpenSinks(opts.LogSinks)
+		if err != nil {
+			log.Emergencyf(err.Error())
+		}
+		log.SetSinks(sinks, levels)
+	}
+
 	// Version flag request?
 	if showVersion {
 		server.PrintVersionAndExit()
 	}
 
+	// Bootstrap token request?
+	if newToken != "" {
+		server.PrintNewTokenAndExit(opts.DSN, newToken, newTokenRole)
+	}
+
 	// Check additional params beyond the flags.
 	for _, arg := range flag.Args() {
 		switch strings.ToLower(arg) {
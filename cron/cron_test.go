@@ -0,0 +1,138 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseErrors(t *testing.T) {
+	t.Parallel()
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"* * * FOO *",
+	} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("Expression %q should not parse.", expr)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		expr  string
+		time  string
+		match bool
+	}{
+		{"* * * * *", "2016-03-04 05:06", true},
+		{"30 17 * * FRI", "2016-03-04 17:30", true},
+		{"30 17 * * FRI", "2016-03-04 17:31", false},
+		{"30 17 * * 5", "2016-03-05 17:30", false},
+		{"*/15 9-17 * * MON-FRI", "2016-03-04 09:45", true},
+		{"*/15 9-17 * * MON-FRI", "2016-03-04 09:40", false},
+		{"*/15 9-17 * * MON-FRI", "2016-03-06 09:45", false},
+		{"0 0 1,15 * *", "2016-03-15 00:00", true},
+		{"0 0 * DEC *", "2016-12-25 00:00", true},
+		{"0 0 * DEC *", "2016-11-25 00:00", false},
+		{"0 0 * * 7", "2016-03-06 00:00", true},
+		{"0 0 * * 0", "2016-03-06 00:00", true},
+		{"5/20 * * * *", "2016-03-04 05:45", true},
+		// Both day fields restricted: either may match.
+		{"0 0 13 * FRI", "2016-05-13 00:00", true},
+		{"0 0 13 * FRI", "2016-03-04 00:00", true},
+		{"0 0 13 * FRI", "2016-03-13 00:00", true},
+		{"0 0 13 * FRI", "2016-03-12 00:00", false},
+	}
+	for _, tc := range tests {
+		s, err := Parse(tc.expr)
+		if err != nil {
+			t.Fatalf("Expression %q should parse: %s", tc.expr, err)
+		}
+		if got := s.Matches(mustTime(t, tc.time)); got != tc.match {
+			t.Errorf("Matches(%q, %s)\nExpected:%t\nActual:%t", tc.expr, tc.time, tc.match, got)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		expr string
+		from string
+		next string
+	}{
+		{"* * * * *", "2016-03-04 05:06", "2016-03-04 05:07"},
+		{"0 * * * *", "2016-03-04 05:06", "2016-03-04 06:00"},
+		{"30 17 * * FRI", "2016-03-04 17:30", "2016-03-11 17:30"},
+		{"0 0 1 1 *", "2016-03-04 05:06", "2017-01-01 00:00"},
+		{"0 12 29 2 *", "2016-03-01 00:00", "2020-02-29 12:00"},
+		{"0 0 31 * *", "2016-04-01 00:00", "2016-05-31 00:00"},
+	}
+	for _, tc := range tests {
+		s, _ := Parse(tc.expr)
+		got := s.Next(mustTime(t, tc.from))
+		if !got.Equal(mustTime(t, tc.next)) {
+			t.Errorf("Next(%q, %s)\nExpected:%s\nActual:%s", tc.expr, tc.from, tc.next, got)
+		}
+	}
+
+	s, _ := Parse("0 0 30 2 *")
+	if got := s.Next(mustTime(t, "2016-01-01 00:00")); !got.IsZero() {
+		t.Errorf("An impossible schedule should return the zero time, got %s", got)
+	}
+}
+
+func TestNextInLocation(t *testing.T) {
+	t.Parallel()
+	loc := time.FixedZone("IST", 5*3600+1800)
+	s, _ := Parse("0 9 * * *")
+	got := s.Next(time.Date(2016, 3, 4, 10, 0, 0, 0, loc))
+	if expected := time.Date(2016, 3, 5, 9, 0, 0, 0, loc); !got.Equal(expected) {
+		t.Errorf("Invalid next time in location.\nExpected:%s\nActual:%s", expected, got)
+	}
+}
+
+func TestActive(t *testing.T) {
+	t.Parallel()
+	// A freeze from Friday 17:00 for the weekend.
+	s, _ := Parse("0 17 * * FRI")
+	d := 63 * time.Hour
+	tests := []struct {
+		time   string
+		active bool
+	}{
+		{"2016-03-04 16:59", false},
+		{"2016-03-04 17:00", true},
+		{"2016-03-06 12:00", true},
+		{"2016-03-07 07:59", true},
+		{"2016-03-07 08:00", false},
+		{"2016-03-09 12:00", false},
+	}
+	for _, tc := range tests {
+		start, ok := s.Active(mustTime(t, tc.time), d)
+		if ok != tc.active {
+			t.Errorf("Active(%s)\nExpected:%t\nActual:%t", tc.time, tc.active, ok)
+		}
+		if ok && !start.Equal(mustTime(t, "2016-03-04 17:00")) {
+			t.Errorf("Invalid start of window at %s: %s", tc.time, start)
+		}
+	}
+}
+
+func mustTime(t *testing.T, value string) time.Time {
+	tm, err := time.Parse("2006-01-02 15:04", value)
+	if err != nil {
+		t.Fatalf("Invalid test time %q: %s", value, err)
+	}
+	return tm
+}
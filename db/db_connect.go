@@ -1,9 +1,13 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"strings"
+	"time"
 
+	"github.com/composer22/coreos-deploy/trace"
 	_ "github.com/go-sql-driver/mysql"
 )
 
@@ -12,16 +16,32 @@ const (
 	Started
 	Success
 	Failed
+	PendingApproval
+	Rejected
+	Expired
+	Scheduled
+	Cancelled
+	RolledBack
 )
 
 type DBConnect struct {
-	db *sql.DB
+	db      *sql.DB
+	ctx     context.Context // Bounds the queries and holds the span they are traced under, if any.
+	observe Observer        // Told of each statement, if set.
 }
 
+// Observer is told the statement, duration and error of each statement run.
+type Observer func(statement string, d time.Duration, err error)
+
 // NewDBConnect is a factory method that returns a new db connection
 func NewDBConnect(dsn string) (*DBConnect, error) {
+	return NewDBConnectDriver("mysql", dsn)
+}
 
-	db, err := sql.Open("mysql", dsn)
+// NewDBConnectDriver is a factory method that returns a new db connection made with a registered
+// database/sql driver that speaks the MySQL dialect, such as a wrapped or test driver.
+func NewDBConnectDriver(driver string, dsn string) (*DBConnect, error) {
+	db, err := sql.Open(driver, dsn)
 	if err != nil {
 		return nil, err
 	}
@@ -32,47 +52,410 @@ func NewDBConnect(dsn string) (*DBConnect, error) {
 		return nil, err
 	}
 
-	return &DBConnect{db: db}, nil
+	return &DBConnect{db: db, ctx: context.Background()}, nil
 }
 
-// ValidAuth returns true if the API Key is valid for a request.
-func (d *DBConnect) ValidAuth(key string) bool {
-	var id int
-	row := d.db.QueryRow("SELECT id FROM auth_tokens WHERE token = ?", key)
-	err := row.Scan(&id)
+// WithContext returns a copy of the connection whose queries use the context, so they are traced
+// as children of its span and cancelled with it.
+func (d *DBConnect) WithContext(ctx context.Context) *DBConnect {
+	return &DBConnect{db: d.db, ctx: ctx, observe: d.observe}
+}
 
-	switch {
-	case err == sql.ErrNoRows:
-		return false
-	case err != nil:
-		return false
-	default:
-		return true
+// SetObserver sets the function told of each statement run by the connection and the copies made
+// from it afterwards.
+func (d *DBConnect) SetObserver(o Observer) {
+	d.observe = o
+}
+
+// observed tells the observer, if any, of a statement that began at the start time and ends its span.
+func (d *DBConnect) observed(q string, start time.Time, span *trace.Span, err error) {
+	span.SetError(err)
+	span.End()
+	if d.observe != nil {
+		d.observe(q, time.Since(start), err)
+	}
+}
+
+// query runs a statement that returns rows under a span of the connection context.
+func (d *DBConnect) query(q string, args ...interface{}) (*sql.Rows, error) {
+	ctx, span := startSpan(d.ctx, "db.query", q)
+	start := time.Now()
+	rows, err := d.db.QueryContext(ctx, q, args...)
+	d.observed(q, start, span, err)
+	return rows, err
+}
+
+// queryRow runs a statement that returns at most one row under a span of the connection context.
+func (d *DBConnect) queryRow(q string, args ...interface{}) *sql.Row {
+	ctx, span := startSpan(d.ctx, "db.query", q)
+	start := time.Now()
+	row := d.db.QueryRowContext(ctx, q, args...)
+	d.observed(q, start, span, row.Err())
+	return row
+}
+
+// exec runs a statement that returns no rows under a span of the connection context.
+func (d *DBConnect) exec(q string, args ...interface{}) (sql.Result, error) {
+	ctx, span := startSpan(d.ctx, "db.exec", q)
+	start := time.Now()
+	result, err := d.db.ExecContext(ctx, q, args...)
+	d.observed(q, start, span, err)
+	return result, err
+}
+
+// startSpan begins the span of a statement.
+func startSpan(ctx context.Context, name string, q string) (context.Context, *trace.Span) {
+	ctx, span := trace.Start(ctx, name)
+	span.SetAttr("db.system", "mysql")
+	span.SetAttr("db.statement", q)
+	return ctx, span
+}
+
+// AuthToken is the information about an API token used to authorize a request. The token secret
+// itself is never stored; only a salted hash of it.
+type AuthToken struct {
+	ID             int    `json:"id"`                   // The primary key of the token.
+	Key            string `json:"key"`                  // The public part of the token used for lookups.
+	Salt           string `json:"-"`                    // The salt used to hash the token secret.
+	Hash           string `json:"-"`                    // The salted hash of the token secret.
+	Name           string `json:"name"`                 // The name of the user or service granted authority.
+	Role           string `json:"role"`                 // The role granted: read, deploy or admin.
+	ServicePattern string `json:"servicePattern"`       // Optional glob of service names the token may deploy.
+	CertSubject    string `json:"certSubject"`          // Optional client certificate common name of this identity.
+	Notes          string `json:"notes"`                // General comments.
+	ExpiresAt      string `json:"expiresAt,omitempty"`  // When the token expires, if ever.
+	LastUsedAt     string `json:"lastUsedAt,omitempty"` // The last time the token authorized a request.
+	RevokedAt      string `json:"revokedAt,omitempty"`  // When the token was revoked, if ever.
+	ExpiresIn      int64  `json:"-"`                    // Seconds until the token expires. Zero never expires.
+	UpdatedAt      string `json:"updatedAt"`            // The last update to this record.
+	CreatedAt      string `json:"createdAt"`            // The create date and time of the token.
+}
+
+const authTokenColumns = "id, token_key, token_salt, token_hash, name, role, service_pattern, cert_subject, " +
+	"notes, expires_at, last_used_at, revoked_at, updated_at, created_at"
+
+// scanAuthToken reads a row of authTokenColumns into a new AuthToken. Any additional columns
+// selected after authTokenColumns are read into extra.
+func scanAuthToken(row interface {
+	Scan(dest ...interface{}) error
+}, extra ...interface{}) (*AuthToken, error) {
+	var name, pattern, subject, notes, expires, used, revoked sql.NullString
+	t := &AuthToken{}
+	dest := []interface{}{&t.ID, &t.Key, &t.Salt, &t.Hash, &name, &t.Role, &pattern, &subject, &notes,
+		&expires, &used, &revoked, &t.UpdatedAt, &t.CreatedAt}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+	t.Name = name.String
+	t.ServicePattern = pattern.String
+	t.CertSubject = subject.String
+	t.Notes = notes.String
+	t.ExpiresAt = expires.String
+	t.LastUsedAt = used.String
+	t.RevokedAt = revoked.String
+	return t, nil
+}
+
+// QueryAuth returns the token information for a token key if the token is neither revoked nor expired.
+func (d *DBConnect) QueryAuth(key string) (*AuthToken, error) {
+	return d.queryActiveAuth("token_key", key)
+}
+
+// QueryAuthBySubject returns the token information for a client certificate common name if the
+// token is neither revoked nor expired.
+func (d *DBConnect) QueryAuthBySubject(subject string) (*AuthToken, error) {
+	return d.queryActiveAuth("cert_subject", subject)
+}
+
+// queryActiveAuth returns an active token where the unique column matches the value.
+func (d *DBConnect) queryActiveAuth(column string, value string) (*AuthToken, error) {
+	var expiresIn int64
+	row := d.queryRow("SELECT "+authTokenColumns+", IFNULL(TIMESTAMPDIFF(SECOND, NOW(), expires_at), 0) "+
+		"FROM auth_tokens "+
+		"WHERE "+column+" = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > NOW())", value)
+	t, err := scanAuthToken(row, &expiresIn)
+	if err != nil {
+		return nil, err
+	}
+	t.ExpiresIn = expiresIn
+	return t, nil
+}
+
+// QueryAuthTokens returns all the tokens, including revoked and expired ones.
+func (d *DBConnect) QueryAuthTokens() ([]*AuthToken, error) {
+	rows, err := d.query("SELECT " + authTokenColumns + " FROM auth_tokens ORDER BY id")
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
+	result := make([]*AuthToken, 0)
+	for rows.Next() {
+		t, err := scanAuthToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, t)
+	}
+	return result, rows.Err()
+}
+
+// QueryAuthToken returns a token by its primary key.
+func (d *DBConnect) QueryAuthToken(id int) (*AuthToken, error) {
+	row := d.queryRow("SELECT "+authTokenColumns+" FROM auth_tokens WHERE id = ?", id)
+	return scanAuthToken(row)
+}
+
+// CreateAuthToken inserts a new token and returns its primary key. expiresIn is in seconds from now;
+// zero or less never expires.
+func (d *DBConnect) CreateAuthToken(key string, salt string, hash string, name string, role string,
+	servicePattern string, certSubject string, notes string, expiresIn int64) (int, error) {
+	result, err := d.exec("INSERT INTO auth_tokens (token_key, token_salt, token_hash, name, role, "+
+		"service_pattern, cert_subject, notes, expires_at, updated_at, created_at) "+
+		"VALUES (?, ?, ?, ?, ?, NULLIF(?, ''), NULLIF(?, ''), ?, "+
+		"IF(? > 0, DATE_ADD(NOW(), INTERVAL ? SECOND), NULL), NOW(), NOW())",
+		key, salt, hash, name, role, servicePattern, certSubject, notes, expiresIn, expiresIn)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+// RotateAuthToken replaces the secret hash of an active token. expiresIn is in seconds from now;
+// zero or less never expires.
+func (d *DBConnect) RotateAuthToken(id int, salt string, hash string, expiresIn int64) error {
+	result, err := d.exec("UPDATE auth_tokens "+
+		"SET token_salt = ?, "+
+		"token_hash = ?, "+
+		"expires_at = IF(? > 0, DATE_ADD(NOW(), INTERVAL ? SECOND), NULL), "+
+		"updated_at = NOW() "+
+		"WHERE id = ? AND revoked_at IS NULL",
+		salt, hash, expiresIn, expiresIn, id)
+	return expectOneRow(result, err)
 }
 
-// StartDeploy inserts a fresh row into the log for a deployment run.
+// RevokeAuthToken marks a token as revoked so it can no longer be used.
+func (d *DBConnect) RevokeAuthToken(id int) error {
+	result, err := d.exec("UPDATE auth_tokens SET revoked_at = NOW(), updated_at = NOW() "+
+		"WHERE id = ? AND revoked_at IS NULL", id)
+	return expectOneRow(result, err)
+}
+
+// TouchAuthToken records that the token was used to authorize a request.
+func (d *DBConnect) TouchAuthToken(id int) error {
+	_, err := d.exec("UPDATE auth_tokens SET last_used_at = NOW() WHERE id = ?", id)
+	return err
+}
+
+// SigningClient is a CI system or other client that signs deploy requests with a shared secret
+// instead of sending a bearer token.
+type SigningClient struct {
+	ID             int    `json:"id"`                  // The primary key of the client.
+	ClientID       string `json:"clientID"`            // The public identifier sent by the client.
+	Secret         string `json:"-"`                   // The shared secret, encrypted at rest.
+	ServicePattern string `json:"servicePattern"`      // Optional glob of service names the client may deploy.
+	Notes          string `json:"notes"`               // General comments.
+	RevokedAt      string `json:"revokedAt,omitempty"` // When the client was revoked, if ever.
+	UpdatedAt      string `json:"updatedAt"`           // The last update to this record.
+	CreatedAt      string `json:"createdAt"`           // The create date and time of the client.
+}
+
+const signingClientColumns = "id, client_id, secret, service_pattern, notes, revoked_at, updated_at, created_at"
+
+// scanSigningClient reads a row of signingClientColumns into a new SigningClient.
+func scanSigningClient(row interface {
+	Scan(dest ...interface{}) error
+}) (*SigningClient, error) {
+	var pattern, notes, revoked sql.NullString
+	c := &SigningClient{}
+	if err := row.Scan(&c.ID, &c.ClientID, &c.Secret, &pattern, &notes, &revoked, &c.UpdatedAt,
+		&c.CreatedAt); err != nil {
+		return nil, err
+	}
+	c.ServicePattern = pattern.String
+	c.Notes = notes.String
+	c.RevokedAt = revoked.String
+	return c, nil
+}
+
+// QuerySigningClient returns an active (not revoked) signing client by its public identifier.
+func (d *DBConnect) QuerySigningClient(clientID string) (*SigningClient, error) {
+	row := d.queryRow("SELECT "+signingClientColumns+" FROM signing_clients "+
+		"WHERE client_id = ? AND revoked_at IS NULL", clientID)
+	return scanSigningClient(row)
+}
+
+// QuerySigningClients returns all the signing clients, including revoked ones.
+func (d *DBConnect) QuerySigningClients() ([]*SigningClient, error) {
+	rows, err := d.query("SELECT " + signingClientColumns + " FROM signing_clients ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]*SigningClient, 0)
+	for rows.Next() {
+		c, err := scanSigningClient(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, c)
+	}
+	return result, rows.Err()
+}
+
+// CreateSigningClient inserts a new signing client and returns its primary key.
+// secret should already be encrypted by the caller.
+func (d *DBConnect) CreateSigningClient(clientID string, secret string, servicePattern string,
+	notes string) (int, error) {
+	result, err := d.exec("INSERT INTO signing_clients (client_id, secret, service_pattern, notes, "+
+		"updated_at, created_at) VALUES (?, ?, NULLIF(?, ''), ?, NOW(), NOW())",
+		clientID, secret, servicePattern, notes)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+// RevokeSigningClient marks a signing client as revoked so its signatures are no longer accepted.
+func (d *DBConnect) RevokeSigningClient(id int) error {
+	result, err := d.exec("UPDATE signing_clients SET revoked_at = NOW(), updated_at = NOW() "+
+		"WHERE id = ? AND revoked_at IS NULL", id)
+	return expectOneRow(result, err)
+}
+
+// expectOneRow returns sql.ErrNoRows if the statement did not change exactly one row.
+func expectOneRow(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows != 1 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// StartDeploy inserts a fresh row into the log for a deployment run. etcd2Keys is stored as JSON
+// and should already have any secret values encrypted or redacted by the caller. deployedBy, principal
+// and remoteAddr identify who requested the deploy and metadata holds optional client information.
+// freezeOverride is the reason an admin gave to deploy during a freeze window, if any.
 func (d *DBConnect) StartDeploy(deployID string, domain string, environment string, serviceName string,
-	version string, numInstances int, serviceTemplate string, etcd2Keys map[string]string,
-	suffix string) bool {
+	version string, numInstances int, serviceTemplate string, etcd2Keys interface{},
+	suffix string, deployedBy string, principal string, remoteAddr string, metadata map[string]string,
+	freezeOverride string) bool {
+	return d.insertDeploy(Started, "Start deploy.", 0, 0, "", deployID, domain, environment, serviceName,
+		version, numInstances, serviceTemplate, etcd2Keys, suffix, deployedBy, principal, remoteAddr,
+		metadata, freezeOverride) == nil
+}
+
+// HoldDeploy inserts a row for a deploy that runs later. With a status of PendingApproval it may not
+// run until it has approvalsRequired approvals, and expires if it is not approved within expiresIn
+// seconds; zero or less never expires. With a status of Scheduled it runs at notBefore, a UTC datetime.
+// Secret values in etcd2Keys must be encrypted, as they are needed when the deploy resumes.
+func (d *DBConnect) HoldDeploy(deployID string, domain string, environment string, serviceName string,
+	version string, numInstances int, serviceTemplate string, etcd2Keys interface{},
+	suffix string, deployedBy string, principal string, remoteAddr string, metadata map[string]string,
+	freezeOverride string, status int, approvalsRequired int, expiresIn int64, notBefore string) error {
+	message := "Awaiting approval."
+	if status == Scheduled {
+		message = "Scheduled."
+	}
+	return d.insertDeploy(status, message, approvalsRequired, expiresIn, notBefore, deployID, domain,
+		environment, serviceName, version, numInstances, serviceTemplate, etcd2Keys, suffix, deployedBy,
+		principal, remoteAddr, metadata, freezeOverride)
+}
+
+// insertDeploy inserts a fresh row into the log for a deploy with the initial status and message.
+func (d *DBConnect) insertDeploy(status int, message string, approvalsRequired int, expiresIn int64,
+	notBefore string, deployID string, domain string, environment string, serviceName string, version string,
+	numInstances int, serviceTemplate string, etcd2Keys interface{}, suffix string, deployedBy string,
+	principal string, remoteAddr string, metadata map[string]string, freezeOverride string) error {
 	etcd2, _ := json.Marshal(etcd2Keys)
-	result, err := d.db.Exec("INSERT INTO deploys (deploy_id, domain, environment, service_name, version, "+
-		"num_instances, service_template, etcd2_keys, status, suffix, message, log, updated_at, created_at) "+
-		"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, \"Start deploy.\", \"Start deploy.\", NOW(), NOW())",
-		deployID, domain, environment, serviceName, version, numInstances, serviceTemplate, etcd2, Started, suffix)
+	var meta interface{}
+	if len(metadata) > 0 {
+		b, _ := json.Marshal(metadata)
+		meta = string(b)
+	}
+	result, err := d.exec("INSERT INTO deploys (deploy_id, domain, environment, service_name, version, "+
+		"num_instances, service_template, etcd2_keys, status, suffix, deployed_by, principal, remote_addr, "+
+		"metadata, freeze_override, approvals_required, expires_at, not_before, message, log, updated_at, "+
+		"created_at) "+
+		"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, "+
+		"IF(? > 0, DATE_ADD(NOW(), INTERVAL ? SECOND), NULL), NULLIF(?, ''), ?, ?, NOW(), NOW())",
+		deployID, domain, environment, serviceName, version, numInstances, serviceTemplate, etcd2, status, suffix,
+		deployedBy, principal, remoteAddr, meta, freezeOverride, approvalsRequired, expiresIn, expiresIn,
+		notBefore, message, message)
 	if err != nil {
-		return false
+		return err
 	}
 	id, err := result.LastInsertId()
-	if err != nil || id <= 0 {
-		return false
+	if err != nil {
+		return err
 	}
-	return true
+	if id <= 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// TransitionDeploy moves a deploy from one status to another. An error is returned if the deploy
+// is not in the from status or is awaiting approval beyond its expiry, so only one caller can make
+// the transition.
+func (d *DBConnect) TransitionDeploy(deployID string, from int, to int, message string) error {
+	return expectOneRow(d.exec("UPDATE deploys SET status = ?, message = ?, updated_at = NOW() "+
+		"WHERE deploy_id = ? AND status = ? AND (status <> ? OR expires_at IS NULL OR expires_at > NOW())",
+		to, message, deployID, from, PendingApproval))
+}
+
+// QueryScheduledDeploys returns the scheduled deploys in order of when they run. If due is true,
+// only those whose time has come are returned.
+func (d *DBConnect) QueryScheduledDeploys(due bool) ([]*DeployStatus, error) {
+	q := "SELECT " + deployStatusColumns + " FROM deploys WHERE status = ?"
+	if due {
+		q += " AND not_before <= UTC_TIMESTAMP()"
+	}
+	rows, err := d.query(q+" ORDER BY not_before, id", Scheduled)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]*DeployStatus, 0)
+	for rows.Next() {
+		r, err := scanDeployStatus(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, r)
+	}
+	return result, rows.Err()
+}
+
+// ExpireDeploys marks deploys awaiting approval beyond their expiry as expired and returns how many.
+func (d *DBConnect) ExpireDeploys() (int64, error) {
+	result, err := d.exec("UPDATE deploys SET status = ?, message = \"Approval expired.\", updated_at = NOW() "+
+		"WHERE status = ? AND expires_at IS NOT NULL AND expires_at <= NOW()", Expired, PendingApproval)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// QueryDeploySource returns the service template and the stored JSON of the etcd2 keys of a deploy
+// so that it can be run after it was requested.
+func (d *DBConnect) QueryDeploySource(deployID string) (serviceTemplate string, etcd2Keys string, err error) {
+	var tmpl, keys sql.NullString
+	err = d.queryRow("SELECT service_template, etcd2_keys FROM deploys WHERE deploy_id = ?",
+		deployID).Scan(&tmpl, &keys)
+	return tmpl.String, keys.String, err
 }
 
 // UpdateDeploy updates the deploy row with information from the run.
 func (d *DBConnect) UpdateDeploy(deployID string, status int, message string, log string) bool {
-	result, err := d.db.Exec("UPDATE deploys "+
+	result, err := d.exec("UPDATE deploys "+
 		"SET status = ?, "+
 		"message = ?, "+
 		"log = ?, "+
@@ -91,36 +474,383 @@ func (d *DBConnect) UpdateDeploy(deployID string, status int, message string, lo
 
 // DeployStatus is used to return deploy status information from the database to the requester.
 type DeployStatus struct {
-	DeployID     string `json:"deployID"`     // The deploy UUID.
-	Domain       string `json:"domain"`       // The domain name serviced.
-	Environment  string `json:"environment"`  // The environment serviced (development, qa etc.)
-	ServiceName  string `json:"serviceName"`  // The application name of the service ex: video-mobile.
-	Version      string `json:"version"`      // The version of teh application ex; 1.0.0
-	Suffix       string `json:"suffix"`       // The suffix added to the service name.
-	NumInstances int    `json:"numInstances"` // The number of instances deployed.
-	Status       int    `json:"status"`       // The status ID of the result.
-	Message      string `json:"message"`      // A user friendly message of what occurred.
-	Log          string `json:"log"`          // The log of all steps run during the deploy.
-	UpdatedAt    string `json:"updatedAt"`    // The create date and time of the deploy.
-	CreatedAt    string `json:"createdAt"`    // The last update to this record.
+	DeployID       string            `json:"deployID"`                 // The deploy UUID.
+	Domain         string            `json:"domain"`                   // The domain name serviced.
+	Environment    string            `json:"environment"`              // The environment serviced (development, qa etc.)
+	ServiceName    string            `json:"serviceName"`              // The application name of the service ex: video-mobile.
+	Version        string            `json:"version"`                  // The version of teh application ex; 1.0.0
+	Suffix         string            `json:"suffix"`                   // The suffix added to the service name.
+	NumInstances   int               `json:"numInstances"`             // The number of instances deployed.
+	Status         int               `json:"status"`                   // The status ID of the result.
+	DeployedBy     string            `json:"deployedBy"`               // The token name, JWT subject or client that requested it.
+	Principal      string            `json:"-"`                        // The unique key of the identity that requested it.
+	RemoteAddr     string            `json:"remoteAddr"`               // The address the deploy was requested from.
+	Metadata       map[string]string `json:"metadata,omitempty"`       // Optional client information, ex: reason, ticket.
+	FreezeOverride string            `json:"freezeOverride,omitempty"` // Why an admin deployed during a freeze window.
+	Required       int               `json:"approvalsRequired"`        // The approvals needed before the deploy may run.
+	ExpiresAt      string            `json:"expiresAt,omitempty"`      // When an unapproved deploy expires.
+	NotBefore      string            `json:"notBefore,omitempty"`      // When a scheduled deploy runs (UTC).
+	Approvals      []*Approval       `json:"approvals,omitempty"`      // The approvals and rejections of the deploy.
+	Steps          []*DeployStep     `json:"steps,omitempty"`          // The steps run by the deploy.
+	Message        string            `json:"message"`                  // A user friendly message of what occurred.
+	Log            string            `json:"log"`                      // The log of all steps run during the deploy.
+	UpdatedAt      string            `json:"updatedAt"`                // The create date and time of the deploy.
+	CreatedAt      string            `json:"createdAt"`                // The last update to this record.
 }
 
-// QueryDeploy returns the status of a deploy request.
-func (d *DBConnect) QueryDeploy(deployID string) (*DeployStatus, error) {
+// DeployFilter selects deploys from the history. Empty fields are not filtered.
+type DeployFilter struct {
+	ServiceName string // Exact service name.
+	DeployedBy  string // Exact requester name.
+	Status      int    // Status ID. Zero is any status.
+	Limit       int    // Maximum number of deploys. Zero or less is no limit.
+
+	// Allows optionally returns false for service names that are skipped, such as those outside the
+	// service pattern of the requester. Skipped deploys do not count toward the limit.
+	Allows func(serviceName string) bool
+}
+
+const deployStatusColumns = "deploy_id, domain, environment, service_name, version, num_instances, status, " +
+	"suffix, deployed_by, principal, remote_addr, metadata, freeze_override, approvals_required, expires_at, " +
+	"not_before, message, log, updated_at, created_at"
+
+// scanDeployStatus reads a deploy status from a row selected with deployStatusColumns.
+func scanDeployStatus(row interface {
+	Scan(...interface{}) error
+}) (*DeployStatus, error) {
 	r := &DeployStatus{}
-	row := d.db.QueryRow("SELECT deploy_id, domain, environment, service_name, version, "+
-		"num_instances, status, suffix, message, log, updated_at, created_at "+
-		"FROM deploys WHERE deploy_id = ?", deployID)
+	var metadata, expiresAt, notBefore sql.NullString
 	err := row.Scan(&r.DeployID, &r.Domain, &r.Environment, &r.ServiceName, &r.Version, &r.NumInstances,
-		&r.Status, &r.Suffix, &r.Message, &r.Log, &r.UpdatedAt, &r.CreatedAt)
-	switch {
-	case err == sql.ErrNoRows:
+		&r.Status, &r.Suffix, &r.DeployedBy, &r.Principal, &r.RemoteAddr, &metadata, &r.FreezeOverride,
+		&r.Required, &expiresAt, &notBefore, &r.Message, &r.Log, &r.UpdatedAt, &r.CreatedAt)
+	if err != nil {
 		return nil, err
-	case err != nil:
+	}
+	r.ExpiresAt, r.NotBefore = expiresAt.String, notBefore.String
+	if metadata.Valid && metadata.String != "" {
+		json.Unmarshal([]byte(metadata.String), &r.Metadata)
+	}
+	return r, nil
+}
+
+// QueryDeploy returns the status of a deploy request.
+func (d *DBConnect) QueryDeploy(deployID string) (*DeployStatus, error) {
+	return scanDeployStatus(d.queryRow("SELECT "+deployStatusColumns+" FROM deploys WHERE deploy_id = ?",
+		deployID))
+}
+
+// QueryDeploys returns the deploys matching the filter, newest first.
+func (d *DBConnect) QueryDeploys(f *DeployFilter) ([]*DeployStatus, error) {
+	where := make([]string, 0)
+	args := make([]interface{}, 0)
+	if f.ServiceName != "" {
+		where = append(where, "service_name = ?")
+		args = append(args, f.ServiceName)
+	}
+	if f.DeployedBy != "" {
+		where = append(where, "deployed_by = ?")
+		args = append(args, f.DeployedBy)
+	}
+	if f.Status > 0 {
+		where = append(where, "status = ?")
+		args = append(args, f.Status)
+	}
+	q := "SELECT " + deployStatusColumns + " FROM deploys"
+	if len(where) > 0 {
+		q += " WHERE " + strings.Join(where, " AND ")
+	}
+	q += " ORDER BY id DESC"
+	if f.Limit <= 0 {
+		result := make([]*DeployStatus, 0)
+		if _, err := d.queryDeploysPage(q, args, f.Allows, &result); err != nil {
+			return nil, err
+		}
+		return result, nil
+	}
+
+	// Skipped deploys are not counted, so pages of the limit are read until enough are allowed.
+	q += " LIMIT ? OFFSET ?"
+	result := make([]*DeployStatus, 0, f.Limit)
+	for offset := 0; len(result) < f.Limit; offset += f.Limit {
+		n, err := d.queryDeploysPage(q, append(args, f.Limit, offset), f.Allows, &result)
+		if err != nil {
+			return nil, err
+		}
+		if n < f.Limit {
+			break
+		}
+	}
+	if len(result) > f.Limit {
+		result = result[:f.Limit]
+	}
+	return result, nil
+}
+
+// queryDeploysPage appends the allowed deploys of a query to the result and returns the number of
+// deploys read.
+func (d *DBConnect) queryDeploysPage(q string, args []interface{}, allows func(string) bool,
+	result *[]*DeployStatus) (int, error) {
+	rows, err := d.query(q, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	n := 0
+	for rows.Next() {
+		r, err := scanDeployStatus(rows)
+		if err != nil {
+			return n, err
+		}
+		n++
+		if allows == nil || allows(r.ServiceName) {
+			*result = append(*result, r)
+		}
+	}
+	return n, rows.Err()
+}
+
+// DeployOutcome is the result and timing of a completed deploy, used for reporting.
+type DeployOutcome struct {
+	ServiceName string // The service deployed.
+	Environment string // The environment deployed to.
+	Status      int    // Success, Failed or RolledBack.
+	StartedAt   string // When the deploy was requested, or scheduled to start if later.
+	CompletedAt string // When the deploy finished.
+}
+
+// QueryDeployOutcomes returns the deploys that completed within the window, oldest first. since and
+// until are datetimes in the DB clock; either may be empty to leave the window open. environment and
+// serviceName filter exactly when given.
+func (d *DBConnect) QueryDeployOutcomes(since string, until string, environment string,
+	serviceName string) ([]*DeployOutcome, error) {
+	where := []string{"status IN (?, ?, ?)"}
+	args := []interface{}{Success, Failed, RolledBack}
+	if since != "" {
+		where = append(where, "updated_at >= ?")
+		args = append(args, since)
+	}
+	if until != "" {
+		where = append(where, "updated_at < ?")
+		args = append(args, until)
+	}
+	if environment != "" {
+		where = append(where, "environment = ?")
+		args = append(args, environment)
+	}
+	if serviceName != "" {
+		where = append(where, "service_name = ?")
+		args = append(args, serviceName)
+	}
+	// not_before is UTC while created_at and updated_at are in the DB clock.
+	rows, err := d.query("SELECT service_name, environment, status, "+
+		"IFNULL(GREATEST(created_at, not_before + INTERVAL TIMESTAMPDIFF(SECOND, UTC_TIMESTAMP(), NOW()) SECOND), "+
+		"created_at), updated_at FROM deploys WHERE "+strings.Join(where, " AND ")+" ORDER BY updated_at, id",
+		args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]*DeployOutcome, 0)
+	for rows.Next() {
+		o := &DeployOutcome{}
+		if err := rows.Scan(&o.ServiceName, &o.Environment, &o.Status, &o.StartedAt, &o.CompletedAt); err != nil {
+			return nil, err
+		}
+		result = append(result, o)
+	}
+	return result, rows.Err()
+}
+
+// Decisions recorded on a deploy awaiting approval.
+const (
+	Approve = "approve"
+	Reject  = "reject"
+)
+
+// Approval is the decision of one approver on a deploy.
+type Approval struct {
+	ID        int    `json:"id"`        // The primary key of the approval.
+	DeployID  string `json:"deployID"`  // The deploy UUID.
+	Approver  string `json:"approver"`  // The name of the identity that decided.
+	Principal string `json:"-"`         // The unique key of the identity that decided.
+	Decision  string `json:"decision"`  // approve or reject.
+	Comment   string `json:"comment"`   // Optional reason given by the approver.
+	CreatedAt string `json:"createdAt"` // When the decision was made.
+}
+
+// InsertApproval records the decision of an approver. An approver, told apart by its principal, may
+// only decide once per deploy.
+func (d *DBConnect) InsertApproval(deployID string, approver string, principal string, decision string,
+	comment string) error {
+	_, err := d.exec("INSERT INTO deploy_approvals (deploy_id, approver, principal, decision, comment, "+
+		"created_at) VALUES (?, ?, ?, ?, ?, NOW())", deployID, approver, principal, decision, comment)
+	return err
+}
+
+// QueryApprovals returns the decisions made on a deploy, oldest first.
+func (d *DBConnect) QueryApprovals(deployID string) ([]*Approval, error) {
+	rows, err := d.query("SELECT id, deploy_id, approver, principal, decision, comment, created_at "+
+		"FROM deploy_approvals WHERE deploy_id = ? ORDER BY id", deployID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]*Approval, 0)
+	for rows.Next() {
+		a := &Approval{}
+		if err := rows.Scan(&a.ID, &a.DeployID, &a.Approver, &a.Principal, &a.Decision, &a.Comment,
+			&a.CreatedAt); err != nil {
+			return nil, err
+		}
+		result = append(result, a)
+	}
+	return result, rows.Err()
+}
+
+// FreezeWindow is a period during which deploys are not allowed. A window either repeats, starting
+// at times matching a cron schedule for a duration, or is an explicit range of datetimes.
+type FreezeWindow struct {
+	ID             int    `json:"id"`                 // The primary key of the window.
+	Environment    string `json:"environment"`        // The environment that is frozen.
+	ServicePattern string `json:"servicePattern"`     // Optional glob of the service names frozen; empty is all.
+	Schedule       string `json:"schedule,omitempty"` // Cron expression of when a repeating window starts.
+	Duration       string `json:"duration,omitempty"` // How long a repeating window lasts, ex: "63h".
+	StartsAt       string `json:"startsAt,omitempty"` // Start of an explicit range (UTC).
+	EndsAt         string `json:"endsAt,omitempty"`   // End of an explicit range (UTC).
+	Timezone       string `json:"timezone"`           // Location the schedule is evaluated in.
+	Reason         string `json:"reason"`             // Why deploys are frozen.
+	CreatedBy      string `json:"createdBy"`          // The name of the identity that created the window.
+	CreatedAt      string `json:"createdAt"`          // The create date and time of the window.
+}
+
+// QueryFreezeWindows returns the freeze windows of an environment or of all environments if empty.
+func (d *DBConnect) QueryFreezeWindows(environment string) ([]*FreezeWindow, error) {
+	q := "SELECT id, environment, service_pattern, schedule, duration, starts_at, ends_at, timezone, reason, " +
+		"created_by, created_at FROM freeze_windows"
+	args := make([]interface{}, 0)
+	if environment != "" {
+		q += " WHERE environment = ?"
+		args = append(args, environment)
+	}
+	rows, err := d.query(q+" ORDER BY id", args...)
+	if err != nil {
 		return nil, err
-	default:
-		return r, nil
 	}
+	defer rows.Close()
+	result := make([]*FreezeWindow, 0)
+	for rows.Next() {
+		w := &FreezeWindow{}
+		var startsAt, endsAt sql.NullString
+		if err := rows.Scan(&w.ID, &w.Environment, &w.ServicePattern, &w.Schedule, &w.Duration, &startsAt,
+			&endsAt, &w.Timezone, &w.Reason, &w.CreatedBy, &w.CreatedAt); err != nil {
+			return nil, err
+		}
+		w.StartsAt, w.EndsAt = startsAt.String, endsAt.String
+		result = append(result, w)
+	}
+	return result, rows.Err()
+}
+
+// CreateFreezeWindow inserts a new freeze window and returns its id. startsAt and endsAt are
+// UTC datetimes and may be empty for a repeating window.
+func (d *DBConnect) CreateFreezeWindow(environment string, servicePattern string, schedule string,
+	duration string, startsAt string, endsAt string, timezone string, reason string,
+	createdBy string) (int, error) {
+	result, err := d.exec("INSERT INTO freeze_windows (environment, service_pattern, schedule, duration, "+
+		"starts_at, ends_at, timezone, reason, created_by, created_at) "+
+		"VALUES (?, ?, ?, ?, NULLIF(?, ''), NULLIF(?, ''), ?, ?, ?, NOW())",
+		environment, servicePattern, schedule, duration, startsAt, endsAt, timezone, reason, createdBy)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+// DeleteFreezeWindow removes a freeze window.
+func (d *DBConnect) DeleteFreezeWindow(id int) error {
+	return expectOneRow(d.exec("DELETE FROM freeze_windows WHERE id = ?", id))
+}
+
+// AuditEvent is a record of a mutating API action.
+type AuditEvent struct {
+	ID          int    `json:"id"`          // The primary key of the event.
+	Actor       string `json:"actor"`       // The name of the authenticated caller, if any.
+	Action      string `json:"action"`      // What was attempted, ex: deploy.create.
+	ServiceName string `json:"serviceName"` // The service acted upon, if any.
+	RequestID   string `json:"requestID"`   // The X-Request-ID of the API call.
+	SourceIP    string `json:"sourceIP"`    // The remote address of the caller.
+	Outcome     string `json:"outcome"`     // success, denied or failed.
+	StatusCode  int    `json:"statusCode"`  // The HTTP status returned to the caller.
+	Detail      string `json:"detail"`      // Additional information such as the target id.
+	CreatedAt   string `json:"createdAt"`   // When the event occurred (UTC).
+}
+
+// AuditFilter selects audit events. Empty fields are not filtered.
+type AuditFilter struct {
+	Actor       string // Exact actor name.
+	Action      string // Exact action.
+	ServiceName string // Exact service name.
+	Outcome     string // Exact outcome.
+	Since       string // Events created at or after this datetime.
+	Until       string // Events created before this datetime.
+	Limit       int    // Maximum number of events. Zero or less is no limit.
+}
+
+// InsertAuditEvent records an audit event.
+func (d *DBConnect) InsertAuditEvent(e *AuditEvent) error {
+	_, err := d.exec("INSERT INTO audit_events (actor, action, service_name, request_id, source_ip, "+
+		"outcome, status_code, detail, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, UTC_TIMESTAMP())",
+		e.Actor, e.Action, e.ServiceName, e.RequestID, e.SourceIP, e.Outcome, e.StatusCode, e.Detail)
+	return err
+}
+
+// QueryAuditEvents returns the audit events matching the filter, newest first.
+func (d *DBConnect) QueryAuditEvents(f *AuditFilter) ([]*AuditEvent, error) {
+	where := make([]string, 0)
+	args := make([]interface{}, 0)
+	for _, c := range []struct {
+		sql   string
+		value string
+	}{
+		{"actor = ?", f.Actor},
+		{"action = ?", f.Action},
+		{"service_name = ?", f.ServiceName},
+		{"outcome = ?", f.Outcome},
+		{"created_at >= ?", f.Since},
+		{"created_at < ?", f.Until},
+	} {
+		if c.value != "" {
+			where = append(where, c.sql)
+			args = append(args, c.value)
+		}
+	}
+	q := "SELECT id, actor, action, service_name, request_id, source_ip, outcome, status_code, detail, " +
+		"created_at FROM audit_events"
+	if len(where) > 0 {
+		q += " WHERE " + strings.Join(where, " AND ")
+	}
+	q += " ORDER BY id DESC"
+	if f.Limit > 0 {
+		q += " LIMIT ?"
+		args = append(args, f.Limit)
+	}
+
+	rows, err := d.query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]*AuditEvent, 0)
+	for rows.Next() {
+		e := &AuditEvent{}
+		if err := rows.Scan(&e.ID, &e.Actor, &e.Action, &e.ServiceName, &e.RequestID, &e.SourceIP,
+			&e.Outcome, &e.StatusCode, &e.Detail, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		result = append(result, e)
+	}
+	return result, rows.Err()
 }
 
 // Close closes the connection(s) to the DB.
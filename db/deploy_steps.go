@@ -0,0 +1,70 @@
+package db
+
+import "database/sql"
+
+// DeployStep is one step of a deploy, such as install_template, with the fleetctl commands it ran.
+type DeployStep struct {
+	ID        int64   `json:"-"`                  // The primary key of the step.
+	DeployID  string  `json:"-"`                  // The deploy UUID.
+	Name      string  `json:"name"`               // The step, ex: write_unit, apply_keys, install_template, flip_ab.
+	Status    int     `json:"status"`             // Started while running, then Success, Failed or RolledBack.
+	Command   string  `json:"command,omitempty"`  // The commands run by the step, one per line.
+	Stdout    string  `json:"stdout,omitempty"`   // The standard output of the commands.
+	Stderr    string  `json:"stderr,omitempty"`   // The standard error of the commands.
+	ExitCode  *int    `json:"exitCode,omitempty"` // The exit code of the last command, if any ran.
+	StartedAt string  `json:"startedAt"`          // When the step began.
+	EndedAt   string  `json:"endedAt,omitempty"`  // When the step ended, if it has.
+	Duration  float64 `json:"duration,omitempty"` // Seconds the step took, once ended.
+}
+
+// StartDeployStep records the start of a step of a deploy and sets the ID of the step.
+func (d *DBConnect) StartDeployStep(s *DeployStep) error {
+	result, err := d.exec("INSERT INTO deploy_steps (deploy_id, name, status, started_at) VALUES (?, ?, ?, NOW(3))",
+		s.DeployID, s.Name, Started)
+	if err != nil {
+		return err
+	}
+	s.ID, err = result.LastInsertId()
+	return err
+}
+
+// EndDeployStep records the end of a step with its status, commands and their output.
+func (d *DBConnect) EndDeployStep(s *DeployStep) error {
+	var exitCode sql.NullInt64
+	if s.ExitCode != nil {
+		exitCode = sql.NullInt64{Int64: int64(*s.ExitCode), Valid: true}
+	}
+	return expectOneRow(d.exec("UPDATE deploy_steps "+
+		"SET status = ?, command = ?, stdout = ?, stderr = ?, exit_code = ?, ended_at = NOW(3) "+
+		"WHERE id = ?", s.Status, s.Command, s.Stdout, s.Stderr, exitCode, s.ID))
+}
+
+// QueryDeploySteps returns the steps of a deploy in the order they were run.
+func (d *DBConnect) QueryDeploySteps(deployID string) ([]*DeployStep, error) {
+	rows, err := d.query("SELECT id, deploy_id, name, status, command, stdout, stderr, exit_code, started_at, "+
+		"ended_at, TIMESTAMPDIFF(MICROSECOND, started_at, ended_at) / 1000000 "+
+		"FROM deploy_steps WHERE deploy_id = ? ORDER BY id", deployID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]*DeployStep, 0)
+	for rows.Next() {
+		s := &DeployStep{}
+		var command, stdout, stderr, endedAt sql.NullString
+		var exitCode sql.NullInt64
+		var duration sql.NullFloat64
+		if err := rows.Scan(&s.ID, &s.DeployID, &s.Name, &s.Status, &command, &stdout, &stderr, &exitCode,
+			&s.StartedAt, &endedAt, &duration); err != nil {
+			return nil, err
+		}
+		s.Command, s.Stdout, s.Stderr, s.EndedAt, s.Duration = command.String, stdout.String, stderr.String,
+			endedAt.String, duration.Float64
+		if exitCode.Valid {
+			code := int(exitCode.Int64)
+			s.ExitCode = &code
+		}
+		result = append(result, s)
+	}
+	return result, rows.Err()
+}
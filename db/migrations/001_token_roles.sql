@@ -0,0 +1,12 @@
+-- Grants each token a role and an optional glob of the services it may deploy, and notes that
+-- secret etcd2 values are encrypted or redacted in the deploy record.
+--
+-- Existing tokens are given the deploy role and may deploy any service. Grant admin to the tokens
+-- that manage others with UPDATE `auth_tokens` SET `role` = 'admin' WHERE `id` = <id>.
+
+ALTER TABLE `deploys`
+  MODIFY `etcd2_keys` text COMMENT 'a json of etcd2 keys that were updated in this deploy. Secret values are encrypted or redacted.';
+
+ALTER TABLE `auth_tokens`
+  ADD COLUMN `role` varchar(32) NOT NULL DEFAULT 'deploy' COMMENT 'The permissions granted to this token: read, deploy or admin.' AFTER `notes`,
+  ADD COLUMN `service_pattern` varchar(255) DEFAULT NULL COMMENT 'An optional glob of service names this token may deploy, for example acme-video-*.' AFTER `role`;
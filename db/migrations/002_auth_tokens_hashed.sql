@@ -0,0 +1,28 @@
+-- Upgrades `auth_tokens` from plaintext tokens to salted hashes of a <key>.<secret> token with
+-- expiry and revocation.
+--
+-- A plaintext token cannot be converted to the new form, so each existing row keeps its name,
+-- role and service pattern, but no longer authorizes requests: it is given a placeholder key and
+-- an empty hash that no secret matches. Create an admin token with --create_token, then issue a
+-- new secret for each row with POST /v1.0/tokens/{id}/rotate.
+
+ALTER TABLE `auth_tokens`
+  ADD COLUMN `token_key` varchar(32) DEFAULT NULL COMMENT 'The public part of the bearer token used to look up this row.' AFTER `id`,
+  ADD COLUMN `token_salt` varchar(64) DEFAULT NULL COMMENT 'The random salt used when hashing the token secret.' AFTER `token_key`,
+  ADD COLUMN `token_hash` varchar(128) DEFAULT NULL COMMENT 'The salted SHA-256 hash of the token secret. The secret itself is never stored.' AFTER `token_salt`,
+  ADD COLUMN `expires_at` datetime DEFAULT NULL COMMENT 'When the token expires. NULL never expires.' AFTER `updated_at`,
+  ADD COLUMN `last_used_at` datetime DEFAULT NULL COMMENT 'The last time the token authorized a request.' AFTER `expires_at`,
+  ADD COLUMN `revoked_at` datetime DEFAULT NULL COMMENT 'When the token was revoked. NULL is active.' AFTER `last_used_at`;
+
+UPDATE `auth_tokens`
+   SET `token_key` = CONCAT('legacy-', `id`),
+       `token_salt` = '',
+       `token_hash` = '';
+
+ALTER TABLE `auth_tokens`
+  MODIFY `token_key` varchar(32) NOT NULL COMMENT 'The public part of the bearer token used to look up this row.',
+  MODIFY `token_salt` varchar(64) NOT NULL COMMENT 'The random salt used when hashing the token secret.',
+  MODIFY `token_hash` varchar(128) NOT NULL COMMENT 'The salted SHA-256 hash of the token secret. The secret itself is never stored.',
+  DROP INDEX `token_UNIQUE`,
+  DROP COLUMN `token`,
+  ADD UNIQUE KEY `token_key_UNIQUE` (`token_key`);
@@ -0,0 +1,15 @@
+-- Adds the clients allowed to send HMAC signed deploy requests.
+
+CREATE TABLE `signing_clients` (
+  `id` int(11) NOT NULL AUTO_INCREMENT COMMENT 'The primary key for each entry in the table.',
+  `client_id` varchar(255) NOT NULL COMMENT 'The public identifier sent by the client in the X-Client-ID header.',
+  `secret` varchar(255) NOT NULL COMMENT 'The shared HMAC secret, encrypted with the server secret key.',
+  `service_pattern` varchar(255) DEFAULT NULL COMMENT 'An optional glob of service names this client may deploy, for example acme-video-*.',
+  `notes` text COMMENT 'General comments.',
+  `revoked_at` datetime DEFAULT NULL COMMENT 'When the client was revoked. NULL is active.',
+  `created_at` datetime NOT NULL COMMENT 'The create date for this row.',
+  `updated_at` datetime NOT NULL COMMENT 'The last update date for this row.',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `id_UNIQUE` (`id`),
+  UNIQUE KEY `client_id_UNIQUE` (`client_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
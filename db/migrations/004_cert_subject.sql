@@ -0,0 +1,5 @@
+-- Maps a client certificate common name to a token so a verified mTLS client authenticates as it.
+
+ALTER TABLE `auth_tokens`
+  ADD COLUMN `cert_subject` varchar(255) DEFAULT NULL COMMENT 'An optional client certificate common name that authenticates as this identity over mTLS.' AFTER `service_pattern`,
+  ADD UNIQUE KEY `cert_subject_UNIQUE` (`cert_subject`);
@@ -0,0 +1,18 @@
+-- Adds the audit log of mutating API actions.
+
+CREATE TABLE `audit_events` (
+  `id` int(11) NOT NULL AUTO_INCREMENT COMMENT 'The primary key for each entry in the table.',
+  `actor` varchar(255) NOT NULL DEFAULT '' COMMENT 'The name of the authenticated token, JWT subject or signing client. Empty if unauthenticated.',
+  `action` varchar(255) NOT NULL COMMENT 'The action attempted, for example deploy.create or token.revoke.',
+  `service_name` varchar(255) NOT NULL DEFAULT '' COMMENT 'The service acted upon, if any.',
+  `request_id` varchar(255) NOT NULL COMMENT 'The X-Request-ID of the API call.',
+  `source_ip` varchar(255) NOT NULL COMMENT 'The remote address of the caller.',
+  `outcome` varchar(32) NOT NULL COMMENT 'The result of the action: success, denied or failed.',
+  `status_code` int(11) NOT NULL COMMENT 'The HTTP status returned to the caller.',
+  `detail` varchar(255) NOT NULL DEFAULT '' COMMENT 'Additional information, such as the id of the target.',
+  `created_at` datetime NOT NULL COMMENT 'When the event occurred in UTC.',
+  PRIMARY KEY (`id`),
+  KEY `actor_IDX` (`actor`),
+  KEY `service_name_IDX` (`service_name`),
+  KEY `created_at_IDX` (`created_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
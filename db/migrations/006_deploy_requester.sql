@@ -0,0 +1,10 @@
+-- Records who requested each deploy, from where, and the optional metadata the client sent.
+--
+-- Deploys saved before this migration have an empty deployed_by and remote_addr, and no metadata.
+
+ALTER TABLE `deploys`
+  ADD COLUMN `deployed_by` varchar(255) NOT NULL DEFAULT '' COMMENT 'The token name, JWT subject or signing client that requested the deploy.' AFTER `suffix`,
+  ADD COLUMN `remote_addr` varchar(255) NOT NULL DEFAULT '' COMMENT 'The address the deploy was requested from.' AFTER `deployed_by`,
+  ADD COLUMN `metadata` text COMMENT 'A json of optional client information, for example reason, ticket and gitCommit.' AFTER `remote_addr`,
+  ADD KEY `service_name_IDX` (`service_name`),
+  ADD KEY `deployed_by_IDX` (`deployed_by`);
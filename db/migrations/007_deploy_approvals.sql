@@ -0,0 +1,25 @@
+-- Adds the approval workflow: the approvals a deploy needs, when an unapproved deploy expires, and
+-- each approval or rejection. The requester and each approver are recorded by the unique key of
+-- their identity, token:<id>, jwt:<subject> or client:<id>, so an approver is told apart from the
+-- requester by more than a name.
+--
+-- Deploys saved before this migration need no approvals and have an empty principal.
+
+ALTER TABLE `deploys`
+  ADD COLUMN `principal` varchar(255) NOT NULL DEFAULT '' COMMENT 'The unique key of the identity that requested the deploy: token:<id>, jwt:<subject> or client:<id>.' AFTER `deployed_by`,
+  ADD COLUMN `approvals_required` int(11) NOT NULL DEFAULT '0' COMMENT 'The number of approvals needed before the deploy may run.' AFTER `metadata`,
+  ADD COLUMN `expires_at` datetime DEFAULT NULL COMMENT 'When the deploy expires if it has not been approved.' AFTER `approvals_required`,
+  MODIFY `status` int(11) NOT NULL DEFAULT '1' COMMENT 'The current status of the deploy: Started, Success, Failed, PendingApproval, Rejected, Expired.',
+  ADD KEY `status_IDX` (`status`);
+
+CREATE TABLE `deploy_approvals` (
+  `id` int(11) NOT NULL AUTO_INCREMENT COMMENT 'The primary key for each entry in the table.',
+  `deploy_id` varchar(255) NOT NULL COMMENT 'The UUID of the deploy being decided.',
+  `approver` varchar(255) NOT NULL COMMENT 'The name of the token or JWT subject that decided.',
+  `principal` varchar(255) NOT NULL DEFAULT '' COMMENT 'The unique key of the identity that decided: token:<id>, jwt:<subject> or client:<id>.',
+  `decision` varchar(32) NOT NULL COMMENT 'approve or reject.',
+  `comment` varchar(255) NOT NULL DEFAULT '' COMMENT 'An optional reason given by the approver.',
+  `created_at` datetime NOT NULL COMMENT 'When the decision was made.',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `deploy_principal_UNIQUE` (`deploy_id`,`principal`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
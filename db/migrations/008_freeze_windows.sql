@@ -0,0 +1,21 @@
+-- Adds the freeze windows during which deploys are rejected, and the reason an admin gave to
+-- deploy during one.
+
+ALTER TABLE `deploys`
+  ADD COLUMN `freeze_override` varchar(1024) NOT NULL DEFAULT '' COMMENT 'The reason an admin gave to deploy during a freeze window. Empty if none was overridden.' AFTER `metadata`;
+
+CREATE TABLE `freeze_windows` (
+  `id` int(11) NOT NULL AUTO_INCREMENT COMMENT 'The primary key for each entry in the table.',
+  `environment` varchar(255) NOT NULL COMMENT 'The environment that is frozen, for example production.',
+  `service_pattern` varchar(255) NOT NULL DEFAULT '' COMMENT 'Optional glob of the service names frozen. Empty freezes all services.',
+  `schedule` varchar(255) NOT NULL DEFAULT '' COMMENT 'A cron expression of when a repeating window starts.',
+  `duration` varchar(32) NOT NULL DEFAULT '' COMMENT 'How long a repeating window lasts, for example 63h.',
+  `starts_at` datetime DEFAULT NULL COMMENT 'The start of an explicit window in UTC.',
+  `ends_at` datetime DEFAULT NULL COMMENT 'The end of an explicit window in UTC.',
+  `timezone` varchar(64) NOT NULL DEFAULT 'UTC' COMMENT 'The location the schedule is evaluated in, for example America/Los_Angeles.',
+  `reason` varchar(255) NOT NULL COMMENT 'Why deploys are frozen.',
+  `created_by` varchar(255) NOT NULL COMMENT 'The name of the identity that created the window.',
+  `created_at` datetime NOT NULL COMMENT 'The create date and time of the window.',
+  PRIMARY KEY (`id`),
+  KEY `environment_IDX` (`environment`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
@@ -0,0 +1,7 @@
+-- Records when a scheduled deploy is started.
+
+ALTER TABLE `deploys`
+  ADD COLUMN `not_before` datetime DEFAULT NULL COMMENT 'When a scheduled deploy is started, in UTC.' AFTER `expires_at`,
+  MODIFY `status` int(11) NOT NULL DEFAULT '1' COMMENT 'The current status of the deploy: Started, Success, Failed, PendingApproval, Rejected, Expired, Scheduled, Cancelled.',
+  DROP INDEX `status_IDX`,
+  ADD KEY `status_IDX` (`status`,`not_before`);
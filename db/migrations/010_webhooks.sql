@@ -0,0 +1,35 @@
+-- Adds the webhooks told of deploy events and the log of each delivery, and the RolledBack status
+-- of a deploy whose new service did not start.
+
+ALTER TABLE `deploys`
+  MODIFY `status` int(11) NOT NULL DEFAULT '1' COMMENT 'The current status of the deploy: Started, Success, Failed, PendingApproval, Rejected, Expired, Scheduled, Cancelled, RolledBack.';
+
+CREATE TABLE `webhooks` (
+  `id` int(11) NOT NULL AUTO_INCREMENT COMMENT 'The primary key for each entry in the table.',
+  `url` varchar(1024) NOT NULL COMMENT 'Where deploy events are posted.',
+  `events` varchar(255) NOT NULL DEFAULT '' COMMENT 'A comma list of the events sent, for example deploy.failed. Empty for all events.',
+  `service_pattern` varchar(255) NOT NULL DEFAULT '' COMMENT 'Optional glob of the service names sent.',
+  `secret` varchar(255) NOT NULL COMMENT 'The encrypted secret used to sign payloads.',
+  `created_by` varchar(255) NOT NULL DEFAULT '' COMMENT 'The name of the identity that created the webhook.',
+  `created_at` datetime NOT NULL COMMENT 'The create date and time of the webhook.',
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `webhook_deliveries` (
+  `id` int(11) NOT NULL AUTO_INCREMENT COMMENT 'The primary key for each entry in the table.',
+  `webhook_id` int(11) NOT NULL COMMENT 'The webhook the event is sent to.',
+  `event` varchar(255) NOT NULL COMMENT 'The event, for example deploy.succeeded.',
+  `deploy_id` varchar(255) NOT NULL DEFAULT '' COMMENT 'The UUID of the deploy of the event, if any.',
+  `payload` text NOT NULL COMMENT 'The JSON body posted.',
+  `status` varchar(32) NOT NULL COMMENT 'The state of the delivery: pending, delivered or failed.',
+  `attempts` int(11) NOT NULL DEFAULT '0' COMMENT 'How many times the event has been sent.',
+  `last_status_code` int(11) NOT NULL DEFAULT '0' COMMENT 'The HTTP status of the last attempt.',
+  `last_error` varchar(255) NOT NULL DEFAULT '' COMMENT 'The error of the last attempt, if any.',
+  `next_attempt_at` datetime NOT NULL COMMENT 'When the event will next be sent, in UTC.',
+  `delivered_at` datetime DEFAULT NULL COMMENT 'When the receiver accepted the event, in UTC.',
+  `created_at` datetime NOT NULL COMMENT 'When the event occurred, in UTC.',
+  `updated_at` datetime NOT NULL COMMENT 'The update date and time of the delivery.',
+  PRIMARY KEY (`id`),
+  KEY `webhook_id_IDX` (`webhook_id`),
+  KEY `status_IDX` (`status`,`next_attempt_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
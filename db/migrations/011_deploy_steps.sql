@@ -0,0 +1,16 @@
+-- Records each step of a deploy with the commands run and their output.
+
+CREATE TABLE `deploy_steps` (
+  `id` int(11) NOT NULL AUTO_INCREMENT COMMENT 'The primary key for each entry in the table.',
+  `deploy_id` varchar(255) NOT NULL COMMENT 'The UUID of the deploy the step belongs to.',
+  `name` varchar(255) NOT NULL COMMENT 'The step, for example write_unit, apply_keys, install_template or flip_ab.',
+  `status` int(11) NOT NULL DEFAULT '1' COMMENT 'The status of the step: Started while running, then Success, Failed or RolledBack.',
+  `command` text COMMENT 'The fleetctl commands run by the step, one per line.',
+  `stdout` mediumtext COMMENT 'The standard output of the commands.',
+  `stderr` mediumtext COMMENT 'The standard error of the commands.',
+  `exit_code` int(11) DEFAULT NULL COMMENT 'The exit code of the last command run, if any.',
+  `started_at` datetime(3) NOT NULL COMMENT 'When the step began.',
+  `ended_at` datetime(3) DEFAULT NULL COMMENT 'When the step ended.',
+  PRIMARY KEY (`id`),
+  KEY `deploy_id_IDX` (`deploy_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
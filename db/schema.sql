@@ -22,17 +22,140 @@ DROP TABLE IF EXISTS `auth_tokens`;
 /*!40101 SET character_set_client = utf8 */;
 CREATE TABLE `auth_tokens` (
   `id` int(11) NOT NULL AUTO_INCREMENT COMMENT 'The primary key for each entry in the table.',
-  `token` varchar(255) NOT NULL COMMENT 'The oauth or bearer token assigned to this user/service.',
+  `token_key` varchar(32) NOT NULL COMMENT 'The public part of the bearer token used to look up this row.',
+  `token_salt` varchar(64) NOT NULL COMMENT 'The random salt used when hashing the token secret.',
+  `token_hash` varchar(128) NOT NULL COMMENT 'The salted SHA-256 hash of the token secret. The secret itself is never stored.',
   `created_at` datetime NOT NULL COMMENT 'The create date for this row.',
   `updated_at` datetime NOT NULL COMMENT 'The last update date for this row.',
+  `expires_at` datetime DEFAULT NULL COMMENT 'When the token expires. NULL never expires.',
+  `last_used_at` datetime DEFAULT NULL COMMENT 'The last time the token authorized a request.',
+  `revoked_at` datetime DEFAULT NULL COMMENT 'When the token was revoked. NULL is active.',
   `name` varchar(255) DEFAULT NULL COMMENT 'The name of the user or service that has been granted authority.',
   `notes` text COMMENT 'General comments.',
+  `role` varchar(32) NOT NULL DEFAULT 'deploy' COMMENT 'The permissions granted to this token: read, deploy or admin.',
+  `service_pattern` varchar(255) DEFAULT NULL COMMENT 'An optional glob of service names this token may deploy, for example acme-video-*.',
+  `cert_subject` varchar(255) DEFAULT NULL COMMENT 'An optional client certificate common name that authenticates as this identity over mTLS.',
   PRIMARY KEY (`id`),
   UNIQUE KEY `id_UNIQUE` (`id`),
-  UNIQUE KEY `token_UNIQUE` (`token`)
+  UNIQUE KEY `token_key_UNIQUE` (`token_key`),
+  UNIQUE KEY `cert_subject_UNIQUE` (`cert_subject`)
 ) ENGINE=InnoDB AUTO_INCREMENT=2 DEFAULT CHARSET=utf8;
 /*!40101 SET character_set_client = @saved_cs_client */;
 
+--
+-- Table structure for table `freeze_windows`
+--
+
+DROP TABLE IF EXISTS `freeze_windows`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `freeze_windows` (
+  `id` int(11) NOT NULL AUTO_INCREMENT COMMENT 'The primary key for each entry in the table.',
+  `environment` varchar(255) NOT NULL COMMENT 'The environment that is frozen, for example production.',
+  `service_pattern` varchar(255) NOT NULL DEFAULT '' COMMENT 'Optional glob of the service names frozen. Empty freezes all services.',
+  `schedule` varchar(255) NOT NULL DEFAULT '' COMMENT 'A cron expression of when a repeating window starts.',
+  `duration` varchar(32) NOT NULL DEFAULT '' COMMENT 'How long a repeating window lasts, for example 63h.',
+  `starts_at` datetime DEFAULT NULL COMMENT 'The start of an explicit window in UTC.',
+  `ends_at` datetime DEFAULT NULL COMMENT 'The end of an explicit window in UTC.',
+  `timezone` varchar(64) NOT NULL DEFAULT 'UTC' COMMENT 'The location the schedule is evaluated in, for example America/Los_Angeles.',
+  `reason` varchar(255) NOT NULL COMMENT 'Why deploys are frozen.',
+  `created_by` varchar(255) NOT NULL COMMENT 'The name of the identity that created the window.',
+  `created_at` datetime NOT NULL COMMENT 'The create date and time of the window.',
+  PRIMARY KEY (`id`),
+  KEY `environment_IDX` (`environment`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `signing_clients`
+--
+
+DROP TABLE IF EXISTS `signing_clients`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `signing_clients` (
+  `id` int(11) NOT NULL AUTO_INCREMENT COMMENT 'The primary key for each entry in the table.',
+  `client_id` varchar(255) NOT NULL COMMENT 'The public identifier sent by the client in the X-Client-ID header.',
+  `secret` varchar(255) NOT NULL COMMENT 'The shared HMAC secret, encrypted with the server secret key.',
+  `service_pattern` varchar(255) DEFAULT NULL COMMENT 'An optional glob of service names this client may deploy, for example acme-video-*.',
+  `notes` text COMMENT 'General comments.',
+  `revoked_at` datetime DEFAULT NULL COMMENT 'When the client was revoked. NULL is active.',
+  `created_at` datetime NOT NULL COMMENT 'The create date for this row.',
+  `updated_at` datetime NOT NULL COMMENT 'The last update date for this row.',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `id_UNIQUE` (`id`),
+  UNIQUE KEY `client_id_UNIQUE` (`client_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `audit_events`
+--
+
+DROP TABLE IF EXISTS `audit_events`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `audit_events` (
+  `id` int(11) NOT NULL AUTO_INCREMENT COMMENT 'The primary key for each entry in the table.',
+  `actor` varchar(255) NOT NULL DEFAULT '' COMMENT 'The name of the authenticated token, JWT subject or signing client. Empty if unauthenticated.',
+  `action` varchar(255) NOT NULL COMMENT 'The action attempted, for example deploy.create or token.revoke.',
+  `service_name` varchar(255) NOT NULL DEFAULT '' COMMENT 'The service acted upon, if any.',
+  `request_id` varchar(255) NOT NULL COMMENT 'The X-Request-ID of the API call.',
+  `source_ip` varchar(255) NOT NULL COMMENT 'The remote address of the caller.',
+  `outcome` varchar(32) NOT NULL COMMENT 'The result of the action: success, denied or failed.',
+  `status_code` int(11) NOT NULL COMMENT 'The HTTP status returned to the caller.',
+  `detail` varchar(255) NOT NULL DEFAULT '' COMMENT 'Additional information, such as the id of the target.',
+  `created_at` datetime NOT NULL COMMENT 'When the event occurred in UTC.',
+  PRIMARY KEY (`id`),
+  KEY `actor_IDX` (`actor`),
+  KEY `service_name_IDX` (`service_name`),
+  KEY `created_at_IDX` (`created_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `deploy_approvals`
+--
+
+DROP TABLE IF EXISTS `deploy_approvals`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `deploy_approvals` (
+  `id` int(11) NOT NULL AUTO_INCREMENT COMMENT 'The primary key for each entry in the table.',
+  `deploy_id` varchar(255) NOT NULL COMMENT 'The UUID of the deploy being decided.',
+  `approver` varchar(255) NOT NULL COMMENT 'The name of the token or JWT subject that decided.',
+  `principal` varchar(255) NOT NULL DEFAULT '' COMMENT 'The unique key of the identity that decided: token:<id>, jwt:<subject> or client:<id>.',
+  `decision` varchar(32) NOT NULL COMMENT 'approve or reject.',
+  `comment` varchar(255) NOT NULL DEFAULT '' COMMENT 'An optional reason given by the approver.',
+  `created_at` datetime NOT NULL COMMENT 'When the decision was made.',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `deploy_principal_UNIQUE` (`deploy_id`,`principal`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `deploy_steps`
+--
+
+DROP TABLE IF EXISTS `deploy_steps`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `deploy_steps` (
+  `id` int(11) NOT NULL AUTO_INCREMENT COMMENT 'The primary key for each entry in the table.',
+  `deploy_id` varchar(255) NOT NULL COMMENT 'The UUID of the deploy the step belongs to.',
+  `name` varchar(255) NOT NULL COMMENT 'The step, for example write_unit, apply_keys, install_template or flip_ab.',
+  `status` int(11) NOT NULL DEFAULT '1' COMMENT 'The status of the step: Started while running, then Success, Failed or RolledBack.',
+  `command` text COMMENT 'The fleetctl commands run by the step, one per line.',
+  `stdout` mediumtext COMMENT 'The standard output of the commands.',
+  `stderr` mediumtext COMMENT 'The standard error of the commands.',
+  `exit_code` int(11) DEFAULT NULL COMMENT 'The exit code of the last command run, if any.',
+  `started_at` datetime(3) NOT NULL COMMENT 'When the step began.',
+  `ended_at` datetime(3) DEFAULT NULL COMMENT 'When the step ended.',
+  PRIMARY KEY (`id`),
+  KEY `deploy_id_IDX` (`deploy_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
 --
 -- Table structure for table `deploys`
 --
@@ -50,18 +173,75 @@ CREATE TABLE `deploys` (
   `version` varchar(255) NOT NULL COMMENT 'The version of the service being deployed e.g. 1.0.2',
   `num_instances` int(11) NOT NULL COMMENT 'The number of service instances to deploy.',
   `service_template` text COMMENT 'The source code for the fleetctl .service file that is used to boot the service application.',
-  `etcd2_keys` text COMMENT 'a json of etcd2 keys that were updated in this deploy.',
+  `etcd2_keys` text COMMENT 'a json of etcd2 keys that were updated in this deploy. Secret values are encrypted or redacted.',
   `suffix` varchar(255) DEFAULT NULL COMMENT 'The suffix added to the service name.',
-  `status` int(11) NOT NULL DEFAULT '1' COMMENT 'The current status of the deploy: Started, Failed, Success.',
+  `deployed_by` varchar(255) NOT NULL DEFAULT '' COMMENT 'The token name, JWT subject or signing client that requested the deploy.',
+  `principal` varchar(255) NOT NULL DEFAULT '' COMMENT 'The unique key of the identity that requested the deploy: token:<id>, jwt:<subject> or client:<id>.',
+  `remote_addr` varchar(255) NOT NULL DEFAULT '' COMMENT 'The address the deploy was requested from.',
+  `metadata` text COMMENT 'A json of optional client information, for example reason, ticket and gitCommit.',
+  `freeze_override` varchar(1024) NOT NULL DEFAULT '' COMMENT 'The reason an admin gave to deploy during a freeze window. Empty if none was overridden.',
+  `approvals_required` int(11) NOT NULL DEFAULT '0' COMMENT 'The number of approvals needed before the deploy may run.',
+  `expires_at` datetime DEFAULT NULL COMMENT 'When the deploy expires if it has not been approved.',
+  `not_before` datetime DEFAULT NULL COMMENT 'When a scheduled deploy is started, in UTC.',
+  `status` int(11) NOT NULL DEFAULT '1' COMMENT 'The current status of the deploy: Started, Success, Failed, PendingApproval, Rejected, Expired, Scheduled, Cancelled, RolledBack.',
   `message` varchar(255) DEFAULT NULL COMMENT 'A short status message.',
   `log` text COMMENT 'A complete set of log messages from the deploy.',
   `updated_at` datetime NOT NULL COMMENT 'The update date and time of the deploy.',
   `created_at` datetime NOT NULL COMMENT 'The create date and time of the deploy.',
   PRIMARY KEY (`id`),
   UNIQUE KEY `id_UNIQUE` (`id`),
-  UNIQUE KEY `key_UNIQUE` (`deploy_id`)
+  UNIQUE KEY `key_UNIQUE` (`deploy_id`),
+  KEY `service_name_IDX` (`service_name`),
+  KEY `deployed_by_IDX` (`deployed_by`),
+  KEY `status_IDX` (`status`,`not_before`)
 ) ENGINE=InnoDB AUTO_INCREMENT=31 DEFAULT CHARSET=utf8;
 /*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `webhooks`
+--
+
+DROP TABLE IF EXISTS `webhooks`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `webhooks` (
+  `id` int(11) NOT NULL AUTO_INCREMENT COMMENT 'The primary key for each entry in the table.',
+  `url` varchar(1024) NOT NULL COMMENT 'Where deploy events are posted.',
+  `events` varchar(255) NOT NULL DEFAULT '' COMMENT 'A comma list of the events sent, for example deploy.failed. Empty for all events.',
+  `service_pattern` varchar(255) NOT NULL DEFAULT '' COMMENT 'Optional glob of the service names sent.',
+  `secret` varchar(255) NOT NULL COMMENT 'The encrypted secret used to sign payloads.',
+  `created_by` varchar(255) NOT NULL DEFAULT '' COMMENT 'The name of the identity that created the webhook.',
+  `created_at` datetime NOT NULL COMMENT 'The create date and time of the webhook.',
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `webhook_deliveries`
+--
+
+DROP TABLE IF EXISTS `webhook_deliveries`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `webhook_deliveries` (
+  `id` int(11) NOT NULL AUTO_INCREMENT COMMENT 'The primary key for each entry in the table.',
+  `webhook_id` int(11) NOT NULL COMMENT 'The webhook the event is sent to.',
+  `event` varchar(255) NOT NULL COMMENT 'The event, for example deploy.succeeded.',
+  `deploy_id` varchar(255) NOT NULL DEFAULT '' COMMENT 'The UUID of the deploy of the event, if any.',
+  `payload` text NOT NULL COMMENT 'The JSON body posted.',
+  `status` varchar(32) NOT NULL COMMENT 'The state of the delivery: pending, delivered or failed.',
+  `attempts` int(11) NOT NULL DEFAULT '0' COMMENT 'How many times the event has been sent.',
+  `last_status_code` int(11) NOT NULL DEFAULT '0' COMMENT 'The HTTP status of the last attempt.',
+  `last_error` varchar(255) NOT NULL DEFAULT '' COMMENT 'The error of the last attempt, if any.',
+  `next_attempt_at` datetime NOT NULL COMMENT 'When the event will next be sent, in UTC.',
+  `delivered_at` datetime DEFAULT NULL COMMENT 'When the receiver accepted the event, in UTC.',
+  `created_at` datetime NOT NULL COMMENT 'When the event occurred, in UTC.',
+  `updated_at` datetime NOT NULL COMMENT 'The update date and time of the delivery.',
+  PRIMARY KEY (`id`),
+  KEY `webhook_id_IDX` (`webhook_id`),
+  KEY `status_IDX` (`status`,`next_attempt_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+/*!40101 SET character_set_client = @saved_cs_client */;
 /*!40103 SET TIME_ZONE=@OLD_TIME_ZONE */;
 
 /*!40101 SET SQL_MODE=@OLD_SQL_MODE */;
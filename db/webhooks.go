@@ -0,0 +1,179 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+)
+
+// Delivery statuses of a webhook notification.
+const (
+	DeliveryPending   = "pending"   // Waiting to be sent or retried.
+	DeliveryDelivered = "delivered" // Accepted by the receiver.
+	DeliveryFailed    = "failed"    // Gave up after the maximum attempts.
+)
+
+// Webhook is a subscription to deploy lifecycle events.
+type Webhook struct {
+	ID             int    `json:"id"`             // The primary key of the webhook.
+	URL            string `json:"url"`            // Where the events are posted.
+	Events         string `json:"events"`         // Comma list of the events sent; empty is all events.
+	ServicePattern string `json:"servicePattern"` // Optional glob of the service names sent.
+	Secret         string `json:"-"`              // The encrypted secret used to sign payloads.
+	CreatedBy      string `json:"createdBy"`      // The name of the identity that created the webhook.
+	CreatedAt      string `json:"createdAt"`      // The create date and time of the webhook.
+}
+
+const webhookColumns = "id, url, events, service_pattern, secret, created_by, created_at"
+
+// scanWebhook reads a webhook from a row selected with webhookColumns.
+func scanWebhook(row interface {
+	Scan(...interface{}) error
+}) (*Webhook, error) {
+	w := &Webhook{}
+	err := row.Scan(&w.ID, &w.URL, &w.Events, &w.ServicePattern, &w.Secret, &w.CreatedBy, &w.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// QueryWebhooks returns all the webhooks.
+func (d *DBConnect) QueryWebhooks() ([]*Webhook, error) {
+	rows, err := d.query("SELECT " + webhookColumns + " FROM webhooks ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]*Webhook, 0)
+	for rows.Next() {
+		w, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, w)
+	}
+	return result, rows.Err()
+}
+
+// QueryWebhook returns a webhook by id.
+func (d *DBConnect) QueryWebhook(id int) (*Webhook, error) {
+	return scanWebhook(d.queryRow("SELECT "+webhookColumns+" FROM webhooks WHERE id = ?", id))
+}
+
+// CreateWebhook inserts a new webhook and returns its id. The secret should already be encrypted.
+func (d *DBConnect) CreateWebhook(url string, events string, servicePattern string, secret string,
+	createdBy string) (int, error) {
+	result, err := d.exec("INSERT INTO webhooks (url, events, service_pattern, secret, created_by, created_at) "+
+		"VALUES (?, ?, ?, ?, ?, NOW())", url, events, servicePattern, secret, createdBy)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+// DeleteWebhook removes a webhook. Deliveries still waiting to be sent are marked as failed.
+func (d *DBConnect) DeleteWebhook(id int) error {
+	if err := expectOneRow(d.exec("DELETE FROM webhooks WHERE id = ?", id)); err != nil {
+		return err
+	}
+	_, err := d.exec("UPDATE webhook_deliveries SET status = ?, last_error = \"Webhook deleted.\", "+
+		"updated_at = NOW() WHERE webhook_id = ? AND status = ?", DeliveryFailed, id, DeliveryPending)
+	return err
+}
+
+// WebhookDelivery is the delivery log entry of one event sent to a webhook.
+type WebhookDelivery struct {
+	ID             int             `json:"id"`                    // The primary key of the delivery.
+	WebhookID      int             `json:"webhookID"`             // The webhook the event is sent to.
+	Event          string          `json:"event"`                 // The event, ex: deploy.succeeded.
+	DeployID       string          `json:"deployID"`              // The deploy of the event, if any.
+	Payload        json.RawMessage `json:"payload"`               // The JSON body posted.
+	Status         string          `json:"status"`                // pending, delivered or failed.
+	Attempts       int             `json:"attempts"`              // How many times it has been sent.
+	LastStatusCode int             `json:"lastStatusCode"`        // The HTTP status of the last attempt.
+	LastError      string          `json:"lastError"`             // The error of the last attempt, if any.
+	NextAttemptAt  string          `json:"nextAttemptAt"`         // When it will next be sent (UTC).
+	DeliveredAt    string          `json:"deliveredAt,omitempty"` // When the receiver accepted it (UTC).
+	CreatedAt      string          `json:"createdAt"`             // When the event occurred (UTC).
+}
+
+const webhookDeliveryColumns = "id, webhook_id, event, deploy_id, payload, status, attempts, last_status_code, " +
+	"last_error, next_attempt_at, delivered_at, created_at"
+
+// scanWebhookDelivery reads a delivery from a row selected with webhookDeliveryColumns.
+func scanWebhookDelivery(row interface {
+	Scan(...interface{}) error
+}) (*WebhookDelivery, error) {
+	dl := &WebhookDelivery{}
+	var payload string
+	var deliveredAt sql.NullString
+	err := row.Scan(&dl.ID, &dl.WebhookID, &dl.Event, &dl.DeployID, &payload, &dl.Status, &dl.Attempts,
+		&dl.LastStatusCode, &dl.LastError, &dl.NextAttemptAt, &deliveredAt, &dl.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	dl.Payload = json.RawMessage(payload)
+	dl.DeliveredAt = deliveredAt.String
+	return dl, nil
+}
+
+// queryWebhookDeliveries returns the deliveries selected by the where clause.
+func (d *DBConnect) queryWebhookDeliveries(where string, args ...interface{}) ([]*WebhookDelivery, error) {
+	rows, err := d.query("SELECT "+webhookDeliveryColumns+" FROM webhook_deliveries WHERE "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]*WebhookDelivery, 0)
+	for rows.Next() {
+		dl, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, dl)
+	}
+	return result, rows.Err()
+}
+
+// QueryWebhookDeliveries returns the most recent deliveries of a webhook, newest first.
+func (d *DBConnect) QueryWebhookDeliveries(webhookID int, limit int) ([]*WebhookDelivery, error) {
+	return d.queryWebhookDeliveries("webhook_id = ? ORDER BY id DESC LIMIT ?", webhookID, limit)
+}
+
+// QueryDueWebhookDeliveries returns pending deliveries that are due to be sent, oldest first.
+func (d *DBConnect) QueryDueWebhookDeliveries(limit int) ([]*WebhookDelivery, error) {
+	return d.queryWebhookDeliveries("status = ? AND next_attempt_at <= UTC_TIMESTAMP() ORDER BY id LIMIT ?",
+		DeliveryPending, limit)
+}
+
+// InsertWebhookDelivery queues an event to be sent to a webhook and returns the delivery id.
+func (d *DBConnect) InsertWebhookDelivery(webhookID int, event string, deployID string, payload []byte) (int, error) {
+	result, err := d.exec("INSERT INTO webhook_deliveries (webhook_id, event, deploy_id, payload, status, "+
+		"attempts, last_status_code, last_error, next_attempt_at, created_at, updated_at) "+
+		"VALUES (?, ?, ?, ?, ?, 0, 0, '', UTC_TIMESTAMP(), UTC_TIMESTAMP(), NOW())",
+		webhookID, event, deployID, string(payload), DeliveryPending)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+// ClaimWebhookDelivery counts a new attempt of a pending delivery and holds it for lease seconds,
+// so that only one sender makes the attempt. An error is returned if another sender claimed it.
+func (d *DBConnect) ClaimWebhookDelivery(id int, attempts int, lease int64) error {
+	return expectOneRow(d.exec("UPDATE webhook_deliveries SET attempts = attempts + 1, "+
+		"next_attempt_at = DATE_ADD(UTC_TIMESTAMP(), INTERVAL ? SECOND), updated_at = NOW() "+
+		"WHERE id = ? AND status = ? AND attempts = ?", lease, id, DeliveryPending, attempts))
+}
+
+// UpdateWebhookDelivery records the result of an attempt. A pending delivery is retried in
+// retryIn seconds.
+func (d *DBConnect) UpdateWebhookDelivery(id int, status string, statusCode int, lastError string,
+	retryIn int64) error {
+	return expectOneRow(d.exec("UPDATE webhook_deliveries SET status = ?, last_status_code = ?, "+
+		"last_error = ?, next_attempt_at = DATE_ADD(UTC_TIMESTAMP(), INTERVAL ? SECOND), "+
+		"delivered_at = IF(? = ?, UTC_TIMESTAMP(), NULL), updated_at = NOW() WHERE id = ?",
+		status, statusCode, lastError, retryIn, status, DeliveryDelivered, id))
+}
@@ -1,37 +1,201 @@
 package etcd2
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
 	"time"
 
+	"github.com/composer22/coreos-deploy/trace"
 	"github.com/coreos/etcd/client"
 	"golang.org/x/net/context"
 )
 
+const (
+	DefaultRequestTimeout = time.Second     // Default header timeout for each request.
+	DefaultDialTimeout    = 5 * time.Second // Default timeout to connect to a member.
+)
+
+// Config holds the settings used to connect to the etcd2 cluster.
+type Config struct {
+	Endpoints      []string      // host:port or URLs of one or more etcd2 members.
+	CAFile         string        // Optional PEM file of CAs used to verify the members.
+	CertFile       string        // Optional PEM client certificate file.
+	KeyFile        string        // Optional PEM client private key file.
+	Username       string        // Optional basic auth user name.
+	Password       string        // Optional basic auth password.
+	RequestTimeout time.Duration // Header timeout for each request.
+	DialTimeout    time.Duration // Timeout to connect to a member.
+	SyncInterval   time.Duration // How often to refresh the member list. Zero disables auto sync.
+	Observe        Observer      // Optional function told of each Set, Make and Get call.
+}
+
+// Observer is told the operation, duration and error of each call to etcd2.
+type Observer func(op string, d time.Duration, err error)
+
 // Etcd2Connect represents a connection to the etcd2 server.
 type Etcd2Connect struct {
-	etcd2 client.Client
+	etcd2   client.Client
+	cancel  context.CancelFunc // Stops the auto sync of endpoints.
+	observe Observer           // Told of each call, if set.
 }
 
-// NewDBConnect is a factory method that returns a new db connection.
-func NewEtcd2Connect(etcd2EndPoint string) (*Etcd2Connect, error) {
+// KeyValueStore reads and writes etcd2 keys. It is met by *Etcd2Connect.
+type KeyValueStore interface {
+	Set(ctx context.Context, data map[string]string) error
+	Make(ctx context.Context, data map[string]string) error
+	Get(ctx context.Context, data map[string]string) (map[string]string, error)
+	Lookup(ctx context.Context, keys []string) (map[string]string, error)
+	Delete(ctx context.Context, keys []string) error
+}
+
+// NewEtcd2Connect is a factory method that returns a new etcd2 connection.
+func NewEtcd2Connect(cfg *Config) (*Etcd2Connect, error) {
+	tlsConfig, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	dialTimeout := cfg.DialTimeout
+	if dialTimeout <= 0 {
+		dialTimeout = DefaultDialTimeout
+	}
+	requestTimeout := cfg.RequestTimeout
+	if requestTimeout <= 0 {
+		requestTimeout = DefaultRequestTimeout
+	}
+
 	c, err := client.New(client.Config{
-		Endpoints:               []string{fmt.Sprintf("http://%s", etcd2EndPoint)},
-		Transport:               client.DefaultTransport,
-		HeaderTimeoutPerRequest: time.Second,
+		Endpoints: endpointURLs(cfg.Endpoints, tlsConfig != nil),
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   dialTimeout,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+			TLSClientConfig:     tlsConfig,
+		},
+		Username:                cfg.Username,
+		Password:                cfg.Password,
+		HeaderTimeoutPerRequest: requestTimeout,
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	return &Etcd2Connect{etcd2: c}, nil
+	e := &Etcd2Connect{etcd2: c, observe: cfg.Observe}
+	if cfg.SyncInterval > 0 {
+		var ctx context.Context
+		ctx, e.cancel = context.WithCancel(context.Background())
+		go e.autoSync(ctx, cfg.SyncInterval)
+	}
+	return e, nil
+}
+
+// tlsConfig returns the TLS configuration for the members or nil if TLS is not configured.
+func (cfg *Config) tlsConfig() (*tls.Config, error) {
+	if cfg.CAFile == "" && cfg.CertFile == "" {
+		return nil, nil
+	}
+	t := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CAFile != "" {
+		b, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		t.RootCAs = x509.NewCertPool()
+		if !t.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in etcd2 CA file %s", cfg.CAFile)
+		}
+	}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		t.Certificates = []tls.Certificate{cert}
+	}
+	return t, nil
+}
+
+// endpointURLs returns the endpoints as URLs. A host:port is given the https scheme if TLS is
+// configured, otherwise http.
+func endpointURLs(endpoints []string, secure bool) []string {
+	scheme := "http"
+	if secure {
+		scheme = "https"
+	}
+	urls := make([]string, 0)
+	for _, ep := range endpoints {
+		if !strings.Contains(ep, "://") {
+			ep = fmt.Sprintf("%s://%s", scheme, ep)
+		}
+		urls = append(urls, ep)
+	}
+	return urls
+}
+
+// autoSync keeps the endpoint list in step with the cluster members so requests fail over when
+// a member goes down. It runs until the context is cancelled.
+func (e *Etcd2Connect) autoSync(ctx context.Context, interval time.Duration) {
+	for {
+		err := e.etcd2.AutoSync(ctx, interval)
+		if err == context.Canceled || err == context.DeadlineExceeded {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Endpoints returns the endpoints currently in use.
+func (e *Etcd2Connect) Endpoints() []string {
+	return e.etcd2.Endpoints()
+}
+
+// Close stops any background work of the connection.
+func (e *Etcd2Connect) Close() {
+	if e.cancel != nil {
+		e.cancel()
+	}
+}
+
+// observed tells the observer, if any, of a call that began at the start time and ends its span.
+func (e *Etcd2Connect) observed(op string, start time.Time, span *trace.Span, err error) {
+	span.SetError(err)
+	span.End()
+	if e.observe != nil {
+		e.observe(op, time.Since(start), err)
+	}
+}
+
+// startSpan begins the span of a call with the keys it reads or writes.
+func startSpan(ctx context.Context, op string, data map[string]string) (context.Context, *trace.Span) {
+	ctx, span := trace.Start(ctx, "etcd2."+op)
+	if span != nil {
+		keys := make([]string, 0, len(data))
+		for k := range data {
+			keys = append(keys, k)
+		}
+		span.SetAttr("etcd2.keys", strings.Join(keys, ","))
+	}
+	return ctx, span
 }
 
 // Set sets the etcd2 key with a value and returns the response or an error.
-func (e *Etcd2Connect) Set(data map[string]string) error {
+func (e *Etcd2Connect) Set(ctx context.Context, data map[string]string) (err error) {
+	ctx, span := startSpan(ctx, "set", data)
+	defer func(start time.Time) { e.observed("set", start, span, err) }(time.Now())
 	kapi := client.NewKeysAPI(e.etcd2)
 	for k, v := range data {
-		if _, err := kapi.Set(context.Background(), k, v, nil); err != nil {
+		if _, err := kapi.Set(ctx, k, v, nil); err != nil {
 			return err
 		}
 	}
@@ -39,11 +203,20 @@ func (e *Etcd2Connect) Set(data map[string]string) error {
 }
 
 // Make creates the etcd2 keys if they do not exist
-func (e *Etcd2Connect) Make(data map[string]string) error {
+func (e *Etcd2Connect) Make(ctx context.Context, data map[string]string) (err error) {
+	ctx, span := startSpan(ctx, "make", data)
+	defer func(start time.Time) {
+		// A key that already exists is expected rather than a failure of etcd2.
+		if cerr, ok := err.(client.Error); ok && cerr.Code == client.ErrorCodeNodeExist {
+			e.observed("make", start, span, nil)
+			return
+		}
+		e.observed("make", start, span, err)
+	}(time.Now())
 	kapi := client.NewKeysAPI(e.etcd2)
 	opts := &client.SetOptions{PrevExist: client.PrevNoExist}
 	for k, v := range data {
-		if _, err := kapi.Set(context.Background(), k, v, opts); err != nil {
+		if _, err := kapi.Set(ctx, k, v, opts); err != nil {
 			return err
 		}
 	}
@@ -51,11 +224,36 @@ func (e *Etcd2Connect) Make(data map[string]string) error {
 }
 
 // Get returns the etcd2 keys for a given set of keys
-func (e *Etcd2Connect) Get(data map[string]string) (map[string]string, error) {
+func (e *Etcd2Connect) Get(ctx context.Context, data map[string]string) (result map[string]string, err error) {
+	ctx, span := startSpan(ctx, "get", data)
+	defer func(start time.Time) { e.observed("get", start, span, err) }(time.Now())
 	kapi := client.NewKeysAPI(e.etcd2)
-	result := make(map[string]string)
+	result = make(map[string]string)
 	for k := range data {
-		resp, err := kapi.Get(context.Background(), k, nil)
+		resp, err := kapi.Get(ctx, k, nil)
+		if err != nil {
+			return nil, err
+		}
+		result[k] = resp.Node.Value
+	}
+	return result, nil
+}
+
+// Lookup returns the values of the keys that exist. Keys that do not exist are left out of the result.
+func (e *Etcd2Connect) Lookup(ctx context.Context, keys []string) (result map[string]string, err error) {
+	data := make(map[string]string)
+	for _, k := range keys {
+		data[k] = ""
+	}
+	ctx, span := startSpan(ctx, "lookup", data)
+	defer func(start time.Time) { e.observed("lookup", start, span, err) }(time.Now())
+	kapi := client.NewKeysAPI(e.etcd2)
+	result = make(map[string]string)
+	for _, k := range keys {
+		resp, err := kapi.Get(ctx, k, nil)
+		if client.IsKeyNotFound(err) {
+			continue
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -63,3 +261,20 @@ func (e *Etcd2Connect) Get(data map[string]string) (map[string]string, error) {
 	}
 	return result, nil
 }
+
+// Delete removes the etcd2 keys. Keys that do not exist are ignored.
+func (e *Etcd2Connect) Delete(ctx context.Context, keys []string) (err error) {
+	data := make(map[string]string)
+	for _, k := range keys {
+		data[k] = ""
+	}
+	ctx, span := startSpan(ctx, "delete", data)
+	defer func(start time.Time) { e.observed("delete", start, span, err) }(time.Now())
+	kapi := client.NewKeysAPI(e.etcd2)
+	for _, k := range keys {
+		if _, err := kapi.Delete(ctx, k, nil); err != nil && !client.IsKeyNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
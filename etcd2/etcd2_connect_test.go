@@ -0,0 +1,119 @@
+package etcd2
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self signed certificate and its key into the directory and returns their paths.
+func writeTestCert(t *testing.T, dir string, cn string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unable to generate a key: %s", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Unable to create a certificate: %s", err)
+	}
+	b, _ := x509.MarshalECPrivateKey(key)
+	certFile, keyFile := filepath.Join(dir, cn+".crt"), filepath.Join(dir, cn+".key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}), 0600)
+	return certFile, keyFile
+}
+
+func TestTLSConfig(t *testing.T) {
+	t.Parallel()
+	dir, _ := ioutil.TempDir("", "coreos-deploy-etcd2")
+	defer os.RemoveAll(dir)
+	caFile, _ := writeTestCert(t, dir, "etcd2-ca")
+	certFile, keyFile := writeTestCert(t, dir, "deploy")
+	emptyFile := filepath.Join(dir, "empty.crt")
+	ioutil.WriteFile(emptyFile, []byte("no certificates here\n"), 0600)
+
+	if c, err := (&Config{}).tlsConfig(); c != nil || err != nil {
+		t.Errorf("Without a CA or certificate TLS should not be configured, received %v, %v.", c, err)
+	}
+
+	tests := []struct {
+		name  string
+		cfg   *Config
+		ok    bool
+		roots bool
+		certs int
+	}{
+		{"a CA file", &Config{CAFile: caFile}, true, true, 0},
+		{"a client certificate", &Config{CertFile: certFile, KeyFile: keyFile}, true, false, 1},
+		{"a CA file and client certificate", &Config{CAFile: caFile, CertFile: certFile, KeyFile: keyFile},
+			true, true, 1},
+		{"a CA file without certificates", &Config{CAFile: emptyFile}, false, false, 0},
+		{"a missing CA file", &Config{CAFile: filepath.Join(dir, "missing.crt")}, false, false, 0},
+		{"a certificate without its key", &Config{CertFile: certFile}, false, false, 0},
+		{"a mismatched key", &Config{CertFile: certFile, KeyFile: caFile}, false, false, 0},
+	}
+	for _, tc := range tests {
+		c, err := tc.cfg.tlsConfig()
+		if !tc.ok {
+			if err == nil {
+				t.Errorf("TLS with %s should be an error.", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("TLS with %s should be configured, received %s.", tc.name, err)
+			continue
+		}
+		if (c.RootCAs != nil) != tc.roots || len(c.Certificates) != tc.certs {
+			t.Errorf("TLS with %s should have CAs %t and %d certificates, received %t and %d.", tc.name,
+				tc.roots, tc.certs, c.RootCAs != nil, len(c.Certificates))
+		}
+	}
+}
+
+func TestEndpointURLs(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		endpoints []string
+		secure    bool
+		want      []string
+	}{
+		{[]string{"10.0.0.1:2379"}, false, []string{"http://10.0.0.1:2379"}},
+		{[]string{"10.0.0.1:2379", "etcd2:4001"}, true, []string{"https://10.0.0.1:2379", "https://etcd2:4001"}},
+		{[]string{"http://10.0.0.1:2379", "10.0.0.2:2379"}, true, []string{"http://10.0.0.1:2379",
+			"https://10.0.0.2:2379"}},
+		{[]string{"https://etcd2.example.com:2379"}, false, []string{"https://etcd2.example.com:2379"}},
+		{nil, false, []string{}},
+	}
+	for _, tc := range tests {
+		received := endpointURLs(tc.endpoints, tc.secure)
+		if len(received) != len(tc.want) {
+			t.Errorf("%v should be %v, received %v.", tc.endpoints, tc.want, received)
+			continue
+		}
+		for i := range received {
+			if received[i] != tc.want[i] {
+				t.Errorf("%v should be %v, received %v.", tc.endpoints, tc.want, received)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,408 @@
+// Package jwt provides verification of JSON Web Tokens signed by an identity provider against a
+// JSON Web Key Set (JWKS) read from a file or URL.
+// Only asymmetric RS256/384/512 and ES256/384/512 signatures are accepted.
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Leeway allowed for clock skew between the identity provider and this server.
+	Leeway = time.Minute
+
+	refreshInterval = time.Hour       // How often keys from a URL are reloaded.
+	refreshMinWait  = 1 * time.Minute // Minimum wait between reloads for an unknown key id.
+	fetchTimeout    = 10 * time.Second
+)
+
+// Errors returned when a token fails verification.
+var (
+	ErrMalformed    = errors.New("jwt: malformed token")
+	ErrAlgorithm    = errors.New("jwt: unsupported signing algorithm")
+	ErrUnknownKey   = errors.New("jwt: signing key not found")
+	ErrSignature    = errors.New("jwt: invalid signature")
+	ErrExpired      = errors.New("jwt: token is expired")
+	ErrNotYetValid  = errors.New("jwt: token is not yet valid")
+	ErrAudience     = errors.New("jwt: invalid audience")
+	ErrIssuer       = errors.New("jwt: invalid issuer")
+	ErrMissingClaim = errors.New("jwt: required claim is missing")
+)
+
+// Claims are the decoded claims of a verified token.
+type Claims map[string]interface{}
+
+// String returns the claim as a string or "" if it is missing or not a string.
+func (c Claims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// Strings returns the claim as a list of strings. A single string claim returns a list of one.
+func (c Claims) Strings(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		result := make([]string, 0)
+		for _, i := range v {
+			if s, ok := i.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	}
+	return nil
+}
+
+// time returns a numeric date claim.
+func (c Claims) time(name string) (time.Time, bool) {
+	f, ok := c[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(f), 0), true
+}
+
+// Verifier validates tokens against a key set and the expected audience and issuer.
+type Verifier struct {
+	mu       sync.RWMutex
+	source   string                      // File path or http(s) URL of the JWKS.
+	audience string                      // Required "aud" claim value.
+	issuer   string                      // Optional required "iss" claim value.
+	keys     map[string]crypto.PublicKey // Public keys by key id.
+	loaded   time.Time                   // When the keys were last loaded.
+	client   *http.Client                // Client used to fetch keys from a URL.
+	now      func() time.Time            // Current time, replaceable for tests.
+}
+
+// NewVerifier is a factory function that returns a new Verifier with the key set loaded from
+// source, which may be a file path or an http(s) URL. audience is required; issuer is optional.
+func NewVerifier(source string, audience string, issuer string) (*Verifier, error) {
+	if audience == "" {
+		return nil, errors.New("jwt: an audience is required")
+	}
+	v := &Verifier{
+		source:   source,
+		audience: audience,
+		issuer:   issuer,
+		client:   &http.Client{Timeout: fetchTimeout},
+		now:      time.Now,
+	}
+	if err := v.load(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// IsToken returns true if the value has the form of a compact serialized JWT.
+func IsToken(value string) bool {
+	return strings.Count(value, ".") == 2
+}
+
+// Verify checks the signature and standard claims of a token and returns its claims.
+func (v *Verifier) Verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrMalformed
+	}
+	hash, ok := algorithmHashes[header.Alg]
+	if !ok {
+		return nil, ErrAlgorithm
+	}
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	if err := verifySignature(header.Alg, hash, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrMalformed
+	}
+	if err := v.validate(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// validate checks the time, audience and issuer claims.
+func (v *Verifier) validate(c Claims) error {
+	now := v.now()
+	exp, ok := c.time("exp")
+	if !ok {
+		return ErrMissingClaim
+	}
+	if now.After(exp.Add(Leeway)) {
+		return ErrExpired
+	}
+	if nbf, ok := c.time("nbf"); ok && now.Add(Leeway).Before(nbf) {
+		return ErrNotYetValid
+	}
+	audOK := false
+	for _, aud := range c.Strings("aud") {
+		if aud == v.audience {
+			audOK = true
+			break
+		}
+	}
+	if !audOK {
+		return ErrAudience
+	}
+	if v.issuer != "" && c.String("iss") != v.issuer {
+		return ErrIssuer
+	}
+	return nil
+}
+
+// key returns the public key for a key id, reloading the key set if needed.
+func (v *Verifier) key(kid string) (crypto.PublicKey, error) {
+	v.mu.RLock()
+	k, ok := v.lookup(kid)
+	stale := v.isURL() && v.now().Sub(v.loaded) > refreshInterval
+	canReload := v.isURL() && v.now().Sub(v.loaded) > refreshMinWait
+	v.mu.RUnlock()
+	if ok && !stale {
+		return k, nil
+	}
+	if !ok && !canReload {
+		return nil, ErrUnknownKey
+	}
+	if err := v.load(); err != nil && !ok {
+		return nil, err
+	}
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	if k, ok = v.lookup(kid); !ok {
+		return nil, ErrUnknownKey
+	}
+	return k, nil
+}
+
+// lookup returns the key for the key id. A token without a key id may only be used with a
+// key set of exactly one key. Caller must hold the lock.
+func (v *Verifier) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(v.keys) == 1 {
+		for _, k := range v.keys {
+			return k, true
+		}
+	}
+	k, ok := v.keys[kid]
+	return k, ok
+}
+
+// Reload reads the key set from its source again, such as after a file has been replaced.
+func (v *Verifier) Reload() error {
+	return v.load()
+}
+
+// isURL returns true if the key set is fetched over http(s).
+func (v *Verifier) isURL() bool {
+	return strings.HasPrefix(v.source, "http://") || strings.HasPrefix(v.source, "https://")
+}
+
+// load reads and parses the key set from its source.
+func (v *Verifier) load() error {
+	var b []byte
+	var err error
+	if v.isURL() {
+		b, err = v.fetch()
+	} else {
+		b, err = ioutil.ReadFile(v.source)
+	}
+	if err != nil {
+		return err
+	}
+	keys, err := ParseKeySet(b)
+	if err != nil {
+		return err
+	}
+	v.mu.Lock()
+	v.keys = keys
+	v.loaded = v.now()
+	v.mu.Unlock()
+	return nil
+}
+
+// fetch retrieves the key set from its URL.
+func (v *Verifier) fetch() ([]byte, error) {
+	resp, err := v.client.Get(v.source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jwt: fetching keys from %s returned %s", v.source, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// jsonWebKey is a single key of a JWKS document.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// ParseKeySet parses the RSA and EC signing keys of a JWKS document. Keys of other types, or
+// keys intended for encryption, are skipped.
+func ParseKeySet(b []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("jwt: invalid key set: %s", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key crypto.PublicKey
+		var err error
+		switch k.Kty {
+		case "RSA":
+			key, err = parseRSAKey(k)
+		case "EC":
+			key, err = parseECKey(k)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("jwt: invalid key %q: %s", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("jwt: key set has no signing keys")
+	}
+	return keys, nil
+}
+
+// parseRSAKey converts a JWK to an RSA public key.
+func parseRSAKey(k jsonWebKey) (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+	exp := new(big.Int).SetBytes(e)
+	if !exp.IsInt64() || exp.Int64() < 3 || exp.Int64() > 1<<31-1 {
+		return nil, errors.New("invalid exponent")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, nil
+}
+
+// parseECKey converts a JWK to an ECDSA public key.
+func parseECKey(k jsonWebKey) (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch k.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil {
+		return nil, err
+	}
+	key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	if !curve.IsOnCurve(key.X, key.Y) {
+		return nil, errors.New("point is not on curve")
+	}
+	return key, nil
+}
+
+var algorithmHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+// verifySignature checks the signature of the signing input with the key.
+func verifySignature(alg string, hash crypto.Hash, key crypto.PublicKey, input []byte, sig []byte) error {
+	h := hash.New()
+	h.Write(input)
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return ErrAlgorithm
+		}
+		if rsa.VerifyPKCS1v15(k, hash, digest, sig) != nil {
+			return ErrSignature
+		}
+	case *ecdsa.PublicKey:
+		bits := k.Curve.Params().BitSize
+		if alg != fmt.Sprintf("ES%d", bits) && !(alg == "ES512" && bits == 521) {
+			return ErrAlgorithm
+		}
+		size := (bits + 7) / 8
+		if len(sig) != 2*size {
+			return ErrSignature
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return ErrSignature
+		}
+	default:
+		return ErrAlgorithm
+	}
+	return nil
+}
+
+// decodeSegment decodes a base64url JSON segment of a token.
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
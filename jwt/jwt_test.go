@@ -0,0 +1,234 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testAudience = "coreos-deploy"
+
+func TestVerifyRSA(t *testing.T) {
+	t.Parallel()
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	v := newTestVerifier(t, rsaJWK("rsa1", &key.PublicKey))
+
+	token := signRS256(t, key, "rsa1", validClaims())
+	claims, err := v.Verify(token)
+	if err != nil {
+		t.Fatalf("Valid token should verify: %s", err)
+	}
+	if claims.String("sub") != "jdoe" {
+		t.Errorf("Invalid subject claim.\nExpected:jdoe\nActual:%s", claims.String("sub"))
+	}
+	if roles := claims.Strings("roles"); len(roles) != 2 || roles[1] != "deploy" {
+		t.Errorf("Invalid roles claim: %v", roles)
+	}
+}
+
+func TestVerifyEC(t *testing.T) {
+	t.Parallel()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	v := newTestVerifier(t, ecJWK("ec1", &key.PublicKey))
+
+	if _, err := v.Verify(signES256(t, key, "ec1", validClaims())); err != nil {
+		t.Errorf("Valid token should verify: %s", err)
+	}
+}
+
+func TestVerifyFailures(t *testing.T) {
+	t.Parallel()
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	v := newTestVerifier(t, rsaJWK("rsa1", &key.PublicKey))
+
+	expired := validClaims()
+	expired["exp"] = time.Now().Add(-time.Hour).Unix()
+	future := validClaims()
+	future["nbf"] = time.Now().Add(time.Hour).Unix()
+	wrongAud := validClaims()
+	wrongAud["aud"] = "someone-else"
+	noExp := validClaims()
+	delete(noExp, "exp")
+
+	tests := []struct {
+		name     string
+		token    string
+		expected error
+	}{
+		{"expired", signRS256(t, key, "rsa1", expired), ErrExpired},
+		{"not yet valid", signRS256(t, key, "rsa1", future), ErrNotYetValid},
+		{"audience", signRS256(t, key, "rsa1", wrongAud), ErrAudience},
+		{"missing exp", signRS256(t, key, "rsa1", noExp), ErrMissingClaim},
+		{"signature", signRS256(t, other, "rsa1", validClaims()), ErrSignature},
+		{"unknown key", signRS256(t, key, "rsa2", validClaims()), ErrUnknownKey},
+		{"none algorithm", unsigned(validClaims()), ErrAlgorithm},
+		{"malformed", "not.a-token", ErrMalformed},
+	}
+	for _, tc := range tests {
+		if _, err := v.Verify(tc.token); err != tc.expected {
+			t.Errorf("%s: Expected error '%v', received '%v'.", tc.name, tc.expected, err)
+		}
+	}
+}
+
+func TestVerifyIssuer(t *testing.T) {
+	t.Parallel()
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	path := writeKeySet(t, rsaJWK("rsa1", &key.PublicKey))
+	v, err := NewVerifier(path, testAudience, "https://idp.example.com/")
+	if err != nil {
+		t.Fatalf("Unable to create verifier: %s", err)
+	}
+	if _, err := v.Verify(signRS256(t, key, "rsa1", validClaims())); err != ErrIssuer {
+		t.Errorf("Expected error '%v', received '%v'.", ErrIssuer, err)
+	}
+}
+
+func TestVerifierFromURL(t *testing.T) {
+	t.Parallel()
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(keySet(rsaJWK("rsa1", &key.PublicKey)))
+	}))
+	defer ts.Close()
+
+	v, err := NewVerifier(ts.URL, testAudience, "")
+	if err != nil {
+		t.Fatalf("Unable to create verifier from URL: %s", err)
+	}
+	if _, err := v.Verify(signRS256(t, key, "rsa1", validClaims())); err != nil {
+		t.Errorf("Valid token should verify: %s", err)
+	}
+}
+
+func TestNewVerifierErrors(t *testing.T) {
+	t.Parallel()
+	if _, err := NewVerifier("/does/not/exist.json", testAudience, ""); err == nil {
+		t.Errorf("Missing key set file should return an error.")
+	}
+	path := writeKeySet(t, map[string]string{"kty": "oct", "kid": "x", "k": "c2VjcmV0"})
+	if _, err := NewVerifier(path, testAudience, ""); err == nil {
+		t.Errorf("Key set without signing keys should return an error.")
+	}
+	if _, err := NewVerifier(path, "", ""); err == nil {
+		t.Errorf("Missing audience should return an error.")
+	}
+}
+
+func TestIsToken(t *testing.T) {
+	t.Parallel()
+	if !IsToken("a.b.c") || IsToken("key.secret") || IsToken("opaque") {
+		t.Errorf("Invalid token form detection.")
+	}
+}
+
+// validClaims returns a set of claims that pass validation.
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"sub":   "jdoe",
+		"aud":   []string{"other", testAudience},
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"roles": []string{"read", "deploy"},
+	}
+}
+
+// newTestVerifier writes the keys to a key set file and returns a verifier for it.
+func newTestVerifier(t *testing.T, keys ...interface{}) *Verifier {
+	v, err := NewVerifier(writeKeySet(t, keys...), testAudience, "")
+	if err != nil {
+		t.Fatalf("Unable to create verifier: %s", err)
+	}
+	return v
+}
+
+// writeKeySet writes a JWKS document to a temporary file and returns its path.
+func writeKeySet(t *testing.T, keys ...interface{}) string {
+	dir, err := ioutil.TempDir("", "jwt")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "jwks.json")
+	if err := ioutil.WriteFile(path, keySet(keys...), 0600); err != nil {
+		t.Fatalf("Unable to write key set: %s", err)
+	}
+	return path
+}
+
+func keySet(keys ...interface{}) []byte {
+	b, _ := json.Marshal(map[string]interface{}{"keys": keys})
+	return b
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func rsaJWK(kid string, k *rsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA",
+		"kid": kid,
+		"use": "sig",
+		"n":   b64(k.N.Bytes()),
+		"e":   b64(big.NewInt(int64(k.E)).Bytes()),
+	}
+}
+
+func ecJWK(kid string, k *ecdsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kty": "EC",
+		"kid": kid,
+		"crv": "P-256",
+		"x":   b64(k.X.FillBytes(make([]byte, 32))),
+		"y":   b64(k.Y.FillBytes(make([]byte, 32))),
+	}
+}
+
+// signingInput returns the encoded header and claims of a token.
+func signingInput(alg string, kid string, claims map[string]interface{}) string {
+	h, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	c, _ := json.Marshal(claims)
+	return b64(h) + "." + b64(c)
+}
+
+func signRS256(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	input := signingInput("RS256", kid, claims)
+	digest := crypto.SHA256.New()
+	digest.Write([]byte(input))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest.Sum(nil))
+	if err != nil {
+		t.Fatalf("Unable to sign token: %s", err)
+	}
+	return input + "." + b64(sig)
+}
+
+func signES256(t *testing.T, key *ecdsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	input := signingInput("ES256", kid, claims)
+	digest := crypto.SHA256.New()
+	digest.Write([]byte(input))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest.Sum(nil))
+	if err != nil {
+		t.Fatalf("Unable to sign token: %s", err)
+	}
+	sig := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return input + "." + b64(sig)
+}
+
+func unsigned(claims map[string]interface{}) string {
+	return fmt.Sprintf("%s.", signingInput("none", "rsa1", claims))
+}
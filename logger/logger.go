@@ -1,13 +1,26 @@
 // Package logger provides a custom logging abstract over the standard out logging of golang.
-// All logging should by go to stdout according to 12-factor principles.
+// By default logging goes to stdout according to 12-factor principles. Entries may instead, or also,
+// be sent to sinks such as syslog and rotated files, each with its own minimum level.
 // Logging levels are based on RFC 5424: http://www.rfc-base.org/rfc-5424.html#
+//
+// Entries are written as text lines or, for log pipelines, as one JSON object per line with the
+// timestamp, level, caller, message and any key/value context.
 package logger
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Standard labels.
@@ -41,6 +54,12 @@ const (
 	colourFormat = "[\x1b[%dm%s\x1b[0m] "
 )
 
+// Output formats.
+const (
+	FormatText = "text" // Human readable lines with a pid prefix and file:line.
+	FormatJSON = "json" // One JSON object per line.
+)
+
 var (
 	// Log labels.
 	Labels = []string{"[EMERGENCY] ",
@@ -57,12 +76,28 @@ var (
 // Wrap the os.Exit() function so we can mock/test or customize exit.
 type exiter func(code int)
 
-// Logger provides a datastructure for all logging state.
+// Logger provides a datastructure for all logging state. A child logger made by With or Subsystem
+// shares the state of its root and adds its context to each entry.
 type Logger struct {
-	logger *log.Logger
-	level  int
-	labels []string
-	exit   exiter
+	logger     *log.Logger
+	level      int32 // Read and written atomically so it may be changed while logging.
+	labels     []string
+	exit       exiter
+	json       bool           // Are entries written as JSON?
+	root       *Logger        // The logger holding the state of a child logger, or nil for a root.
+	context    []interface{}  // Key/value pairs added to each entry of a child logger.
+	subsystem  string         // The subsystem of a child logger whose level may differ from the root.
+	levelMu    sync.RWMutex   // Guards subsystems.
+	subsystems map[string]int // The levels of subsystems that differ from the level of the logger.
+	mu         sync.Mutex     // Serializes entries so each sink is told the level of the entry written.
+	sinks      []*levelSink   // Where entries are written.
+	writing    int            // The level of the entry being written.
+}
+
+// levelSink is a sink and the least severe level written to it.
+type levelSink struct {
+	sink  Sink
+	level int
 }
 
 // New is a factory method to return a new logger instance.
@@ -74,10 +109,12 @@ func New(lvl int, clrs bool) *Logger {
 	}
 
 	l := &Logger{
-		logger: log.New(os.Stdout, pre, flags),
-		level:  lvl,
-		exit:   func(code int) { os.Exit(code) },
+		level:      int32(lvl),
+		exit:       func(code int) { os.Exit(code) },
+		subsystems: make(map[string]int),
+		sinks:      []*levelSink{{sink: NewWriterSink(os.Stdout), level: Debug}},
 	}
+	l.logger = log.New(sinkWriter{l}, pre, flags)
 
 	if clrs {
 		l.SetColouredLabels()
@@ -87,8 +124,93 @@ func New(lvl int, clrs bool) *Logger {
 	return l
 }
 
-// SetLogLevel allows a user to set the log level of the logger.
+// SetSinks replaces the sinks of the logger and its children, closing the previous ones. Each sink
+// receives the entries of its level or more severe, and of the level of the logger or more severe.
+func (l *Logger) SetSinks(sinks []Sink, levels []int) error {
+	if len(sinks) != len(levels) {
+		return errors.New("A level is required for each sink.")
+	}
+	l = l.base()
+	replaced := make([]*levelSink, 0, len(sinks))
+	for i, s := range sinks {
+		if levels[i] < Emergency || levels[i] > Debug {
+			return errors.New(fmt.Sprintf("%d log level arg is not in valid range.", levels[i]))
+		}
+		replaced = append(replaced, &levelSink{sink: s, level: levels[i]})
+	}
+	l.mu.Lock()
+	previous := l.sinks
+	l.sinks = replaced
+	l.mu.Unlock()
+	for _, ls := range previous {
+		ls.sink.Close()
+	}
+	return nil
+}
+
+// sinkWriter receives the formatted entries of a logger and writes them to each sink that accepts
+// the level of the entry.
+type sinkWriter struct {
+	l *Logger
+}
+
+// Write writes an entry to the sinks, returning the first error.
+func (w sinkWriter) Write(p []byte) (int, error) {
+	var err error
+	for _, ls := range w.l.sinks {
+		if w.l.writing <= ls.level {
+			if e := ls.sink.Write(w.l.writing, p); e != nil && err == nil {
+				err = e
+			}
+		}
+	}
+	return len(p), err
+}
+
+// With returns a child logger that adds the key/value pairs to each entry, after any context of l,
+// ex: l.With("deployID", id, "service", name). The level, format and output remain those of the root.
+func (l *Logger) With(keysAndValues ...interface{}) *Logger {
+	context := make([]interface{}, 0, len(l.context)+len(keysAndValues))
+	context = append(context, l.context...)
+	if len(keysAndValues)%2 != 0 {
+		keysAndValues = append(keysAndValues, nil)
+	}
+	return &Logger{root: l.base(), subsystem: l.subsystem, context: append(context, keysAndValues...)}
+}
+
+// Subsystem returns a child logger of a subsystem, ex: l.Subsystem("db"), keeping the context of l.
+// Its entries are written at the level set for the subsystem by SetSubsystemLevel, if any, otherwise
+// at the level of the root.
+func (l *Logger) Subsystem(name string) *Logger {
+	return &Logger{root: l.base(), subsystem: name, context: l.context}
+}
+
+// base returns the logger holding the state of l.
+func (l *Logger) base() *Logger {
+	if l.root != nil {
+		return l.root
+	}
+	return l
+}
+
+// enabled returns true if messages of the level are written.
+func (l *Logger) enabled(lvl int) bool {
+	b := l.base()
+	if l.subsystem != "" {
+		b.levelMu.RLock()
+		level, ok := b.subsystems[l.subsystem]
+		b.levelMu.RUnlock()
+		if ok {
+			return level >= lvl
+		}
+	}
+	return int(atomic.LoadInt32(&b.level)) >= lvl
+}
+
+// SetLogLevel allows a user to set the log level of the logger and its children. It is safe to call
+// while logging.
 func (l *Logger) SetLogLevel(lvl int) error {
+	l = l.base()
 	if lvl < UseDefault || lvl > Debug {
 		return errors.New(fmt.Sprintf("%d log level arg is not in valid range.", lvl))
 	}
@@ -96,22 +218,77 @@ func (l *Logger) SetLogLevel(lvl int) error {
 	if lvl == UseDefault {
 		lvl = Info
 	}
-	l.level = lvl
+	atomic.StoreInt32(&l.level, int32(lvl))
 	return nil
 }
 
+// SetSubsystemLevel sets the log level of the children of a subsystem. UseDefault returns the
+// subsystem to the level of the logger.
+func (l *Logger) SetSubsystemLevel(name string, lvl int) error {
+	l = l.base()
+	if lvl < UseDefault || lvl > Debug {
+		return errors.New(fmt.Sprintf("%d log level arg is not in valid range.", lvl))
+	}
+	l.levelMu.Lock()
+	defer l.levelMu.Unlock()
+	if lvl == UseDefault {
+		delete(l.subsystems, name)
+		return nil
+	}
+	l.subsystems[name] = lvl
+	return nil
+}
+
+// GetSubsystemLevels returns the levels of the subsystems that have their own level.
+func (l *Logger) GetSubsystemLevels() map[string]int {
+	l = l.base()
+	l.levelMu.RLock()
+	defer l.levelMu.RUnlock()
+	levels := make(map[string]int, len(l.subsystems))
+	for name, lvl := range l.subsystems {
+		levels[name] = lvl
+	}
+	return levels
+}
+
+// SetFormat sets the output format of the logger and its children to FormatText or FormatJSON.
+func (l *Logger) SetFormat(format string) error {
+	l = l.base()
+	switch format {
+	case FormatText:
+		l.logger.SetFlags(log.Lshortfile | log.Ldate | log.Lmicroseconds)
+		l.logger.SetPrefix(fmt.Sprintf("[%d] ", os.Getpid()))
+		l.json = false
+	case FormatJSON:
+		l.logger.SetFlags(0)
+		l.logger.SetPrefix("")
+		l.json = true
+	default:
+		return errors.New(fmt.Sprintf("%s log format is not text or json.", format))
+	}
+	return nil
+}
+
+// GetFormat returns the output format of the logger.
+func (l *Logger) GetFormat() string {
+	if l.base().json {
+		return FormatJSON
+	}
+	return FormatText
+}
+
 // SetExitFunc allows a user to set the exit function of the logger.
 func (l *Logger) SetExitFunc(e exiter) error {
 	if e == nil {
 		return errors.New("Exit function is manadatory.")
 	}
-	l.exit = e
+	l.base().exit = e
 	return nil
 }
 
 // GetLogLevel returns the current log level of the logger.
 func (l *Logger) GetLogLevel() int {
-	return l.level
+	return int(atomic.LoadInt32(&l.base().level))
 }
 
 // SetPlainLabels sets the message labels to simple text output.
@@ -143,61 +320,71 @@ func (l *Logger) SetColouredLabels() {
 // Emergencyf prints an emergency message to the system log,
 // This is considered an unrecoverable error and the application also exits, unless dont exit = true.
 func (l *Logger) Emergencyf(format string, v ...interface{}) {
-	if l.level >= Emergency {
+	if l.enabled(Emergency) {
 		l.Output(3, Labels[Emergency], format, v...)
 	}
-	l.performExit(l.exit)
+	l.performExit(l.base().exit)
 }
 
 // Alertf prints an alert message to the system log.
 func (l *Logger) Alertf(format string, v ...interface{}) {
-	if l.level >= Alert {
+	if l.enabled(Alert) {
 		l.Output(3, Labels[Alert], format, v...)
 	}
 }
 
 // Criticalf prints a critical message to the system log.
 func (l *Logger) Criticalf(format string, v ...interface{}) {
-	if l.level >= Critical {
+	if l.enabled(Critical) {
 		l.Output(3, Labels[Critical], format, v...)
 	}
 }
 
 // Errorf prints an error message to the system log.
 func (l *Logger) Errorf(format string, v ...interface{}) {
-	if l.level >= Error {
+	if l.enabled(Error) {
 		l.Output(3, Labels[Error], format, v...)
 	}
 }
 
 // Warningf prints a warning message to the system log.
 func (l *Logger) Warningf(format string, v ...interface{}) {
-	if l.level >= Warning {
+	if l.enabled(Warning) {
 		l.Output(3, Labels[Warning], format, v...)
 	}
 }
 
 // Noticef prints a notice message to the system log.
 func (l *Logger) Noticef(format string, v ...interface{}) {
-	if l.level >= Notice {
+	if l.enabled(Notice) {
 		l.Output(3, Labels[Notice], format, v...)
 	}
 }
 
 // Infof prints an informational message to the system log.
 func (l *Logger) Infof(format string, v ...interface{}) {
-	if l.level >= Info {
+	if l.enabled(Info) {
 		l.Output(3, Labels[Info], format, v...)
 	}
 }
 
 // Debugf prints a debug message to the system log.
 func (l *Logger) Debugf(format string, v ...interface{}) {
-	if l.level >= Debug {
+	if l.enabled(Debug) {
 		l.Output(3, Labels[Debug], format, v...)
 	}
 }
 
+// Logw prints a message at the level with key/value pairs of context,
+// ex: Logw(Info, "Deploy started.", "deployID", id, "service", name).
+// Unlike Emergencyf, an Emergency message does not exit.
+func (l *Logger) Logw(lvl int, msg string, keysAndValues ...interface{}) {
+	if lvl < Emergency || lvl > Debug || !l.enabled(lvl) {
+		return
+	}
+	l.output(3, Labels[lvl], msg, keysAndValues)
+}
+
 // Output prints a message directly into the system log. Normally, you should use level message functions.
 // so that level can trap the write.
 func (l *Logger) Output(cd int, lbl string, format string, v ...interface{}) error {
@@ -205,7 +392,117 @@ func (l *Logger) Output(cd int, lbl string, format string, v ...interface{}) err
 	if cd > 0 {
 		d = cd
 	}
-	return l.logger.Output(d, fmt.Sprintf(lbl+format, v...))
+	return l.output(d+1, lbl, fmt.Sprintf(format, v...), nil)
+}
+
+// output writes a message with its context as text or JSON. cd is the call depth of the code that
+// logged the message, counted as for log.Output from the caller of output.
+func (l *Logger) output(cd int, lbl string, msg string, keysAndValues []interface{}) error {
+	if len(l.context) > 0 {
+		keysAndValues = append(append([]interface{}{}, l.context...), keysAndValues...)
+	}
+	b := l.base()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.writing = levelOf(lbl)
+	if !b.json {
+		return b.logger.Output(cd, lbl+msg+textContext(keysAndValues))
+	}
+	return b.logger.Output(cd, jsonEntry(cd, lbl, msg, keysAndValues))
+}
+
+// levelOf returns the level of a label, or Info for a label that is not one of Labels.
+func levelOf(lbl string) int {
+	for i, l := range Labels {
+		if l == lbl {
+			return i
+		}
+	}
+	return Info
+}
+
+// jsonEntry returns the JSON object of an entry. cd is the call depth given to output, which is also
+// the depth of the code that logged the message counted from jsonEntry.
+func jsonEntry(cd int, lbl string, msg string, keysAndValues []interface{}) string {
+	var b bytes.Buffer
+	b.WriteString(`{"timestamp":`)
+	writeJSON(&b, time.Now().UTC().Format(time.RFC3339Nano))
+	b.WriteString(`,"level":`)
+	writeJSON(&b, strings.ToLower(strings.Trim(strings.TrimSpace(lbl), "[]")))
+	if _, file, line, ok := runtime.Caller(cd); ok {
+		b.WriteString(`,"caller":`)
+		writeJSON(&b, filepath.Base(file)+":"+strconv.Itoa(line))
+	}
+	b.WriteString(`,"pid":`)
+	b.WriteString(strconv.Itoa(os.Getpid()))
+	b.WriteString(`,"message":`)
+	writeJSON(&b, strings.TrimRight(msg, "\n"))
+	for i := 0; i < len(keysAndValues); i += 2 {
+		key := contextKey(keysAndValues[i])
+		if reservedKeys[key] {
+			key = "context." + key
+		}
+		b.WriteByte(',')
+		writeJSON(&b, key)
+		b.WriteByte(':')
+		writeJSON(&b, contextValue(keysAndValues, i+1))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// reservedKeys are the fields of every JSON entry, which context keys are not allowed to replace.
+var reservedKeys = map[string]bool{"timestamp": true, "level": true, "caller": true, "pid": true, "message": true}
+
+// contextKey returns the key at a position of the key/value context.
+func contextKey(k interface{}) string {
+	if s, ok := k.(string); ok {
+		return s
+	}
+	return fmt.Sprint(k)
+}
+
+// contextValue returns the value at a position of the key/value context, or nil if it is missing.
+func contextValue(keysAndValues []interface{}, i int) interface{} {
+	if i >= len(keysAndValues) {
+		return nil
+	}
+	if err, ok := keysAndValues[i].(error); ok {
+		return err.Error()
+	}
+	return keysAndValues[i]
+}
+
+// writeJSON writes a value as JSON, or its string form if it cannot be marshalled.
+func writeJSON(b *bytes.Buffer, v interface{}) {
+	j, err := json.Marshal(v)
+	if err != nil {
+		j, _ = json.Marshal(fmt.Sprint(v))
+	}
+	b.Write(j)
+}
+
+// textContext returns the key/value context as " key=value" pairs for a text line. Strings with
+// spaces or quotes are quoted and other values that are not numbers or booleans are written as JSON.
+func textContext(keysAndValues []interface{}) string {
+	var b bytes.Buffer
+	for i := 0; i < len(keysAndValues); i += 2 {
+		b.WriteByte(' ')
+		b.WriteString(contextKey(keysAndValues[i]))
+		b.WriteByte('=')
+		switch v := contextValue(keysAndValues, i+1).(type) {
+		case string:
+			if v == "" || strings.ContainsAny(v, " \"=\t\n") {
+				v = strconv.Quote(v)
+			}
+			b.WriteString(v)
+		case int, int64, float64, bool:
+			fmt.Fprint(&b, v)
+		default:
+			writeJSON(&b, v)
+		}
+	}
+	return b.String()
 }
 
 // performExit wraps the application exit point wih a custom closure/anonymous function.
@@ -2,6 +2,7 @@ package logger
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
@@ -189,3 +190,122 @@ func expectOutput(t *testing.T, f func(), expected string) {
 		t.Errorf("Expected '%s', received '%s'.", expected, out)
 	}
 }
+
+func TestSetFormat(t *testing.T) {
+	l := New(Debug, false)
+	if l.GetFormat() != FormatText {
+		t.Errorf("The default format should be text.")
+	}
+	if err := l.SetFormat(FormatJSON); err != nil || l.GetFormat() != FormatJSON {
+		t.Errorf("The format should be set to json.")
+	}
+	if err := l.SetFormat("xml"); err == nil {
+		t.Errorf("An unknown format should be rejected.")
+	}
+}
+
+func TestJSONFormat(t *testing.T) {
+	t.Parallel()
+	var b bytes.Buffer
+	l := New(Debug, false)
+	l.SetFormat(FormatJSON)
+	l.logger.SetOutput(&b)
+	l.Warningf("Deploy %s is slow.", "A1")
+	l.Logw(Info, "Deploy started.", "deployID", "A1", "instances", 2, "level", "ignored", "odd")
+	l.Logw(Debug+1, "Not a level.")
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Each entry should be a line, received %q.", b.String())
+	}
+	var e map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &e); err != nil {
+		t.Fatalf("An entry should be JSON, received %s.", lines[0])
+	}
+	if e["level"] != "warning" || e["message"] != "Deploy A1 is slow." || e["timestamp"] == nil ||
+		!strings.HasPrefix(e["caller"].(string), "logger_test.go:") {
+		t.Errorf("An entry should have the timestamp, level, caller and message, received %s.", lines[0])
+	}
+	e = nil
+	json.Unmarshal([]byte(lines[1]), &e)
+	if e["level"] != "info" || e["deployID"] != "A1" || e["instances"] != float64(2) ||
+		e["context.level"] != "ignored" || e["odd"] != nil {
+		t.Errorf("The context should be added to the entry, received %s.", lines[1])
+	}
+}
+
+func TestTextContext(t *testing.T) {
+	t.Parallel()
+	var b bytes.Buffer
+	l := New(Info, false)
+	l.logger.SetOutput(&b)
+	l.Logw(Info, "Request received.", "requestID", "A1", "note", "two words", "request", map[string]int{"n": 1})
+	l.Logw(Debug, "Filtered.")
+	expected := fmt.Sprintf(`%sRequest received. requestID=A1 note="two words" request={"n":1}`+"\n", Labels[Info])
+	if !strings.HasSuffix(b.String(), expected) {
+		t.Errorf("Expected '%s', received '%s'.", expected, b.String())
+	}
+}
+
+func TestWith(t *testing.T) {
+	t.Parallel()
+	var b bytes.Buffer
+	l := New(Info, false)
+	l.logger.SetOutput(&b)
+	deploy := l.With("deployID", "A1").With("service", "web")
+	deploy.Infof("Deploy %s.", "started")
+	deploy.Logw(Warning, "Slow.", "step", "flip_ab")
+	deploy.Debugf("Filtered.")
+
+	// The level and format of the root apply to its children.
+	l.SetLogLevel(Debug)
+	l.SetFormat(FormatJSON)
+	deploy.Debugf("Stopping.")
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 entries, received %q.", b.String())
+	}
+	if !strings.HasSuffix(lines[0], Labels[Info]+"Deploy started. deployID=A1 service=web") ||
+		!strings.HasSuffix(lines[1], Labels[Warning]+"Slow. deployID=A1 service=web step=flip_ab") {
+		t.Errorf("Child entries should carry their context, received %q.", lines[:2])
+	}
+	var e map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[2]), &e); err != nil || e["deployID"] != "A1" || e["service"] != "web" ||
+		e["level"] != "debug" {
+		t.Errorf("Child entries should follow the root level and format, received %s.", lines[2])
+	}
+	if deploy.GetLogLevel() != Debug || len(l.context) != 0 {
+		t.Errorf("The root should hold the level without the child context.")
+	}
+}
+
+func TestSubsystemLevel(t *testing.T) {
+	t.Parallel()
+	var b bytes.Buffer
+	l := New(Info, false)
+	l.logger.SetOutput(&b)
+	db := l.Subsystem("db").With("deployID", "A1")
+	http := l.Subsystem("http")
+
+	if err := l.SetSubsystemLevel("db", Debug+1); err == nil {
+		t.Errorf("High param value was not tested properly.")
+	}
+	l.SetSubsystemLevel("db", Debug)
+	l.SetSubsystemLevel("http", Error)
+	db.Debugf("Query.")
+	http.Infof("Filtered by the subsystem level.")
+	l.Debugf("Filtered by the logger level.")
+
+	// A subsystem set to UseDefault follows the logger again.
+	l.SetSubsystemLevel("db", UseDefault)
+	db.Debugf("Filtered again.")
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 1 || !strings.HasSuffix(lines[0], Labels[Debug]+"Query. deployID=A1") {
+		t.Errorf("Only the debug subsystem should log at debug, received %q.", b.String())
+	}
+	if levels := l.GetSubsystemLevels(); len(levels) != 1 || levels["http"] != Error {
+		t.Errorf("Expected the http level only, received %v.", levels)
+	}
+}
@@ -0,0 +1,206 @@
+package logger
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	fileDefaultKeep   = 7                 // Rotated files kept by default.
+	rotatedTimeFormat = "20060102-150405" // Suffix of a rotated file.
+)
+
+// fileSink appends entries to a file, rotating it once it exceeds a size or age.
+type fileSink struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64         // Rotate once the file is larger than this many bytes. Zero never rotates by size.
+	maxAge  time.Duration // Rotate once the file is older than this. Zero never rotates by age.
+	keep    int           // Rotated files kept, oldest removed first.
+	file    *os.File
+	size    int64     // Bytes in the current file.
+	opened  time.Time // When the current file was begun.
+	closed  bool      // Set by Close; the file is not reopened.
+	now     func() time.Time
+	rename  func(oldpath, newpath string) error
+}
+
+// NewFileSink is a factory function that returns a Sink appending entries to the file at a path with
+// optional max_size, max_age and keep query parameters, ex: /var/log/deploy.log?max_size=100MB&max_age=24h.
+// A rotated file is renamed with the time it was rotated, ex: deploy.log.20160102-150405.
+func NewFileSink(target string) (Sink, error) {
+	path, query := target, ""
+	if i := strings.Index(target, "?"); i >= 0 {
+		path, query = target[:i], target[i+1:]
+	}
+	if path == "" {
+		return nil, errors.New("A log file path is required.")
+	}
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	s := &fileSink{path: path, keep: fileDefaultKeep, now: time.Now, rename: os.Rename}
+	if v := q.Get("max_size"); v != "" {
+		if s.maxSize, err = parseSize(v); err != nil {
+			return nil, err
+		}
+	}
+	if v := q.Get("max_age"); v != "" {
+		if s.maxAge, err = time.ParseDuration(v); err != nil || s.maxAge < 0 {
+			return nil, errors.New(fmt.Sprintf("%s is not a log file age.", v))
+		}
+	}
+	if v := q.Get("keep"); v != "" {
+		if s.keep, err = strconv.Atoi(v); err != nil || s.keep < 0 {
+			return nil, errors.New(fmt.Sprintf("%s is not a count of log files to keep.", v))
+		}
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// parseSize returns the bytes of a size such as 512, 64KB, 100MB or 1GB.
+func parseSize(v string) (int64, error) {
+	mult := int64(1)
+	n := strings.ToUpper(strings.TrimSpace(v))
+	for suffix, m := range map[string]int64{"KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30} {
+		if strings.HasSuffix(n, suffix) {
+			n, mult = strings.TrimSuffix(n, suffix), m
+			break
+		}
+	}
+	size, err := strconv.ParseInt(n, 10, 64)
+	if err != nil || size < 0 {
+		return 0, errors.New(fmt.Sprintf("%s is not a log file size.", v))
+	}
+	return size * mult, nil
+}
+
+// open opens the file for appending. An existing file keeps its age from its modification time.
+func (s *fileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.file, s.size, s.opened = f, info.Size(), s.now()
+	if info.Size() > 0 {
+		s.opened = info.ModTime()
+	}
+	return nil
+}
+
+// Write appends the entry, first rotating the file if the entry would exceed its size or the file
+// is too old. When the rotation fails the entry is still appended to the current file and the rotation
+// is tried again on the next entry.
+func (s *fileSink) Write(lvl int, entry []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errors.New("The log file is closed.")
+	}
+	if s.file == nil {
+		// An earlier rotation was unable to begin a new file.
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	var rotateErr error
+	if s.size > 0 && ((s.maxSize > 0 && s.size+int64(len(entry)) > s.maxSize) ||
+		(s.maxAge > 0 && s.now().Sub(s.opened) >= s.maxAge)) {
+		if rotateErr = s.rotate(); s.file == nil {
+			return rotateErr
+		}
+	}
+	n, err := s.file.Write(entry)
+	s.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return err
+}
+
+// rotate renames the file with the current time, begins a new one and removes the oldest rotated
+// files beyond those kept. When the file cannot be renamed it is reopened so entries keep being
+// appended to it.
+func (s *fileSink) rotate() error {
+	s.file.Close()
+	s.file = nil
+	rotated := s.path + "." + s.now().Format(rotatedTimeFormat)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(rotated); os.IsNotExist(err) {
+			break
+		}
+		rotated = fmt.Sprintf("%s.%s.%d", s.path, s.now().Format(rotatedTimeFormat), i)
+	}
+	if err := s.rename(s.path, rotated); err != nil {
+		if e := s.open(); e != nil {
+			return e
+		}
+		return err
+	}
+	if err := s.open(); err != nil {
+		return err
+	}
+	s.opened = s.now()
+
+	matches, _ := filepath.Glob(s.path + ".*")
+	var old []string
+	for _, m := range matches {
+		if s.rotatedFile(m) {
+			old = append(old, m)
+		}
+	}
+	sort.Strings(old)
+	for len(old) > s.keep {
+		os.Remove(old[0])
+		old = old[1:]
+	}
+	return nil
+}
+
+// rotatedFile returns true if the name is one given to the file by rotate, ex: deploy.log.20160102-150405
+// or deploy.log.20160102-150405.1. Other files beside the log are never removed.
+func (s *fileSink) rotatedFile(name string) bool {
+	suffix := strings.TrimPrefix(name, s.path+".")
+	if suffix == name {
+		return false
+	}
+	stamp := suffix
+	if i := strings.Index(suffix, "."); i >= 0 {
+		stamp = suffix[:i]
+		if _, err := strconv.ParseUint(suffix[i+1:], 10, 32); err != nil {
+			return false
+		}
+	}
+	_, err := time.Parse(rotatedTimeFormat, stamp)
+	return err == nil
+}
+
+// Close closes the file.
+func (s *fileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
@@ -0,0 +1,220 @@
+package logger
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLevel(t *testing.T) {
+	t.Parallel()
+	for name, expected := range map[string]int{"emergency": Emergency, "WARNING": Warning, "Debug": Debug} {
+		if lvl, err := ParseLevel(name); err != nil || lvl != expected {
+			t.Errorf("%s should be level %d, received %d.", name, expected, lvl)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Errorf("An unknown level should be an error.")
+	}
+}
+
+func TestOpenSinks(t *testing.T) {
+	t.Parallel()
+	dir, _ := ioutil.TempDir("", "coreos-deploy-sinks")
+	defer os.RemoveAll(dir)
+
+	sinks, levels, err := OpenSinks("stdout@info, file:" + filepath.Join(dir, "deploy.log") + "?keep=2@Warning")
+	if err != nil {
+		t.Fatalf("The sinks should open, received %s.", err)
+	}
+	if len(sinks) != 2 || levels[0] != Info || levels[1] != Warning {
+		t.Errorf("Each sink should have its level, received %v.", levels)
+	}
+	if s, ok := sinks[1].(*fileSink); !ok || s.keep != 2 {
+		t.Errorf("The file sink should keep its options, received %+v.", sinks[1])
+	}
+	for _, s := range sinks {
+		s.Close()
+	}
+
+	for _, list := range []string{"", "stdout,kafka:logs", "syslog:http://logs", "file:" + dir + "/x.log?max_size=big"} {
+		if _, _, err := OpenSinks(list); err == nil {
+			t.Errorf("%q should not open.", list)
+		}
+	}
+}
+
+func TestSyslogSink(t *testing.T) {
+	t.Parallel()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen for syslog: %s", err)
+	}
+	defer conn.Close()
+
+	s, err := NewSyslogSink("udp://" + conn.LocalAddr().String() + "?facility=local0&tag=deploy")
+	if err != nil {
+		t.Fatalf("The syslog sink should open, received %s.", err)
+	}
+	defer s.Close()
+	if err := s.Write(Warning, []byte("Deploy failed.\n")); err != nil {
+		t.Fatalf("The entry should be sent, received %s.", err)
+	}
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("No syslog message was received: %s", err)
+	}
+	msg := string(buf[:n])
+	if !strings.HasPrefix(msg, "<132>1 ") || !strings.Contains(msg, " deploy ") ||
+		!strings.HasSuffix(msg, " - - Deploy failed.") {
+		t.Errorf("The message should be RFC 5424 of local0.warning, received %q.", msg)
+	}
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	t.Parallel()
+	dir, _ := ioutil.TempDir("", "coreos-deploy-rotate")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "deploy.log")
+
+	s, err := NewFileSink(path + "?max_size=1KB&keep=2")
+	if err != nil {
+		t.Fatalf("The file sink should open, received %s.", err)
+	}
+	fs := s.(*fileSink)
+	clock := time.Date(2016, 1, 2, 15, 4, 5, 0, time.UTC)
+	fs.now = func() time.Time { clock = clock.Add(time.Second); return clock }
+
+	entry := []byte(strings.Repeat("x", 399) + "\n")
+	for i := 0; i < 10; i++ {
+		if err := s.Write(Info, entry); err != nil {
+			t.Fatalf("The entry should be written, received %s.", err)
+		}
+	}
+	s.Close()
+
+	// Two entries fit in each file, so four files were rotated and the oldest two removed.
+	rotated, _ := filepath.Glob(path + ".*")
+	if len(rotated) != 2 {
+		t.Fatalf("Expected 2 rotated files, received %v.", rotated)
+	}
+	for _, p := range append(rotated, path) {
+		if b, _ := ioutil.ReadFile(p); len(b) != 2*len(entry) {
+			t.Errorf("%s should hold two entries, received %d bytes.", p, len(b))
+		}
+	}
+
+	// A file older than max_age is rotated on the next entry.
+	s, _ = NewFileSink(path + "?max_age=1h&keep=5")
+	fs = s.(*fileSink)
+	fs.now = func() time.Time { return fs.opened.Add(2 * time.Hour) }
+	s.Write(Info, entry)
+	s.Close()
+	if rotated, _ = filepath.Glob(path + ".*"); len(rotated) != 3 {
+		t.Errorf("An old file should be rotated, received %v.", rotated)
+	}
+}
+
+func TestFileSinkRotationKeepsOtherFiles(t *testing.T) {
+	t.Parallel()
+	dir, _ := ioutil.TempDir("", "coreos-deploy-rotate")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "deploy.log")
+	others := []string{path + ".bak", path + ".1", path + ".2015-01-01", path + ".20150101-000000.old"}
+	for _, p := range others {
+		ioutil.WriteFile(p, []byte("keep me\n"), 0644)
+	}
+	ioutil.WriteFile(path+".20150101-000000", []byte("old\n"), 0644)
+
+	s, _ := NewFileSink(path + "?max_size=1KB&keep=1")
+	fs := s.(*fileSink)
+	clock := time.Date(2016, 1, 2, 15, 4, 5, 0, time.UTC)
+	fs.now = func() time.Time { clock = clock.Add(time.Second); return clock }
+	entry := []byte(strings.Repeat("x", 599) + "\n")
+	for i := 0; i < 3; i++ {
+		s.Write(Info, entry)
+	}
+	s.Close()
+
+	for _, p := range others {
+		if _, err := os.Stat(p); err != nil {
+			t.Errorf("%s is not a rotated file and should be kept, received %s.", p, err)
+		}
+	}
+	if _, err := os.Stat(path + ".20150101-000000"); !os.IsNotExist(err) {
+		t.Errorf("The oldest rotated file should be removed.")
+	}
+	if rotated, _ := filepath.Glob(path + ".2016*"); len(rotated) != 1 {
+		t.Errorf("Only the newest rotated file should be kept, received %v.", rotated)
+	}
+}
+
+func TestFileSinkRotationFailure(t *testing.T) {
+	t.Parallel()
+	dir, _ := ioutil.TempDir("", "coreos-deploy-rotate")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "deploy.log")
+
+	s, _ := NewFileSink(path + "?max_size=1KB")
+	fs := s.(*fileSink)
+	fs.rename = func(oldpath, newpath string) error { return errors.New("Rename failed.") }
+	entry := []byte(strings.Repeat("x", 599) + "\n")
+	if err := s.Write(Info, entry); err != nil {
+		t.Fatalf("The entry should be written, received %s.", err)
+	}
+	if err := s.Write(Info, entry); err == nil {
+		t.Errorf("A failed rotation should be reported.")
+	}
+
+	// The file is kept and written once the rotation succeeds.
+	fs.rename = os.Rename
+	if err := s.Write(Info, entry); err != nil {
+		t.Fatalf("The entry should be written after the rotation, received %s.", err)
+	}
+	s.Close()
+	rotated, _ := filepath.Glob(path + ".*")
+	if len(rotated) != 1 {
+		t.Fatalf("Expected 1 rotated file, received %v.", rotated)
+	}
+	if b, _ := ioutil.ReadFile(rotated[0]); len(b) != 2*len(entry) {
+		t.Errorf("The entries written during the failure should be kept, received %d bytes.", len(b))
+	}
+	if b, _ := ioutil.ReadFile(path); len(b) != len(entry) {
+		t.Errorf("The new file should hold one entry, received %d bytes.", len(b))
+	}
+	if err := s.Write(Info, entry); err == nil {
+		t.Errorf("A closed sink should not be written.")
+	}
+}
+
+func TestSetSinks(t *testing.T) {
+	t.Parallel()
+	var all, warnings bytes.Buffer
+	l := New(Info, false)
+	if err := l.SetSinks([]Sink{NewWriterSink(&all)}, []int{Debug, Warning}); err == nil {
+		t.Errorf("Each sink should require a level.")
+	}
+	l.SetSinks([]Sink{NewWriterSink(&all), NewWriterSink(&warnings)}, []int{Debug, Warning})
+
+	deploy := l.With("deployID", "A1")
+	deploy.Infof("Deploy started.")
+	deploy.Errorf("Deploy failed.")
+	l.Debugf("Filtered by the logger level.")
+
+	if strings.Count(all.String(), "\n") != 2 || !strings.Contains(all.String(), Labels[Info]+"Deploy started.") {
+		t.Errorf("The debug sink should receive each entry of the logger, received %q.", all.String())
+	}
+	if strings.Count(warnings.String(), "\n") != 1 ||
+		!strings.Contains(warnings.String(), Labels[Error]+"Deploy failed. deployID=A1") {
+		t.Errorf("The warning sink should receive only warnings or worse, received %q.", warnings.String())
+	}
+}
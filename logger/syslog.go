@@ -0,0 +1,146 @@
+package logger
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	syslogDefaultFacility = 3               // daemon
+	syslogDefaultTag      = "coreos-deploy" // APP-NAME of each message.
+	syslogDialTimeout     = 5 * time.Second // Timeout to connect to the syslog server.
+)
+
+// syslogFacilities are the RFC 5424 facility codes by name.
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7, "uucp": 8,
+	"cron": 9, "authpriv": 10, "ftp": 11, "local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogSink sends entries as RFC 5424 messages to a syslog server. The levels of the logger are
+// the RFC 5424 severities.
+type syslogSink struct {
+	mu       sync.Mutex
+	network  string // udp, tcp, unixgram or unix.
+	address  string // host:port or socket path.
+	facility int
+	tag      string
+	hostname string
+	conn     net.Conn // nil until connected or after a failed write.
+}
+
+// NewSyslogSink is a factory function that returns a Sink sending entries to the syslog server at
+// a URL of udp://HOST:PORT, tcp://HOST:PORT or unix:///PATH, with optional facility and tag query
+// parameters. Messages over TCP are framed by octet counting (RFC 6587).
+func NewSyslogSink(target string) (Sink, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	s := &syslogSink{facility: syslogDefaultFacility, tag: syslogDefaultTag, hostname: "-"}
+	switch u.Scheme {
+	case "udp", "tcp":
+		if u.Host == "" {
+			return nil, errors.New(fmt.Sprintf("%s has no syslog host.", target))
+		}
+		s.network, s.address = u.Scheme, u.Host
+	case "unix":
+		if u.Path == "" {
+			return nil, errors.New(fmt.Sprintf("%s has no syslog socket path.", target))
+		}
+		s.network, s.address = "unixgram", u.Path
+	default:
+		return nil, errors.New(fmt.Sprintf("%s is not a udp, tcp or unix syslog URL.", target))
+	}
+	q := u.Query()
+	if f := q.Get("facility"); f != "" {
+		code, ok := syslogFacilities[f]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("%s is not a syslog facility.", f))
+		}
+		s.facility = code
+	}
+	if t := q.Get("tag"); t != "" {
+		s.tag = t
+	}
+	if h, err := os.Hostname(); err == nil && h != "" {
+		s.hostname = h
+	}
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// connect dials the syslog server. A unix socket that does not accept datagrams is tried as a stream.
+func (s *syslogSink) connect() error {
+	conn, err := net.DialTimeout(s.network, s.address, syslogDialTimeout)
+	if err != nil && s.network == "unixgram" {
+		if conn, err = net.DialTimeout("unix", s.address, syslogDialTimeout); err == nil {
+			s.network = "unix"
+		}
+	}
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+// Write sends the entry as a message of the severity of the level. A failed connection is dialled
+// again once.
+func (s *syslogSink) Write(lvl int, entry []byte) error {
+	msg := s.format(lvl, time.Now(), entry)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if s.conn == nil {
+			if err = s.connect(); err != nil {
+				continue
+			}
+		}
+		if _, err = s.conn.Write(msg); err == nil {
+			return nil
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+// format returns the RFC 5424 message of an entry, framed for the network.
+// ex: <27>1 2016-01-02T15:04:05.123456Z host coreos-deploy 42 - - message
+func (s *syslogSink) format(lvl int, t time.Time, entry []byte) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %d - - ", s.facility*8+lvl, t.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		s.hostname, s.tag, os.Getpid())
+	b.Write(bytes.TrimRight(entry, "\n"))
+	switch s.network {
+	case "tcp":
+		return append([]byte(strconv.Itoa(b.Len())+" "), b.Bytes()...)
+	case "unix":
+		b.WriteByte('\n') // A stream socket separates messages by line.
+	}
+	return b.Bytes()
+}
+
+// Close closes the connection to the syslog server.
+func (s *syslogSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
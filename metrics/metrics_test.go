@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCounter(t *testing.T) {
+	t.Parallel()
+	r := NewRegistry()
+	c := r.NewCounter("requests_total", "Requests handled.", "route", "code")
+	c.Inc("/v1.0/deploy", "200")
+	c.Add(2, "/v1.0/deploy", "200")
+	c.Inc("/v1.0/status/", "404")
+
+	var b bytes.Buffer
+	if err := r.Write(&b); err != nil {
+		t.Fatalf("Write should succeed, received %s.", err)
+	}
+	want := `# HELP requests_total Requests handled.
+# TYPE requests_total counter
+requests_total{route="/v1.0/deploy",code="200"} 3
+requests_total{route="/v1.0/status/",code="404"} 1
+`
+	if b.String() != want {
+		t.Errorf("Counter should be written as\n%s\nreceived\n%s", want, b.String())
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	t.Parallel()
+	r := NewRegistry()
+	h := r.NewHistogram("duration_seconds", "How long.", []float64{1, 5}, "command")
+	h.Observe(0.5, "start")
+	h.Observe(1, "start")
+	h.Observe(3, "start")
+	h.Observe(9, "start")
+
+	var b bytes.Buffer
+	r.Write(&b)
+	want := `# HELP duration_seconds How long.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{command="start",le="1"} 2
+duration_seconds_bucket{command="start",le="5"} 3
+duration_seconds_bucket{command="start",le="+Inf"} 4
+duration_seconds_sum{command="start"} 13.5
+duration_seconds_count{command="start"} 4
+`
+	if b.String() != want {
+		t.Errorf("Histogram should be written as\n%s\nreceived\n%s", want, b.String())
+	}
+}
+
+func TestGaugeAndEscaping(t *testing.T) {
+	t.Parallel()
+	r := NewRegistry()
+	r.NewGaugeFunc("queue_depth", "Waiting\nwork.", func() float64 { return 2 })
+	c := r.NewCounter("odd_total", "Odd labels.", "name")
+	c.Inc("a\"b\\c\nd")
+
+	var b bytes.Buffer
+	r.Write(&b)
+	for _, line := range []string{
+		`# HELP queue_depth Waiting\nwork.`,
+		"queue_depth 2",
+		`odd_total{name="a\"b\\c\nd"} 1`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("Output should contain %q, received\n%s", line, b.String())
+		}
+	}
+}
+
+func TestLabelCount(t *testing.T) {
+	t.Parallel()
+	defer func() {
+		if recover() == nil {
+			t.Errorf("The wrong number of label values should panic.")
+		}
+	}()
+	NewRegistry().NewCounter("c_total", "C.", "a").Inc()
+}
@@ -0,0 +1,296 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/composer22/coreos-deploy/db"
+	"github.com/composer22/coreos-deploy/trace"
+)
+
+const approvalSweepInterval = time.Minute // How often unapproved deploys are checked for expiry.
+
+// approvalRule is the number of approvals required for deploys to an environment, optionally
+// limited to services matching a glob.
+type approvalRule struct {
+	environment    string // The environment of the server the rule applies to.
+	servicePattern string // Optional glob of service names the rule applies to.
+	count          int    // The approvals required.
+}
+
+// parseApprovalRules parses a comma list of ENVIRONMENT[/SERVICE_GLOB]=COUNT rules.
+// ex: "production=1,production/acme-billing-*=2,production/acme-docs=0"
+func parseApprovalRules(list string) ([]*approvalRule, error) {
+	rules := make([]*approvalRule, 0)
+	for _, r := range splitList(list) {
+		i := strings.LastIndex(r, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid approval rule %q", r)
+		}
+		count, err := strconv.Atoi(r[i+1:])
+		if err != nil || count < 0 {
+			return nil, fmt.Errorf("invalid approval count in rule %q", r)
+		}
+		rule := &approvalRule{environment: r[:i], count: count}
+		if j := strings.Index(rule.environment, "/"); j >= 0 {
+			rule.environment, rule.servicePattern = rule.environment[:j], rule.environment[j+1:]
+			if _, err := path.Match(rule.servicePattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid service glob in rule %q", r)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// requiredApprovals returns the approvals needed to deploy a service to the environment. Rules
+// for a service take precedence over rules for the whole environment; if several rules of the
+// same kind match, the highest count is used.
+func requiredApprovals(rules []*approvalRule, environment string, serviceName string) int {
+	envCount, svcCount, svcMatch := 0, 0, false
+	for _, r := range rules {
+		if r.environment != environment {
+			continue
+		}
+		if r.servicePattern == "" {
+			if r.count > envCount {
+				envCount = r.count
+			}
+			continue
+		}
+		if ok, _ := path.Match(r.servicePattern, serviceName); ok {
+			if !svcMatch || r.count > svcCount {
+				svcCount = r.count
+			}
+			svcMatch = true
+		}
+	}
+	if svcMatch {
+		return svcCount
+	}
+	return envCount
+}
+
+// approvalRequest is the optional payload to approve, reject or cancel a deploy.
+type approvalRequest struct {
+	Comment string `json:"comment"` // A reason for the decision.
+}
+
+// approvalResponse returns the state of a deploy after a decision.
+type approvalResponse struct {
+	DeployID          string `json:"deployID"`          // The deploy UUID.
+	Status            int    `json:"status"`            // The status ID of the deploy.
+	Approvals         int    `json:"approvals"`         // The approvals given so far.
+	ApprovalsRequired int    `json:"approvalsRequired"` // The approvals needed before the deploy runs.
+}
+
+// deployActionHandler handles requests to act on a deploy that has not started. The caller must
+// have the deploy role for the service. An approver cannot be the identity that requested the deploy.
+//
+//	POST /v1.0/deploy/{id}/approve - approve the deploy. It runs once enough approvals are given.
+//	POST /v1.0/deploy/{id}/reject  - reject the deploy.
+//	POST /v1.0/deploy/{id}/cancel  - cancel a scheduled deploy or one awaiting approval.
+func (s *Server) deployActionHandler(w http.ResponseWriter, r *http.Request) {
+	if s.invalidHeader(w, r) || s.invalidMethod(w, r, httpPost) || s.invalidAuth(w, r, RoleDeploy) {
+		return
+	}
+
+	params := routeParams(r.URL.Path, httpRouteV1Deploy)
+	if len(params) != 2 || (params[1] != db.Approve && params[1] != db.Reject && params[1] != deployCancel) {
+		http.Error(w, NotFound, http.StatusNotFound)
+		return
+	}
+	deployID, decision := params[0], params[1]
+	setAudit(r, "deploy."+decision, "", "deployID="+deployID)
+
+	var q approvalRequest
+	if b, err := ioutil.ReadAll(r.Body); err == nil && len(b) > 0 {
+		if err := json.Unmarshal(b, &q); err != nil {
+			http.Error(w, InvalidJSONText, http.StatusBadRequest)
+			return
+		}
+	}
+
+	d := s.db.WithContext(r.Context())
+	st, err := d.QueryDeploy(deployID)
+	if err != nil {
+		http.Error(w, NotFound, http.StatusNotFound)
+		return
+	}
+	setAudit(r, "", st.ServiceName, "")
+	if s.invalidService(w, r, st.ServiceName) {
+		return
+	}
+	if decision == deployCancel {
+		s.cancelDeploy(w, r, st, q.Comment)
+		return
+	}
+	if st.Status != db.PendingApproval {
+		http.Error(w, NotPendingApproval, http.StatusConflict)
+		return
+	}
+	// Names are not unique, so the requester is matched by principal. Deploys saved before principals
+	// were recorded are matched by name.
+	id := requestIdentity(r)
+	approver := id.Name
+	if id.Principal == st.Principal || (st.Principal == "" && approver == st.DeployedBy) {
+		http.Error(w, SelfApproval, http.StatusForbidden)
+		return
+	}
+	if err := d.InsertApproval(deployID, approver, id.Principal, decision, q.Comment); err != nil {
+		http.Error(w, AlreadyDecided, http.StatusConflict)
+		return
+	}
+
+	if decision == db.Reject {
+		msg := fmt.Sprintf("Rejected by %s.", approver)
+		if err := d.TransitionDeploy(deployID, db.PendingApproval, db.Rejected, msg); err != nil {
+			http.Error(w, NotPendingApproval, http.StatusConflict)
+			return
+		}
+		s.writeApproval(w, r, deployID, db.Rejected, st.Required)
+		return
+	}
+
+	approvals, err := d.QueryApprovals(deployID)
+	if err != nil {
+		http.Error(w, DatabaseError, http.StatusInternalServerError)
+		return
+	}
+	if countDecisions(approvals, db.Approve) < st.Required {
+		s.writeApproval(w, r, deployID, db.PendingApproval, st.Required)
+		return
+	}
+
+	// Enough approvals: a deploy for later waits for the scheduler.
+	if st.NotBefore != "" {
+		if t, err := time.Parse(dbTimeFormat, st.NotBefore); err == nil && t.After(time.Now()) {
+			msg := fmt.Sprintf("Approved by %s. Scheduled.", approver)
+			if err := d.TransitionDeploy(deployID, db.PendingApproval, db.Scheduled, msg); err != nil {
+				http.Error(w, NotPendingApproval, http.StatusConflict)
+				return
+			}
+			s.writeApproval(w, r, deployID, db.Scheduled, st.Required)
+			return
+		}
+	}
+
+	// A freeze window created since the deploy was requested still applies.
+	freeze, until, err := s.activeFreeze(r.Context(), st.Environment, st.ServiceName, time.Now())
+	if err != nil {
+		http.Error(w, DatabaseError, http.StatusInternalServerError)
+		return
+	}
+	if freeze != nil && st.FreezeOverride == "" {
+		msg := frozenMessage(freeze, until)
+		if err := d.TransitionDeploy(deployID, db.PendingApproval, db.Failed, msg); err != nil {
+			http.Error(w, NotPendingApproval, http.StatusConflict)
+			return
+		}
+		http.Error(w, msg, http.StatusLocked)
+		return
+	}
+
+	// Otherwise rebuild the request before claiming it so a failure leaves it pending.
+	req, err := s.storedServiceRequest(trace.Detach(r.Context()), st)
+	if err != nil {
+		s.log.Errorf("Unable to load deploy %s for approval: %s", deployID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	msg := fmt.Sprintf("Approved by %s. Start deploy.", approver)
+	if err := d.TransitionDeploy(deployID, db.PendingApproval, db.Started, msg); err != nil {
+		http.Error(w, NotPendingApproval, http.StatusConflict)
+		return
+	}
+	s.wg.Add(1)
+	go req.Resume()
+	s.writeApproval(w, r, deployID, db.Started, st.Required)
+}
+
+// writeApproval writes the state of a deploy after a decision to the response.
+func (s *Server) writeApproval(w http.ResponseWriter, r *http.Request, deployID string, status int, required int) {
+	approvals, err := s.db.WithContext(r.Context()).QueryApprovals(deployID)
+	if err != nil {
+		http.Error(w, DatabaseError, http.StatusInternalServerError)
+		return
+	}
+	b, _ := json.Marshal(&approvalResponse{
+		DeployID:          deployID,
+		Status:            status,
+		Approvals:         countDecisions(approvals, db.Approve),
+		ApprovalsRequired: required,
+	})
+	w.Write(b)
+}
+
+// countDecisions returns the number of approvals with the decision.
+func countDecisions(approvals []*db.Approval, decision string) int {
+	n := 0
+	for _, a := range approvals {
+		if a.Decision == decision {
+			n++
+		}
+	}
+	return n
+}
+
+// storedServiceRequest rebuilds the request of a deploy that was saved to run later. The deploy is
+// traced under the span in ctx, if any.
+func (s *Server) storedServiceRequest(ctx context.Context, st *db.DeployStatus) (*ServiceRequest, error) {
+	tmpl, raw, err := s.db.WithContext(ctx).QueryDeploySource(st.DeployID)
+	if err != nil {
+		return nil, err
+	}
+	var stored Etcd2Keys
+	if raw != "" {
+		if err := json.Unmarshal([]byte(raw), &stored); err != nil {
+			return nil, err
+		}
+	}
+	keys, err := stored.Opened(s.secrets)
+	if err != nil {
+		return nil, err
+	}
+	q := NewServiceRequest(st.ServiceName, st.Version, st.NumInstances, tmpl, keys)
+	q.Metadata = st.Metadata
+	q.DeployedBy = st.DeployedBy
+	q.Principal = st.Principal
+	q.Overridden = st.FreezeOverride
+	q.RemoteAddr = st.RemoteAddr
+	q.Domain = st.Domain
+	q.Environment = st.Environment
+	q.DeployID = st.DeployID
+	q.Suffix = st.Suffix
+	s.prepareRequest(ctx, q)
+	return q, nil
+}
+
+// expireApprovals periodically marks deploys that were not approved in time as expired until the
+// server is shut down.
+func (s *Server) expireApprovals(done <-chan struct{}) {
+	t := time.NewTicker(approvalSweepInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			n, err := s.db.ExpireDeploys()
+			if err != nil {
+				s.log.Errorf("Unable to expire deploys awaiting approval: %s", err)
+				continue
+			}
+			if n > 0 {
+				s.log.Infof("Expired %d deploy(s) awaiting approval.", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/composer22/coreos-deploy/db"
+)
+
+// decide posts a decision on a deploy as the identity and returns the response.
+func decide(s *Server, deployID string, decision string, id *Identity) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.deployActionHandler(w, requestAs(httpPost, httpRouteV1Deploy+"/"+deployID+"/"+decision, "", id))
+	return w
+}
+
+func TestSelfApproval(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name      string
+		principal string // Of the deploy.
+		approver  *Identity
+		code      int
+	}{
+		{"same principal", "token:1", &Identity{Name: "ci", Principal: "token:1"}, http.StatusForbidden},
+		{"same principal, other name", "token:1", &Identity{Name: "ops", Principal: "token:1"}, http.StatusForbidden},
+		{"same name, other principal", "token:1", &Identity{Name: "ci", Principal: "jwt:ci"}, http.StatusOK},
+		{"other name and principal", "token:1", &Identity{Name: "ops", Principal: "token:2"}, http.StatusOK},
+		{"no principal, same name", "", &Identity{Name: "ci", Principal: "token:2"}, http.StatusForbidden},
+		{"no principal, other name", "", &Identity{Name: "ops", Principal: "token:2"}, http.StatusOK},
+	}
+	for _, tc := range tests {
+		s, _, _ := newDeploysServer(t, &db.DeployStatus{DeployID: "D1", ServiceName: "acme-web",
+			Status: db.PendingApproval, Required: 2, DeployedBy: "ci", Principal: tc.principal})
+		tc.approver.Role = RoleDeploy
+		if w := decide(s, "D1", db.Approve, tc.approver); w.Code != tc.code {
+			t.Errorf("Approval with %s should return %d, received %d: %s", tc.name, tc.code, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestDeployActions(t *testing.T) {
+	t.Parallel()
+	later := time.Now().Add(time.Hour).UTC().Format(dbTimeFormat)
+	s, _, d := newDeploysServer(t,
+		&db.DeployStatus{DeployID: "A", ServiceName: "acme-web", Status: db.PendingApproval, Required: 2,
+			DeployedBy: "ci", Principal: "token:1", NotBefore: later},
+		&db.DeployStatus{DeployID: "R", ServiceName: "acme-web", Status: db.PendingApproval, Required: 2,
+			DeployedBy: "ci", Principal: "token:1"},
+		&db.DeployStatus{DeployID: "C", ServiceName: "acme-web", Status: db.Scheduled, DeployedBy: "ci",
+			Principal: "token:1"},
+		&db.DeployStatus{DeployID: "S", ServiceName: "acme-web", Status: db.Started, DeployedBy: "ci",
+			Principal: "token:1"},
+	)
+	alice := &Identity{Name: "alice", Role: RoleDeploy, Principal: "jwt:alice"}
+	bob := &Identity{Name: "bob", Role: RoleDeploy, Principal: "jwt:bob"}
+
+	tests := []struct {
+		name     string
+		deployID string
+		decision string
+		id       *Identity
+		code     int
+		status   int // Of the deploy afterward.
+	}{
+		{"first approval", "A", db.Approve, alice, http.StatusOK, db.PendingApproval},
+		{"second approval by the same approver", "A", db.Approve, alice, http.StatusConflict, db.PendingApproval},
+		{"last approval of a deploy for later", "A", db.Approve, bob, http.StatusOK, db.Scheduled},
+		{"approval once scheduled", "A", db.Approve, &Identity{Name: "carol", Role: RoleDeploy,
+			Principal: "jwt:carol"}, http.StatusConflict, db.Scheduled},
+		{"reject", "R", db.Reject, alice, http.StatusOK, db.Rejected},
+		{"approval once rejected", "R", db.Approve, bob, http.StatusConflict, db.Rejected},
+		{"cancel a scheduled deploy", "C", deployCancel, alice, http.StatusOK, db.Cancelled},
+		{"cancel again", "C", deployCancel, alice, http.StatusConflict, db.Cancelled},
+		{"cancel a started deploy", "S", deployCancel, alice, http.StatusConflict, db.Started},
+		{"approve a started deploy", "S", db.Approve, alice, http.StatusConflict, db.Started},
+		{"approve an unknown deploy", "X", db.Approve, alice, http.StatusNotFound, 0},
+		{"unknown action", "A", "hurry", alice, http.StatusNotFound, db.Scheduled},
+		{"read role", "R", db.Approve, &Identity{Name: "viewer", Role: RoleRead, Principal: "jwt:viewer"},
+			http.StatusForbidden, db.Rejected},
+	}
+	for _, tc := range tests {
+		w := decide(s, tc.deployID, tc.decision, tc.id)
+		if w.Code != tc.code {
+			t.Errorf("%s should return %d, received %d: %s", tc.name, tc.code, w.Code, w.Body.String())
+		}
+		if tc.status == 0 {
+			continue
+		}
+		if st := d.status(tc.deployID); st != tc.status {
+			t.Errorf("After %s the deploy should have status %d, has %d.", tc.name, tc.status, st)
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var resp struct {
+			Status int `json:"status"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Status != tc.status {
+			t.Errorf("After %s the response should have status %d: %s", tc.name, tc.status, w.Body.String())
+		}
+	}
+}
+
+func TestFinalApprovalFreeze(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		frozen   bool
+		override string
+		code     int
+		status   int // The status the deploy is first moved to.
+	}{
+		{"no freeze", false, "", http.StatusOK, db.Started},
+		{"freeze", true, "", http.StatusLocked, db.Failed},
+		{"freeze overridden by an admin", true, "Hotfix for OPS-123", http.StatusOK, db.Started},
+	}
+	for _, tc := range tests {
+		// The version names a directory that does not exist, so a started deploy fails at its first
+		// step rather than calling etcd2 and fleetctl.
+		st := &db.DeployStatus{DeployID: "D1", ServiceName: "acme-web", Version: "missing/1.0",
+			Environment: "production", Status: db.PendingApproval, Required: 1, DeployedBy: "ci",
+			Principal: "token:1", FreezeOverride: tc.override}
+		s, f, d := newDeploysServer(t, st)
+		if tc.frozen {
+			f.on("FROM freeze_windows", freezeRow)
+		} else {
+			f.on("FROM freeze_windows", noRows)
+		}
+
+		w := decide(s, "D1", db.Approve, &Identity{Name: "ops", Role: RoleDeploy, Principal: "token:2"})
+		s.wg.Wait()
+		if w.Code != tc.code {
+			t.Errorf("With %s the approval should return %d, received %d: %s", tc.name, tc.code, w.Code,
+				w.Body.String())
+		}
+		moves := d.moves("D1")
+		if len(moves) == 0 || moves[0] != tc.status {
+			t.Errorf("With %s the deploy should move to %d, moved to %v.", tc.name, tc.status, moves)
+		}
+		if tc.status == db.Failed && (len(moves) != 1 || !strings.HasPrefix(st.Message, DeployFrozen)) {
+			t.Errorf("With %s the deploy should fail with the freeze, received %v %q.", tc.name, moves, st.Message)
+		}
+	}
+}
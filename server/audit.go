@@ -0,0 +1,167 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/composer22/coreos-deploy/db"
+)
+
+// Audit outcomes of an action.
+const (
+	AuditSuccess = "success" // The action was accepted.
+	AuditDenied  = "denied"  // The caller was not authenticated or not permitted.
+	AuditFailed  = "failed"  // The action was rejected or could not be completed.
+
+	auditDefaultLimit = 100 // Events returned when no limit is requested.
+	auditDetailMax    = 255 // Longest detail stored with an event.
+)
+
+// auditEntry collects the details of an action while it is being handled.
+type auditEntry struct {
+	action  string // What was attempted, ex: deploy.create.
+	service string // The service acted upon, if any.
+	detail  string // Additional information such as the target id.
+}
+
+type auditKey struct{}
+
+// setAudit describes the action being handled so it can be recorded. It is a no-op for requests
+// that are not audited.
+func setAudit(r *http.Request, action string, service string, detail string) {
+	e, ok := r.Context().Value(auditKey{}).(*auditEntry)
+	if !ok {
+		return
+	}
+	if action != "" {
+		e.action = action
+	}
+	if service != "" {
+		e.service = service
+	}
+	if detail != "" {
+		e.detail = detail
+	}
+}
+
+// audited wraps a handler so every mutating request to it is recorded in the audit log with
+// the outcome of the response. action is used unless the handler describes the action with setAudit.
+func (s *Server) audited(action string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == httpGet || r.Method == httpHead {
+			h(w, r)
+			return
+		}
+		e := &auditEntry{action: action}
+		rw := newResponseRecorder(w)
+		h(rw, r.WithContext(context.WithValue(r.Context(), auditKey{}, e)))
+		s.recordAudit(r, e, w.Header().Get("X-Request-ID"), rw.status)
+	}
+}
+
+// recordAudit writes an audit event to the DB.
+func (s *Server) recordAudit(r *http.Request, e *auditEntry, reqID string, status int) {
+	outcome := AuditSuccess
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		outcome = AuditDenied
+	case status >= http.StatusBadRequest:
+		outcome = AuditFailed
+	}
+	ev := &db.AuditEvent{
+		Action:      e.action,
+		ServiceName: e.service,
+		RequestID:   reqID,
+		SourceIP:    remoteIP(r),
+		Outcome:     outcome,
+		StatusCode:  status,
+		Detail:      e.detail,
+	}
+	if len(ev.Detail) > auditDetailMax {
+		ev.Detail = ev.Detail[:auditDetailMax]
+	}
+	if id := requestIdentity(r); id != nil {
+		ev.Actor = id.Name
+	}
+	if err := s.db.WithContext(r.Context()).InsertAuditEvent(ev); err != nil {
+		s.log.Errorf("Unable to record audit event %s for request %s: %s", ev.Action, reqID, err)
+	}
+}
+
+// remoteIP returns the address of the caller without the port.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// auditHandler handles an admin request to query the audit log. The query parameters actor,
+// action, service and outcome filter exactly; since and until are RFC 3339 times. format=jsonl
+// exports the events one per line, unlimited unless a limit is given.
+func (s *Server) auditHandler(w http.ResponseWriter, r *http.Request) {
+	if s.invalidHeader(w, r) || s.invalidMethod(w, r, httpGet) || s.invalidAuth(w, r, RoleAdmin) {
+		return
+	}
+
+	qs := r.URL.Query()
+	jsonl := qs.Get("format") == "jsonl"
+	f := &db.AuditFilter{
+		Actor:       qs.Get("actor"),
+		Action:      qs.Get("action"),
+		ServiceName: qs.Get("service"),
+		Outcome:     qs.Get("outcome"),
+		Limit:       auditDefaultLimit,
+	}
+	if jsonl {
+		f.Limit = 0
+	}
+	var err error
+	if f.Since, err = auditTime(qs.Get("since")); err != nil {
+		http.Error(w, InvalidQueryString, http.StatusBadRequest)
+		return
+	}
+	if f.Until, err = auditTime(qs.Get("until")); err != nil {
+		http.Error(w, InvalidQueryString, http.StatusBadRequest)
+		return
+	}
+	if l := qs.Get("limit"); l != "" {
+		if f.Limit, err = strconv.Atoi(l); err != nil || f.Limit < 0 {
+			http.Error(w, InvalidQueryString, http.StatusBadRequest)
+			return
+		}
+	}
+
+	events, err := s.db.WithContext(r.Context()).QueryAuditEvents(f)
+	if err != nil {
+		http.Error(w, DatabaseError, http.StatusInternalServerError)
+		return
+	}
+	if !jsonl {
+		b, _ := json.Marshal(events)
+		w.Write(b)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	for _, e := range events {
+		enc.Encode(e)
+	}
+}
+
+// auditTime converts an optional RFC 3339 time to the UTC datetime format of the DB.
+func auditTime(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return "", err
+	}
+	return t.UTC().Format(dbTimeFormat), nil
+}
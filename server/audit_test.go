@@ -0,0 +1,196 @@
+package server
+
+import (
+	"bufio"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/composer22/coreos-deploy/db"
+)
+
+// auditRecorder collects the audit events inserted into the fake DB.
+type auditRecorder struct {
+	mu     sync.Mutex
+	events []*db.AuditEvent
+}
+
+// insert is the fake DB answer to InsertAuditEvent.
+func (a *auditRecorder) insert(args []driver.Value) *fakeResult {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.events = append(a.events, &db.AuditEvent{
+		Actor:       args[0].(string),
+		Action:      args[1].(string),
+		ServiceName: args[2].(string),
+		RequestID:   args[3].(string),
+		SourceIP:    args[4].(string),
+		Outcome:     args[5].(string),
+		StatusCode:  int(args[6].(int64)),
+		Detail:      args[7].(string),
+	})
+	return &fakeResult{affected: 1, lastID: int64(len(a.events))}
+}
+
+// last returns the most recent event or nil if none was recorded.
+func (a *auditRecorder) last() *db.AuditEvent {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.events) == 0 {
+		return nil
+	}
+	return a.events[len(a.events)-1]
+}
+
+func TestAudited(t *testing.T) {
+	t.Parallel()
+	s, f := newFakeServer(t)
+	s.opts.Environment = "production"
+	s.approvals = []*approvalRule{{environment: "production", count: 1}}
+	a := &auditRecorder{}
+	f.on("INSERT INTO audit_events", a.insert)
+	f.on("FROM freeze_windows", noRows)
+	f.on("INSERT INTO deploys", func(args []driver.Value) *fakeResult {
+		return &fakeResult{affected: 1, lastID: 1}
+	})
+	deploy := s.audited("deploy.create", s.deployHandler)
+	body := `{"serviceName":"acme-web","version":"1.0.0"}`
+
+	tests := []struct {
+		name     string
+		method   string
+		body     string
+		id       *Identity
+		code     int
+		expected *db.AuditEvent // nil if the request is not audited.
+	}{
+		{"a held deploy", httpPost, body, &Identity{Name: "ci", Role: RoleDeploy}, http.StatusOK,
+			&db.AuditEvent{Actor: "ci", Action: "deploy.create", ServiceName: "acme-web", Outcome: AuditSuccess,
+				StatusCode: http.StatusOK, Detail: "version=1.0.0"}},
+		{"a deploy out of scope", httpPost, body, &Identity{Name: "ci", Role: RoleDeploy, ServicePattern: "other-*"},
+			http.StatusForbidden, &db.AuditEvent{Actor: "ci", Action: "deploy.create", ServiceName: "acme-web",
+				Outcome: AuditDenied, StatusCode: http.StatusForbidden, Detail: "version=1.0.0"}},
+		{"a deploy by a reader", httpPost, body, &Identity{Name: "viewer", Role: RoleRead}, http.StatusForbidden,
+			&db.AuditEvent{Actor: "viewer", Action: "deploy.create", Outcome: AuditDenied,
+				StatusCode: http.StatusForbidden}},
+		{"an anonymous deploy", httpPost, body, nil, http.StatusUnauthorized,
+			&db.AuditEvent{Action: "deploy.create", Outcome: AuditDenied, StatusCode: http.StatusUnauthorized}},
+		{"an invalid deploy", httpPost, "{", &Identity{Name: "ci", Role: RoleDeploy}, http.StatusBadRequest,
+			&db.AuditEvent{Actor: "ci", Action: "deploy.create", Outcome: AuditFailed,
+				StatusCode: http.StatusBadRequest}},
+		{"a read", httpGet, "", &Identity{Name: "ci", Role: RoleDeploy}, http.StatusMethodNotAllowed, nil},
+	}
+	for i, tc := range tests {
+		before := a.last()
+		reqID := fmt.Sprintf("R%d", i)
+		w := httptest.NewRecorder()
+		w.Header().Set("X-Request-ID", reqID)
+		deploy(w, requestAs(tc.method, httpRouteV1Deploy, tc.body, tc.id))
+		if w.Code != tc.code {
+			t.Errorf("%s should return %d, received %d: %s", tc.name, tc.code, w.Code, w.Body.String())
+		}
+		e := a.last()
+		if tc.expected == nil {
+			if e != before {
+				t.Errorf("%s should not be audited, received %+v.", tc.name, e)
+			}
+			continue
+		}
+		if e == before {
+			t.Errorf("%s should be audited.", tc.name)
+			continue
+		}
+		tc.expected.RequestID, tc.expected.SourceIP = reqID, "192.0.2.1"
+		if *e != *tc.expected {
+			t.Errorf("%s should be audited as %+v, received %+v.", tc.name, tc.expected, e)
+		}
+	}
+}
+
+func TestAuditHandler(t *testing.T) {
+	t.Parallel()
+	s, f := newFakeServer(t)
+	var mu sync.Mutex
+	var queried []driver.Value
+	f.on("FROM audit_events", func(args []driver.Value) *fakeResult {
+		mu.Lock()
+		queried = args
+		mu.Unlock()
+		return &fakeResult{
+			columns: strings.Split("id,actor,action,service_name,request_id,source_ip,outcome,status_code,detail,"+
+				"created_at", ","),
+			rows: [][]driver.Value{
+				{int64(2), "ci", "deploy.create", "acme-web", "R2", "192.0.2.1", AuditDenied, int64(403), "",
+					"2016-01-02 15:04:05"},
+				{int64(1), "ci", "deploy.create", "acme-api", "R1", "192.0.2.1", AuditDenied, int64(403), "",
+					"2016-01-02 15:04:00"},
+			},
+		}
+	})
+	admin := &Identity{Name: "admin", Role: RoleAdmin}
+
+	tests := []struct {
+		name  string
+		query string
+		id    *Identity
+		code  int
+		args  []driver.Value // The filter values queried.
+		jsonl bool
+	}{
+		{"the default", "", admin, http.StatusOK, []driver.Value{int64(auditDefaultLimit)}, false},
+		{"an export", "?format=jsonl&actor=ci&outcome=denied", admin, http.StatusOK,
+			[]driver.Value{"ci", AuditDenied}, true},
+		{"a limited export", "?format=jsonl&service=acme-web&since=2016-01-02T15:00:00%2B01:00&limit=2", admin,
+			http.StatusOK, []driver.Value{"acme-web", "2016-01-02 14:00:00", int64(2)}, true},
+		{"an invalid time", "?since=yesterday", admin, http.StatusBadRequest, nil, false},
+		{"an invalid limit", "?limit=-1", admin, http.StatusBadRequest, nil, false},
+		{"a deployer", "?format=jsonl", &Identity{Name: "ci", Role: RoleDeploy}, http.StatusForbidden, nil, false},
+	}
+	for _, tc := range tests {
+		mu.Lock()
+		queried = nil
+		mu.Unlock()
+		w := httptest.NewRecorder()
+		s.auditHandler(w, requestAs(httpGet, httpRouteV1Audit+tc.query, "", tc.id))
+		if w.Code != tc.code {
+			t.Errorf("%s should return %d, received %d: %s", tc.name, tc.code, w.Code, w.Body.String())
+			continue
+		}
+		mu.Lock()
+		args := queried
+		mu.Unlock()
+		if fmt.Sprint(args) != fmt.Sprint(tc.args) {
+			t.Errorf("%s should query %v, received %v.", tc.name, tc.args, args)
+		}
+		if tc.code != http.StatusOK {
+			continue
+		}
+		if !tc.jsonl {
+			var events []*db.AuditEvent
+			if err := json.Unmarshal(w.Body.Bytes(), &events); err != nil || len(events) != 2 {
+				t.Errorf("%s should return a list of 2 events, received %s.", tc.name, w.Body.String())
+			}
+			continue
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+			t.Errorf("%s should be newline delimited JSON, received %s.", tc.name, ct)
+		}
+		var ids []int
+		lines := bufio.NewScanner(w.Body)
+		for lines.Scan() {
+			var e db.AuditEvent
+			if err := json.Unmarshal(lines.Bytes(), &e); err != nil {
+				t.Errorf("%s should have an event on each line, received %q.", tc.name, lines.Text())
+			}
+			ids = append(ids, e.ID)
+		}
+		if fmt.Sprint(ids) != "[2 1]" {
+			t.Errorf("%s should stream the events newest first, received %v.", tc.name, ids)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/composer22/coreos-deploy/db"
+	"github.com/composer22/coreos-deploy/jwt"
+)
+
+// Roles that may be granted to an API caller. Each role includes the permissions of those before it.
+const (
+	RoleRead   = "read"   // May query the server, deploy status and cluster.
+	RoleDeploy = "deploy" // May also deploy services.
+	RoleAdmin  = "admin"  // May perform all actions.
+)
+
+var roleRanks = map[string]int{
+	RoleRead:   1,
+	RoleDeploy: 2,
+	RoleAdmin:  3,
+}
+
+// Identity represents the authenticated caller of a request.
+type Identity struct {
+	Name           string `json:"name"`           // The name of the user or service.
+	Role           string `json:"role"`           // The role granted: read, deploy or admin.
+	ServicePattern string `json:"servicePattern"` // Optional glob of service names the caller may deploy.
+	Principal      string `json:"-"`              // Unique key of the caller, ex: token:12, jwt:<subject>, client:<id>.
+}
+
+// HasRole returns true if the identity has been granted at least the role requested.
+func (i *Identity) HasRole(role string) bool {
+	have, ok := roleRanks[i.Role]
+	return ok && have >= roleRanks[role]
+}
+
+// AllowsService returns true if the identity is permitted to act upon the service name.
+func (i *Identity) AllowsService(serviceName string) bool {
+	if i.ServicePattern == "" {
+		return true
+	}
+	ok, err := path.Match(i.ServicePattern, serviceName)
+	return ok && err == nil
+}
+
+type identityKey struct{}
+
+// requestIdentity returns the authenticated identity of the request or nil if there is none.
+func requestIdentity(r *http.Request) *Identity {
+	id, _ := r.Context().Value(identityKey{}).(*Identity)
+	return id
+}
+
+// authenticate validates any credentials sent with the request and returns the request carrying
+// the caller identity. If the credentials are missing or invalid, the request is returned as is.
+func (s *Server) authenticate(r *http.Request) *http.Request {
+	var id *Identity
+	bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	switch {
+	case r.Header.Get(signatureHeader) != "":
+		id = s.signedIdentity(r)
+	case bearer == "":
+		id = tokenIdentity(s.lookupCertSubject(r))
+	case s.jwt != nil && jwt.IsToken(bearer):
+		id = s.jwtIdentity(bearer)
+	default:
+		id = tokenIdentity(s.lookupToken(r, bearer))
+	}
+	if id == nil {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), identityKey{}, id))
+}
+
+// tokenIdentity returns the identity of a token or nil if there is no token.
+func tokenIdentity(t *db.AuthToken) *Identity {
+	if t == nil {
+		return nil
+	}
+	return &Identity{
+		Name:           t.Name,
+		Role:           t.Role,
+		ServicePattern: t.ServicePattern,
+		Principal:      fmt.Sprintf("token:%d", t.ID),
+	}
+}
+
+// jwtIdentity returns the identity of a JWT issued by the identity provider or nil if the token
+// is not valid. The subject becomes the identity name and the highest role found in the role
+// claim is granted. A token without a subject is rejected as it cannot be told apart from others.
+func (s *Server) jwtIdentity(token string) *Identity {
+	claims, err := s.jwt.Verify(token)
+	if err != nil {
+		s.log.Debugf("JWT rejected: %s", err)
+		return nil
+	}
+	sub := claims.String("sub")
+	if sub == "" {
+		s.log.Debugf("JWT rejected: no subject")
+		return nil
+	}
+	id := &Identity{
+		Name:           sub,
+		ServicePattern: claims.String(s.opts.JWTServiceClaim),
+		Principal:      "jwt:" + sub,
+	}
+	for _, role := range claims.Strings(s.opts.JWTRoleClaim) {
+		if roleRanks[role] > roleRanks[id.Role] {
+			id.Role = role
+		}
+	}
+	return id
+}
+
+// lookupToken returns the token for a bearer token or nil if it is not valid. Results are cached
+// so the DB is not queried on every request. If the DB cannot be reached, a previously validated
+// token continues to be accepted for a short while.
+func (s *Server) lookupToken(r *http.Request, bearer string) *db.AuthToken {
+	key, secret, ok := splitToken(bearer)
+	if !ok {
+		return nil
+	}
+	if e := s.tokens.get(bearer); e != nil {
+		return e.token
+	}
+
+	t, err := s.db.WithContext(r.Context()).QueryAuth(key)
+	switch {
+	case err == sql.ErrNoRows:
+		s.tokens.set(bearer, nil, 0)
+		return nil
+	case err != nil:
+		s.log.Errorf("Unable to query auth token: %s", err)
+		return s.tokens.getStale(bearer)
+	case !validTokenSecret(t, secret):
+		s.tokens.set(bearer, nil, 0)
+		return nil
+	}
+	s.tokens.set(bearer, t, t.ExpiresIn)
+	s.db.WithContext(r.Context()).TouchAuthToken(t.ID)
+	return t
+}
+
+// lookupCertSubject returns the token whose cert_subject matches the common name of a verified
+// client certificate, or nil if there is none. Results are cached as with bearer tokens.
+func (s *Server) lookupCertSubject(r *http.Request) *db.AuthToken {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	if subject == "" {
+		return nil
+	}
+	cacheKey := "cert:" + subject
+	if e := s.tokens.get(cacheKey); e != nil {
+		return e.token
+	}
+
+	t, err := s.db.WithContext(r.Context()).QueryAuthBySubject(subject)
+	switch {
+	case err == sql.ErrNoRows:
+		s.tokens.set(cacheKey, nil, 0)
+		return nil
+	case err != nil:
+		s.log.Errorf("Unable to query client certificate identity: %s", err)
+		return s.tokens.getStale(cacheKey)
+	}
+	s.tokens.set(cacheKey, t, t.ExpiresIn)
+	s.db.WithContext(r.Context()).TouchAuthToken(t.ID)
+	return t
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/composer22/coreos-deploy/db"
+	"github.com/composer22/coreos-deploy/jwt"
+)
+
+// requestAs returns a JSON request made by the identity, or an anonymous request for nil.
+func requestAs(method string, path string, body string, id *Identity) *http.Request {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Accept", "application/json")
+	if id == nil {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), identityKey{}, id))
+}
+
+func TestHasRole(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		have string
+		want string
+		ok   bool
+	}{
+		{RoleRead, RoleRead, true},
+		{RoleRead, RoleDeploy, false},
+		{RoleRead, RoleAdmin, false},
+		{RoleDeploy, RoleRead, true},
+		{RoleDeploy, RoleDeploy, true},
+		{RoleDeploy, RoleAdmin, false},
+		{RoleAdmin, RoleRead, true},
+		{RoleAdmin, RoleDeploy, true},
+		{RoleAdmin, RoleAdmin, true},
+		{"root", RoleRead, false},
+		{"", RoleRead, false},
+	}
+	for _, tc := range tests {
+		if ok := (&Identity{Role: tc.have}).HasRole(tc.want); ok != tc.ok {
+			t.Errorf("Role %q requesting %q should be %t.", tc.have, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestAllowsService(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		pattern string
+		service string
+		ok      bool
+	}{
+		{"", "anything", true},
+		{"acme-*", "acme-web", true},
+		{"acme-*", "other-web", false},
+		{"acme-web", "acme-web", true},
+		{"acme-web", "acme-web2", false},
+		{"acme-?", "acme-1", true},
+		{"[", "acme-web", false}, // A malformed pattern allows nothing.
+	}
+	for _, tc := range tests {
+		if ok := (&Identity{ServicePattern: tc.pattern}).AllowsService(tc.service); ok != tc.ok {
+			t.Errorf("Pattern %q for service %q should be %t.", tc.pattern, tc.service, tc.ok)
+		}
+	}
+}
+
+func TestInvalidAuth(t *testing.T) {
+	t.Parallel()
+	s := &Server{}
+	tests := []struct {
+		id   *Identity
+		role string
+		code int
+	}{
+		{nil, RoleRead, http.StatusUnauthorized},
+		{&Identity{Name: "viewer", Role: RoleRead}, RoleDeploy, http.StatusForbidden},
+		{&Identity{Name: "ci", Role: RoleDeploy}, RoleAdmin, http.StatusForbidden},
+		{&Identity{Name: "ci", Role: RoleDeploy}, RoleDeploy, http.StatusOK},
+		{&Identity{Name: "ops", Role: RoleAdmin}, RoleDeploy, http.StatusOK},
+	}
+	for _, tc := range tests {
+		w := httptest.NewRecorder()
+		if s.invalidAuth(w, requestAs(httpGet, httpRouteV1Info, "", tc.id), tc.role) != (tc.code != http.StatusOK) ||
+			w.Code != tc.code {
+			t.Errorf("%+v requesting %s should return %d, received %d.", tc.id, tc.role, tc.code, w.Code)
+		}
+	}
+}
+
+// TestServiceScoping checks each handler that acts on a service rejects a caller whose service
+// pattern does not match it.
+func TestServiceScoping(t *testing.T) {
+	t.Parallel()
+	s, f := newFakeServer(t)
+	f.on("FROM deploys WHERE deploy_id = ?", func(args []driver.Value) *fakeResult {
+		return deployRow(&db.DeployStatus{DeployID: args[0].(string), ServiceName: "acme-web", Status: db.Started})
+	})
+
+	// Too many metadata entries fail the deploy after the service check, before any DB change.
+	metadata := make([]string, 0)
+	for i := 0; i <= maxMetadataKeys; i++ {
+		metadata = append(metadata, fmt.Sprintf(`"k%d":"v"`, i))
+	}
+	deploy := func(service string) string {
+		return fmt.Sprintf(`{"serviceName":"%s","metadata":{%s}}`, service, strings.Join(metadata, ","))
+	}
+
+	tests := []struct {
+		pattern string
+		handler http.HandlerFunc
+		path    string
+		body    string
+		code    int
+	}{
+		{"acme-*", s.deployHandler, httpRouteV1Deploy, deploy("acme-web"), http.StatusBadRequest},
+		{"acme-*", s.deployHandler, httpRouteV1Deploy, deploy("other-web"), http.StatusForbidden},
+		{"", s.deployHandler, httpRouteV1Deploy, deploy("other-web"), http.StatusBadRequest},
+		{"acme-*", s.deployActionHandler, httpRouteV1Deploy + "/D1/approve", "", http.StatusConflict},
+		{"other-*", s.deployActionHandler, httpRouteV1Deploy + "/D1/approve", "", http.StatusForbidden},
+		{"other-*", s.deployActionHandler, httpRouteV1Deploy + "/D1/cancel", "", http.StatusForbidden},
+	}
+	for _, tc := range tests {
+		w := httptest.NewRecorder()
+		id := &Identity{Name: "ci", Role: RoleDeploy, ServicePattern: tc.pattern}
+		tc.handler(w, requestAs(httpPost, tc.path, tc.body, id))
+		if w.Code != tc.code {
+			t.Errorf("%s with pattern %q should return %d, received %d: %s", tc.path, tc.pattern, tc.code, w.Code,
+				w.Body.String())
+		}
+	}
+}
+
+// newJWTSigner returns the key set of a new key, and a function that signs claims as a JWT with the key.
+func newJWTSigner() ([]byte, func(claims map[string]interface{}) string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{{"kty": "EC", "kid": "ec1",
+		"crv": "P-256", "x": b64(key.X.FillBytes(make([]byte, 32))), "y": b64(key.Y.FillBytes(make([]byte, 32)))}}})
+	sign := func(claims map[string]interface{}) string {
+		h, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": "ec1", "typ": "JWT"})
+		c, _ := json.Marshal(claims)
+		input := b64(h) + "." + b64(c)
+		digest := sha256.Sum256([]byte(input))
+		r, s, _ := ecdsa.Sign(rand.Reader, key, digest[:])
+		return input + "." + b64(append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...))
+	}
+	return jwks, sign
+}
+
+// newJWTServer returns a server that verifies JWTs against a key set file, the path of the file, and
+// a function that signs claims with the key in the file.
+func newJWTServer(t *testing.T) (*Server, string, func(claims map[string]interface{}) string) {
+	jwks, sign := newJWTSigner()
+	dir, _ := ioutil.TempDir("", "coreos-deploy-jwt")
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "jwks.json")
+	ioutil.WriteFile(path, jwks, 0600)
+	v, err := jwt.NewVerifier(path, "coreos-deploy", "")
+	if err != nil {
+		t.Fatalf("Unable to create the JWT verifier: %s", err)
+	}
+	s, _ := newFakeServer(t)
+	s.jwt = v
+	s.opts.JWTRoleClaim, s.opts.JWTServiceClaim = DefaultJWTRoleClaim, DefaultJWTServiceClaim
+	return s, path, sign
+}
+
+// jwtClaims returns valid claims for the subject, or without a subject if it is empty.
+func jwtClaims(sub string) map[string]interface{} {
+	c := map[string]interface{}{"aud": "coreos-deploy", "exp": time.Now().Add(time.Hour).Unix(),
+		DefaultJWTRoleClaim: []string{"read", "deploy"}, DefaultJWTServiceClaim: "acme-*"}
+	if sub != "" {
+		c["sub"] = sub
+	}
+	return c
+}
+
+func TestJWTIdentity(t *testing.T) {
+	t.Parallel()
+	s, _, sign := newJWTServer(t)
+	id := s.jwtIdentity(sign(jwtClaims("jdoe")))
+	if id == nil || id.Name != "jdoe" || id.Principal != "jwt:jdoe" || id.Role != RoleDeploy ||
+		id.ServicePattern != "acme-*" {
+		t.Errorf("A valid JWT should return the identity of its subject, received %+v.", id)
+	}
+	if id := s.jwtIdentity(sign(jwtClaims(""))); id != nil {
+		t.Errorf("A JWT without a subject should be rejected, received %+v.", id)
+	}
+}
+
+func TestReloadKeySet(t *testing.T) {
+	t.Parallel()
+	s, path, _ := newJWTServer(t)
+	jwks, sign := newJWTSigner()
+	ioutil.WriteFile(path, jwks, 0600)
+	token := sign(jwtClaims("jdoe"))
+	if s.jwtIdentity(token) != nil {
+		t.Fatalf("A JWT signed by a rotated key should be rejected until the key set is reloaded.")
+	}
+	s.reloadKeySet()
+	if s.jwtIdentity(token) == nil {
+		t.Errorf("A JWT signed by a rotated key should be accepted once the key set is reloaded.")
+	}
+}
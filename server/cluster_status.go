@@ -2,10 +2,13 @@ package server
 
 import (
 	"bufio"
+	"context"
 	"os/exec"
 	"regexp"
 	"sort"
 	"strings"
+
+	"github.com/composer22/coreos-deploy/logger"
 )
 
 // ClusterStatus is the master header for info on the cluster.
@@ -58,8 +61,10 @@ func NewClusterUnit(unit string, hash string, active string, load string, sub st
 	}
 }
 
-// GetClusterInfo returns a structure that represents the state of the cluster services.
-func GetClusterInfo(machineQuery string, unitQuery string) (*ClusterStatus, error) {
+// GetClusterInfo returns a structure that represents the state of the cluster services. Commands and
+// failures are logged to log.
+func GetClusterInfo(ctx context.Context, log *logger.Logger, machineQuery string, unitQuery string) (
+	*ClusterStatus, error) {
 	// Both query strings are optional.
 	if machineQuery == "" {
 		machineQuery = ".*"
@@ -69,11 +74,13 @@ func GetClusterInfo(machineQuery string, unitQuery string) (*ClusterStatus, erro
 	}
 	mre := regexp.MustCompile(machineQuery)
 	ure := regexp.MustCompile(unitQuery)
+	log.Debugf("Listing cluster machines matching %q and units matching %q.", machineQuery, unitQuery)
 
 	// Get the machines.
 	cmd := exec.Command(fleetctl, "list-machines", "-fields=machine,ip,metadata", "-full=true", "-l=true", "-no-legend")
-	stdout, err := execCmd(cmd)
+	stdout, err := execCmd(ctx, log, cmd)
 	if err != nil {
+		log.Errorf("Unable to list cluster machines: %s", err)
 		return nil, err
 	}
 	machines := make(map[string]*ClusterMachine, 0)
@@ -93,8 +100,9 @@ func GetClusterInfo(machineQuery string, unitQuery string) (*ClusterStatus, erro
 	// Get the units.
 	cmd = exec.Command(fleetctl, "list-units", "-fields=machine,unit,hash,active,load,sub", "-full=true", "-l=true",
 		"-no-legend")
-	stdout, err = execCmd(cmd)
+	stdout, err = execCmd(ctx, log, cmd)
 	if err != nil {
+		log.Errorf("Unable to list cluster units: %s", err)
 		return nil, err
 	}
 	scanner = bufio.NewScanner(strings.NewReader(stdout))
@@ -3,25 +3,51 @@ package server
 import "time"
 
 const (
-	version              = "0.0.2"        // Application and server version.
-	DefaultHostName      = "localhost"    // The hostname of the server.
-	DefaultEnvironment   = "development"  // The default environment for the server.
-	DefaultPort          = 8080           // Port to receive requests: see IANA Port Numbers.
-	DefaultProfPort      = 0              // Profiler port to receive requests.*
-	DefaultMaxProcs      = 0              // Maximum number of computer processors to utilize.*
-	DefaultEtcd2Endpoint = "0.0.0.0:2379" // Default address and port to etcd2 service.
+	version              = "0.0.2"         // Application and server version.
+	DefaultHostName      = "localhost"     // The hostname of the server.
+	DefaultEnvironment   = "development"   // The default environment for the server.
+	DefaultPort          = 8080            // Port to receive requests: see IANA Port Numbers.
+	DefaultProfPort      = 0               // Profiler port to receive requests.*
+	DefaultMaxProcs      = 0               // Maximum number of computer processors to utilize.*
+	DefaultEtcd2Endpoint = "0.0.0.0:2379"  // Default address and port to etcd2 service.
+	DefaultEtcd2Timeout  = time.Second     // Default header timeout for each etcd2 request.
+	DefaultEtcd2Dial     = 5 * time.Second // Default timeout to connect to an etcd2 member.
 
-	suffixSize = 8 // Added to service name to make it unique on deploy.
+	DefaultLogRedactHeaders = "Authorization,Proxy-Authorization,Cookie" // Headers masked in the request log.
+	DefaultLogBodyMax       = 4096                                       // Maximum body bytes in the request log.*
+	DefaultAuthCacheTTL     = 60                                         // Seconds a valid token is cached.*
+	DefaultAuthCacheNegTTL  = 5                                          // Seconds an invalid token is cached.*
+	DefaultJWTRoleClaim     = "coreos_deploy_role"                       // JWT claim holding the role(s) granted.
+	DefaultJWTServiceClaim  = "coreos_deploy_services"                   // JWT claim holding the service glob.
+	DefaultApprovalTTL      = 24 * time.Hour                             // How long a deploy may await approval.*
+
+	suffixSize   = 8                     // Added to service name to make it unique on deploy.
+	dbTimeFormat = "2006-01-02 15:04:05" // Format of datetimes in the DB.
+
+	historyDefaultLimit = 50   // Deploys returned by the history when no limit is requested.
+	historyMaxLimit     = 1000 // Most deploys returned by the history.
+	maxMetadataKeys     = 32   // Most metadata entries on a deploy request.
+	maxMetadataSize     = 1024 // Longest metadata key or value on a deploy request.
 
 	// * zeros = no change or no limitations or not enabled.
 
 	// http: routes.
-	httpRouteV1Health     = "/v1.0/health"
-	httpRouteV1Info       = "/v1.0/info"
-	httpRouteV1Metrics    = "/v1.0/metrics"
-	httpRouteV1Deploy     = "/v1.0/deploy"
-	httpRouteV1Status     = "/v1.0/status/"
-	httpRouteV1ClusterMap = "/v1.0/cluster_map"
+	httpRouteV1Health         = "/v1.0/health"
+	httpRouteV1Info           = "/v1.0/info"
+	httpRouteV1Metrics        = "/v1.0/metrics"
+	httpRouteV1Deploy         = "/v1.0/deploy"
+	httpRouteV1Status         = "/v1.0/status/"
+	httpRouteV1History        = "/v1.0/history"
+	httpRouteV1Scheduled      = "/v1.0/scheduled"
+	httpRouteV1ClusterMap     = "/v1.0/cluster_map"
+	httpRouteV1Tokens         = "/v1.0/tokens"
+	httpRouteV1SigningClients = "/v1.0/signing_clients"
+	httpRouteV1Audit          = "/v1.0/audit"
+	httpRouteV1Freezes        = "/v1.0/freezes"
+	httpRouteV1Webhooks       = "/v1.0/webhooks"
+	httpRouteV1DeployReport   = "/v1.0/reports/deploys"
+	httpRouteV1LogLevel       = "/v1.0/admin/loglevel"
+	httpRouteMetrics          = "/metrics"
 
 	// Connections.
 	TCPReadTimeout  = 10 * time.Second
@@ -50,5 +76,24 @@ const (
 	InvalidJSONText      = "Invalid JSON format in text of body in request."
 	InvalidJSONAttribute = "Invalid - 'text' attribute in JSON not found."
 	InvalidAuthorization = "Invalid authorization."
+	Forbidden            = "Forbidden - insufficient permission for this request."
 	InvalidQueryString   = "Invalid query string."
+	InvalidRole          = "Invalid role - must be one of read, deploy or admin."
+	InvalidDuration      = "Invalid duration."
+	NotFound             = "Resource not found."
+	DatabaseError        = "Unable to complete the request in the database."
+	InvalidMetadata      = "Invalid metadata - too many entries, an entry is too long or a key is reserved."
+	NotPendingApproval   = "Deploy is not awaiting approval."
+	SelfApproval         = "Forbidden - a deploy cannot be approved or rejected by its requester."
+	AlreadyDecided       = "Deploy has already been approved or rejected by this identity."
+	InvalidFreeze        = "Invalid freeze window."
+	DeployFrozen         = "Deploys are frozen."
+	OverrideForbidden    = "Forbidden - only an admin may override a freeze window."
+	OverrideReason       = "An overrideReason is required to override a freeze window."
+	InvalidNotBefore     = "Invalid notBefore - must be an RFC 3339 time."
+	NotCancellable       = "Deploy is not scheduled or awaiting approval."
+	InvalidWebhook       = "Invalid webhook."
+	SecretKeyRequired    = "A secret key file must be configured on the server for this request."
+	InvalidLogLevel      = "Invalid log level - must be an RFC 5424 level such as error, warning, info or debug."
+	InvalidLogSubsystem  = "Invalid log subsystem - must be one of http, deploy, fleet, etcd2 or db."
 )
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const redactedValue = "[REDACTED]" // Replaces secret values in logs and history.
+
+// Etcd2Key represents a single value to be written to etcd2. In the request JSON it may be either
+// a plain string or an object of the form {"value":"...","secret":true}.
+type Etcd2Key struct {
+	Value  string `json:"value"`            // The value written to etcd2.
+	Secret bool   `json:"secret,omitempty"` // Should the value be hidden from logs and history?
+}
+
+// UnmarshalJSON accepts either a plain string or a value/secret object.
+func (k *Etcd2Key) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		k.Value, k.Secret = s, false
+		return nil
+	}
+	var v struct {
+		Value  *string `json:"value"`
+		Secret bool    `json:"secret"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	if v.Value == nil {
+		return errors.New("etcd2 key object requires a value attribute")
+	}
+	k.Value, k.Secret = *v.Value, v.Secret
+	return nil
+}
+
+// MarshalJSON writes plain values as strings so history rows keep their original form.
+func (k *Etcd2Key) MarshalJSON() ([]byte, error) {
+	if !k.Secret {
+		return json.Marshal(k.Value)
+	}
+	return json.Marshal(&struct {
+		Value  string `json:"value"`
+		Secret bool   `json:"secret"`
+	}{
+		Value:  k.Value,
+		Secret: true,
+	})
+}
+
+// Etcd2Keys is the set of etcd2 keys to update during a deploy.
+type Etcd2Keys map[string]*Etcd2Key
+
+// UnmarshalJSON decodes each key as an Etcd2Key and rejects a key without a value, such as
+// {"k":null}, which would otherwise decode to a nil key.
+func (k *Etcd2Keys) UnmarshalJSON(b []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	if raw == nil {
+		return nil // null leaves the keys unset.
+	}
+	keys := make(Etcd2Keys, len(raw))
+	for name, v := range raw {
+		if string(bytes.TrimSpace(v)) == "null" {
+			return fmt.Errorf("etcd2 key %s requires a value", name)
+		}
+		key := &Etcd2Key{}
+		if err := key.UnmarshalJSON(v); err != nil {
+			return err
+		}
+		keys[name] = key
+	}
+	*k = keys
+	return nil
+}
+
+// NewEtcd2Keys is a factory function that returns a set of plain (non secret) keys.
+func NewEtcd2Keys(values map[string]string) Etcd2Keys {
+	k := make(Etcd2Keys)
+	for name, v := range values {
+		k[name] = &Etcd2Key{Value: v}
+	}
+	return k
+}
+
+// Values returns the key value pairs to be written to etcd2.
+func (k Etcd2Keys) Values() map[string]string {
+	result := make(map[string]string)
+	for name, v := range k {
+		result[name] = v.Value
+	}
+	return result
+}
+
+// HasSecrets returns true if any of the keys are marked as secret.
+func (k Etcd2Keys) HasSecrets() bool {
+	for _, v := range k {
+		if v.Secret {
+			return true
+		}
+	}
+	return false
+}
+
+// Redacted returns a copy of the keys with all secret values masked.
+func (k Etcd2Keys) Redacted() Etcd2Keys {
+	result := make(Etcd2Keys)
+	for name, v := range k {
+		if v.Secret {
+			result[name] = &Etcd2Key{Value: redactedValue, Secret: true}
+			continue
+		}
+		result[name] = &Etcd2Key{Value: v.Value}
+	}
+	return result
+}
+
+// Sealed returns a copy of the keys with all secret values encrypted by the box for storage.
+// If no box is configured, the secret values are redacted instead.
+func (k Etcd2Keys) Sealed(box *SecretBox) (Etcd2Keys, error) {
+	if box == nil {
+		return k.Redacted(), nil
+	}
+	result := make(Etcd2Keys)
+	for name, v := range k {
+		if !v.Secret {
+			result[name] = &Etcd2Key{Value: v.Value}
+			continue
+		}
+		sealed, err := box.Seal(v.Value)
+		if err != nil {
+			return nil, err
+		}
+		result[name] = &Etcd2Key{Value: sealed, Secret: true}
+	}
+	return result, nil
+}
+
+// Opened returns a copy of stored keys with all secret values decrypted by the box, so that a
+// deploy saved for later can be run. An error is returned if a secret value cannot be decrypted.
+func (k Etcd2Keys) Opened(box *SecretBox) (Etcd2Keys, error) {
+	result := make(Etcd2Keys)
+	for name, v := range k {
+		if !v.Secret {
+			result[name] = &Etcd2Key{Value: v.Value}
+			continue
+		}
+		if box == nil {
+			return nil, errors.New("a secret key is required to decrypt stored etcd2 keys")
+		}
+		plain, err := box.Open(v.Value)
+		if err != nil {
+			return nil, err
+		}
+		result[name] = &Etcd2Key{Value: plain, Secret: true}
+	}
+	return result, nil
+}
+
+// redactSecretKeys masks any secret etcd2 key values found in a JSON request body. Bodies that
+// are not JSON objects, or do not contain etcd2 keys, are returned unchanged. Keys that cannot be
+// decoded are masked as a whole, as they cannot be told apart from secrets.
+func redactSecretKeys(body []byte) []byte {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return body
+	}
+	raw, ok := doc["etcd2Keys"]
+	if !ok {
+		return body
+	}
+	var keys Etcd2Keys
+	err := json.Unmarshal(raw, &keys)
+	switch {
+	case err != nil:
+		doc["etcd2Keys"], _ = json.Marshal(redactedValue)
+	case !keys.HasSecrets():
+		return body
+	default:
+		doc["etcd2Keys"], _ = json.Marshal(keys.Redacted())
+	}
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return body
+	}
+	return b
+}
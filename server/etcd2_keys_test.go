@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEtcd2KeysUnmarshal(t *testing.T) {
+	t.Parallel()
+	var q ServiceRequest
+	err := json.Unmarshal([]byte(`{"etcd2Keys":{"plain":"a","hidden":{"value":"s3cr3t","secret":true}}}`), &q)
+	if err != nil {
+		t.Fatalf("The keys should decode, received %s.", err)
+	}
+	if q.Etcd2Keys["plain"].Value != "a" || q.Etcd2Keys["plain"].Secret ||
+		q.Etcd2Keys["hidden"].Value != "s3cr3t" || !q.Etcd2Keys["hidden"].Secret {
+		t.Errorf("The plain and secret forms should decode, received %+v.", q.Etcd2Keys)
+	}
+	if err := json.Unmarshal([]byte(`{"etcd2Keys":null}`), &q); err != nil {
+		t.Errorf("Null keys should be accepted, received %s.", err)
+	}
+
+	for _, body := range []string{
+		`{"etcd2Keys":{"k":null}}`,
+		`{"etcd2Keys":{"k":1}}`,
+		`{"etcd2Keys":{"k":{"secret":true}}}`,
+		`{"etcd2Keys":["k"]}`,
+	} {
+		var q ServiceRequest
+		if err := json.Unmarshal([]byte(body), &q); err == nil {
+			t.Errorf("%s should be rejected.", body)
+		}
+	}
+}
+
+func TestEtcd2KeysRedacted(t *testing.T) {
+	t.Parallel()
+	keys := Etcd2Keys{"plain": {Value: "a"}, "hidden": {Value: "s3cr3t", Secret: true}}
+	if !keys.HasSecrets() || NewEtcd2Keys(map[string]string{"plain": "a"}).HasSecrets() {
+		t.Errorf("Only keys marked secret should be secrets.")
+	}
+	r := keys.Redacted()
+	if r["hidden"].Value != redactedValue || r["plain"].Value != "a" || keys["hidden"].Value != "s3cr3t" {
+		t.Errorf("Only a copy of the secret values should be masked, received %+v.", r)
+	}
+	if v := keys.Values(); v["hidden"] != "s3cr3t" || v["plain"] != "a" {
+		t.Errorf("The values written to etcd2 should be plain, received %v.", v)
+	}
+}
+
+func TestRedactSecretKeys(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		body     string
+		contains string
+		hidden   string
+	}{
+		{`{"etcd2Keys":{"db":{"value":"s3cr3t","secret":true},"host":"h1"}}`, `"h1"`, "s3cr3t"},
+		{`{"etcd2Keys":{"k":null,"db":{"value":"s3cr3t","secret":true}}}`, redactedValue, "s3cr3t"},
+		{`{"serviceName":"web"}`, `"web"`, ""},
+		{`not json`, "not json", ""},
+	}
+	for _, tc := range tests {
+		b := string(redactSecretKeys([]byte(tc.body)))
+		if !strings.Contains(b, tc.contains) || (tc.hidden != "" && strings.Contains(b, tc.hidden)) {
+			t.Errorf("%s should be redacted, received %s.", tc.body, b)
+		}
+	}
+}
+
+func TestDeployNullEtcd2Key(t *testing.T) {
+	t.Parallel()
+	s := &Server{}
+	body := `{"serviceName":"web","etcd2Keys":{"k":null}}`
+	r := httptest.NewRequest(httpPost, httpRouteV1Deploy, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Accept", "application/json")
+	r = r.WithContext(context.WithValue(r.Context(), identityKey{}, &Identity{Name: "ci", Role: RoleDeploy}))
+	w := httptest.NewRecorder()
+	s.deployHandler(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("A null etcd2 key should be rejected, received %d.", w.Code)
+	}
+	rd := NewRedactor(nil, nil, 0)
+	if b := rd.Body([]byte(`{"etcd2Keys":{"k":null}}`)); strings.Contains(b, "null") {
+		t.Errorf("The log of the request should not panic or show the keys, received %s.", b)
+	}
+}
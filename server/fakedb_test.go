@@ -0,0 +1,304 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/composer22/coreos-deploy/db"
+	"github.com/composer22/coreos-deploy/logger"
+)
+
+// fakeDB answers the statements of a DBConnect from handlers so handlers can be tested without
+// MySQL. Each statement is answered by the first handler whose fragment it contains.
+type fakeDB struct {
+	mu       sync.Mutex
+	handlers []*fakeHandler
+	execs    []string // Statements executed, in order.
+}
+
+type fakeHandler struct {
+	fragment string
+	answer   func(args []driver.Value) *fakeResult
+}
+
+// fakeResult is the answer to a statement: rows for a query, or the rows affected by an exec.
+type fakeResult struct {
+	columns  []string
+	rows     [][]driver.Value
+	affected int64
+	lastID   int64
+	err      error
+}
+
+var (
+	fakeDBsMu sync.Mutex
+	fakeDBs   = make(map[string]*fakeDB)
+)
+
+func init() {
+	sql.Register("fake", fakeDriver{})
+}
+
+// newFakeServer returns a server with a fake DB and a logger that discards its entries.
+func newFakeServer(t *testing.T) (*Server, *fakeDB) {
+	f := &fakeDB{}
+	fakeDBsMu.Lock()
+	name := fmt.Sprintf("%s-%d", t.Name(), len(fakeDBs))
+	fakeDBs[name] = f
+	fakeDBsMu.Unlock()
+	d, err := db.NewDBConnectDriver("fake", name)
+	if err != nil {
+		t.Fatalf("Unable to open the fake DB: %s", err)
+	}
+	log := logger.New(logger.Info, false)
+	log.SetSinks([]logger.Sink{logger.NewWriterSink(ioutil.Discard)}, []int{logger.Debug})
+	return &Server{opts: &Options{}, db: d, log: log, tokens: newTokenCache(0, 0), stats: NewStatus()}, f
+}
+
+// on answers the statements containing the fragment.
+func (f *fakeDB) on(fragment string, answer func(args []driver.Value) *fakeResult) {
+	f.mu.Lock()
+	f.handlers = append(f.handlers, &fakeHandler{fragment: fragment, answer: answer})
+	f.mu.Unlock()
+}
+
+// executed returns the executed statements containing the fragment.
+func (f *fakeDB) executed(fragment string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	result := make([]string, 0)
+	for _, q := range f.execs {
+		if strings.Contains(q, fragment) {
+			result = append(result, q)
+		}
+	}
+	return result
+}
+
+func (f *fakeDB) answer(query string, args []driver.Value, exec bool) *fakeResult {
+	f.mu.Lock()
+	if exec {
+		f.execs = append(f.execs, query)
+	}
+	var h *fakeHandler
+	for _, c := range f.handlers {
+		if strings.Contains(query, c.fragment) {
+			h = c
+			break
+		}
+	}
+	f.mu.Unlock()
+	if h == nil {
+		if exec {
+			return &fakeResult{affected: 1}
+		}
+		return &fakeResult{err: fmt.Errorf("fake DB has no answer for %s", query)}
+	}
+	return h.answer(args)
+}
+
+// deployRow returns the columns of db.deployStatusColumns with a row for each deploy.
+func deployRow(sts ...*db.DeployStatus) *fakeResult {
+	result := &fakeResult{
+		columns: strings.Split("deploy_id,domain,environment,service_name,version,num_instances,status,suffix,"+
+			"deployed_by,principal,remote_addr,metadata,freeze_override,approvals_required,expires_at,not_before,message,log,updated_at,"+
+			"created_at", ","),
+	}
+	for _, st := range sts {
+		var metadata, expiresAt, notBefore driver.Value
+		if len(st.Metadata) > 0 {
+			b, _ := json.Marshal(st.Metadata)
+			metadata = string(b)
+		}
+		if st.ExpiresAt != "" {
+			expiresAt = st.ExpiresAt
+		}
+		if st.NotBefore != "" {
+			notBefore = st.NotBefore
+		}
+		result.rows = append(result.rows, []driver.Value{st.DeployID, st.Domain, st.Environment, st.ServiceName,
+			st.Version, int64(st.NumInstances), int64(st.Status), st.Suffix, st.DeployedBy, st.Principal,
+			st.RemoteAddr, metadata, st.FreezeOverride, int64(st.Required), expiresAt, notBefore, st.Message, st.Log,
+			"2016-01-02 15:04:05", "2016-01-02 15:04:05"})
+	}
+	return result
+}
+
+// fakeDeploys holds the deploys and decisions of a fake DB so handlers can move deploys between states.
+type fakeDeploys struct {
+	mu        sync.Mutex
+	deploys   map[string]*db.DeployStatus
+	statuses  map[string][]int // Each status a deploy was moved to, in order.
+	approvals map[string][]*db.Approval
+}
+
+// newDeploysServer returns a server with a fake DB holding the deploys. A held deploy has an empty
+// service template and no etcd2 keys.
+func newDeploysServer(t *testing.T, sts ...*db.DeployStatus) (*Server, *fakeDB, *fakeDeploys) {
+	s, f := newFakeServer(t)
+	d := &fakeDeploys{
+		deploys:   make(map[string]*db.DeployStatus),
+		statuses:  make(map[string][]int),
+		approvals: make(map[string][]*db.Approval),
+	}
+	for _, st := range sts {
+		d.deploys[st.DeployID] = st
+	}
+	f.on("SELECT service_template, etcd2_keys FROM deploys", func(args []driver.Value) *fakeResult {
+		return &fakeResult{columns: []string{"service_template", "etcd2_keys"}, rows: [][]driver.Value{{"", ""}}}
+	})
+	f.on("FROM deploys WHERE deploy_id = ?", func(args []driver.Value) *fakeResult {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if st, ok := d.deploys[args[0].(string)]; ok {
+			return deployRow(st)
+		}
+		return noRows(args)
+	})
+	f.on("WHERE deploy_id = ? AND status = ?", func(args []driver.Value) *fakeResult {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		st, ok := d.deploys[args[2].(string)]
+		if !ok || int64(st.Status) != args[3].(int64) {
+			return &fakeResult{}
+		}
+		st.Status, st.Message = int(args[0].(int64)), args[1].(string)
+		d.statuses[st.DeployID] = append(d.statuses[st.DeployID], st.Status)
+		return &fakeResult{affected: 1}
+	})
+	f.on("UPDATE deploys SET status = ?, message = ?, log = ?", func(args []driver.Value) *fakeResult {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		st, ok := d.deploys[args[3].(string)]
+		if !ok {
+			return &fakeResult{}
+		}
+		st.Status, st.Message = int(args[0].(int64)), args[1].(string)
+		d.statuses[st.DeployID] = append(d.statuses[st.DeployID], st.Status)
+		return &fakeResult{affected: 1}
+	})
+	f.on("INSERT INTO deploy_approvals", func(args []driver.Value) *fakeResult {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		deployID := args[0].(string)
+		for _, a := range d.approvals[deployID] {
+			if a.Principal == args[2].(string) {
+				return &fakeResult{err: errors.New("duplicate entry for key deploy_principal_UNIQUE")}
+			}
+		}
+		d.approvals[deployID] = append(d.approvals[deployID], &db.Approval{DeployID: deployID,
+			Approver: args[1].(string), Principal: args[2].(string), Decision: args[3].(string)})
+		return &fakeResult{affected: 1}
+	})
+	f.on("FROM deploy_approvals", func(args []driver.Value) *fakeResult {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		result := &fakeResult{
+			columns: strings.Split("id,deploy_id,approver,principal,decision,comment,created_at", ","),
+		}
+		for i, a := range d.approvals[args[0].(string)] {
+			result.rows = append(result.rows, []driver.Value{int64(i + 1), a.DeployID, a.Approver, a.Principal,
+				a.Decision, "", "2016-01-02 15:04:05"})
+		}
+		return result
+	})
+	return s, f, d
+}
+
+// status returns the status of a deploy.
+func (d *fakeDeploys) status(deployID string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.deploys[deployID].Status
+}
+
+// moves returns each status a deploy was moved to, in order.
+func (d *fakeDeploys) moves(deployID string) []int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]int(nil), d.statuses[deployID]...)
+}
+
+// noRows is the answer to a query that matches nothing.
+func noRows(args []driver.Value) *fakeResult {
+	return &fakeResult{columns: []string{"id"}}
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	fakeDBsMu.Lock()
+	defer fakeDBsMu.Unlock()
+	f, ok := fakeDBs[name]
+	if !ok {
+		return nil, errors.New("unknown fake DB " + name)
+	}
+	return &fakeConn{db: f}, nil
+}
+
+type fakeConn struct {
+	db *fakeDB
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{db: c.db, query: query}, nil
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) { return nil, errors.New("fake DB has no transactions") }
+
+func (c *fakeConn) Ping(ctx context.Context) error { return nil }
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	r := s.db.answer(s.query, args, true)
+	if r.err != nil {
+		return nil, r.err
+	}
+	return r, nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	r := s.db.answer(s.query, args, false)
+	if r.err != nil {
+		return nil, r.err
+	}
+	return &fakeRows{result: r}, nil
+}
+
+func (r *fakeResult) LastInsertId() (int64, error) { return r.lastID, nil }
+func (r *fakeResult) RowsAffected() (int64, error) { return r.affected, nil }
+
+type fakeRows struct {
+	result *fakeResult
+	next   int
+}
+
+func (r *fakeRows) Columns() []string { return r.result.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.result.rows) {
+		return io.EOF
+	}
+	copy(dest, r.result.rows[r.next])
+	r.next++
+	return nil
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/composer22/coreos-deploy/cron"
+	"github.com/composer22/coreos-deploy/db"
+)
+
+// freezeRequest is the payload to create a freeze window. Either schedule and duration, or
+// startsAt and endsAt must be given.
+type freezeRequest struct {
+	Environment    string `json:"environment"`    // The environment to freeze. Defaults to the server environment.
+	ServicePattern string `json:"servicePattern"` // Optional glob of the service names to freeze.
+	Schedule       string `json:"schedule"`       // Cron expression of when a repeating window starts.
+	Duration       string `json:"duration"`       // How long a repeating window lasts, ex: "63h".
+	StartsAt       string `json:"startsAt"`       // RFC 3339 start of an explicit window.
+	EndsAt         string `json:"endsAt"`         // RFC 3339 end of an explicit window.
+	Timezone       string `json:"timezone"`       // Location to evaluate the schedule in. Defaults to UTC.
+	Reason         string `json:"reason"`         // Why deploys are frozen.
+}
+
+// freezeResponse returns a freeze window along with whether it is in effect.
+type freezeResponse struct {
+	*db.FreezeWindow
+	Active bool   `json:"active"`          // Is the window in effect now?
+	Until  string `json:"until,omitempty"` // When the window in effect ends (RFC 3339).
+}
+
+// freezeEnd returns when the window ends if it is in effect at the time t.
+func freezeEnd(w *db.FreezeWindow, t time.Time) (time.Time, bool) {
+	if w.Schedule != "" {
+		sched, err := cron.Parse(w.Schedule)
+		if err != nil {
+			return time.Time{}, false
+		}
+		d, err := time.ParseDuration(w.Duration)
+		if err != nil {
+			return time.Time{}, false
+		}
+		loc, err := time.LoadLocation(w.Timezone)
+		if err != nil {
+			loc = time.UTC
+		}
+		start, ok := sched.Active(t.In(loc), d)
+		return start.Add(d), ok
+	}
+	start, err := time.Parse(dbTimeFormat, w.StartsAt)
+	if err != nil {
+		return time.Time{}, false
+	}
+	end, err := time.Parse(dbTimeFormat, w.EndsAt)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return end, !t.Before(start) && t.Before(end)
+}
+
+// activeFreeze returns the freeze window in effect for a service in the environment at the time t
+// and when it ends, or nil if deploys are allowed. If several windows apply, the one that ends last
+// is returned. The query is traced under the span in ctx, if any.
+func (s *Server) activeFreeze(ctx context.Context, environment string, serviceName string, t time.Time) (
+	*db.FreezeWindow, time.Time, error) {
+	windows, err := s.db.WithContext(ctx).QueryFreezeWindows(environment)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var active *db.FreezeWindow
+	var until time.Time
+	for _, w := range windows {
+		if w.ServicePattern != "" {
+			if ok, _ := path.Match(w.ServicePattern, serviceName); !ok {
+				continue
+			}
+		}
+		if end, ok := freezeEnd(w, t); ok && end.After(until) {
+			active, until = w, end
+		}
+	}
+	return active, until, nil
+}
+
+// frozenMessage returns the response to a deploy rejected by a freeze window.
+func frozenMessage(w *db.FreezeWindow, until time.Time) string {
+	return fmt.Sprintf("%s Freeze window %d (%s) ends %s.", DeployFrozen, w.ID, w.Reason,
+		until.UTC().Format(time.RFC3339))
+}
+
+// freezesHandler handles requests to list and manage deploy freeze windows.
+//
+//	GET    /v1.0/freezes      - list the windows of all environments and whether they are in effect.
+//	POST   /v1.0/freezes      - create a window (admin).
+//	DELETE /v1.0/freezes/{id} - remove a window (admin).
+func (s *Server) freezesHandler(w http.ResponseWriter, r *http.Request) {
+	if s.invalidHeader(w, r) || s.invalidAuth(w, r, RoleRead) {
+		return
+	}
+
+	params := routeParams(r.URL.Path, httpRouteV1Freezes)
+	switch {
+	case len(params) == 0 && r.Method == httpGet:
+		s.listFreezes(w, r)
+	case len(params) == 0 && r.Method == httpPost:
+		setAudit(r, "freeze.create", "", "")
+		if s.invalidAuth(w, r, RoleAdmin) {
+			return
+		}
+		s.createFreeze(w, r)
+	case len(params) == 1 && r.Method == httpDelete:
+		setAudit(r, "freeze.delete", "", "id="+params[0])
+		if s.invalidAuth(w, r, RoleAdmin) {
+			return
+		}
+		id, err := strconv.Atoi(params[0])
+		if err != nil || s.db.WithContext(r.Context()).DeleteFreezeWindow(id) != nil {
+			http.Error(w, NotFound, http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(fmt.Sprintf(`{"id":%d,"deleted":true}`, id)))
+	default:
+		http.Error(w, InvalidMethod, http.StatusMethodNotAllowed)
+	}
+}
+
+// listFreezes returns all the freeze windows and whether they are in effect. The query parameter
+// environment limits the list to one environment.
+func (s *Server) listFreezes(w http.ResponseWriter, r *http.Request) {
+	windows, err := s.db.WithContext(r.Context()).QueryFreezeWindows(r.URL.Query().Get("environment"))
+	if err != nil {
+		http.Error(w, DatabaseError, http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	result := make([]*freezeResponse, 0)
+	for _, fw := range windows {
+		resp := &freezeResponse{FreezeWindow: fw}
+		if end, ok := freezeEnd(fw, now); ok {
+			resp.Active = true
+			resp.Until = end.UTC().Format(time.RFC3339)
+		}
+		result = append(result, resp)
+	}
+	b, _ := json.Marshal(result)
+	w.Write(b)
+}
+
+// createFreeze creates a new freeze window.
+func (s *Server) createFreeze(w http.ResponseWriter, r *http.Request) {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, InvalidBody, http.StatusBadRequest)
+		return
+	}
+	var q freezeRequest
+	if err := json.Unmarshal(b, &q); err != nil {
+		http.Error(w, InvalidJSONText, http.StatusBadRequest)
+		return
+	}
+	if q.Environment == "" {
+		q.Environment = s.opts.Environment
+	}
+	if q.Timezone == "" {
+		q.Timezone = "UTC"
+	}
+	startsAt, endsAt, err := q.validate()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s err: %s", InvalidFreeze, err), http.StatusBadRequest)
+		return
+	}
+
+	id, err := s.db.WithContext(r.Context()).CreateFreezeWindow(q.Environment, q.ServicePattern, q.Schedule,
+		q.Duration, startsAt, endsAt, q.Timezone, q.Reason, requestIdentity(r).Name)
+	if err != nil {
+		http.Error(w, DatabaseError, http.StatusInternalServerError)
+		return
+	}
+	setAudit(r, "", "", fmt.Sprintf("id=%d environment=%s", id, q.Environment))
+	w.Write([]byte(fmt.Sprintf(`{"id":%d}`, id)))
+}
+
+// validate checks the freeze request and returns the explicit range, if any, as UTC datetimes.
+func (q *freezeRequest) validate() (startsAt string, endsAt string, err error) {
+	if q.Reason == "" {
+		return "", "", errors.New("a reason is required")
+	}
+	if q.ServicePattern != "" {
+		if _, err := path.Match(q.ServicePattern, ""); err != nil {
+			return "", "", errors.New("invalid service pattern")
+		}
+	}
+	if _, err := time.LoadLocation(q.Timezone); err != nil {
+		return "", "", fmt.Errorf("unknown timezone %s", q.Timezone)
+	}
+
+	switch {
+	case q.Schedule != "" && q.StartsAt == "" && q.EndsAt == "":
+		if _, err := cron.Parse(q.Schedule); err != nil {
+			return "", "", err
+		}
+		d, err := time.ParseDuration(q.Duration)
+		if err != nil || d <= 0 {
+			return "", "", errors.New("a positive duration is required with a schedule")
+		}
+		return "", "", nil
+	case q.Schedule == "" && q.Duration == "" && q.StartsAt != "" && q.EndsAt != "":
+		start, err := time.Parse(time.RFC3339, q.StartsAt)
+		if err != nil {
+			return "", "", err
+		}
+		end, err := time.Parse(time.RFC3339, q.EndsAt)
+		if err != nil {
+			return "", "", err
+		}
+		if !end.After(start) {
+			return "", "", errors.New("endsAt must be after startsAt")
+		}
+		return start.UTC().Format(dbTimeFormat), end.UTC().Format(dbTimeFormat), nil
+	default:
+		return "", "", errors.New("either schedule and duration, or startsAt and endsAt are required")
+	}
+}
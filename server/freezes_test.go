@@ -0,0 +1,248 @@
+package server
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/composer22/coreos-deploy/db"
+)
+
+// freezeRows answers QueryFreezeWindows with the windows of the environment queried.
+func freezeRows(windows ...*db.FreezeWindow) func(args []driver.Value) *fakeResult {
+	return func(args []driver.Value) *fakeResult {
+		result := &fakeResult{columns: strings.Split("id,environment,service_pattern,schedule,duration,starts_at,"+
+			"ends_at,timezone,reason,created_by,created_at", ",")}
+		for _, w := range windows {
+			if len(args) > 0 && args[0].(string) != w.Environment {
+				continue
+			}
+			var startsAt, endsAt driver.Value
+			if w.StartsAt != "" {
+				startsAt, endsAt = w.StartsAt, w.EndsAt
+			}
+			result.rows = append(result.rows, []driver.Value{int64(w.ID), w.Environment, w.ServicePattern,
+				w.Schedule, w.Duration, startsAt, endsAt, "UTC", w.Reason, "ops", "2016-01-02 15:04:05"})
+		}
+		return result
+	}
+}
+
+func TestActiveFreeze(t *testing.T) {
+	t.Parallel()
+	s, f := newFakeServer(t)
+	f.on("FROM freeze_windows", freezeRows(
+		// Weekends, from Friday 18:00 to Monday 09:00.
+		&db.FreezeWindow{ID: 1, Environment: "production", Schedule: "0 18 * * 5", Duration: "63h",
+			Reason: "Weekend"},
+		&db.FreezeWindow{ID: 2, Environment: "production", ServicePattern: "acme-*",
+			StartsAt: "2016-01-06 00:00:00", EndsAt: "2016-01-08 00:00:00", Reason: "Acme migration"},
+		&db.FreezeWindow{ID: 3, Environment: "production", StartsAt: "2016-01-07 00:00:00",
+			EndsAt: "2016-01-07 12:00:00", Reason: "Data center move"},
+		&db.FreezeWindow{ID: 4, Environment: "staging", StartsAt: "2016-01-01 00:00:00",
+			EndsAt: "2016-02-01 00:00:00", Reason: "Staging rebuild"},
+	))
+
+	tests := []struct {
+		name        string
+		environment string
+		service     string
+		at          string
+		id          int    // The window in effect or zero for none.
+		until       string // When the window ends.
+	}{
+		{"a weekend", "production", "other-web", "2016-01-02T12:00:00Z", 1, "2016-01-04T09:00:00Z"},
+		{"a weekday", "production", "other-web", "2016-01-05T12:00:00Z", 0, ""},
+		{"a service window", "production", "acme-web", "2016-01-06T12:00:00Z", 2, "2016-01-08T00:00:00Z"},
+		{"another service", "production", "other-web", "2016-01-06T12:00:00Z", 0, ""},
+		{"overlapping windows", "production", "acme-web", "2016-01-07T06:00:00Z", 2, "2016-01-08T00:00:00Z"},
+		{"an environment window", "production", "other-web", "2016-01-07T06:00:00Z", 3, "2016-01-07T12:00:00Z"},
+		{"the end of a range", "production", "other-web", "2016-01-07T12:00:00Z", 0, ""},
+		{"another environment", "staging", "other-web", "2016-01-05T12:00:00Z", 4, "2016-02-01T00:00:00Z"},
+	}
+	for _, tc := range tests {
+		at, _ := time.Parse(time.RFC3339, tc.at)
+		w, until, err := s.activeFreeze(requestAs(httpGet, "/", "", nil).Context(), tc.environment, tc.service, at)
+		if err != nil {
+			t.Fatalf("%s should be checked, received %s.", tc.name, err)
+		}
+		id, end := 0, ""
+		if w != nil {
+			id, end = w.ID, until.UTC().Format(time.RFC3339)
+		}
+		if id != tc.id || end != tc.until {
+			t.Errorf("%s should be frozen by %d until %q, received %d until %q.", tc.name, tc.id, tc.until, id, end)
+		}
+	}
+}
+
+func TestDeployFreeze(t *testing.T) {
+	t.Parallel()
+	admin := &Identity{Name: "admin", Role: RoleAdmin}
+	deployer := &Identity{Name: "ci", Role: RoleDeploy}
+	tests := []struct {
+		name     string
+		pattern  string // The service pattern of the window in effect.
+		id       *Identity
+		body     string
+		code     int
+		override string // The reason stored with the deploy.
+		action   string // The audited action.
+	}{
+		{"a deploy in an environment window", "", deployer, `{"serviceName":"acme-web","version":"1.0.0"}`,
+			http.StatusLocked, "", "deploy.create"},
+		{"a deploy in a service window", "acme-*", deployer, `{"serviceName":"acme-web","version":"1.0.0"}`,
+			http.StatusLocked, "", "deploy.create"},
+		{"a deploy of another service", "other-*", deployer, `{"serviceName":"acme-web","version":"1.0.0"}`,
+			http.StatusOK, "", "deploy.create"},
+		{"an admin deploy", "", admin, `{"serviceName":"acme-web","version":"1.0.0"}`,
+			http.StatusLocked, "", "deploy.create"},
+		{"an override by a deployer", "", deployer,
+			`{"serviceName":"acme-web","version":"1.0.0","freezeOverride":true,"overrideReason":"Hotfix"}`,
+			http.StatusForbidden, "", "deploy.create"},
+		{"an override without a reason", "", admin,
+			`{"serviceName":"acme-web","version":"1.0.0","freezeOverride":true}`,
+			http.StatusBadRequest, "", "deploy.create"},
+		{"an override with a reason", "", admin,
+			`{"serviceName":"acme-web","version":"1.0.0","freezeOverride":true,"overrideReason":"Hotfix OPS-123"}`,
+			http.StatusOK, "Hotfix OPS-123", "deploy.freeze_override"},
+	}
+	for _, tc := range tests {
+		s, f := newFakeServer(t)
+		s.opts.Environment = "production"
+		s.approvals = []*approvalRule{{environment: "production", count: 1}}
+		now := time.Now().UTC()
+		f.on("FROM freeze_windows", freezeRows(&db.FreezeWindow{ID: 1, Environment: "production",
+			ServicePattern: tc.pattern, StartsAt: now.Add(-time.Hour).Format(dbTimeFormat),
+			EndsAt: now.Add(time.Hour).Format(dbTimeFormat), Reason: "Release freeze"}))
+		a := &auditRecorder{}
+		f.on("INSERT INTO audit_events", a.insert)
+		override := "none"
+		f.on("INSERT INTO deploys", func(args []driver.Value) *fakeResult {
+			override = args[14].(string)
+			return &fakeResult{affected: 1, lastID: 1}
+		})
+
+		w := httptest.NewRecorder()
+		s.audited("deploy.create", s.deployHandler)(w, requestAs(httpPost, httpRouteV1Deploy, tc.body, tc.id))
+		if w.Code != tc.code {
+			t.Errorf("%s should return %d, received %d: %s", tc.name, tc.code, w.Code, w.Body.String())
+			continue
+		}
+		if tc.code == http.StatusLocked && !strings.Contains(w.Body.String(), "Freeze window 1 (Release freeze)") {
+			t.Errorf("%s should name the freeze window, received %s", tc.name, w.Body.String())
+		}
+		if tc.code == http.StatusOK && override != tc.override {
+			t.Errorf("%s should store the override %q, received %q.", tc.name, tc.override, override)
+		}
+		e := a.last()
+		if e == nil || e.Action != tc.action || e.StatusCode != tc.code {
+			t.Errorf("%s should be audited as %s with %d, received %+v.", tc.name, tc.action, tc.code, e)
+			continue
+		}
+		if tc.override != "" && !strings.Contains(e.Detail, "reason="+tc.override) {
+			t.Errorf("%s should audit the reason, received %q.", tc.name, e.Detail)
+		}
+	}
+}
+
+func TestFreezesHandler(t *testing.T) {
+	t.Parallel()
+	s, f := newFakeServer(t)
+	s.opts.Environment = "production"
+	now := time.Now().UTC()
+	var created []driver.Value
+	f.on("INSERT INTO freeze_windows", func(args []driver.Value) *fakeResult {
+		created = args
+		return &fakeResult{affected: 1, lastID: 7}
+	})
+	f.on("DELETE FROM freeze_windows", func(args []driver.Value) *fakeResult {
+		if args[0].(int64) != 7 {
+			return &fakeResult{affected: 0}
+		}
+		return &fakeResult{affected: 1}
+	})
+	f.on("FROM freeze_windows", freezeRows(
+		&db.FreezeWindow{ID: 1, Environment: "production", StartsAt: now.Add(-time.Hour).Format(dbTimeFormat),
+			EndsAt: now.Add(time.Hour).Format(dbTimeFormat), Reason: "Release freeze"},
+		&db.FreezeWindow{ID: 2, Environment: "production", StartsAt: "2016-01-06 00:00:00",
+			EndsAt: "2016-01-08 00:00:00", Reason: "Acme migration"},
+	))
+	admin := &Identity{Name: "admin", Role: RoleAdmin}
+
+	// The list tells which windows are in effect.
+	w := httptest.NewRecorder()
+	s.freezesHandler(w, requestAs(httpGet, httpRouteV1Freezes, "", &Identity{Name: "viewer", Role: RoleRead}))
+	var list []*freezeResponse
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list) != 2 || !list[0].Active || list[0].Until == "" || list[1].Active {
+		t.Errorf("The list should show only the first window in effect, received %s.", w.Body.String())
+	}
+
+	tests := []struct {
+		name string
+		body string
+		id   *Identity
+		code int
+		args []driver.Value // The window created: environment, pattern, schedule, duration, starts and ends.
+	}{
+		{"a date range", `{"servicePattern":"acme-*","startsAt":"2016-01-06T01:00:00+01:00",` +
+			`"endsAt":"2016-01-08T00:00:00Z","reason":"Acme migration"}`, admin, http.StatusOK,
+			[]driver.Value{"production", "acme-*", "", "", "2016-01-06 00:00:00", "2016-01-08 00:00:00"}},
+		{"a schedule", `{"environment":"staging","schedule":"0 18 * * 5","duration":"63h","reason":"Weekend"}`,
+			admin, http.StatusOK, []driver.Value{"staging", "", "0 18 * * 5", "63h", "", ""}},
+		{"a reversed range", `{"startsAt":"2016-01-08T00:00:00Z","endsAt":"2016-01-06T00:00:00Z",` +
+			`"reason":"Backwards"}`, admin, http.StatusBadRequest, nil},
+		{"a range and a schedule", `{"schedule":"0 18 * * 5","duration":"63h","startsAt":"2016-01-06T00:00:00Z",` +
+			`"endsAt":"2016-01-08T00:00:00Z","reason":"Both"}`, admin, http.StatusBadRequest, nil},
+		{"no reason", `{"startsAt":"2016-01-06T00:00:00Z","endsAt":"2016-01-08T00:00:00Z"}`, admin,
+			http.StatusBadRequest, nil},
+		{"a deployer", `{"startsAt":"2016-01-06T00:00:00Z","endsAt":"2016-01-08T00:00:00Z","reason":"Mine"}`,
+			&Identity{Name: "ci", Role: RoleDeploy}, http.StatusForbidden, nil},
+	}
+	for _, tc := range tests {
+		created = nil
+		w := httptest.NewRecorder()
+		s.freezesHandler(w, requestAs(httpPost, httpRouteV1Freezes, tc.body, tc.id))
+		if w.Code != tc.code {
+			t.Errorf("Creating %s should return %d, received %d: %s", tc.name, tc.code, w.Code, w.Body.String())
+			continue
+		}
+		if tc.args == nil {
+			if created != nil {
+				t.Errorf("Creating %s should not store a window.", tc.name)
+			}
+			continue
+		}
+		if len(created) < len(tc.args) {
+			t.Errorf("Creating %s should store a window.", tc.name)
+			continue
+		}
+		for i := range tc.args {
+			if created[i] != tc.args[i] {
+				t.Errorf("Creating %s should store %v, received %v.", tc.name, tc.args, created[:len(tc.args)])
+				break
+			}
+		}
+	}
+
+	for _, tc := range []struct {
+		path string
+		id   *Identity
+		code int
+	}{
+		{httpRouteV1Freezes + "/7", &Identity{Name: "ci", Role: RoleDeploy}, http.StatusForbidden},
+		{httpRouteV1Freezes + "/8", admin, http.StatusNotFound},
+		{httpRouteV1Freezes + "/7", admin, http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		s.freezesHandler(w, requestAs(httpDelete, tc.path, "", tc.id))
+		if w.Code != tc.code {
+			t.Errorf("Deleting %s should return %d, received %d: %s", tc.path, tc.code, w.Code, w.Body.String())
+		}
+	}
+}
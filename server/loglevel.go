@@ -0,0 +1,163 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/composer22/coreos-deploy/db"
+	"github.com/composer22/coreos-deploy/etcd2"
+	"github.com/composer22/coreos-deploy/logger"
+)
+
+// Subsystems whose log level may be set apart from the level of the server.
+const (
+	logHTTP   = "http"   // The requests received.
+	logDeploy = "deploy" // Deploys and their steps.
+	logFleet  = "fleet"  // fleetctl commands.
+	logEtcd2  = "etcd2"  // Calls to etcd2.
+	logDB     = "db"     // DB statements.
+
+	logLevelDefault = "default" // Returns a subsystem to the level of the server.
+)
+
+var logSubsystems = map[string]bool{logHTTP: true, logDeploy: true, logFleet: true, logEtcd2: true, logDB: true}
+
+// logLevelRequest is the body of a request to change the log levels. Omitted levels are unchanged.
+type logLevelRequest struct {
+	Level      string            `json:"level"`      // The level of the server, ex: debug.
+	Subsystems map[string]string `json:"subsystems"` // Levels by subsystem, or "default" to follow the server.
+}
+
+// logLevelResponse returns the log levels in effect.
+type logLevelResponse struct {
+	Level      string            `json:"level"`      // The level of the server.
+	Subsystems map[string]string `json:"subsystems"` // The subsystems with a level of their own.
+}
+
+// logLevelHandler handles an admin request to query or change the log levels of the running server.
+func (s *Server) logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	if s.invalidHeader(w, r) || s.invalidAuth(w, r, RoleAdmin) {
+		return
+	}
+
+	switch r.Method {
+	case httpGet:
+	case httpPut:
+		if !s.setLogLevels(w, r) {
+			return
+		}
+	default:
+		http.Error(w, InvalidMethod, http.StatusMethodNotAllowed)
+		return
+	}
+	resp := &logLevelResponse{
+		Level:      logger.LevelName(s.log.GetLogLevel()),
+		Subsystems: make(map[string]string),
+	}
+	for name, lvl := range s.log.GetSubsystemLevels() {
+		resp.Subsystems[name] = logger.LevelName(lvl)
+	}
+	b, _ := json.Marshal(resp)
+	w.Write(b)
+}
+
+// setLogLevels changes the log levels to those of the request body. No level is changed unless all
+// are valid. It returns false if an error has been written.
+func (s *Server) setLogLevels(w http.ResponseWriter, r *http.Request) bool {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, InvalidBody, http.StatusBadRequest)
+		return false
+	}
+	var q logLevelRequest
+	if err := json.Unmarshal(b, &q); err != nil {
+		http.Error(w, InvalidJSONText, http.StatusBadRequest)
+		return false
+	}
+
+	level := logger.UseDefault
+	if q.Level != "" {
+		if level, err = logger.ParseLevel(q.Level); err != nil {
+			http.Error(w, InvalidLogLevel, http.StatusBadRequest)
+			return false
+		}
+	}
+	subsystems := make(map[string]int)
+	for name, l := range q.Subsystems {
+		if !logSubsystems[name] {
+			http.Error(w, InvalidLogSubsystem, http.StatusBadRequest)
+			return false
+		}
+		subsystems[name] = logger.UseDefault
+		if !strings.EqualFold(l, logLevelDefault) {
+			if subsystems[name], err = logger.ParseLevel(l); err != nil {
+				http.Error(w, InvalidLogLevel, http.StatusBadRequest)
+				return false
+			}
+		}
+	}
+
+	changes := make([]string, 0)
+	if level != logger.UseDefault {
+		s.log.SetLogLevel(level)
+		changes = append(changes, "level="+logger.LevelName(level))
+	}
+	for name, lvl := range subsystems {
+		s.log.SetSubsystemLevel(name, lvl)
+		if lvl == logger.UseDefault {
+			changes = append(changes, name+"="+logLevelDefault)
+		} else {
+			changes = append(changes, name+"="+logger.LevelName(lvl))
+		}
+	}
+	sort.Strings(changes)
+	setAudit(r, "", "", strings.Join(changes, ","))
+	s.log.Noticef("Log levels changed by %s: %s", requestIdentity(r).Name, strings.Join(changes, " "))
+	return true
+}
+
+// shiftLogLevel raises the log level of the server by delta levels toward Debug, or lowers it for a
+// negative delta, within the RFC 5424 levels.
+func (s *Server) shiftLogLevel(delta int) {
+	lvl := s.log.GetLogLevel() + delta
+	if lvl < logger.Emergency {
+		lvl = logger.Emergency
+	}
+	if lvl > logger.Debug {
+		lvl = logger.Debug
+	}
+	s.log.SetLogLevel(lvl)
+	s.log.Noticef("Log level set to %s.", logger.LevelName(lvl))
+}
+
+// etcd2Observer returns the observer of etcd2 calls, which records their metrics and logs them to
+// the etcd2 subsystem.
+func (s *Server) etcd2Observer() etcd2.Observer {
+	log := s.log.Subsystem(logEtcd2)
+	return func(op string, d time.Duration, err error) {
+		observeEtcd2(op, d, err)
+		logCall(log, "etcd2 "+op, d, err)
+	}
+}
+
+// dbObserver returns the observer of DB statements, which logs them to the db subsystem.
+func (s *Server) dbObserver() db.Observer {
+	log := s.log.Subsystem(logDB)
+	return func(statement string, d time.Duration, err error) {
+		logCall(log, statement, d, err)
+	}
+}
+
+// logCall logs a call made by a subsystem at Debug with its duration and any error. The caller
+// handles and logs any error itself at the level it warrants.
+func logCall(log *logger.Logger, call string, d time.Duration, err error) {
+	if err != nil {
+		log.Logw(logger.Debug, "Call failed.", "call", call, "duration", d.String(), "error", err.Error())
+		return
+	}
+	log.Logw(logger.Debug, "Call finished.", "call", call, "duration", d.String())
+}
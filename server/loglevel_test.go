@@ -0,0 +1,78 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/composer22/coreos-deploy/logger"
+)
+
+// logLevelRequestAs returns a request to the log level route made by an identity of the role.
+func logLevelRequestAs(method string, body string, role string) *http.Request {
+	r := httptest.NewRequest(method, httpRouteV1LogLevel, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Accept", "application/json")
+	return r.WithContext(context.WithValue(r.Context(), identityKey{}, &Identity{Name: "ops", Role: role}))
+}
+
+func TestLogLevelHandler(t *testing.T) {
+	t.Parallel()
+	s := &Server{log: logger.New(logger.Info, false)}
+	s.log.SetSinks([]logger.Sink{logger.NewWriterSink(&strings.Builder{})}, []int{logger.Debug})
+
+	w := httptest.NewRecorder()
+	s.logLevelHandler(w, logLevelRequestAs(httpPut, `{"level":"warning","subsystems":{"db":"debug"}}`, RoleAdmin))
+	var resp logLevelResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("The levels should be set, received %d %s.", w.Code, w.Body.String())
+	}
+	if resp.Level != "warning" || resp.Subsystems[logDB] != "debug" || s.log.GetLogLevel() != logger.Warning {
+		t.Errorf("The new levels should be in effect, received %+v.", resp)
+	}
+
+	w = httptest.NewRecorder()
+	s.logLevelHandler(w, logLevelRequestAs(httpPut, `{"subsystems":{"db":"default"}}`, RoleAdmin))
+	if len(s.log.GetSubsystemLevels()) != 0 || !strings.Contains(w.Body.String(), `"level":"warning"`) {
+		t.Errorf("The subsystem should follow the server level, received %s.", w.Body.String())
+	}
+
+	tests := []struct {
+		body string
+		role string
+		code int
+	}{
+		{`{"level":"verbose"}`, RoleAdmin, http.StatusBadRequest},
+		{`{"level":"debug","subsystems":{"cache":"debug"}}`, RoleAdmin, http.StatusBadRequest},
+		{`{"subsystems":{"db":"loud"}}`, RoleAdmin, http.StatusBadRequest},
+		{`{"level":"debug"}`, RoleDeploy, http.StatusForbidden},
+	}
+	for _, tc := range tests {
+		w = httptest.NewRecorder()
+		s.logLevelHandler(w, logLevelRequestAs(httpPut, tc.body, tc.role))
+		if w.Code != tc.code {
+			t.Errorf("%s as %s should return %d, received %d.", tc.body, tc.role, tc.code, w.Code)
+		}
+	}
+	if s.log.GetLogLevel() != logger.Warning {
+		t.Errorf("A rejected request should not change the level.")
+	}
+}
+
+func TestShiftLogLevel(t *testing.T) {
+	t.Parallel()
+	s := &Server{log: logger.New(logger.Info, false)}
+	s.log.SetSinks([]logger.Sink{logger.NewWriterSink(&strings.Builder{})}, []int{logger.Debug})
+	s.shiftLogLevel(1)
+	s.shiftLogLevel(1)
+	if s.log.GetLogLevel() != logger.Debug {
+		t.Errorf("The level should not be raised past debug, received %d.", s.log.GetLogLevel())
+	}
+	s.shiftLogLevel(-2)
+	if s.log.GetLogLevel() != logger.Notice {
+		t.Errorf("The level should be lowered, received %d.", s.log.GetLogLevel())
+	}
+}
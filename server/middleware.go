@@ -1,22 +1,77 @@
 package server
 
-import "net/http"
+import (
+	"net/http"
+	"time"
+
+	"github.com/composer22/coreos-deploy/trace"
+)
 
 // Middleware is used to perform filtering work on the request before the main controllers are
 // called.
 type Middleware struct {
 	serv    *Server
 	handler http.Handler
+	redact  *Redactor // Masks sensitive values before requests are logged.
 }
 
 // ServeHTTP implements the interface to accept requests so they can be filtered before handling
 // by the server.
 func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Don't log health checks
+	m.serv.initResponseHeader(w)
+	route := m.route(r)
+
+	// Don't log, trace or authenticate health checks
+	var span *trace.Span
 	if r.URL.Path != httpRouteV1Health {
-		m.serv.LogRequest(r)
+		r, span = m.serv.startRequestSpan(w, r, route)
+		m.serv.LogRequest(r, w.Header().Get("X-Request-ID"), m.redact)
+		r = m.serv.authenticate(r)
 	}
-	m.serv.incrementStats(r)
-	m.serv.initResponseHeader(w)
-	m.handler.ServeHTTP(w, r)
+	m.serv.incrementStats(r, route)
+	start := time.Now()
+	rw := newResponseRecorder(w)
+	m.handler.ServeHTTP(rw, r)
+	d := time.Since(start)
+	endRequestSpan(span, rw.status)
+	m.serv.incrementResponseStats(route, rw.status, rw.bytes, d)
+	observeRequest(route, r.Method, rw.status, d)
+}
+
+// route returns the registered pattern that the request was routed to, or "other" if none, so
+// statistics are kept per route rather than for each distinct path.
+func (m *Middleware) route(r *http.Request) string {
+	mux, ok := m.handler.(*http.ServeMux)
+	if !ok {
+		return r.URL.Path
+	}
+	if _, pattern := mux.Handler(r); pattern != "" {
+		return pattern
+	}
+	return "other"
+}
+
+// responseRecorder wraps a ResponseWriter to remember the status code and size of the response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int   // The status code written or 200 if none has been written.
+	bytes  int64 // The bytes of the body written.
+}
+
+// newResponseRecorder is a factory function that returns a new responseRecorder instance.
+func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+// WriteHeader records the status code and writes it to the client.
+func (rr *responseRecorder) WriteHeader(status int) {
+	rr.status = status
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+// Write records the size of the body and writes it to the client.
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	n, err := rr.ResponseWriter.Write(b)
+	rr.bytes += int64(n)
+	return n, err
 }
@@ -1,20 +1,54 @@
 package server
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"time"
+)
 
 // Options represents parameters that are passed to the application to be used in constructing
 // the server.
 type Options struct {
-	Name          string `json:"name"`          // The name of the server.
-	HostName      string `json:"hostName"`      // The hostname of the server.
-	Domain        string `json:"domain"`        // The domain of the server.
-	Environment   string `json:"environment"`   // The environment of the server (dev, stage, prod, etc).
-	Port          int    `json:"port"`          // The default port of the server.
-	ProfPort      int    `json:"profPort"`      // The profiler port of the server.
-	Etcd2Endpoint string `json:"etcd2Endpoint"` // The IP address and port to the etcd2 service.
-	DSN           string `json:"-"`             // The DSN login string to the database.
-	MaxProcs      int    `json:"maxProcs"`      // The maximum number of processor cores available.
-	Debug         bool   `json:"debugEnabled"`  // Is debugging enabled in the application or server.
+	Name                 string        `json:"name"`                 // The name of the server.
+	HostName             string        `json:"hostName"`             // The hostname of the server.
+	Domain               string        `json:"domain"`               // The domain of the server.
+	Environment          string        `json:"environment"`          // The environment of the server (dev, stage, prod, etc).
+	Port                 int           `json:"port"`                 // The default port of the server.
+	ProfPort             int           `json:"profPort"`             // The profiler port of the server.
+	Etcd2Endpoint        string        `json:"etcd2Endpoint"`        // Comma list of IP:port or URLs of the etcd2 service.
+	Etcd2CAFile          string        `json:"etcd2CAFile"`          // PEM file of CAs used to verify etcd2.
+	Etcd2CertFile        string        `json:"etcd2CertFile"`        // PEM client certificate file for etcd2.
+	Etcd2KeyFile         string        `json:"etcd2KeyFile"`         // PEM client private key file for etcd2.
+	Etcd2Username        string        `json:"etcd2Username"`        // Basic auth user name for etcd2.
+	Etcd2Password        string        `json:"-"`                    // Basic auth password for etcd2.
+	Etcd2Timeout         time.Duration `json:"etcd2Timeout"`         // Header timeout for each etcd2 request.
+	Etcd2DialTimeout     time.Duration `json:"etcd2DialTimeout"`     // Timeout to connect to an etcd2 member.
+	Etcd2SyncInterval    time.Duration `json:"etcd2SyncInterval"`    // How often to refresh the etcd2 members.
+	DSN                  string        `json:"-"`                    // The DSN login string to the database.
+	SecretKeyFile        string        `json:"secretKeyFile"`        // File holding the hex key used to encrypt secrets at rest.
+	RedactHeaders        string        `json:"redactHeaders"`        // Comma list of header names masked in the request log.
+	RedactPaths          string        `json:"redactPaths"`          // Comma list of JSON body paths masked in the request log.
+	LogBodyMax           int           `json:"logBodyMax"`           // Maximum number of body bytes written to the request log.
+	LogFormat            string        `json:"logFormat"`            // Output format of the log: text or json.
+	LogSinks             string        `json:"logSinks"`             // Comma list of KIND[:TARGET][@LEVEL] log sinks.
+	AuthCacheTTL         int           `json:"authCacheTTL"`         // Seconds a valid API token is cached.
+	AuthCacheNegTTL      int           `json:"authCacheNegTTL"`      // Seconds an invalid API token is cached.
+	JWTKeySet            string        `json:"jwtKeySet"`            // File or URL of the JWKS used to validate JWT bearer tokens.
+	JWTAudience          string        `json:"jwtAudience"`          // The required "aud" claim of a JWT.
+	JWTIssuer            string        `json:"jwtIssuer"`            // The required "iss" claim of a JWT, if any.
+	JWTRoleClaim         string        `json:"jwtRoleClaim"`         // The JWT claim holding the role(s) granted.
+	JWTServiceClaim      string        `json:"jwtServiceClaim"`      // The JWT claim holding the service name glob, if any.
+	TLSCert              string        `json:"tlsCert"`              // PEM certificate file to serve https.
+	TLSKey               string        `json:"tlsKey"`               // PEM private key file to serve https.
+	TLSClientCA          string        `json:"tlsClientCA"`          // PEM file of CAs used to verify client certificates.
+	TLSRequireClientCert bool          `json:"tlsRequireClientCert"` // Must every client present a certificate?
+	ApprovalRules        string        `json:"approvalRules"`        // Comma list of ENV[/SERVICE_GLOB]=COUNT approval rules.
+	ApprovalTTL          time.Duration `json:"approvalTTL"`          // How long a deploy may await approval.
+	SlackTargets         string        `json:"-"`                    // Comma list of ENV=URL|CHANNEL chat notification targets.
+	SlackToken           string        `json:"-"`                    // Slack bot token used to post to channels.
+	TraceOTLPEndpoint    string        `json:"traceOTLPEndpoint"`    // OTLP/HTTP collector URL spans are exported to.
+	TraceFile            string        `json:"traceFile"`            // File spans are appended to as JSON.
+	MaxProcs             int           `json:"maxProcs"`             // The maximum number of processor cores available.
+	Debug                bool          `json:"debugEnabled"`         // Is debugging enabled in the application or server.
 }
 
 // String is an implentation of the Stringer interface so the structure is returned as a string
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/composer22/coreos-deploy/db"
+	"github.com/composer22/coreos-deploy/metrics"
+)
+
+// Buckets of the deploy duration histogram in seconds.
+var deployBuckets = []float64{5, 10, 30, 60, 120, 300, 600, 1200, 1800, 3600}
+
+// Prometheus metrics of the server, written by /metrics.
+var (
+	promRegistry = metrics.NewRegistry()
+
+	httpRequests = promRegistry.NewCounter("coreos_deploy_http_requests_total",
+		"HTTP requests handled by route, method and status code.", "route", "method", "code")
+	httpDuration = promRegistry.NewHistogram("coreos_deploy_http_request_duration_seconds",
+		"Time to handle HTTP requests by route and method.", metrics.DefaultBuckets, "route", "method")
+	deploysTotal = promRegistry.NewCounter("coreos_deploy_deploys_total",
+		"Deploys completed by service and status.", "service", "status")
+	deployDuration = promRegistry.NewHistogram("coreos_deploy_deploy_duration_seconds",
+		"Time to run deploys by service and status.", deployBuckets, "service", "status")
+	fleetDuration = promRegistry.NewHistogram("coreos_deploy_fleet_command_duration_seconds",
+		"Time to run fleetctl commands by command.", metrics.DefaultBuckets, "command")
+	fleetErrors = promRegistry.NewCounter("coreos_deploy_fleet_command_errors_total",
+		"fleetctl commands that failed by command.", "command")
+	etcd2Duration = promRegistry.NewHistogram("coreos_deploy_etcd2_request_duration_seconds",
+		"Time of etcd2 calls by operation.", metrics.DefaultBuckets, "operation")
+	etcd2Errors = promRegistry.NewCounter("coreos_deploy_etcd2_request_errors_total",
+		"etcd2 calls that failed by operation.", "operation")
+
+	deploysQueued  int64 // Deploys waiting for the deploy lock.
+	deploysRunning int64 // Deploys holding the deploy lock.
+	processStart   = time.Now()
+)
+
+func init() {
+	promRegistry.NewGaugeFunc("coreos_deploy_deploy_queue_depth", "Deploys waiting for another deploy to finish.",
+		func() float64 { return float64(atomic.LoadInt64(&deploysQueued)) })
+	promRegistry.NewGaugeFunc("coreos_deploy_deploys_in_progress", "Deploys running.",
+		func() float64 { return float64(atomic.LoadInt64(&deploysRunning)) })
+	promRegistry.NewGaugeFunc("coreos_deploy_start_time_seconds", "Start time of the process in unix seconds.",
+		func() float64 { return float64(processStart.Unix()) })
+	promRegistry.NewGaugeFunc("go_goroutines", "Number of goroutines that currently exist.",
+		func() float64 { return float64(runtime.NumGoroutine()) })
+}
+
+// statusName returns the name of a deploy status used as a metric label.
+func statusName(status int) string {
+	switch status {
+	case db.Started:
+		return "started"
+	case db.Success:
+		return "success"
+	case db.Failed:
+		return "failed"
+	case db.PendingApproval:
+		return "pending_approval"
+	case db.Rejected:
+		return "rejected"
+	case db.Expired:
+		return "expired"
+	case db.Scheduled:
+		return "scheduled"
+	case db.Cancelled:
+		return "cancelled"
+	case db.RolledBack:
+		return "rolled_back"
+	}
+	return strconv.Itoa(status)
+}
+
+// methodName returns the HTTP method used as a metric label. Methods the server does not handle
+// are "other", as clients may send any method.
+func methodName(method string) string {
+	switch method {
+	case httpGet, httpPost, httpPut, httpDelete, httpHead:
+		return method
+	}
+	return "other"
+}
+
+// observeRequest records a handled HTTP request. The route is the pattern the request matched and
+// the method one of a few known ones so the number of series stays bounded.
+func observeRequest(route string, method string, status int, d time.Duration) {
+	method = methodName(method)
+	httpRequests.Inc(route, method, strconv.Itoa(status))
+	httpDuration.Observe(d.Seconds(), route, method)
+}
+
+// observeEtcd2 records a call to etcd2.
+func observeEtcd2(op string, d time.Duration, err error) {
+	etcd2Duration.Observe(d.Seconds(), op)
+	if err != nil {
+		etcd2Errors.Inc(op)
+	}
+}
+
+// prometheusHandler handles a request for the server metrics in the Prometheus text format.
+func (s *Server) prometheusHandler(w http.ResponseWriter, r *http.Request) {
+	if s.invalidMethod(w, r, httpGet) || s.invalidAuth(w, r, RoleRead) {
+		return
+	}
+	w.Header().Set("Content-Type", metrics.ContentType)
+	promRegistry.Write(w)
+}
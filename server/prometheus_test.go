@@ -0,0 +1,26 @@
+package server
+
+import "testing"
+
+func TestMethodName(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		method string
+		name   string
+	}{
+		{"GET", "GET"},
+		{"POST", "POST"},
+		{"PUT", "PUT"},
+		{"DELETE", "DELETE"},
+		{"HEAD", "HEAD"},
+		{"get", "other"},
+		{"OPTIONS", "other"},
+		{"X-RANDOM-1234", "other"},
+		{"", "other"},
+	}
+	for _, tc := range tests {
+		if name := methodName(tc.method); name != tc.name {
+			t.Errorf("Method %q should be labeled %q, received %q.", tc.method, tc.name, name)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Redactor masks sensitive header values and JSON body attributes before a request is logged.
+type Redactor struct {
+	headers map[string]bool // Canonical header names whose values are masked.
+	paths   [][]string      // Dotted JSON paths in the body whose values are masked.
+	maxBody int             // Maximum body bytes to log. Zero or less is no limit.
+}
+
+// NewRedactor is a factory function that returns a new Redactor instance.
+// headers are header names, paths are dotted JSON paths where "*" matches any key or array element
+// (ex: "etcd2Keys.*"), and maxBody limits the size of the body written to the log.
+func NewRedactor(headers []string, paths []string, maxBody int) *Redactor {
+	rd := &Redactor{
+		headers: make(map[string]bool),
+		paths:   make([][]string, 0),
+		maxBody: maxBody,
+	}
+	for _, h := range headers {
+		rd.headers[http.CanonicalHeaderKey(h)] = true
+	}
+	for _, p := range paths {
+		rd.paths = append(rd.paths, strings.Split(p, "."))
+	}
+	return rd
+}
+
+// Header returns a copy of the header with the values of sensitive headers masked. The auth scheme
+// of a value, such as "Bearer", is kept so the log still shows what kind of credential was sent.
+func (rd *Redactor) Header(h http.Header) http.Header {
+	if h == nil {
+		return nil
+	}
+	result := make(http.Header)
+	for name, values := range h {
+		if !rd.headers[http.CanonicalHeaderKey(name)] {
+			result[name] = values
+			continue
+		}
+		masked := make([]string, 0)
+		for _, v := range values {
+			if i := strings.Index(v, " "); i > 0 {
+				masked = append(masked, v[:i+1]+redactedValue)
+				continue
+			}
+			masked = append(masked, redactedValue)
+		}
+		result[name] = masked
+	}
+	return result
+}
+
+// Body returns the body as a string for the log with secret etcd2 keys and configured JSON paths
+// masked, truncated to the maximum body size.
+func (rd *Redactor) Body(b []byte) string {
+	b = redactSecretKeys(b)
+	if len(rd.paths) > 0 {
+		var doc interface{}
+		if err := json.Unmarshal(b, &doc); err == nil {
+			for _, p := range rd.paths {
+				doc = redactPath(doc, p)
+			}
+			if rb, err := json.Marshal(doc); err == nil {
+				b = rb
+			}
+		}
+	}
+	if rd.maxBody > 0 && len(b) > rd.maxBody {
+		// Back off to the start of a rune so a multi-byte character is not split.
+		n := rd.maxBody
+		for n > 0 && !utf8.RuneStart(b[n]) {
+			n--
+		}
+		return fmt.Sprintf("%s...(%d bytes truncated)", b[:n], len(b)-n)
+	}
+	return string(b)
+}
+
+// redactPath masks the value(s) found at the path within the JSON document.
+func redactPath(node interface{}, path []string) interface{} {
+	if len(path) == 0 {
+		return redactedValue
+	}
+	switch n := node.(type) {
+	case map[string]interface{}:
+		for k, v := range n {
+			if path[0] == "*" || path[0] == k {
+				n[k] = redactPath(v, path[1:])
+			}
+		}
+	case []interface{}:
+		for i, v := range n {
+			if path[0] == "*" || path[0] == strconv.Itoa(i) {
+				n[i] = redactPath(v, path[1:])
+			}
+		}
+	}
+	return node
+}
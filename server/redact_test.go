@@ -0,0 +1,34 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestRedactorBodyTruncate(t *testing.T) {
+	t.Parallel()
+	rd := NewRedactor(nil, nil, 4)
+	// "é" is two bytes, so the cut after the fourth byte is inside a rune.
+	b := rd.Body([]byte(`"abé€xyz"`))
+	if !utf8.ValidString(b) || !strings.HasPrefix(b, `"ab...`) || !strings.HasSuffix(b, "(9 bytes truncated)") {
+		t.Errorf("The body should be cut before the split rune, received %q.", b)
+	}
+	if b := NewRedactor(nil, nil, 6).Body([]byte(`"abé"`)); b != `"abé"` {
+		t.Errorf("A body within the maximum should not be truncated, received %q.", b)
+	}
+}
+
+func TestRedactorMasks(t *testing.T) {
+	t.Parallel()
+	rd := NewRedactor([]string{"authorization"}, []string{"metadata.token"}, 0)
+	h := rd.Header(http.Header{"Authorization": {"Bearer abc"}, "Accept": {"application/json"}})
+	if h.Get("Authorization") != "Bearer "+redactedValue || h.Get("Accept") != "application/json" {
+		t.Errorf("Only the configured headers should be masked, received %v.", h)
+	}
+	if b := rd.Body([]byte(`{"metadata":{"token":"abc","ticket":"OPS-1"}}`)); strings.Contains(b, "abc") ||
+		!strings.Contains(b, "OPS-1") {
+		t.Errorf("Only the configured paths should be masked, received %s.", b)
+	}
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/composer22/coreos-deploy/db"
+)
+
+const (
+	reportDefaultDays = 30  // Days reported when no window is requested.
+	reportMaxDays     = 366 // Longest window reported.
+)
+
+// deployReport is the DORA style summary of the deploys that completed within a window.
+type deployReport struct {
+	Since    string           `json:"since"`    // Start of the window (RFC 3339).
+	Until    string           `json:"until"`    // End of the window (RFC 3339).
+	Days     float64          `json:"days"`     // Length of the window in days.
+	Services []*serviceReport `json:"services"` // One summary for each service and environment.
+}
+
+// serviceReport summarizes the deploys of a service to an environment.
+type serviceReport struct {
+	ServiceName        string    `json:"serviceName"`               // The service deployed.
+	Environment        string    `json:"environment"`               // The environment deployed to.
+	Deploys            int       `json:"deploys"`                   // Deploys completed.
+	DeploysPerDay      float64   `json:"deploysPerDay"`             // Deploy frequency.
+	Successes          int       `json:"successes"`                 // Deploys that succeeded.
+	Failures           int       `json:"failures"`                  // Deploys that failed.
+	Rollbacks          int       `json:"rollbacks"`                 // Deploys that were rolled back.
+	SuccessRate        float64   `json:"successRate"`               // Successes / deploys.
+	ChangeFailureRate  float64   `json:"changeFailureRate"`         // (Failures + rollbacks) / deploys.
+	MeanDuration       float64   `json:"meanDurationSeconds"`       // Mean time from start to completion.
+	Recoveries         int       `json:"recoveries"`                // Failures followed by a successful deploy.
+	MeanTimeToRecovery float64   `json:"meanTimeToRecoverySeconds"` // Mean time from a failure to the next success.
+	durationTotal      float64   // Sum of the deploy durations in seconds.
+	recoveryTotal      float64   // Sum of the recovery times in seconds.
+	failingSince       time.Time // When the first unrecovered failure completed.
+	timedDeploys       int       // Deploys with a valid duration.
+}
+
+// summarizeDeploys builds the report of each service and environment from deploy outcomes ordered
+// by completion time. A recovery is measured from the first failure or rollback to the next success.
+func summarizeDeploys(outcomes []*db.DeployOutcome, days float64) []*serviceReport {
+	reports := make(map[string]*serviceReport)
+	for _, o := range outcomes {
+		key := o.Environment + "\x00" + o.ServiceName
+		rp, ok := reports[key]
+		if !ok {
+			rp = &serviceReport{ServiceName: o.ServiceName, Environment: o.Environment}
+			reports[key] = rp
+		}
+		rp.Deploys++
+		completed, err := time.ParseInLocation(dbTimeFormat, o.CompletedAt, time.Local)
+		if err != nil {
+			continue
+		}
+		if started, err := time.ParseInLocation(dbTimeFormat, o.StartedAt, time.Local); err == nil &&
+			!completed.Before(started) {
+			rp.durationTotal += completed.Sub(started).Seconds()
+			rp.timedDeploys++
+		}
+		switch o.Status {
+		case db.Success:
+			rp.Successes++
+			if !rp.failingSince.IsZero() {
+				rp.Recoveries++
+				rp.recoveryTotal += completed.Sub(rp.failingSince).Seconds()
+				rp.failingSince = time.Time{}
+			}
+		case db.Failed, db.RolledBack:
+			if o.Status == db.Failed {
+				rp.Failures++
+			} else {
+				rp.Rollbacks++
+			}
+			if rp.failingSince.IsZero() {
+				rp.failingSince = completed
+			}
+		}
+	}
+
+	result := make([]*serviceReport, 0, len(reports))
+	for _, rp := range reports {
+		if days > 0 {
+			rp.DeploysPerDay = round3(float64(rp.Deploys) / days)
+		}
+		rp.SuccessRate = round3(float64(rp.Successes) / float64(rp.Deploys))
+		rp.ChangeFailureRate = round3(float64(rp.Failures+rp.Rollbacks) / float64(rp.Deploys))
+		if rp.timedDeploys > 0 {
+			rp.MeanDuration = round3(rp.durationTotal / float64(rp.timedDeploys))
+		}
+		if rp.Recoveries > 0 {
+			rp.MeanTimeToRecovery = round3(rp.recoveryTotal / float64(rp.Recoveries))
+		}
+		result = append(result, rp)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Environment != result[j].Environment {
+			return result[i].Environment < result[j].Environment
+		}
+		return result[i].ServiceName < result[j].ServiceName
+	})
+	return result
+}
+
+// round3 rounds to three decimal places.
+func round3(v float64) float64 {
+	return math.Round(v*1000) / 1000
+}
+
+// deployReportHandler handles a client request for deploy statistics of each service and environment.
+// The window is the last days (default 30), or from since until until as RFC 3339 times. environment
+// and service filter exactly. Only services matching the service pattern of the caller are reported.
+// format=csv returns the services as CSV rather than JSON.
+func (s *Server) deployReportHandler(w http.ResponseWriter, r *http.Request) {
+	if s.invalidHeader(w, r) || s.invalidMethod(w, r, httpGet) || s.invalidAuth(w, r, RoleRead) {
+		return
+	}
+
+	qs := r.URL.Query()
+	until := time.Now()
+	days := reportDefaultDays
+	var err error
+	if d := qs.Get("days"); d != "" {
+		if days, err = strconv.Atoi(d); err != nil || days < 1 || days > reportMaxDays {
+			http.Error(w, InvalidQueryString, http.StatusBadRequest)
+			return
+		}
+	}
+	since := until.AddDate(0, 0, -days)
+	if v := qs.Get("until"); v != "" {
+		if until, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, InvalidQueryString, http.StatusBadRequest)
+			return
+		}
+		since = until.AddDate(0, 0, -days)
+	}
+	if v := qs.Get("since"); v != "" {
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, InvalidQueryString, http.StatusBadRequest)
+			return
+		}
+	}
+	if !until.After(since) || until.Sub(since) > reportMaxDays*24*time.Hour {
+		http.Error(w, InvalidQueryString, http.StatusBadRequest)
+		return
+	}
+
+	// Deploy times are recorded with the DB clock, which is expected to match the server.
+	outcomes, err := s.db.WithContext(r.Context()).QueryDeployOutcomes(since.Local().Format(dbTimeFormat),
+		until.Local().Format(dbTimeFormat), qs.Get("environment"), qs.Get("service"))
+	if err != nil {
+		http.Error(w, DatabaseError, http.StatusInternalServerError)
+		return
+	}
+	report := &deployReport{
+		Since: since.Format(time.RFC3339),
+		Until: until.Format(time.RFC3339),
+		Days:  round3(until.Sub(since).Hours() / 24),
+	}
+
+	// Only services the caller may access are reported.
+	id := requestIdentity(r)
+	allowed := make([]*db.DeployOutcome, 0, len(outcomes))
+	for _, o := range outcomes {
+		if id.AllowsService(o.ServiceName) {
+			allowed = append(allowed, o)
+		}
+	}
+	report.Services = summarizeDeploys(allowed, report.Days)
+
+	if qs.Get("format") != "csv" {
+		b, _ := json.Marshal(report)
+		w.Write(b)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", "attachment; filename=deploys.csv")
+	writeDeployReportCSV(w, report)
+}
+
+// writeDeployReportCSV writes the services of the report as CSV with a header row.
+func writeDeployReportCSV(w http.ResponseWriter, report *deployReport) {
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"serviceName", "environment", "since", "until", "deploys", "deploysPerDay", "successes",
+		"failures", "rollbacks", "successRate", "changeFailureRate", "meanDurationSeconds", "recoveries",
+		"meanTimeToRecoverySeconds"})
+	for _, rp := range report.Services {
+		cw.Write([]string{rp.ServiceName, rp.Environment, report.Since, report.Until, strconv.Itoa(rp.Deploys),
+			f(rp.DeploysPerDay), strconv.Itoa(rp.Successes), strconv.Itoa(rp.Failures), strconv.Itoa(rp.Rollbacks),
+			f(rp.SuccessRate), f(rp.ChangeFailureRate), f(rp.MeanDuration), strconv.Itoa(rp.Recoveries),
+			f(rp.MeanTimeToRecovery)})
+	}
+	cw.Flush()
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/composer22/coreos-deploy/db"
+)
+
+func outcome(service string, env string, status int, started string, completed string) *db.DeployOutcome {
+	return &db.DeployOutcome{ServiceName: service, Environment: env, Status: status, StartedAt: started,
+		CompletedAt: completed}
+}
+
+func TestSummarizeDeploys(t *testing.T) {
+	t.Parallel()
+	outcomes := []*db.DeployOutcome{
+		outcome("acme-video", "production", db.Success, "2016-03-01 10:00:00", "2016-03-01 10:02:00"),
+		outcome("acme-video", "production", db.Failed, "2016-03-02 10:00:00", "2016-03-02 10:01:00"),
+		outcome("acme-video", "production", db.RolledBack, "2016-03-02 11:00:00", "2016-03-02 11:01:00"),
+		outcome("acme-video", "production", db.Success, "2016-03-02 11:30:00", "2016-03-02 12:01:00"),
+		outcome("acme-docs", "production", db.Success, "2016-03-03 09:00:00", "2016-03-03 09:00:30"),
+		outcome("acme-video", "staging", db.Failed, "2016-03-03 09:00:00", "2016-03-03 09:01:00"),
+	}
+	reports := summarizeDeploys(outcomes, 10)
+	if len(reports) != 3 || reports[0].ServiceName != "acme-docs" || reports[2].Environment != "staging" {
+		t.Fatalf("There should be a report for each service and environment in order, received %+v.", reports)
+	}
+
+	rp := reports[1]
+	if rp.Deploys != 4 || rp.Successes != 2 || rp.Failures != 1 || rp.Rollbacks != 1 {
+		t.Errorf("Outcomes should be counted, received %+v.", rp)
+	}
+	if rp.DeploysPerDay != 0.4 || rp.SuccessRate != 0.5 || rp.ChangeFailureRate != 0.5 {
+		t.Errorf("Rates should be computed, received %+v.", rp)
+	}
+	if rp.MeanDuration != 525 {
+		t.Errorf("Mean duration should be 525s, received %v.", rp.MeanDuration)
+	}
+	if rp.Recoveries != 1 || rp.MeanTimeToRecovery != 7200 {
+		t.Errorf("Recovery should be measured from the first failure, received %+v.", rp)
+	}
+	if st := reports[2]; st.Recoveries != 0 || st.MeanTimeToRecovery != 0 || st.ChangeFailureRate != 1 {
+		t.Errorf("An unrecovered failure should not count as a recovery, received %+v.", st)
+	}
+}
+
+func TestDeployReportScoping(t *testing.T) {
+	t.Parallel()
+	s, f := newFakeServer(t)
+	f.on("FROM deploys", func(args []driver.Value) *fakeResult {
+		result := &fakeResult{columns: []string{"service_name", "environment", "status", "started_at", "updated_at"}}
+		for _, service := range []string{"acme-web", "other-web", "acme-api"} {
+			result.rows = append(result.rows, []driver.Value{service, "production", int64(db.Success),
+				"2016-03-01 10:00:00", "2016-03-01 10:02:00"})
+		}
+		return result
+	})
+
+	tests := []struct {
+		pattern  string
+		services []string
+	}{
+		{"", []string{"acme-api", "acme-web", "other-web"}},
+		{"acme-*", []string{"acme-api", "acme-web"}},
+		{"none-*", []string{}},
+	}
+	for _, tc := range tests {
+		w := httptest.NewRecorder()
+		id := &Identity{Name: "viewer", Role: RoleRead, ServicePattern: tc.pattern}
+		s.deployReportHandler(w, requestAs(httpGet, httpRouteV1DeployReport, "", id))
+		var report struct {
+			Services []struct {
+				ServiceName string `json:"serviceName"`
+			} `json:"services"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+			t.Fatalf("Unable to decode the report: %s: %s", err, w.Body.String())
+		}
+		received := make([]string, 0)
+		for _, rp := range report.Services {
+			received = append(received, rp.ServiceName)
+		}
+		if strings.Join(received, ",") != strings.Join(tc.services, ",") {
+			t.Errorf("Pattern %q should report %v, received %v.", tc.pattern, tc.services, received)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/composer22/coreos-deploy/db"
+	"github.com/composer22/coreos-deploy/trace"
+)
+
+const (
+	schedulerInterval = 15 * time.Second // How often scheduled deploys are checked.
+	deployCancel      = "cancel"         // The action to cancel a deploy that has not started.
+)
+
+// holdResponse returns a deploy saved to run later.
+type holdResponse struct {
+	DeployID          string `json:"deployID"`            // The deploy UUID.
+	Status            int    `json:"status"`              // PendingApproval or Scheduled.
+	ApprovalsRequired int    `json:"approvalsRequired"`   // The approvals needed before the deploy runs.
+	NotBefore         string `json:"notBefore,omitempty"` // When the deploy is scheduled to start (UTC).
+}
+
+// runScheduler starts scheduled deploys when their time comes until the server is shut down.
+// Scheduled deploys are kept in the DB so they survive a restart of the server.
+func (s *Server) runScheduler(done <-chan struct{}) {
+	t := time.NewTicker(schedulerInterval)
+	defer t.Stop()
+	for {
+		s.startDueDeploys()
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// startDueDeploys starts the scheduled deploys whose time has come. Each deploy is claimed in the
+// DB first so it is only started once, even with several servers.
+func (s *Server) startDueDeploys() {
+	due, err := s.db.QueryScheduledDeploys(true)
+	if err != nil {
+		s.log.Errorf("Unable to query scheduled deploys: %s", err)
+		return
+	}
+	for _, st := range due {
+		s.startDueDeploy(st)
+	}
+}
+
+// startDueDeploy starts a scheduled deploy unless a freeze window applies. It is traced with the
+// deploy ID as the trace ID, joining the trace of the request that scheduled it.
+func (s *Server) startDueDeploy(st *db.DeployStatus) {
+	traceID, _ := trace.ParseTraceID(st.DeployID)
+	ctx, span := s.tracer.Root(context.Background(), "scheduled deploy", traceID, trace.SpanID{})
+	span.SetAttr("deploy.id", st.DeployID)
+	defer span.End()
+	d := s.db.WithContext(ctx)
+	log := s.log.Subsystem(logDeploy).With("deployID", st.DeployID, "service", st.ServiceName, "version", st.Version)
+
+	req, err := s.storedServiceRequest(ctx, st)
+	if err != nil {
+		log.Errorf("Unable to load scheduled deploy: %s", err)
+		span.SetError(err)
+		d.TransitionDeploy(st.DeployID, db.Scheduled, db.Failed, "Unable to load the scheduled deploy.")
+		return
+	}
+
+	// A freeze window created since the deploy was scheduled still applies.
+	freeze, until, err := s.activeFreeze(ctx, st.Environment, st.ServiceName, time.Now())
+	if err != nil {
+		log.Errorf("Unable to check freeze windows for scheduled deploy: %s", err)
+		span.SetError(err)
+		return
+	}
+	if freeze != nil && st.FreezeOverride == "" {
+		d.TransitionDeploy(st.DeployID, db.Scheduled, db.Failed, frozenMessage(freeze, until))
+		return
+	}
+
+	// A server shutting down leaves the deploy for the next one to start.
+	if !s.addJob() {
+		return
+	}
+	if err := d.TransitionDeploy(st.DeployID, db.Scheduled, db.Started, "Start scheduled deploy."); err != nil {
+		s.wg.Done()
+		return // Cancelled or started by another server.
+	}
+	log.Infof("Starting scheduled deploy.")
+	go req.Resume()
+}
+
+// cancelDeploy cancels a deploy that is scheduled or awaiting approval.
+func (s *Server) cancelDeploy(w http.ResponseWriter, r *http.Request, st *db.DeployStatus, comment string) {
+	if st.Status != db.Scheduled && st.Status != db.PendingApproval {
+		http.Error(w, NotCancellable, http.StatusConflict)
+		return
+	}
+	msg := fmt.Sprintf("Cancelled by %s.", requestIdentity(r).Name)
+	if comment != "" {
+		msg = fmt.Sprintf("Cancelled by %s: %s", requestIdentity(r).Name, comment)
+	}
+	if err := s.db.WithContext(r.Context()).TransitionDeploy(st.DeployID, st.Status, db.Cancelled, msg); err != nil {
+		http.Error(w, NotCancellable, http.StatusConflict)
+		return
+	}
+	w.Write([]byte(fmt.Sprintf(`{"deployID":"%s","status":%d}`, st.DeployID, db.Cancelled)))
+}
+
+// scheduledHandler handles a client request for the deploys scheduled to start, soonest first.
+func (s *Server) scheduledHandler(w http.ResponseWriter, r *http.Request) {
+	if s.invalidHeader(w, r) || s.invalidMethod(w, r, httpGet) || s.invalidAuth(w, r, RoleRead) {
+		return
+	}
+
+	result, err := s.db.WithContext(r.Context()).QueryScheduledDeploys(false)
+	if err != nil {
+		http.Error(w, DatabaseError, http.StatusInternalServerError)
+		return
+	}
+	b, _ := json.Marshal(result)
+	w.Write(b)
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/composer22/coreos-deploy/db"
+)
+
+// freezeRow returns the columns of a freeze window of production in effect for the next hour.
+func freezeRow(args []driver.Value) *fakeResult {
+	now := time.Now().UTC()
+	return &fakeResult{
+		columns: strings.Split("id,environment,service_pattern,schedule,duration,starts_at,ends_at,timezone,"+
+			"reason,created_by,created_at", ","),
+		rows: [][]driver.Value{{int64(1), "production", "", "", "", now.Add(-time.Hour).Format(dbTimeFormat),
+			now.Add(time.Hour).Format(dbTimeFormat), "UTC", "Release freeze", "ops", "2016-01-02 15:04:05"}},
+	}
+}
+
+func TestStartDueDeployFreeze(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		frozen   bool
+		metadata map[string]string
+		override string
+		status   int // The status the deploy is first moved to.
+	}{
+		{"no freeze", false, nil, "", db.Started},
+		{"freeze", true, nil, "", db.Failed},
+		{"freeze with an override in the metadata", true, map[string]string{"freezeOverride": "forged"}, "",
+			db.Failed},
+		{"freeze overridden by an admin", true, nil, "Hotfix for OPS-123", db.Started},
+	}
+	for _, tc := range tests {
+		// The version names a directory that does not exist, so a started deploy fails at its first
+		// step rather than calling etcd2 and fleetctl.
+		st := &db.DeployStatus{DeployID: "D1", ServiceName: "acme-web", Version: "missing/1.0",
+			Environment: "production", Status: db.Scheduled, Metadata: tc.metadata, FreezeOverride: tc.override}
+		s, f, d := newDeploysServer(t, st)
+		if tc.frozen {
+			f.on("FROM freeze_windows", freezeRow)
+		} else {
+			f.on("FROM freeze_windows", noRows)
+		}
+
+		s.startDueDeploy(st)
+		s.wg.Wait()
+		moves := d.moves("D1")
+		if len(moves) == 0 || moves[0] != tc.status {
+			t.Errorf("With %s the deploy should move to %d, moved to %v.", tc.name, tc.status, moves)
+		}
+		if tc.status == db.Failed && (len(moves) != 1 || !strings.HasPrefix(st.Message, DeployFrozen)) {
+			t.Errorf("With %s the deploy should fail with the freeze, received %v %q.", tc.name, moves, st.Message)
+		}
+	}
+}
+
+func TestStartDueDeployClaimed(t *testing.T) {
+	t.Parallel()
+
+	// Another server started or cancelled the deploy first.
+	st := &db.DeployStatus{DeployID: "D1", ServiceName: "acme-web", Version: "missing/1.0", Status: db.Cancelled}
+	s, f, d := newDeploysServer(t, st)
+	f.on("FROM freeze_windows", noRows)
+	s.startDueDeploy(st)
+	s.wg.Wait()
+	if moves := d.moves("D1"); len(moves) != 0 {
+		t.Errorf("A deploy claimed elsewhere should not be moved, moved to %v.", moves)
+	}
+}
+
+func TestStartDueDeployShutdown(t *testing.T) {
+	t.Parallel()
+	st := &db.DeployStatus{DeployID: "D1", ServiceName: "acme-web", Version: "missing/1.0", Status: db.Scheduled}
+	s, f, d := newDeploysServer(t, st)
+	f.on("FROM freeze_windows", noRows)
+	s.done = make(chan struct{})
+	close(s.done)
+	s.startDueDeploy(st)
+	s.wg.Wait()
+	if moves := d.moves("D1"); len(moves) != 0 {
+		t.Errorf("A server shutting down should leave the deploy scheduled, moved to %v.", moves)
+	}
+}
+
+func TestAddJob(t *testing.T) {
+	t.Parallel()
+	s := &Server{done: make(chan struct{})}
+	if !s.addJob() {
+		t.Fatalf("A job should be added while the server runs.")
+	}
+	s.wg.Done()
+	close(s.done)
+	if s.addJob() {
+		t.Errorf("A job should not be added once the server is shutting down.")
+	}
+	s.wg.Wait()
+}
+
+// TestHoldExpiry checks a deploy awaiting approval does not expire before it is scheduled to start.
+func TestHoldExpiry(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		notBefore time.Duration // From now; zero is not scheduled.
+		min, max  int64         // Seconds until the deploy expires.
+	}{
+		{0, 3600, 3600},
+		{30 * time.Minute, 3600, 3600},
+		{48 * time.Hour, 48 * 3600, 48*3600 + 1},
+	}
+	for _, tc := range tests {
+		s, f := newFakeServer(t)
+		s.opts.Environment = "production"
+		s.opts.ApprovalTTL = time.Hour
+		s.approvals = []*approvalRule{{environment: "production", count: 1}}
+		f.on("FROM freeze_windows", noRows)
+		var expiresIn int64 = -1
+		f.on("INSERT INTO deploys", func(args []driver.Value) *fakeResult {
+			expiresIn = args[16].(int64)
+			return &fakeResult{affected: 1, lastID: 1}
+		})
+
+		body := `{"serviceName":"acme-web","version":"1.0.0"}`
+		if tc.notBefore > 0 {
+			body = fmt.Sprintf(`{"serviceName":"acme-web","version":"1.0.0","notBefore":"%s"}`,
+				time.Now().Add(tc.notBefore).Format(time.RFC3339))
+		}
+		w := httptest.NewRecorder()
+		s.deployHandler(w, requestAs(httpPost, httpRouteV1Deploy, body, &Identity{Name: "ci", Role: RoleDeploy}))
+		if w.Code != http.StatusOK {
+			t.Fatalf("The deploy should be held, received %d: %s", w.Code, w.Body.String())
+		}
+		if expiresIn < tc.min || expiresIn > tc.max {
+			t.Errorf("A deploy due in %s should expire in %d to %d seconds, expires in %d.", tc.notBefore, tc.min,
+				tc.max, expiresIn)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	secretKeySize = 32        // AES-256.
+	sealedPrefix  = "enc:v1:" // Marks a value as encrypted by a SecretBox.
+)
+
+// SecretBox encrypts and decrypts secret values at rest using a server-side key.
+type SecretBox struct {
+	aead cipher.AEAD
+}
+
+// NewSecretBox is a factory function that returns a SecretBox for a 32 byte key.
+func NewSecretBox(key []byte) (*SecretBox, error) {
+	if len(key) != secretKeySize {
+		return nil, fmt.Errorf("secret key must be %d bytes, received %d", secretKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &SecretBox{aead: aead}, nil
+}
+
+// LoadSecretBox reads a hex encoded key from a file and returns a SecretBox for it.
+func LoadSecretBox(path string) (*SecretBox, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("secret key file %s is not hex encoded: %s", path, err)
+	}
+	return NewSecretBox(key)
+}
+
+// Seal encrypts the plain text and returns a printable sealed value.
+func (b *SecretBox) Seal(plain string) (string, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := b.aead.Seal(nonce, nonce, []byte(plain), nil)
+	return sealedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a value previously returned by Seal.
+func (b *SecretBox) Open(sealed string) (string, error) {
+	if !strings.HasPrefix(sealed, sealedPrefix) {
+		return "", errors.New("value is not sealed")
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(sealed, sealedPrefix))
+	if err != nil {
+		return "", err
+	}
+	ns := b.aead.NonceSize()
+	if len(raw) < ns {
+		return "", errors.New("sealed value is too short")
+	}
+	plain, err := b.aead.Open(nil, raw[:ns], raw[ns:], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSecretBoxSealOpen(t *testing.T) {
+	t.Parallel()
+	box, err := NewSecretBox(bytes.Repeat([]byte{7}, secretKeySize))
+	if err != nil {
+		t.Fatalf("The box should be made, received %s.", err)
+	}
+	a, _ := box.Seal("s3cr3t")
+	b, _ := box.Seal("s3cr3t")
+	if !strings.HasPrefix(a, sealedPrefix) || strings.Contains(a, "s3cr3t") || a == b {
+		t.Errorf("Each seal should be prefixed, hide the value and use a new nonce, received %s %s.", a, b)
+	}
+	if plain, err := box.Open(a); err != nil || plain != "s3cr3t" {
+		t.Errorf("The sealed value should open, received %q %v.", plain, err)
+	}
+
+	other, _ := NewSecretBox(bytes.Repeat([]byte{8}, secretKeySize))
+	tampered := a[:len(a)-2] + "AA"
+	for _, tc := range []struct {
+		box    *SecretBox
+		sealed string
+	}{
+		{other, a},                   // The wrong key.
+		{box, tampered},              // A modified cipher text.
+		{box, "s3cr3t"},              // Not sealed.
+		{box, sealedPrefix + "!!"},   // Not base64.
+		{box, sealedPrefix + "AAAA"}, // Shorter than a nonce.
+	} {
+		if _, err := tc.box.Open(tc.sealed); err == nil {
+			t.Errorf("%s should not open.", tc.sealed)
+		}
+	}
+}
+
+func TestLoadSecretBox(t *testing.T) {
+	t.Parallel()
+	dir, _ := ioutil.TempDir("", "coreos-deploy-secret")
+	defer os.RemoveAll(dir)
+	good := filepath.Join(dir, "good.key")
+	ioutil.WriteFile(good, []byte(hex.EncodeToString(bytes.Repeat([]byte{1}, secretKeySize))+"\n"), 0600)
+	short := filepath.Join(dir, "short.key")
+	ioutil.WriteFile(short, []byte("0102"), 0600)
+	notHex := filepath.Join(dir, "text.key")
+	ioutil.WriteFile(notHex, []byte("not a key"), 0600)
+
+	if _, err := LoadSecretBox(good); err != nil {
+		t.Errorf("A hex key file should load, received %s.", err)
+	}
+	for _, path := range []string{short, notHex, filepath.Join(dir, "missing.key")} {
+		if _, err := LoadSecretBox(path); err == nil {
+			t.Errorf("%s should not load.", path)
+		}
+	}
+}
+
+func TestEtcd2KeysSealedOpened(t *testing.T) {
+	t.Parallel()
+	box, _ := NewSecretBox(bytes.Repeat([]byte{7}, secretKeySize))
+	keys := Etcd2Keys{"plain": {Value: "a"}, "hidden": {Value: "s3cr3t", Secret: true}}
+
+	sealed, err := keys.Sealed(box)
+	if err != nil || sealed["plain"].Value != "a" || !strings.HasPrefix(sealed["hidden"].Value, sealedPrefix) {
+		t.Fatalf("Only the secret values should be sealed, received %+v %v.", sealed, err)
+	}
+	opened, err := sealed.Opened(box)
+	if err != nil || opened["hidden"].Value != "s3cr3t" || !opened["hidden"].Secret || opened["plain"].Value != "a" {
+		t.Errorf("The stored keys should open to the originals, received %+v %v.", opened, err)
+	}
+	if _, err := sealed.Opened(nil); err == nil {
+		t.Errorf("Secret values should not open without a key.")
+	}
+	if r, _ := keys.Sealed(nil); r["hidden"].Value != redactedValue {
+		t.Errorf("Without a key the secret values should be redacted, received %+v.", r)
+	}
+}
@@ -2,7 +2,7 @@
 package server
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,8 +13,10 @@ import (
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	// Allow dynamic profiling.
@@ -22,7 +24,9 @@ import (
 
 	"github.com/composer22/coreos-deploy/db"
 	"github.com/composer22/coreos-deploy/etcd2"
+	"github.com/composer22/coreos-deploy/jwt"
 	"github.com/composer22/coreos-deploy/logger"
+	"github.com/composer22/coreos-deploy/trace"
 )
 
 // Server is the main structure that represents a server instance.
@@ -30,23 +34,37 @@ type Server struct {
 	mu sync.RWMutex   // For locking access to server attributes.
 	wg sync.WaitGroup // Synchronize shutdown pending jobs.
 
-	running bool                // Is the server running?
-	opts    *Options            // Original options used to create the server.
-	db      *db.DBConnect       // Database connection
-	etcd2   *etcd2.Etcd2Connect // Etcd2 connection
-	stats   *Status             // Server statistics since it started.
-	srvr    *http.Server        // HTTP server.
-	log     *logger.Logger      // Log instance for recording error and other messages.
+	running    bool                // Is the server running?
+	opts       *Options            // Original options used to create the server.
+	db         *db.DBConnect       // Database connection
+	etcd2      *etcd2.Etcd2Connect // Etcd2 connection
+	secrets    *SecretBox          // Encrypts secret values stored at rest.
+	tokens     *tokenCache         // Cache of validated API tokens.
+	jwt        *jwt.Verifier       // Validates JWT bearer tokens when configured.
+	signatures *signatureCache     // Recently accepted request signatures.
+	certs      *certReloader       // TLS certificates when serving https.
+	approvals  []*approvalRule     // Approvals required to deploy services.
+	webhooks   *webhookDispatcher  // Sends deploy events to webhooks.
+	notifiers  notifiers           // Informed of deploy lifecycle events.
+	slack      *slackNotifier      // Posts deploy events to chat, if configured.
+	tracer     *trace.Tracer       // Exports spans of requests and deploys, if configured.
+	done       chan struct{}       // Closed on shutdown to stop background work.
+	stats      *Status             // Server statistics since it started.
+	srvr       *http.Server        // HTTP server.
+	log        *logger.Logger      // Log instance for recording error and other messages.
 }
 
 // New is a factory function that returns a new server instance.
 func New(ops *Options, l *logger.Logger) *Server {
 	s := &Server{
-		opts:    ops,
-		stats:   NewStatus(),
-		log:     l,
-		running: false,
+		opts:       ops,
+		stats:      NewStatus(),
+		signatures: newSignatureCache(),
+		log:        l,
+		running:    false,
 	}
+	s.tokens = newTokenCache(time.Duration(s.opts.AuthCacheTTL)*time.Second,
+		time.Duration(s.opts.AuthCacheNegTTL)*time.Second)
 
 	if s.opts.Debug {
 		s.log.SetLogLevel(logger.Debug)
@@ -57,12 +75,28 @@ func New(ops *Options, l *logger.Logger) *Server {
 	mux.HandleFunc(httpRouteV1Health, s.healthHandler)
 	mux.HandleFunc(httpRouteV1Info, s.infoHandler)
 	mux.HandleFunc(httpRouteV1Metrics, s.metricsHandler)
-	mux.HandleFunc(httpRouteV1Deploy, s.deployHandler)
+	mux.HandleFunc(httpRouteMetrics, s.prometheusHandler)
+	mux.HandleFunc(httpRouteV1Deploy, s.audited("deploy.create", s.deployHandler))
+	mux.HandleFunc(httpRouteV1Deploy+"/", s.audited("deploy", s.deployActionHandler))
 	mux.HandleFunc(httpRouteV1Status, s.statusHandler)
+	mux.HandleFunc(httpRouteV1History, s.historyHandler)
+	mux.HandleFunc(httpRouteV1Scheduled, s.scheduledHandler)
+	mux.HandleFunc(httpRouteV1DeployReport, s.deployReportHandler)
 	mux.HandleFunc(httpRouteV1ClusterMap, s.clusterMapHandler)
+	mux.HandleFunc(httpRouteV1Tokens, s.audited("token", s.tokensHandler))
+	mux.HandleFunc(httpRouteV1Tokens+"/", s.audited("token", s.tokensHandler))
+	mux.HandleFunc(httpRouteV1SigningClients, s.audited("signing_client", s.signingClientsHandler))
+	mux.HandleFunc(httpRouteV1SigningClients+"/", s.audited("signing_client", s.signingClientsHandler))
+	mux.HandleFunc(httpRouteV1Audit, s.auditHandler)
+	mux.HandleFunc(httpRouteV1Freezes, s.audited("freeze", s.freezesHandler))
+	mux.HandleFunc(httpRouteV1Freezes+"/", s.audited("freeze", s.freezesHandler))
+	mux.HandleFunc(httpRouteV1Webhooks, s.audited("webhook", s.webhooksHandler))
+	mux.HandleFunc(httpRouteV1Webhooks+"/", s.audited("webhook", s.webhooksHandler))
+	mux.HandleFunc(httpRouteV1LogLevel, s.audited("loglevel.set", s.logLevelHandler))
+	rd := NewRedactor(splitList(s.opts.RedactHeaders), splitList(s.opts.RedactPaths), s.opts.LogBodyMax)
 	s.srvr = &http.Server{
 		Addr:         fmt.Sprintf("%s:%d", s.opts.HostName, s.opts.Port),
-		Handler:      &Middleware{serv: s, handler: mux},
+		Handler:      &Middleware{serv: s, handler: mux, redact: rd},
 		ReadTimeout:  TCPReadTimeout,
 		WriteTimeout: TCPWriteTimeout,
 	}
@@ -89,31 +123,116 @@ func (s *Server) Start() error {
 
 	s.mu.Lock()
 
+	// Parse the approvals required for deploys.
+	approvals, err := parseApprovalRules(s.opts.ApprovalRules)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.approvals = approvals
+
+	// Configure the chat notifications of deploys.
+	slack, err := newSlackNotifier(s.opts.SlackTargets, s.opts.SlackToken, s.log)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.slack = slack
+
+	// Configure the export of trace spans.
+	tracer, err := s.newTracer()
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.tracer = tracer
+
+	// Load the key used to encrypt secret values at rest.
+	if s.opts.SecretKeyFile != "" {
+		box, err := LoadSecretBox(s.opts.SecretKeyFile)
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		s.secrets = box
+	}
+
+	// Load the TLS certificates for https.
+	if s.opts.TLSCert != "" {
+		certs, err := newCertReloader(s.opts.TLSCert, s.opts.TLSKey, s.opts.TLSClientCA,
+			s.opts.TLSRequireClientCert)
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		s.certs = certs
+		s.srvr.TLSConfig = certs.tlsConfig()
+	}
+
+	// Load the identity provider keys for JWT authentication.
+	if s.opts.JWTKeySet != "" {
+		v, err := jwt.NewVerifier(s.opts.JWTKeySet, s.opts.JWTAudience, s.opts.JWTIssuer)
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		s.jwt = v
+	}
+
 	// Connect to db
 	db, err := db.NewDBConnect(s.opts.DSN)
 	if err != nil {
 		s.mu.Unlock()
 		return err
 	}
+	db.SetObserver(s.dbObserver())
 	s.db = db
 
 	// Connect to etcd2
-	etcd2, err := etcd2.NewEtcd2Connect(s.opts.Etcd2Endpoint)
+	etcd2, err := etcd2.NewEtcd2Connect(&etcd2.Config{
+		Endpoints:      splitList(s.opts.Etcd2Endpoint),
+		CAFile:         s.opts.Etcd2CAFile,
+		CertFile:       s.opts.Etcd2CertFile,
+		KeyFile:        s.opts.Etcd2KeyFile,
+		Username:       s.opts.Etcd2Username,
+		Password:       s.opts.Etcd2Password,
+		RequestTimeout: s.opts.Etcd2Timeout,
+		DialTimeout:    s.opts.Etcd2DialTimeout,
+		SyncInterval:   s.opts.Etcd2SyncInterval,
+		Observe:        s.etcd2Observer(),
+	})
 	if err != nil {
 		s.mu.Unlock()
 		return err
 	}
 	s.etcd2 = etcd2
+	s.log.Infof("Using etcd2 endpoints: %s", strings.Join(etcd2.Endpoints(), ","))
 
 	// Pprof http endpoint for the profiler.
 	if s.opts.ProfPort > 0 {
 		s.StartProfiler()
 	}
 
+	// Expire deploys that are not approved in time, start scheduled deploys and send webhook events.
+	s.done = make(chan struct{})
+	s.webhooks = newWebhookDispatcher(s.db, s.secrets, s.log)
+	s.notifiers = notifiers{s.webhooks}
+	if s.slack != nil {
+		s.notifiers = append(s.notifiers, s.slack)
+	}
+	go s.expireApprovals(s.done)
+	go s.runScheduler(s.done)
+	go s.webhooks.run(s.done)
+
 	s.stats.Start = time.Now()
 	s.running = true
+	certs := s.certs
 	s.mu.Unlock()
-	err = s.srvr.ListenAndServe()
+	if certs != nil {
+		err = s.srvr.ListenAndServeTLS("", "")
+	} else {
+		err = s.srvr.ListenAndServe()
+	}
 	if err != nil {
 		s.log.Emergencyf("Listen and Server Error: %s", err.Error())
 	}
@@ -138,6 +257,21 @@ func (s *Server) StartProfiler() {
 	}()
 }
 
+// addJob adds a background job to the wait group unless the server is shutting down, and returns
+// whether it did. Shutdown closes done under the lock before it waits, so a job is never added
+// while it waits.
+func (s *Server) addJob() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	select {
+	case <-s.done:
+		return false
+	default:
+	}
+	s.wg.Add(1)
+	return true
+}
+
 // Shutdown takes down the server gracefully back to an initialize state.
 func (s *Server) Shutdown() {
 	if !s.isRunning() {
@@ -146,22 +280,41 @@ func (s *Server) Shutdown() {
 	s.log.Infof("BEGIN server service stop.")
 	s.mu.Lock()
 	s.srvr.SetKeepAlivesEnabled(false)
+	close(s.done)
 	s.wg.Wait()
 	if s.db != nil {
 		s.db.Close()
 	}
+	if s.etcd2 != nil {
+		s.etcd2.Close()
+	}
+	s.tracer.Close()
 	s.running = false
 	s.mu.Unlock()
 	s.log.Infof("END server service stop.")
 }
 
 // handleSignals responds to operating system interrupts such as application kills.
+// SIGHUP reloads the TLS certificates and the JWT key set. SIGUSR1 raises the log level one step toward debug and
+// SIGUSR2 lowers it.
 func (s *Server) handleSignals() {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2)
 	go func() {
 		for sig := range c {
 			s.log.Infof("Server received signal: %v\n", sig)
+			switch sig {
+			case syscall.SIGHUP:
+				s.reloadCerts()
+				s.reloadKeySet()
+				continue
+			case syscall.SIGUSR1:
+				s.shiftLogLevel(1)
+				continue
+			case syscall.SIGUSR2:
+				s.shiftLogLevel(-1)
+				continue
+			}
 			s.Shutdown()
 			s.log.Infof("Server exiting.")
 			os.Exit(0)
@@ -169,6 +322,34 @@ func (s *Server) handleSignals() {
 	}()
 }
 
+// reloadCerts reads the TLS certificate files again so renewed certificates are used for new
+// connections without a restart.
+func (s *Server) reloadCerts() {
+	s.mu.RLock()
+	certs := s.certs
+	s.mu.RUnlock()
+	if certs == nil {
+		return
+	}
+	if err := certs.reload(); err != nil {
+		s.log.Errorf("Unable to reload TLS certificates: %s", err)
+		return
+	}
+	s.log.Infof("TLS certificates reloaded.")
+}
+
+// reloadKeySet reads the JWT key set again so rotated keys are used without a restart.
+func (s *Server) reloadKeySet() {
+	if s.jwt == nil {
+		return
+	}
+	if err := s.jwt.Reload(); err != nil {
+		s.log.Errorf("Unable to reload the JWT key set: %s", err)
+		return
+	}
+	s.log.Infof("JWT key set reloaded.")
+}
+
 // The following methods handle server routes.
 
 // healthHandler handles a client "is the server alive?" request.
@@ -180,7 +361,7 @@ func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
 
 // infoHandler handles a client request for server information.
 func (s *Server) infoHandler(w http.ResponseWriter, r *http.Request) {
-	if s.invalidHeader(w, r) || s.invalidMethod(w, r, httpGet) || s.invalidAuth(w, r) {
+	if s.invalidHeader(w, r) || s.invalidMethod(w, r, httpGet) || s.invalidAuth(w, r, RoleRead) {
 		return
 	}
 
@@ -197,7 +378,7 @@ func (s *Server) infoHandler(w http.ResponseWriter, r *http.Request) {
 
 // metricsHandler handles a client request for server statistics.
 func (s *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
-	if s.invalidHeader(w, r) || s.invalidMethod(w, r, httpGet) || s.invalidAuth(w, r) {
+	if s.invalidHeader(w, r) || s.invalidMethod(w, r, httpGet) || s.invalidAuth(w, r, RoleRead) {
 		return
 	}
 
@@ -207,12 +388,14 @@ func (s *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
 	runtime.ReadMemStats(mStats)
 	b, _ := json.Marshal(
 		&struct {
-			Options *Options          `json:"options"`
-			Stats   *Status           `json:"stats"`
-			Memory  *runtime.MemStats `json:"memStats"`
+			Options *Options                 `json:"options"`
+			Stats   *Status                  `json:"stats"`
+			Latency map[string]*RouteLatency `json:"routeLatency"`
+			Memory  *runtime.MemStats        `json:"memStats"`
 		}{
 			Options: s.opts,
 			Stats:   s.stats,
+			Latency: s.stats.RouteLatencies(time.Now()),
 			Memory:  mStats,
 		})
 	w.Write(b)
@@ -220,7 +403,7 @@ func (s *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
 
 // deployHandler handles a client request for deploying a service to the cluster.
 func (s *Server) deployHandler(w http.ResponseWriter, r *http.Request) {
-	if s.invalidHeader(w, r) || s.invalidMethod(w, r, httpPost) || s.invalidAuth(w, r) {
+	if s.invalidHeader(w, r) || s.invalidMethod(w, r, httpPost) || s.invalidAuth(w, r, RoleDeploy) {
 		return
 	}
 
@@ -237,16 +420,95 @@ func (s *Server) deployHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, InvalidJSONText, http.StatusBadRequest)
 		return
 	}
+	setAudit(r, "", q.ServiceName, "version="+q.Version)
+	if s.invalidService(w, r, q.ServiceName) {
+		return
+	}
+	if invalidMetadata(q.Metadata) {
+		http.Error(w, InvalidMetadata, http.StatusBadRequest)
+		return
+	}
+
+	// A deploy with a time in the future is scheduled to start then.
+	runAt, scheduled := time.Now(), false
+	if q.NotBefore != "" {
+		t, err := time.Parse(time.RFC3339, q.NotBefore)
+		if err != nil {
+			http.Error(w, InvalidNotBefore, http.StatusBadRequest)
+			return
+		}
+		if t.After(runAt) {
+			runAt, scheduled = t, true
+		}
+	}
+
+	// Reject deploys during a freeze window unless an admin overrides it with a reason.
+	freeze, until, err := s.activeFreeze(r.Context(), s.opts.Environment, q.ServiceName, runAt)
+	if err != nil {
+		http.Error(w, DatabaseError, http.StatusInternalServerError)
+		return
+	}
+	if freeze != nil {
+		switch {
+		case !q.FreezeOverride:
+			http.Error(w, frozenMessage(freeze, until), http.StatusLocked)
+			return
+		case !requestIdentity(r).HasRole(RoleAdmin):
+			http.Error(w, OverrideForbidden, http.StatusForbidden)
+			return
+		case q.OverrideReason == "":
+			http.Error(w, OverrideReason, http.StatusBadRequest)
+			return
+		}
+		setAudit(r, "deploy.freeze_override", "", fmt.Sprintf("version=%s freezeID=%d reason=%s", q.Version,
+			freeze.ID, q.OverrideReason))
+		s.log.Warningf("Deploy %s of %s overrides freeze window %d: %s", reqID, q.ServiceName, freeze.ID,
+			q.OverrideReason)
+		q.Overridden = q.OverrideReason
+	}
+	if q.Etcd2Keys.HasSecrets() && s.secrets == nil {
+		s.log.Warningf("Deploy %s has secret etcd2 keys but no secret key file is configured. "+
+			"Secret values will be redacted in the deploy history.", reqID)
+	}
 
 	// Set a few extra values for the deploy processing.
 	q.Domain = s.opts.Domain
 	q.Environment = s.opts.Environment
 	q.DeployID = reqID
+	q.DeployedBy = requestIdentity(r).Name
+	q.Principal = requestIdentity(r).Principal
+	q.RemoteAddr = remoteIP(r)
 	q.Suffix = randomString(suffixSize)
-	q.mu = &s.mu
-	q.wg = &s.wg
-	q.db = s.db
-	q.e2 = s.etcd2
+	s.prepareRequest(trace.Detach(r.Context()), &q)
+
+	// Hold the deploy if it must be approved first or is scheduled for later.
+	if required := requiredApprovals(s.approvals, q.Environment, q.ServiceName); required > 0 || scheduled {
+		if q.Etcd2Keys.HasSecrets() && s.secrets == nil {
+			http.Error(w, SecretKeyRequired, http.StatusConflict)
+			return
+		}
+		resp := &holdResponse{DeployID: reqID, Status: db.Scheduled, ApprovalsRequired: required}
+		if required > 0 {
+			resp.Status = db.PendingApproval
+		}
+		if scheduled {
+			resp.NotBefore = runAt.UTC().Format(dbTimeFormat)
+		}
+
+		// A deploy for later may await approval at least until it is due, rounded up to the second.
+		ttl := s.opts.ApprovalTTL
+		if due := runAt.Sub(time.Now()).Truncate(time.Second) + time.Second; scheduled && ttl > 0 && due > ttl {
+			ttl = due
+		}
+		if err := q.Hold(resp.Status, required, ttl, resp.NotBefore); err != nil {
+			s.log.Errorf("Unable to hold deploy %s: %s", reqID, err)
+			http.Error(w, DatabaseError, http.StatusInternalServerError)
+			return
+		}
+		b, _ := json.Marshal(resp)
+		w.Write(b)
+		return
+	}
 
 	// Evoke a background deploy task.
 	s.wg.Add(1)
@@ -254,32 +516,93 @@ func (s *Server) deployHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(fmt.Sprintf(`{"deployID":"%s"}`, reqID)))
 }
 
+// prepareRequest sets the server resources used by a deploy. The deploy is traced under the span
+// in ctx, if any.
+func (s *Server) prepareRequest(ctx context.Context, q *ServiceRequest) {
+	q.ctx = ctx
+	q.log = s.log.Subsystem(logDeploy).With("deployID", q.DeployID, "service", q.ServiceName, "version", q.Version)
+	q.fleetLog = q.log.Subsystem(logFleet)
+	q.mu = &s.mu
+	q.wg = &s.wg
+	q.db = s.db.WithContext(ctx)
+	q.e2 = s.etcd2
+	q.fleetctl = fleetctl
+	q.secrets = s.secrets
+	q.notifier = s.notifiers
+}
+
 // statusHandler handles a client request for checking on a previous deploy status.
 func (s *Server) statusHandler(w http.ResponseWriter, r *http.Request) {
-	if s.invalidHeader(w, r) || s.invalidMethod(w, r, httpGet) || s.invalidAuth(w, r) {
+	if s.invalidHeader(w, r) || s.invalidMethod(w, r, httpGet) || s.invalidAuth(w, r, RoleRead) {
 		return
 	}
 
 	// Get the ID from the query parameters and perform a lookup.
 	_, deployID := filepath.Split(r.URL.Path)
-	result, err := s.db.QueryDeploy(deployID)
+	d := s.db.WithContext(r.Context())
+	result, err := d.QueryDeploy(deployID)
 
 	// Format the response data.
 	if err != nil {
 		w.Write([]byte(fmt.Sprintf(`{"id":%s,"error":"%s"}`, deployID, err)))
 		return
 	}
+	if s.invalidService(w, r, result.ServiceName) {
+		return
+	}
+	if result.Required > 0 {
+		result.Approvals, _ = d.QueryApprovals(deployID)
+	}
+	result.Steps, _ = d.QueryDeploySteps(deployID)
+	b, _ := json.Marshal(result)
+	w.Write(b)
+}
+
+// historyHandler handles a client request for previous deploys, newest first. The query parameters
+// service, deployedBy and status filter the deploys and limit changes the count.
+func (s *Server) historyHandler(w http.ResponseWriter, r *http.Request) {
+	if s.invalidHeader(w, r) || s.invalidMethod(w, r, httpGet) || s.invalidAuth(w, r, RoleRead) {
+		return
+	}
+
+	qs := r.URL.Query()
+	f := &db.DeployFilter{
+		ServiceName: qs.Get("service"),
+		DeployedBy:  qs.Get("deployedBy"),
+		Limit:       historyDefaultLimit,
+		Allows:      requestIdentity(r).AllowsService,
+	}
+	var err error
+	if st := qs.Get("status"); st != "" {
+		if f.Status, err = strconv.Atoi(st); err != nil {
+			http.Error(w, InvalidQueryString, http.StatusBadRequest)
+			return
+		}
+	}
+	if l := qs.Get("limit"); l != "" {
+		if f.Limit, err = strconv.Atoi(l); err != nil || f.Limit < 1 || f.Limit > historyMaxLimit {
+			http.Error(w, InvalidQueryString, http.StatusBadRequest)
+			return
+		}
+	}
+
+	result, err := s.db.WithContext(r.Context()).QueryDeploys(f)
+	if err != nil {
+		http.Error(w, DatabaseError, http.StatusInternalServerError)
+		return
+	}
 	b, _ := json.Marshal(result)
 	w.Write(b)
 }
 
 // clusterMapHandler handles a client request for a machine map of the cluster.
 func (s *Server) clusterMapHandler(w http.ResponseWriter, r *http.Request) {
-	if s.invalidHeader(w, r) || s.invalidMethod(w, r, httpGet) || s.invalidAuth(w, r) {
+	if s.invalidHeader(w, r) || s.invalidMethod(w, r, httpGet) || s.invalidAuth(w, r, RoleRead) {
 		return
 	}
 
-	result, err := GetClusterInfo(r.URL.Query().Get("mq"), r.URL.Query().Get("uq"))
+	log := s.log.Subsystem(logFleet).With("requestID", w.Header().Get("X-Request-ID"))
+	result, err := GetClusterInfo(r.Context(), log, r.URL.Query().Get("mq"), r.URL.Query().Get("uq"))
 	if err != nil {
 		http.Error(w, fmt.Sprintf("%s err: %s", InvalidQueryString, err.Error()), http.StatusNotAcceptable)
 		return
@@ -300,11 +623,18 @@ func (s *Server) initResponseHeader(w http.ResponseWriter) {
 }
 
 // incrementStats increments the statistics for the request being handled by the server.
-func (s *Server) incrementStats(r *http.Request) {
+func (s *Server) incrementStats(r *http.Request, route string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.stats.IncrRequestStats(r.ContentLength)
-	s.stats.IncrRouteStats(r.URL.Path, r.ContentLength)
+	s.stats.IncrRouteStats(route, r.ContentLength)
+}
+
+// incrementResponseStats increments the statistics for the response sent by the server.
+func (s *Server) incrementResponseStats(route string, code int, wb int64, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.IncrResponseStats(route, code, wb, d, time.Now())
 }
 
 // invalidHeader validates that the header information is acceptable for processing the
@@ -327,14 +657,27 @@ func (s *Server) invalidMethod(w http.ResponseWriter, r *http.Request, method st
 	return false
 }
 
-// invalidAuth validates that the Authorization token is valid for using the API
-func (s *Server) invalidAuth(w http.ResponseWriter, r *http.Request) bool {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if !s.db.ValidAuth(strings.Replace(r.Header.Get("Authorization"), "Bearer ", "", -1)) {
+// invalidAuth validates that the request has been authenticated and that the caller has been
+// granted the role required by the route.
+func (s *Server) invalidAuth(w http.ResponseWriter, r *http.Request, role string) bool {
+	id := requestIdentity(r)
+	if id == nil {
 		http.Error(w, InvalidAuthorization, http.StatusUnauthorized)
 		return true
 	}
+	if !id.HasRole(role) {
+		http.Error(w, Forbidden, http.StatusForbidden)
+		return true
+	}
+	return false
+}
+
+// invalidService validates that the caller is permitted to act upon the service name.
+func (s *Server) invalidService(w http.ResponseWriter, r *http.Request, serviceName string) bool {
+	if id := requestIdentity(r); id == nil || !id.AllowsService(serviceName) {
+		http.Error(w, Forbidden, http.StatusForbidden)
+		return true
+	}
 	return false
 }
 
@@ -359,31 +702,26 @@ type requestLogEntry struct {
 	Trailer       http.Header `json:"trailer"`
 }
 
-// LogRequest logs the http request information into the logger.
-func (s *Server) LogRequest(r *http.Request) {
+// LogRequest logs the http request information into the logger with the request ID as context.
+// Sensitive headers and body values are masked by the redactor before they are written.
+func (s *Server) LogRequest(r *http.Request, requestID string, rd *Redactor) {
 	var cl int64
 
 	if r.ContentLength > 0 {
 		cl = r.ContentLength
 	}
 
-	bd, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		bd = []byte("Could not parse body")
-	}
-	r.Body = ioutil.NopCloser(bytes.NewBuffer(bd)) // We need to set the body back after we read it.
-
-	b, _ := json.Marshal(&requestLogEntry{
+	bd := readBody(r) // The body is set back after it is read.
+	s.log.Subsystem(logHTTP).Logw(logger.Info, "Request received.", "requestID", requestID, "request", &requestLogEntry{
 		Method:        r.Method,
 		URL:           r.URL,
 		Proto:         r.Proto,
-		Header:        r.Header,
-		Body:          string(bd),
+		Header:        rd.Header(r.Header),
+		Body:          rd.Body(bd),
 		ContentLength: cl,
 		Host:          r.Host,
 		RemoteAddr:    r.RemoteAddr,
 		RequestURI:    r.RequestURI,
-		Trailer:       r.Trailer,
+		Trailer:       rd.Header(r.Trailer),
 	})
-	s.log.Infof(`{"request":%s}`, string(b))
 }
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/composer22/coreos-deploy/db"
+)
+
+func TestHistoryScoping(t *testing.T) {
+	t.Parallel()
+	s, f := newFakeServer(t)
+	deploys := []*db.DeployStatus{
+		{DeployID: "D5", ServiceName: "other-db", Status: db.Success},
+		{DeployID: "D4", ServiceName: "acme-web", Status: db.Success},
+		{DeployID: "D3", ServiceName: "other-web", Status: db.Success},
+		{DeployID: "D2", ServiceName: "other-api", Status: db.Success},
+		{DeployID: "D1", ServiceName: "acme-api", Status: db.Success},
+	}
+	var mu sync.Mutex
+	var pages []string
+	f.on("FROM deploys", func(args []driver.Value) *fakeResult {
+		limit, offset := int(args[len(args)-2].(int64)), int(args[len(args)-1].(int64))
+		mu.Lock()
+		pages = append(pages, fmt.Sprintf("%d@%d", limit, offset))
+		mu.Unlock()
+		page := make([]*db.DeployStatus, 0)
+		for i := offset; i < offset+limit && i < len(deploys); i++ {
+			page = append(page, deploys[i])
+		}
+		return deployRow(page...)
+	})
+
+	tests := []struct {
+		pattern string
+		query   string
+		want    []string
+		pages   []string // The pages read, as limit@offset.
+	}{
+		{"", "?limit=2", []string{"D5", "D4"}, []string{"2@0"}},
+		{"acme-*", "?limit=2", []string{"D4", "D1"}, []string{"2@0", "2@2", "2@4"}},
+		{"acme-*", "?limit=1", []string{"D4"}, []string{"1@0", "1@1"}},
+		{"*-api", "", []string{"D2", "D1"}, []string{"50@0"}},
+		{"none-*", "?limit=2", []string{}, []string{"2@0", "2@2", "2@4"}},
+	}
+	for _, tc := range tests {
+		mu.Lock()
+		pages = nil
+		mu.Unlock()
+		w := httptest.NewRecorder()
+		id := &Identity{Name: "viewer", Role: RoleRead, ServicePattern: tc.pattern}
+		s.historyHandler(w, requestAs(httpGet, httpRouteV1History+tc.query, "", id))
+		if w.Code != http.StatusOK {
+			t.Fatalf("History should return %d, received %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		var result []*db.DeployStatus
+		json.Unmarshal(w.Body.Bytes(), &result)
+		received := make([]string, 0)
+		for _, st := range result {
+			received = append(received, st.DeployID)
+		}
+		if len(received) != len(tc.want) {
+			t.Errorf("Pattern %q with %q should list %v, received %v.", tc.pattern, tc.query, tc.want, received)
+			continue
+		}
+		for i := range received {
+			if received[i] != tc.want[i] {
+				t.Errorf("Pattern %q with %q should list %v, received %v.", tc.pattern, tc.query, tc.want, received)
+				break
+			}
+		}
+		mu.Lock()
+		if fmt.Sprint(pages) != fmt.Sprint(tc.pages) {
+			t.Errorf("Pattern %q with %q should read the pages %v, received %v.", tc.pattern, tc.query, tc.pages,
+				pages)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestStatusScoping(t *testing.T) {
+	t.Parallel()
+	s, _, _ := newDeploysServer(t, &db.DeployStatus{DeployID: "D1", ServiceName: "acme-web", Status: db.Success,
+		Log: "Deploy log."})
+
+	tests := []struct {
+		pattern string
+		code    int
+	}{
+		{"", http.StatusOK},
+		{"acme-*", http.StatusOK},
+		{"other-*", http.StatusForbidden},
+	}
+	for _, tc := range tests {
+		w := httptest.NewRecorder()
+		id := &Identity{Name: "viewer", Role: RoleRead, ServicePattern: tc.pattern}
+		s.statusHandler(w, requestAs(httpGet, httpRouteV1Status+"D1", "", id))
+		if w.Code != tc.code {
+			t.Errorf("Pattern %q should return %d, received %d: %s", tc.pattern, tc.code, w.Code, w.Body.String())
+		}
+		if tc.code == http.StatusForbidden && strings.Contains(w.Body.String(), "Deploy log.") {
+			t.Errorf("Pattern %q should not see the deploy, received %s", tc.pattern, w.Body.String())
+		}
+	}
+}
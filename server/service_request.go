@@ -1,6 +1,8 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -8,9 +10,13 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/composer22/coreos-deploy/db"
 	"github.com/composer22/coreos-deploy/etcd2"
+	"github.com/composer22/coreos-deploy/logger"
+	"github.com/composer22/coreos-deploy/trace"
 )
 
 const (
@@ -25,7 +31,15 @@ type ServiceRequest struct {
 	Version         string              `json:"version"`         // The version of the deploy.
 	NumInstances    int                 `json:"numInstances"`    // The number of instances to deploy.
 	ServiceTemplate string              `json:"serviceTemplate"` // Source code for the unit template.
-	Etcd2Keys       map[string]string   `json:"etcd2Keys"`       // etcd2 keys to update.
+	Etcd2Keys       Etcd2Keys           `json:"etcd2Keys"`       // etcd2 keys to update.
+	Metadata        map[string]string   `json:"metadata"`        // Optional client information, ex: reason, ticket.
+	FreezeOverride  bool                `json:"freezeOverride"`  // Deploy during a freeze window (admin only).
+	OverrideReason  string              `json:"overrideReason"`  // Why the freeze window is overridden.
+	NotBefore       string              `json:"notBefore"`       // Optional RFC 3339 time to start the deploy.
+	DeployedBy      string              `json:"-"`               // The name of the identity requesting the deploy.
+	Principal       string              `json:"-"`               // The unique key of the identity requesting the deploy.
+	RemoteAddr      string              `json:"-"`               // The address the deploy was requested from.
+	Overridden      string              `json:"-"`               // Why an admin deployed during a freeze window, once allowed.
 	Suffix          string              `json:"-"`               // A unique suffix for the new service.
 	Domain          string              `json:"-"`               // What domain this cluster is serving.
 	Environment     string              `json:"-"`               // The environment (dev, stage, prod, etc).
@@ -33,11 +47,20 @@ type ServiceRequest struct {
 	mu              *sync.RWMutex       `json:"-"`               // One deploy at a time for this server.
 	wg              *sync.WaitGroup     `json:"-"`               // The wait group.
 	db              *db.DBConnect       `json:"-"`               // The DB connection for status updates.
-	e2              *etcd2.Etcd2Connect `json:"-"`               // The etcd2 connection point.
+	e2              etcd2.KeyValueStore `json:"-"`               // The etcd2 connection point.
+	fleetctl        string              `json:"-"`               // The fleetctl command run by the deploy.
+	previous        map[string]string   `json:"-"`               // The etcd2 keys as they were before the deploy.
+	secrets         *SecretBox          `json:"-"`               // Encrypts secret keys for storage.
+	notifier        Notifier            `json:"-"`               // Informed of the start and result of the deploy.
+	started         time.Time           `json:"-"`               // When the deploy began running.
+	ctx             context.Context     `json:"-"`               // Holds the span the deploy is traced under, if any.
+	log             *logger.Logger      `json:"-"`               // Tags each entry with the deploy ID, service and version.
+	fleetLog        *logger.Logger      `json:"-"`               // Logs the fleetctl commands of the deploy.
+	current         *db.DeployStep      `json:"-"`               // The step being run, if any.
 }
 
 // NewServiceRequest is a factory function that returns a ServiceRequest instance.
-func NewServiceRequest(name string, vers string, instances int, template string, keys map[string]string) *ServiceRequest {
+func NewServiceRequest(name string, vers string, instances int, template string, keys Etcd2Keys) *ServiceRequest {
 	return &ServiceRequest{
 		ServiceName:     name,
 		Version:         vers,
@@ -50,54 +73,237 @@ func NewServiceRequest(name string, vers string, instances int, template string,
 // Deploy is a go routine that attempts to update etcd2 and/or run fleetctl to start a service in coreOS.
 func (r *ServiceRequest) Deploy() {
 	defer r.wg.Done()
+	r.lock()
+	defer r.unlock()
+
+	// Write the start of job record to the DB. Secret keys are never stored as plain text.
+	storedKeys, err := r.Etcd2Keys.Sealed(r.secrets)
+	if err != nil {
+		storedKeys = r.Etcd2Keys.Redacted()
+	}
+	r.db.StartDeploy(r.DeployID, r.Domain, r.Environment, r.ServiceName, r.Version, r.NumInstances,
+		r.ServiceTemplate, storedKeys, r.Suffix, r.DeployedBy, r.Principal, r.RemoteAddr, r.Metadata,
+		r.Overridden)
+	r.run()
+}
+
+// Hold records the deploy so that it runs later: once it has been approved if the status is
+// PendingApproval, or at notBefore (a UTC datetime) if Scheduled. The secret keys are encrypted
+// rather than redacted as they are needed when the deploy resumes.
+func (r *ServiceRequest) Hold(status int, approvalsRequired int, ttl time.Duration, notBefore string) error {
+	storedKeys := r.Etcd2Keys
+	if r.Etcd2Keys.HasSecrets() {
+		if r.secrets == nil {
+			return errors.New("a secret key is required to hold secret etcd2 keys")
+		}
+		var err error
+		if storedKeys, err = r.Etcd2Keys.Sealed(r.secrets); err != nil {
+			return err
+		}
+	}
+	return r.db.HoldDeploy(r.DeployID, r.Domain, r.Environment, r.ServiceName, r.Version, r.NumInstances,
+		r.ServiceTemplate, storedKeys, r.Suffix, r.DeployedBy, r.Principal, r.RemoteAddr, r.Metadata,
+		r.Overridden, status, approvalsRequired, int64(ttl/time.Second), notBefore)
+}
+
+// Resume is a go routine that runs a deploy that was held and has since been marked as started.
+func (r *ServiceRequest) Resume() {
+	defer r.wg.Done()
+	r.lock()
+	defer r.unlock()
+	r.run()
+}
+
+// lock waits for other deploys on the server to finish, counting the deploy as queued meanwhile.
+func (r *ServiceRequest) lock() {
+	atomic.AddInt64(&deploysQueued, 1)
 	r.mu.Lock()
-	defer r.mu.Unlock()
+	atomic.AddInt64(&deploysQueued, -1)
+	atomic.AddInt64(&deploysRunning, 1)
+}
 
-	var log string = ""
+// unlock lets the next deploy on the server run.
+func (r *ServiceRequest) unlock() {
+	atomic.AddInt64(&deploysRunning, -1)
+	r.mu.Unlock()
+}
 
-	// Write the start of job record to the DB.
-	r.db.StartDeploy(r.DeployID, r.Domain, r.Environment, r.ServiceName, r.Version, r.NumInstances,
-		r.ServiceTemplate, r.Etcd2Keys, r.Suffix)
+// rollbackError is returned by flipAB when the new service could not be started, and its instances
+// were removed and the etcd2 keys restored, leaving the previous service running.
+type rollbackError struct {
+	err error
+}
+
+func (e *rollbackError) Error() string {
+	return e.err.Error()
+}
+
+// notify informs the notifier, if any, of an event of the deploy. The log is given once the deploy
+// has completed.
+func (r *ServiceRequest) notify(event string, status int, msg string, log string) {
+	if r.notifier == nil {
+		return
+	}
+	e := &DeployEvent{
+		Event:       event,
+		DeployID:    r.DeployID,
+		ServiceName: r.ServiceName,
+		Version:     r.Version,
+		Domain:      r.Domain,
+		Environment: r.Environment,
+		Status:      status,
+		Message:     msg,
+		DeployedBy:  r.DeployedBy,
+		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+		Log:         log,
+	}
+	if event != EventDeployStarted {
+		e.Duration = time.Since(r.started).Seconds()
+	}
+	r.notifier.Notify(e)
+}
+
+// finish records the result of the deploy in the DB and informs the notifier.
+func (r *ServiceRequest) finish(status int, msg string, log string) {
+	span := trace.FromContext(r.ctx)
+	span.SetAttr("deploy.status", statusName(status))
+	if status != db.Success {
+		span.SetError(errors.New(msg))
+	}
+	r.db.UpdateDeploy(r.DeployID, status, msg, log)
+	if status == db.Success {
+		r.log.Infof("Deploy finished: %s", msg)
+	} else {
+		r.log.Errorf("Deploy ended with status %s: %s", statusName(status), msg)
+	}
+	deploysTotal.Inc(r.ServiceName, statusName(status))
+	deployDuration.Observe(time.Since(r.started).Seconds(), r.ServiceName, statusName(status))
+	switch status {
+	case db.Success:
+		r.notify(EventDeploySucceeded, status, msg, log)
+	case db.RolledBack:
+		r.notify(EventDeployRolledBack, status, msg, log)
+	default:
+		r.notify(EventDeployFailed, status, msg, log)
+	}
+}
+
+// step begins the span of a step of the deploy and records its start in the DB.
+func (r *ServiceRequest) step(name string) (context.Context, *trace.Span) {
+	r.current = &db.DeployStep{DeployID: r.DeployID, Name: name}
+	if err := r.db.StartDeployStep(r.current); err != nil {
+		r.log.Errorf("Unable to record the start of step %s: %s", name, err)
+	}
+	return trace.Start(r.ctx, "deploy."+name)
+}
+
+// endStep ends the span of the step being run with its error, if any, and records its result in
+// the DB.
+func (r *ServiceRequest) endStep(span *trace.Span, err error) {
+	span.SetError(err)
+	span.End()
+	s := r.current
+	r.current = nil
+	switch err.(type) {
+	case nil:
+		s.Status = db.Success
+	case *rollbackError:
+		s.Status = db.RolledBack
+	default:
+		s.Status = db.Failed
+	}
+	if s.ID == 0 {
+		return // The start of the step was not recorded.
+	}
+	if err := r.db.EndDeployStep(s); err != nil {
+		r.log.Errorf("Unable to record the end of step %s: %s", s.Name, err)
+	}
+}
+
+// runFleetctl runs fleetctl with the arguments and adds the command and its output to the step
+// being run.
+func (r *ServiceRequest) runFleetctl(ctx context.Context, args ...string) (string, error) {
+	cmd := exec.Command(r.fleetctl, args...)
+	result, err := runCmd(ctx, r.fleetLog, cmd)
+	if s := r.current; s != nil {
+		s.Command += strings.Join(cmd.Args, " ") + "\n"
+		s.Stdout += result.stdout
+		s.Stderr += result.stderr
+		s.ExitCode = &result.exitCode
+	}
+	if result.stderr != "" {
+		return "", err
+	}
+	return result.stdout, err
+}
+
+// run performs the steps of the deploy and records the result in the DB.
+func (r *ServiceRequest) run() {
+	var log string = ""
+	var span *trace.Span
+	r.ctx, span = trace.Start(r.ctx, "deploy")
+	span.SetAttr("deploy.id", r.DeployID)
+	span.SetAttr("service.name", r.ServiceName)
+	span.SetAttr("service.version", r.Version)
+	span.SetAttr("deploy.environment", r.Environment)
+	defer span.End()
+	r.db = r.db.WithContext(r.ctx)
+	r.started = time.Now()
+	r.log.Infof("Deploy started.")
+	r.notify(EventDeployStarted, db.Started, "Start deploy.", "")
 
 	// Save service unit code.
 	log += "Saving service unit code to temp file.\n"
 	serviceFileName := fmt.Sprintf("%s-%s-%s@.service", r.ServiceName, r.Version, r.Suffix)
 	serviceFilePath := fmt.Sprintf("%s%s", tmpDir, serviceFileName)
+	_, stepSpan := r.step("write_unit")
 	err := ioutil.WriteFile(serviceFilePath, []byte(r.ServiceTemplate), 0644)
+	r.endStep(stepSpan, err)
 	if err != nil {
 		msg := "Unable to write service unit file to temp."
 		log += fmt.Sprintf("ERR: %s\n%s\n", msg, err)
-		r.db.UpdateDeploy(r.DeployID, db.Failed, msg, log)
+		r.finish(db.Failed, msg, log)
 		return
 	}
 
-	// Apply etcd2 key changes.
+	// Apply etcd2 key changes, keeping the values they replace in case the deploy is rolled back.
 	log += "Applying etcd2 key changes.\n"
-	if err := r.e2.Set(r.Etcd2Keys); err != nil {
+	ctx, stepSpan := r.step("apply_keys")
+	names := make([]string, 0, len(r.Etcd2Keys))
+	for name := range r.Etcd2Keys {
+		names = append(names, name)
+	}
+	if r.previous, err = r.e2.Lookup(ctx, names); err == nil {
+		err = r.e2.Set(ctx, r.Etcd2Keys.Values())
+	}
+	r.endStep(stepSpan, err)
+	if err != nil {
 		msg := "Unable to apply etcd2 key changes."
 		log += fmt.Sprintf("ERR: %s\n%s\n", msg, err)
-		r.db.UpdateDeploy(r.DeployID, db.Failed, msg, log)
+		r.finish(db.Failed, msg, log)
 		return
 	}
 
 	// Install service template.
 	log += "Install service template.\n"
-	cmd := exec.Command(fleetctl, "destroy", serviceFileName)
-	if _, err := execCmd(cmd); err != nil {
+	ctx, stepSpan = r.step("install_template")
+	if _, err := r.runFleetctl(ctx, "destroy", serviceFileName); err != nil {
 		msg := err.Error()
 		if msg != "exit status 1" && !strings.Contains(msg, "unit does not exist") {
 			msg = "Unable to destroy previous service for new template."
 			log += fmt.Sprintf("ERR: %s\n%s\n", msg, err)
-			r.db.UpdateDeploy(r.DeployID, db.Failed, msg, log)
+			r.endStep(stepSpan, err)
+			r.finish(db.Failed, msg, log)
 			return
 		}
 	}
 
-	cmd = exec.Command(fleetctl, "submit", serviceFilePath)
-	if _, err := execCmd(cmd); err != nil {
+	_, err = r.runFleetctl(ctx, "submit", serviceFilePath)
+	r.endStep(stepSpan, err)
+	if err != nil {
 		msg := "Unable to submit service template."
 		log += fmt.Sprintf("ERR: %s\n%s\n", msg, err)
-		r.db.UpdateDeploy(r.DeployID, db.Failed, msg, log)
+		r.finish(db.Failed, msg, log)
 		return
 	}
 
@@ -106,21 +312,27 @@ func (r *ServiceRequest) Deploy() {
 
 	// Start new services in the cluster.
 	log += "Performing A/B rotation of service.\n"
-	if err := r.flipAB(); err != nil {
-		msg := "Unable to perform A/B rotation of service."
+	ctx, stepSpan = r.step("flip_ab")
+	err = r.flipAB(ctx)
+	r.endStep(stepSpan, err)
+	if err != nil {
+		msg, status := "Unable to perform A/B rotation of service.", db.Failed
+		if _, ok := err.(*rollbackError); ok {
+			msg, status = "Unable to start the new service. Rolled back to the previous service.", db.RolledBack
+		}
 		log += fmt.Sprintf("ERR: %s\n%s\n", msg, err)
-		r.db.UpdateDeploy(r.DeployID, db.Failed, msg, log)
+		r.finish(status, msg, log)
 		return
 	}
 
 	// Update the job record with a success.
 	msg := "Service deployed successfully."
 	log += fmt.Sprintf("SUCCESS: %s\n", msg)
-	r.db.UpdateDeploy(r.DeployID, db.Success, msg, log)
+	r.finish(db.Success, msg, log)
 }
 
 // flipAB instantiates new instance using the service template and takes down previous services.
-func (r *ServiceRequest) flipAB() error {
+func (r *ServiceRequest) flipAB(ctx context.Context) error {
 	// Initialize keys
 	currentCycleKey := fmt.Sprintf(etc2CurrentCycleTmpl, r.Domain, r.ServiceName)
 	currentUnitKey := fmt.Sprintf(etc2CurrentUnitTmpl, r.Domain, r.ServiceName)
@@ -131,10 +343,10 @@ func (r *ServiceRequest) flipAB() error {
 	etc2Keys[currentCycleKey] = "B"
 	etc2Keys[currentUnitKey] = "*coreos-deploy-noop"
 	etc2Keys[currentCountKey] = "0"
-	r.e2.Make(etc2Keys)
+	r.e2.Make(ctx, etc2Keys)
 
 	// Get current cycle info.
-	etc2Keys, err := r.e2.Get(etc2Keys)
+	etc2Keys, err := r.e2.Get(ctx, etc2Keys)
 	if err != nil {
 		return err
 	}
@@ -145,41 +357,74 @@ func (r *ServiceRequest) flipAB() error {
 		newCycle = "B"
 	}
 
-	// Start n new instances in the cluster.
+	// Start n new instances in the cluster. If one does not start and a previous service is running,
+	// the deploy is rolled back to it.
+	cc, _ := strconv.Atoi(etc2Keys[currentCountKey])
+	hasPrevious := etc2Keys[currentUnitKey] != "*coreos-deploy-noop" && cc > 0
 	for i := 1; i <= r.NumInstances; i++ {
 		serviceCmd := fmt.Sprintf("%s-%s-%s@%s%d.service", r.ServiceName, r.Version, r.Suffix, newCycle, i)
-		cmd := exec.Command(fleetctl, "stop", serviceCmd)
-		execCmd(cmd)
-		cmd = exec.Command(fleetctl, "destroy", serviceCmd)
-		execCmd(cmd)
-		cmd = exec.Command(fleetctl, "start", serviceCmd)
-		if _, err := execCmd(cmd); err != nil {
-			return err
+		r.runFleetctl(ctx, "stop", serviceCmd)
+		r.runFleetctl(ctx, "destroy", serviceCmd)
+		r.log.Debugf("Starting %s.", serviceCmd)
+		if _, err := r.runFleetctl(ctx, "start", serviceCmd); err != nil {
+			if !hasPrevious {
+				return err
+			}
+			r.log.Warningf("Unable to start %s, rolling back: %s", serviceCmd, err)
+			if rerr := r.rollback(ctx, newCycle, i); rerr != nil {
+				return fmt.Errorf("%s; unable to roll back: %s", err, rerr)
+			}
+			return &rollbackError{err}
 		}
 	}
 
 	// Take down old services.
-	if etc2Keys[currentUnitKey] != "*coreos-deploy-noop" {
-		cc, _ := strconv.Atoi(etc2Keys[currentCountKey])
+	if hasPrevious {
 		for i := 1; i <= cc; i++ {
 			serviceCmd := fmt.Sprintf("%s@%s%d.service", etc2Keys[currentUnitKey], etc2Keys[currentCycleKey], i)
-			fmt.Println(serviceCmd)
-			cmd := exec.Command(fleetctl, "stop", serviceCmd)
-			execCmd(cmd)
-			cmd = exec.Command(fleetctl, "destroy", serviceCmd)
-			execCmd(cmd)
+			r.log.Debugf("Stopping previous %s.", serviceCmd)
+			r.runFleetctl(ctx, "stop", serviceCmd)
+			r.runFleetctl(ctx, "destroy", serviceCmd)
 		}
 		// Destroy old template.
-		cmd := exec.Command(fleetctl, "destroy", fmt.Sprintf("%s@.service", etc2Keys[currentUnitKey]))
-		execCmd(cmd)
+		r.runFleetctl(ctx, "destroy", fmt.Sprintf("%s@.service", etc2Keys[currentUnitKey]))
 	}
 
 	// Set current cycle to new values for next time.
 	etc2Keys[currentCycleKey] = newCycle
 	etc2Keys[currentUnitKey] = fmt.Sprintf("%s-%s-%s", r.ServiceName, r.Version, r.Suffix)
 	etc2Keys[currentCountKey] = strconv.Itoa(r.NumInstances)
-	if err := r.e2.Set(etc2Keys); err != nil {
+	if err := r.e2.Set(ctx, etc2Keys); err != nil {
 		return err
 	}
 	return nil
 }
+
+// rollback stops and destroys the first n instances of the new service in the cycle and its template,
+// then restores the etcd2 keys changed by the deploy, leaving the previous service running. A key
+// that did not exist before the deploy is removed.
+func (r *ServiceRequest) rollback(ctx context.Context, cycle string, n int) error {
+	unit := fmt.Sprintf("%s-%s-%s", r.ServiceName, r.Version, r.Suffix)
+	for i := 1; i <= n; i++ {
+		serviceCmd := fmt.Sprintf("%s@%s%d.service", unit, cycle, i)
+		r.runFleetctl(ctx, "stop", serviceCmd)
+		r.runFleetctl(ctx, "destroy", serviceCmd)
+	}
+	r.runFleetctl(ctx, "destroy", fmt.Sprintf("%s@.service", unit))
+
+	added := make([]string, 0)
+	for name := range r.Etcd2Keys {
+		if _, ok := r.previous[name]; !ok {
+			added = append(added, name)
+		}
+	}
+	if len(r.previous) > 0 {
+		if err := r.e2.Set(ctx, r.previous); err != nil {
+			return err
+		}
+	}
+	if len(added) > 0 {
+		return r.e2.Delete(ctx, added)
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/composer22/coreos-deploy/db"
+)
+
+func TestEndStep(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{nil, db.Success},
+		{errors.New("unit file not found"), db.Failed},
+		{&rollbackError{errors.New("start failed")}, db.RolledBack},
+	}
+	for _, tc := range tests {
+		s := &db.DeployStep{Name: "flip_ab"}
+		r := &ServiceRequest{current: s}
+		r.endStep(nil, tc.err)
+		if s.Status != tc.status || r.current != nil {
+			t.Errorf("%v should end the step with status %d, received %d.", tc.err, tc.status, s.Status)
+		}
+	}
+}
+
+// fakeKeyStore holds etcd2 keys in memory.
+type fakeKeyStore struct {
+	mu   sync.Mutex
+	keys map[string]string
+}
+
+func (f *fakeKeyStore) Set(ctx context.Context, data map[string]string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for k, v := range data {
+		f.keys[k] = v
+	}
+	return nil
+}
+
+func (f *fakeKeyStore) Make(ctx context.Context, data map[string]string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for k, v := range data {
+		if _, ok := f.keys[k]; !ok {
+			f.keys[k] = v
+		}
+	}
+	return nil
+}
+
+func (f *fakeKeyStore) Get(ctx context.Context, data map[string]string) (map[string]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	result := make(map[string]string)
+	for k := range data {
+		v, ok := f.keys[k]
+		if !ok {
+			return nil, fmt.Errorf("key not found: %s", k)
+		}
+		result[k] = v
+	}
+	return result, nil
+}
+
+func (f *fakeKeyStore) Lookup(ctx context.Context, keys []string) (map[string]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	result := make(map[string]string)
+	for _, k := range keys {
+		if v, ok := f.keys[k]; ok {
+			result[k] = v
+		}
+	}
+	return result, nil
+}
+
+func (f *fakeKeyStore) Delete(ctx context.Context, keys []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, k := range keys {
+		delete(f.keys, k)
+	}
+	return nil
+}
+
+// eventRecorder records the events of a deploy.
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (n *eventRecorder) Notify(e *DeployEvent) {
+	n.mu.Lock()
+	n.events = append(n.events, e.Event)
+	n.mu.Unlock()
+}
+
+// fakeFleetctl writes a fleetctl script to the directory that appends each command to a log and fails
+// the command given, if any. It returns the paths of the script and the log.
+func fakeFleetctl(t *testing.T, dir string, failed string) (string, string) {
+	script, log := filepath.Join(dir, "fleetctl"), filepath.Join(dir, "fleetctl.log")
+	body := fmt.Sprintf("#!/bin/sh\necho \"$*\" >> %s\nif [ \"$*\" = \"%s\" ]; then\n"+
+		"  echo \"unit failed\" >&2\n  exit 1\nfi\n", log, failed)
+	if err := ioutil.WriteFile(script, []byte(body), 0755); err != nil {
+		t.Fatalf("Unable to write the fleetctl script: %s", err)
+	}
+	return script, log
+}
+
+// TestFlipAB runs a deploy against a fake fleetctl and etcd2, checking a deploy whose new service does
+// not start is rolled back only when a previous service is running.
+func TestFlipAB(t *testing.T) {
+	t.Parallel()
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		t.Fatalf("Unable to make %s: %s", tmpDir, err)
+	}
+	const (
+		cycleKey = "/example.com/apps/services/acme-web/current-cycle"
+		unitKey  = "/example.com/apps/services/acme-web/current-cycle-unit"
+		countKey = "/example.com/apps/services/acme-web/current-cycle-count"
+	)
+	running := map[string]string{cycleKey: "A", unitKey: "acme-web-0.9-old", countKey: "2", "/acme-web/db": "old"}
+	tests := []struct {
+		name     string
+		keys     map[string]string // In etcd2 before the deploy.
+		failed   string            // The fleetctl command that fails, if any.
+		status   int
+		event    string
+		after    map[string]string // Keys expected in etcd2 after the deploy.
+		commands []string          // Expected in the fleetctl log.
+		teardown string            // The fleetctl log after the failed command.
+	}{
+		{"success", running, "", db.Success, EventDeploySucceeded,
+			map[string]string{cycleKey: "B", unitKey: "acme-web-1.0-new", countKey: "2", "/acme-web/db": "new",
+				"/acme-web/cache": "on"},
+			[]string{"start acme-web-1.0-new@B2.service", "destroy acme-web-0.9-old@A1.service",
+				"destroy acme-web-0.9-old@.service"}, ""},
+		{"rollback", running, "start acme-web-1.0-new@B2.service", db.RolledBack, EventDeployRolledBack,
+			map[string]string{cycleKey: "A", unitKey: "acme-web-0.9-old", countKey: "2", "/acme-web/db": "old"},
+			[]string{"start acme-web-1.0-new@B1.service", "start acme-web-1.0-new@B2.service"},
+			"stop acme-web-1.0-new@B1.service\ndestroy acme-web-1.0-new@B1.service\nstop acme-web-1.0-new@B2.service\n" +
+				"destroy acme-web-1.0-new@B2.service\ndestroy acme-web-1.0-new@.service\n"},
+		{"first deploy", nil, "start acme-web-1.0-new@A2.service", db.Failed, EventDeployFailed,
+			map[string]string{cycleKey: "B", unitKey: "*coreos-deploy-noop", countKey: "0", "/acme-web/db": "new",
+				"/acme-web/cache": "on"},
+			[]string{"start acme-web-1.0-new@A1.service", "start acme-web-1.0-new@A2.service"}, ""},
+		{"template not submitted", running, "submit " + tmpDir + "acme-web-1.0-new@.service", db.Failed,
+			EventDeployFailed,
+			map[string]string{cycleKey: "A", unitKey: "acme-web-0.9-old", countKey: "2", "/acme-web/db": "new",
+				"/acme-web/cache": "on"},
+			[]string{"destroy acme-web-1.0-new@.service"}, ""},
+	}
+	for _, tc := range tests {
+		dir, _ := ioutil.TempDir("", "coreos-deploy-flip")
+		defer os.RemoveAll(dir)
+		script, fleetLog := fakeFleetctl(t, dir, tc.failed)
+		store := &fakeKeyStore{keys: make(map[string]string)}
+		for k, v := range tc.keys {
+			store.keys[k] = v
+		}
+		s, _, d := newDeploysServer(t, &db.DeployStatus{DeployID: "D1", ServiceName: "acme-web", Status: db.Started})
+		events := &eventRecorder{}
+
+		q := NewServiceRequest("acme-web", "1.0", 2, "[Service]",
+			NewEtcd2Keys(map[string]string{"/acme-web/db": "new", "/acme-web/cache": "on"}))
+		q.DeployID, q.Domain, q.Suffix = "D1", "example.com", "new"
+		s.prepareRequest(context.Background(), q)
+		q.e2, q.fleetctl, q.notifier = store, script, events
+		q.run()
+
+		if st := d.status("D1"); st != tc.status {
+			t.Errorf("A %s should end with status %d, received %d.", tc.name, tc.status, st)
+		}
+		if len(events.events) != 2 || events.events[1] != tc.event {
+			t.Errorf("A %s should send %s, received %v.", tc.name, tc.event, events.events)
+		}
+		if len(store.keys) != len(tc.after) {
+			t.Errorf("A %s should leave etcd2 keys %v, received %v.", tc.name, tc.after, store.keys)
+		}
+		for k, v := range tc.after {
+			if store.keys[k] != v {
+				t.Errorf("A %s should leave %s as %q, received %q.", tc.name, k, v, store.keys[k])
+			}
+		}
+		b, _ := ioutil.ReadFile(fleetLog)
+		commands := "\n" + string(b)
+		for _, c := range tc.commands {
+			if !strings.Contains(commands, "\n"+c+"\n") {
+				t.Errorf("A %s should run fleetctl %s, ran:%s", tc.name, c, commands)
+			}
+		}
+		if tc.status == db.Success {
+			continue
+		}
+		failed := "\n" + tc.failed + "\n"
+		if i := strings.Index(commands, failed); i < 0 || commands[i+len(failed):] != tc.teardown {
+			t.Errorf("A %s should run fleetctl %q after the failure, ran:%s", tc.name, tc.teardown, commands)
+		}
+	}
+}
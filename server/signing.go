@@ -0,0 +1,211 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	signatureHeader   = "X-Signature" // "sha256=" + hex HMAC-SHA256 of "<timestamp>.<body>".
+	timestampHeader   = "X-Timestamp" // Unix seconds when the request was signed.
+	clientIDHeader    = "X-Client-ID" // The public identifier of the signing client.
+	signaturePrefix   = "sha256="
+	signatureMaxSkew  = 5 * time.Minute // How far a signed timestamp may be from the server clock.
+	signingSecretSize = 32              // Random bytes in a new shared secret.
+)
+
+// signatureCache remembers signatures recently accepted so a captured request cannot be replayed
+// within the allowed clock skew.
+type signatureCache struct {
+	mu   sync.Mutex
+	seen map[string]time.Time // Signature to when it may be forgotten.
+}
+
+// newSignatureCache is a factory function that returns a new signatureCache instance.
+func newSignatureCache() *signatureCache {
+	return &signatureCache{seen: make(map[string]time.Time)}
+}
+
+// add records a signature and returns false if it has already been seen.
+func (c *signatureCache) add(sig string) bool {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, forget := range c.seen {
+		if now.After(forget) {
+			delete(c.seen, k)
+		}
+	}
+	if _, ok := c.seen[sig]; ok {
+		return false
+	}
+	c.seen[sig] = now.Add(2 * signatureMaxSkew)
+	return true
+}
+
+// signBody returns the signature header value of a body signed at the timestamp.
+func signBody(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// signedIdentity validates an HMAC signed request and returns the identity of the signing client,
+// or nil if the request is not validly signed. Signatures are only accepted for deploy requests.
+func (s *Server) signedIdentity(r *http.Request) *Identity {
+	sig := r.Header.Get(signatureHeader)
+	ts := r.Header.Get(timestampHeader)
+	clientID := r.Header.Get(clientIDHeader)
+	if r.URL.Path != httpRouteV1Deploy || !strings.HasPrefix(sig, signaturePrefix) || ts == "" ||
+		clientID == "" || s.secrets == nil {
+		return nil
+	}
+
+	secs, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil
+	}
+	if skew := time.Since(time.Unix(secs, 0)); skew > signatureMaxSkew || skew < -signatureMaxSkew {
+		s.log.Warningf("Signed request from %s rejected: timestamp outside of allowed skew.", clientID)
+		return nil
+	}
+
+	c, err := s.db.WithContext(r.Context()).QuerySigningClient(clientID)
+	if err != nil {
+		return nil
+	}
+	secret, err := s.secrets.Open(c.Secret)
+	if err != nil {
+		s.log.Errorf("Unable to decrypt secret of signing client %s: %s", clientID, err)
+		return nil
+	}
+	if !hmac.Equal([]byte(signBody(secret, ts, readBody(r))), []byte(sig)) {
+		return nil
+	}
+	if !s.signatures.add(sig) {
+		s.log.Warningf("Signed request from %s rejected: signature has already been used.", clientID)
+		return nil
+	}
+	return &Identity{
+		Name:           c.ClientID,
+		Role:           RoleDeploy,
+		ServicePattern: c.ServicePattern,
+		Principal:      "client:" + c.ClientID,
+	}
+}
+
+// readBody returns the body of the request and sets it back so it can be read again.
+func readBody(r *http.Request) []byte {
+	if r.Body == nil {
+		return nil
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		b = []byte{}
+	}
+	r.Body = ioutil.NopCloser(bytes.NewBuffer(b))
+	return b
+}
+
+// signingClientRequest is the payload to create a signing client.
+type signingClientRequest struct {
+	ClientID       string `json:"clientID"`       // The public identifier of the client.
+	ServicePattern string `json:"servicePattern"` // Optional glob of service names the client may deploy.
+	Notes          string `json:"notes"`          // General comments.
+}
+
+// signingClientsHandler handles admin requests to create, list and revoke signing clients.
+//
+//	GET    /v1.0/signing_clients      - list all clients.
+//	POST   /v1.0/signing_clients      - create a client and return its shared secret once.
+//	DELETE /v1.0/signing_clients/{id} - revoke a client.
+func (s *Server) signingClientsHandler(w http.ResponseWriter, r *http.Request) {
+	if s.invalidHeader(w, r) || s.invalidAuth(w, r, RoleAdmin) {
+		return
+	}
+
+	params := routeParams(r.URL.Path, httpRouteV1SigningClients)
+	switch {
+	case len(params) == 0 && r.Method == httpGet:
+		clients, err := s.db.WithContext(r.Context()).QuerySigningClients()
+		if err != nil {
+			http.Error(w, DatabaseError, http.StatusInternalServerError)
+			return
+		}
+		b, _ := json.Marshal(clients)
+		w.Write(b)
+	case len(params) == 0 && r.Method == httpPost:
+		setAudit(r, "signing_client.create", "", "")
+		s.createSigningClient(w, r)
+	case len(params) == 1 && r.Method == httpDelete:
+		setAudit(r, "signing_client.revoke", "", "id="+params[0])
+		id, err := strconv.Atoi(params[0])
+		if err != nil || s.db.WithContext(r.Context()).RevokeSigningClient(id) != nil {
+			http.Error(w, NotFound, http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(fmt.Sprintf(`{"id":%d,"revoked":true}`, id)))
+	default:
+		http.Error(w, InvalidMethod, http.StatusMethodNotAllowed)
+	}
+}
+
+// createSigningClient creates a new signing client with a random shared secret.
+func (s *Server) createSigningClient(w http.ResponseWriter, r *http.Request) {
+	if s.secrets == nil {
+		http.Error(w, SecretKeyRequired, http.StatusConflict)
+		return
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, InvalidBody, http.StatusBadRequest)
+		return
+	}
+	var q signingClientRequest
+	if err := json.Unmarshal(b, &q); err != nil || q.ClientID == "" {
+		http.Error(w, InvalidJSONText, http.StatusBadRequest)
+		return
+	}
+
+	raw := make([]byte, signingSecretSize)
+	if _, err := rand.Read(raw); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	secret := base64.RawURLEncoding.EncodeToString(raw)
+	sealed, err := s.secrets.Seal(secret)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	id, err := s.db.WithContext(r.Context()).CreateSigningClient(q.ClientID, sealed, q.ServicePattern, q.Notes)
+	if err != nil {
+		http.Error(w, DatabaseError, http.StatusInternalServerError)
+		return
+	}
+	setAudit(r, "", "", fmt.Sprintf("id=%d clientID=%s", id, q.ClientID))
+	b, _ = json.Marshal(&struct {
+		ID       int    `json:"id"`
+		ClientID string `json:"clientID"`
+		Secret   string `json:"secret"`
+	}{
+		ID:       id,
+		ClientID: q.ClientID,
+		Secret:   secret,
+	})
+	w.Write(b)
+}
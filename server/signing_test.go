@@ -0,0 +1,134 @@
+package server
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newSigningServer returns a server with a fake DB that knows the signing client "ci" and its secret.
+func newSigningServer(t *testing.T, secret string) *Server {
+	s, f := newFakeServer(t)
+	box, err := NewSecretBox(bytes.Repeat([]byte{7}, secretKeySize))
+	if err != nil {
+		t.Fatalf("Unable to make the secret box: %s", err)
+	}
+	sealed, _ := box.Seal(secret)
+	s.secrets = box
+	s.signatures = newSignatureCache()
+	f.on("FROM signing_clients", func(args []driver.Value) *fakeResult {
+		if args[0] != "ci" {
+			return noRows(args)
+		}
+		return &fakeResult{
+			columns: strings.Split("id,client_id,secret,service_pattern,notes,revoked_at,updated_at,created_at", ","),
+			rows: [][]driver.Value{{int64(1), "ci", sealed, "acme-*", nil, nil, "2016-01-02 15:04:05",
+				"2016-01-02 15:04:05"}},
+		}
+	})
+	return s
+}
+
+// signedRequest returns a deploy request signed by the client at the time with the secret.
+func signedRequest(clientID string, secret string, at time.Time, body string) *http.Request {
+	ts := strconv.FormatInt(at.Unix(), 10)
+	r := requestAs(httpPost, httpRouteV1Deploy, body, nil)
+	r.Header.Set(clientIDHeader, clientID)
+	r.Header.Set(timestampHeader, ts)
+	r.Header.Set(signatureHeader, signBody(secret, ts, []byte(body)))
+	return r
+}
+
+func TestSignedIdentity(t *testing.T) {
+	t.Parallel()
+	s := newSigningServer(t, "s3cr3t")
+	body := `{"serviceName":"acme-web"}`
+
+	at := time.Now()
+	r := signedRequest("ci", "s3cr3t", at, body)
+	id := s.signedIdentity(r)
+	if id == nil || id.Name != "ci" || id.Role != RoleDeploy || id.ServicePattern != "acme-*" {
+		t.Fatalf("A valid signature should return the identity of the client, received %+v.", id)
+	}
+	if b, _ := ioutil.ReadAll(r.Body); string(b) != body {
+		t.Errorf("The body should be readable after the signature check, received %q.", b)
+	}
+
+	// The same signed request a second time.
+	if s.signedIdentity(signedRequest("ci", "s3cr3t", at, body)) != nil {
+		t.Errorf("A replayed signature should be rejected.")
+	}
+}
+
+func TestSignedIdentityRejects(t *testing.T) {
+	t.Parallel()
+	s := newSigningServer(t, "s3cr3t")
+	body := `{"serviceName":"acme-web"}`
+	tests := []struct {
+		name string
+		r    func() *http.Request
+	}{
+		{"timestamp too old", func() *http.Request {
+			return signedRequest("ci", "s3cr3t", time.Now().Add(-signatureMaxSkew-time.Minute), body)
+		}},
+		{"timestamp too far ahead", func() *http.Request {
+			return signedRequest("ci", "s3cr3t", time.Now().Add(signatureMaxSkew+time.Minute), body)
+		}},
+		{"timestamp not a number", func() *http.Request {
+			r := signedRequest("ci", "s3cr3t", time.Now(), body)
+			r.Header.Set(timestampHeader, "yesterday")
+			return r
+		}},
+		{"tampered body", func() *http.Request {
+			r := signedRequest("ci", "s3cr3t", time.Now(), body)
+			r.Body = ioutil.NopCloser(strings.NewReader(`{"serviceName":"other-web"}`))
+			return r
+		}},
+		{"tampered timestamp", func() *http.Request {
+			r := signedRequest("ci", "s3cr3t", time.Now(), body)
+			r.Header.Set(timestampHeader, strconv.FormatInt(time.Now().Unix()+1, 10))
+			return r
+		}},
+		{"wrong secret", func() *http.Request {
+			return signedRequest("ci", "guess", time.Now(), body)
+		}},
+		{"unknown client", func() *http.Request {
+			return signedRequest("unknown", "s3cr3t", time.Now(), body)
+		}},
+		{"missing prefix", func() *http.Request {
+			r := signedRequest("ci", "s3cr3t", time.Now(), body)
+			r.Header.Set(signatureHeader, strings.TrimPrefix(r.Header.Get(signatureHeader), signaturePrefix))
+			return r
+		}},
+		{"another route", func() *http.Request {
+			r := signedRequest("ci", "s3cr3t", time.Now(), body)
+			r.URL.Path = httpRouteV1Tokens
+			return r
+		}},
+	}
+	for _, tc := range tests {
+		if id := s.signedIdentity(tc.r()); id != nil {
+			t.Errorf("A request with a %s should be rejected, received %+v.", tc.name, id)
+		}
+	}
+}
+
+func TestSignatureCache(t *testing.T) {
+	t.Parallel()
+	c := newSignatureCache()
+	if !c.add("a") || !c.add("b") {
+		t.Errorf("New signatures should be accepted.")
+	}
+	if c.add("a") {
+		t.Errorf("A seen signature should be rejected.")
+	}
+	c.seen["a"] = time.Now().Add(-time.Second)
+	if !c.add("a") {
+		t.Errorf("A forgotten signature should be accepted again.")
+	}
+}
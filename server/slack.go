@@ -0,0 +1,235 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/composer22/coreos-deploy/logger"
+)
+
+const (
+	slackAPIURL      = "https://slack.com/api/" // The base of the Slack Web API.
+	slackTimeout     = 5 * time.Second          // How long Slack has to respond.
+	slackLogLines    = 15                       // Lines from the end of the deploy log shown on failure.
+	slackLogMax      = 1500                     // Longest deploy log tail shown on failure.
+	slackAnyEnv      = "*"                      // The target of environments without their own.
+	slackColorStart  = "#439FE0"
+	slackColorGood   = "good"
+	slackColorDanger = "danger"
+	slackColorWarn   = "warning"
+)
+
+// slackPayload is a message in the Slack incoming webhook and chat.postMessage format.
+type slackPayload struct {
+	Channel     string             `json:"channel,omitempty"` // The channel when posting with the Web API.
+	TS          string             `json:"ts,omitempty"`      // The message to replace with chat.update.
+	Text        string             `json:"text"`              // The summary line, also used in notifications.
+	Attachments []*slackAttachment `json:"attachments"`       // The details of the deploy.
+}
+
+// slackAttachment is the coloured detail block of a message.
+type slackAttachment struct {
+	Color    string        `json:"color"`          // The colour of the bar beside the block.
+	Fallback string        `json:"fallback"`       // Plain text for clients that cannot show attachments.
+	Fields   []*slackField `json:"fields"`         // Short name and value pairs.
+	Text     string        `json:"text,omitempty"` // The failure detail, if any.
+	MrkdwnIn []string      `json:"mrkdwn_in,omitempty"`
+}
+
+// slackField is a name and value shown in an attachment.
+type slackField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+// slackResponse is the reply of the Slack Web API.
+type slackResponse struct {
+	OK      bool   `json:"ok"`
+	Error   string `json:"error"`
+	Channel string `json:"channel"` // The channel ID the message was posted to.
+	TS      string `json:"ts"`      // The ID of the message in the channel.
+}
+
+// slackMessageRef locates a posted message so it can be updated.
+type slackMessageRef struct {
+	channel string
+	ts      string
+}
+
+// slackNotifier posts deploy events to chat in the Slack message format. Each environment has a
+// target: an incoming webhook URL, or a channel posted to with the Web API and a bot token. Channel
+// messages are updated with the result when the deploy completes; incoming webhooks cannot update a
+// message, so the result is posted as a new message.
+type slackNotifier struct {
+	targets map[string]string           // Environment to webhook URL or channel.
+	token   string                      // The Slack bot token for channel targets.
+	apiURL  string                      // The base of the Slack Web API.
+	client  *http.Client                // Posts the messages.
+	log     *logger.Logger              // Records errors posting messages.
+	mu      sync.Mutex                  // For locking access to posted.
+	posted  map[string]*slackMessageRef // Deploy ID to the start message of a running deploy.
+}
+
+// newSlackNotifier is a factory function that returns a slackNotifier for a comma list of
+// ENVIRONMENT=TARGET, or nil if no targets are given. ENVIRONMENT may be * for all others.
+func newSlackNotifier(list string, token string, l *logger.Logger) (*slackNotifier, error) {
+	targets := make(map[string]string)
+	for _, t := range splitList(list) {
+		i := strings.Index(t, "=")
+		if i <= 0 || i == len(t)-1 {
+			return nil, fmt.Errorf("invalid slack target %q", t)
+		}
+		env, target := t[:i], t[i+1:]
+		if !isURL(target) && token == "" {
+			return nil, fmt.Errorf("slack target %q is a channel and requires a slack token", t)
+		}
+		targets[env] = target
+	}
+	if len(targets) == 0 {
+		return nil, nil
+	}
+	return &slackNotifier{
+		targets: targets,
+		token:   token,
+		apiURL:  slackAPIURL,
+		client:  &http.Client{Timeout: slackTimeout},
+		log:     l,
+		posted:  make(map[string]*slackMessageRef),
+	}, nil
+}
+
+// isURL returns true if the target is an http or https URL.
+func isURL(target string) bool {
+	return strings.HasPrefix(target, "https://") || strings.HasPrefix(target, "http://")
+}
+
+// Notify posts the event to the target of its environment.
+func (n *slackNotifier) Notify(e *DeployEvent) {
+	target, ok := n.targets[e.Environment]
+	if !ok {
+		if target, ok = n.targets[slackAnyEnv]; !ok {
+			return
+		}
+	}
+	msg := slackMessage(e)
+	if isURL(target) {
+		if err := n.post(target, "", msg, nil); err != nil {
+			n.log.Errorf("Unable to post %s of deploy %s to slack: %s", e.Event, e.DeployID, err)
+		}
+		return
+	}
+
+	// Post the start to the channel, then replace it with the result.
+	n.mu.Lock()
+	ref := n.posted[e.DeployID]
+	delete(n.posted, e.DeployID)
+	n.mu.Unlock()
+	method := "chat.postMessage"
+	msg.Channel = target
+	if e.Event != EventDeployStarted && ref != nil {
+		method, msg.Channel, msg.TS = "chat.update", ref.channel, ref.ts
+	}
+	var resp slackResponse
+	if err := n.post(n.apiURL+method, n.token, msg, &resp); err != nil {
+		n.log.Errorf("Unable to post %s of deploy %s to slack: %s", e.Event, e.DeployID, err)
+		return
+	}
+	if e.Event == EventDeployStarted {
+		n.mu.Lock()
+		n.posted[e.DeployID] = &slackMessageRef{channel: resp.Channel, ts: resp.TS}
+		n.mu.Unlock()
+	}
+}
+
+// post sends a message to Slack and decodes the Web API response into resp when given.
+func (n *slackNotifier) post(target string, token string, msg *slackPayload, resp *slackResponse) error {
+	b, _ := json.Marshal(msg)
+	req, err := http.NewRequest(httpPost, target, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("slack responded %s", res.Status)
+	}
+	if resp == nil {
+		return nil
+	}
+	if err := json.NewDecoder(res.Body).Decode(resp); err != nil {
+		return err
+	}
+	if !resp.OK {
+		return errors.New(resp.Error)
+	}
+	return nil
+}
+
+// slackMessage formats a deploy event as a chat message.
+func slackMessage(e *DeployEvent) *slackPayload {
+	color, verb := slackColorStart, "started deploying"
+	switch e.Event {
+	case EventDeploySucceeded:
+		color, verb = slackColorGood, "deployed"
+	case EventDeployFailed:
+		color, verb = slackColorDanger, "failed to deploy"
+	case EventDeployRolledBack:
+		color, verb = slackColorWarn, "rolled back"
+	}
+	deployer := e.DeployedBy
+	if deployer == "" {
+		deployer = "unknown"
+	}
+	text := fmt.Sprintf("%s %s *%s* %s to %s", deployer, verb, e.ServiceName, e.Version, e.Environment)
+
+	a := &slackAttachment{
+		Color:    color,
+		Fallback: text,
+		Fields: []*slackField{
+			{Title: "Service", Value: e.ServiceName, Short: true},
+			{Title: "Version", Value: e.Version, Short: true},
+			{Title: "Environment", Value: e.Environment, Short: true},
+			{Title: "Deployed By", Value: deployer, Short: true},
+		},
+	}
+	if e.Duration > 0 {
+		d := time.Duration(e.Duration * float64(time.Second)).Round(time.Second)
+		a.Fields = append(a.Fields, &slackField{Title: "Duration", Value: d.String(), Short: true})
+	}
+	a.Fields = append(a.Fields, &slackField{Title: "Deploy ID", Value: e.DeployID, Short: true})
+	if e.Event == EventDeployFailed || e.Event == EventDeployRolledBack {
+		a.Text = e.Message
+		if tail := logTail(e.Log, slackLogLines, slackLogMax); tail != "" {
+			a.Text += "\n```" + tail + "```"
+		}
+		a.MrkdwnIn = []string{"text"}
+	}
+	return &slackPayload{Text: text, Attachments: []*slackAttachment{a}}
+}
+
+// logTail returns up to the last n lines of the log, no longer than max bytes.
+func logTail(log string, n int, max int) string {
+	lines := strings.Split(strings.TrimRight(log, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	tail := strings.Join(lines, "\n")
+	if len(tail) > max {
+		tail = tail[len(tail)-max:]
+	}
+	return tail
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/composer22/coreos-deploy/logger"
+)
+
+// slackReceiver records the messages posted to a fake Slack.
+type slackReceiver struct {
+	mu    sync.Mutex
+	paths []string
+	msgs  []*slackPayload
+	auth  []string
+}
+
+func (rc *slackReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var msg slackPayload
+	json.NewDecoder(r.Body).Decode(&msg)
+	rc.mu.Lock()
+	rc.paths = append(rc.paths, r.URL.Path)
+	rc.msgs = append(rc.msgs, &msg)
+	rc.auth = append(rc.auth, r.Header.Get("Authorization"))
+	rc.mu.Unlock()
+	w.Write([]byte(`{"ok":true,"channel":"C123","ts":"1457143391.000002"}`))
+}
+
+func TestSlackTargets(t *testing.T) {
+	t.Parallel()
+	l := logger.New(logger.Emergency, false)
+	if n, err := newSlackNotifier("", "", l); n != nil || err != nil {
+		t.Errorf("No targets should not notify, received %v %v.", n, err)
+	}
+	for _, list := range []string{"production", "=https://hooks.slack.com/x", "production=", "production=#deploys"} {
+		if _, err := newSlackNotifier(list, "", l); err == nil {
+			t.Errorf("Targets %q should not be accepted without a token.", list)
+		}
+	}
+	if _, err := newSlackNotifier("production=#deploys,*=https://hooks.slack.com/x", "xoxb-1", l); err != nil {
+		t.Errorf("Targets should be accepted, received %s.", err)
+	}
+
+	// Options are shown by /info and /metrics, which must not reveal the webhooks or token.
+	b, _ := json.Marshal(&Options{SlackTargets: "production=https://hooks.slack.com/x", SlackToken: "xoxb-1"})
+	if strings.Contains(string(b), "hooks.slack.com") || strings.Contains(string(b), "xoxb-1") {
+		t.Errorf("Options should not show slack targets or the token, received %s.", b)
+	}
+}
+
+func TestSlackIncomingWebhook(t *testing.T) {
+	t.Parallel()
+	rc := &slackReceiver{}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+	n, _ := newSlackNotifier("*="+srv.URL+"/hook", "", logger.New(logger.Emergency, false))
+
+	n.Notify(&DeployEvent{Event: EventDeployStarted, DeployID: "d1", ServiceName: "acme-video",
+		Version: "1.0.2", Environment: "staging", DeployedBy: "ci"})
+	n.Notify(&DeployEvent{Event: EventDeployFailed, DeployID: "d1", ServiceName: "acme-video",
+		Version: "1.0.2", Environment: "staging", DeployedBy: "ci", Duration: 42,
+		Message: "Unable to submit service template.", Log: "Saving service unit code.\nERR: boom\n"})
+
+	if len(rc.msgs) != 2 || rc.paths[1] != "/hook" || rc.auth[1] != "" {
+		t.Fatalf("Each event should be posted to the webhook, received %v.", rc.paths)
+	}
+	a := rc.msgs[1].Attachments[0]
+	if a.Color != slackColorDanger || !strings.Contains(a.Text, "ERR: boom") ||
+		!strings.Contains(a.Text, "Unable to submit") {
+		t.Errorf("Failure should show the message and log tail, received %+v.", a)
+	}
+	found := false
+	for _, f := range a.Fields {
+		if f.Title == "Duration" && f.Value == "42s" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Failure should show the duration, received %+v.", a.Fields)
+	}
+}
+
+func TestSlackChannelUpdate(t *testing.T) {
+	t.Parallel()
+	rc := &slackReceiver{}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+	n, _ := newSlackNotifier("production=#deploys", "xoxb-1", logger.New(logger.Emergency, false))
+	n.apiURL = srv.URL + "/api/"
+
+	n.Notify(&DeployEvent{Event: EventDeployStarted, DeployID: "d2", Environment: "staging"})
+	if len(rc.msgs) != 0 {
+		t.Fatalf("Other environments should not be posted, received %v.", rc.paths)
+	}
+	n.Notify(&DeployEvent{Event: EventDeployStarted, DeployID: "d2", Environment: "production"})
+	n.Notify(&DeployEvent{Event: EventDeploySucceeded, DeployID: "d2", Environment: "production"})
+
+	if len(rc.msgs) != 2 || rc.paths[0] != "/api/chat.postMessage" || rc.paths[1] != "/api/chat.update" {
+		t.Fatalf("The start should be posted then updated, received %v.", rc.paths)
+	}
+	if rc.msgs[0].Channel != "#deploys" || rc.auth[0] != "Bearer xoxb-1" {
+		t.Errorf("The start should be posted to the channel with the token, received %+v.", rc.msgs[0])
+	}
+	if rc.msgs[1].Channel != "C123" || rc.msgs[1].TS != "1457143391.000002" ||
+		rc.msgs[1].Attachments[0].Color != slackColorGood {
+		t.Errorf("The result should replace the start message, received %+v.", rc.msgs[1])
+	}
+}
+
+func TestLogTail(t *testing.T) {
+	t.Parallel()
+	if got := logTail("a\nb\nc\nd\n", 2, 100); got != "c\nd" {
+		t.Errorf("Tail should be the last lines, received %q.", got)
+	}
+	if got := logTail("abcdef", 5, 3); got != "def" {
+		t.Errorf("Tail should be limited in size, received %q.", got)
+	}
+}
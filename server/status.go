@@ -2,23 +2,53 @@ package server
 
 import (
 	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
 	"time"
 )
 
+const (
+	latencyWindow  = 5 * time.Minute // How far back route latency percentiles look.
+	latencySamples = 1024            // Most recent response times kept for each route.
+)
+
 // Status contains runtime statistics.
 type Status struct {
-	Start        time.Time                   `json:"startTime"`    // The start time of the server.
-	RequestCount int64                       `json:"requestCount"` // How many requests came in to the server.
-	RequestBytes int64                       `json:"requestBytes"` // Size of the requests in bytes.
-	RouteStats   map[string]map[string]int64 `json:"routeStats"`   // How many requests/bytes came into each route.
+	Start            time.Time                   `json:"startTime"`        // The start time of the server.
+	RequestCount     int64                       `json:"requestCount"`     // How many requests came in to the server.
+	RequestBytes     int64                       `json:"requestBytes"`     // Size of the requests in bytes.
+	ResponseBytes    int64                       `json:"responseBytes"`    // Size of the responses in bytes.
+	RouteStats       map[string]map[string]int64 `json:"routeStats"`       // How many requests/bytes came into each route.
+	RouteStatusCodes map[string]map[string]int64 `json:"routeStatusCodes"` // How many responses of each status code each route returned.
+	latency          map[string]*latencyRing     // Recent response times of each route.
+}
+
+// RouteLatency summarizes the response times of a route within the latency window, in milliseconds.
+type RouteLatency struct {
+	Samples int     `json:"samples"` // Responses in the window.
+	P50     float64 `json:"p50Ms"`   // Median.
+	P90     float64 `json:"p90Ms"`   // 90th percentile.
+	P95     float64 `json:"p95Ms"`   // 95th percentile.
+	P99     float64 `json:"p99Ms"`   // 99th percentile.
+	Max     float64 `json:"maxMs"`   // Slowest.
+}
+
+// latencyRing keeps the most recent response times of a route.
+type latencyRing struct {
+	at   []time.Time // When each response was sent.
+	ms   []float64   // How long each response took.
+	next int         // Where the next sample is written once the ring is full.
 }
 
 // NewStatus is a factory function that returns a new instance of Status.
 // options is an optional list of functions that initialize the structure
 func NewStatus(options ...func(*Status)) *Status {
 	st := &Status{
-		Start:      time.Now(),
-		RouteStats: make(map[string]map[string]int64),
+		Start:            time.Now(),
+		RouteStats:       make(map[string]map[string]int64),
+		RouteStatusCodes: make(map[string]map[string]int64),
+		latency:          make(map[string]*latencyRing),
 	}
 
 	for _, f := range options {
@@ -47,6 +77,80 @@ func (s *Status) IncrRouteStats(path string, rb int64) {
 	}
 }
 
+// IncrResponseStats records the status code, size and duration of a response from the route.
+func (s *Status) IncrResponseStats(path string, code int, wb int64, d time.Duration, now time.Time) {
+	s.ResponseBytes += wb
+	if _, ok := s.RouteStats[path]; !ok {
+		s.RouteStats[path] = make(map[string]int64)
+	}
+	s.RouteStats[path]["responseBytes"] += wb
+	if _, ok := s.RouteStatusCodes[path]; !ok {
+		s.RouteStatusCodes[path] = make(map[string]int64)
+	}
+	s.RouteStatusCodes[path][strconv.Itoa(code)]++
+
+	ring, ok := s.latency[path]
+	if !ok {
+		ring = &latencyRing{}
+		s.latency[path] = ring
+	}
+	ring.add(now, float64(d)/float64(time.Millisecond))
+}
+
+// RouteLatencies returns the response time percentiles of each route within the latency window
+// before now. Routes without responses in the window are left out.
+func (s *Status) RouteLatencies(now time.Time) map[string]*RouteLatency {
+	result := make(map[string]*RouteLatency)
+	for path, ring := range s.latency {
+		if l := ring.summary(now.Add(-latencyWindow)); l != nil {
+			result[path] = l
+		}
+	}
+	return result
+}
+
+// add records a response time, replacing the oldest once the ring is full.
+func (r *latencyRing) add(at time.Time, ms float64) {
+	if len(r.ms) < latencySamples {
+		r.at = append(r.at, at)
+		r.ms = append(r.ms, ms)
+		return
+	}
+	r.at[r.next], r.ms[r.next] = at, ms
+	r.next = (r.next + 1) % latencySamples
+}
+
+// summary returns the percentiles of the response times since the time, or nil if there are none.
+func (r *latencyRing) summary(since time.Time) *RouteLatency {
+	ms := make([]float64, 0, len(r.ms))
+	for i, at := range r.at {
+		if !at.Before(since) {
+			ms = append(ms, r.ms[i])
+		}
+	}
+	if len(ms) == 0 {
+		return nil
+	}
+	sort.Float64s(ms)
+	return &RouteLatency{
+		Samples: len(ms),
+		P50:     percentile(ms, 50),
+		P90:     percentile(ms, 90),
+		P95:     percentile(ms, 95),
+		P99:     percentile(ms, 99),
+		Max:     ms[len(ms)-1],
+	}
+}
+
+// percentile returns the nearest rank percentile p of the sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
 // String is an implentation of the Stringer interface so the structure is returned as a
 // string to fmt.Print() etc.
 func (s *Status) String() string {
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResponseStats(t *testing.T) {
+	t.Parallel()
+	st := NewStatus()
+	now := time.Now()
+	for i := 1; i <= 100; i++ {
+		st.IncrResponseStats(httpRouteV1Status, 200, 10, time.Duration(i)*time.Millisecond, now)
+	}
+	st.IncrResponseStats(httpRouteV1Status, 404, 5, time.Millisecond, now)
+
+	if st.ResponseBytes != 1005 || st.RouteStats[httpRouteV1Status]["responseBytes"] != 1005 {
+		t.Errorf("Response bytes should be counted, received %d.", st.ResponseBytes)
+	}
+	if codes := st.RouteStatusCodes[httpRouteV1Status]; codes["200"] != 100 || codes["404"] != 1 {
+		t.Errorf("Status codes should be counted, received %v.", codes)
+	}
+	l := st.RouteLatencies(now)[httpRouteV1Status]
+	if l == nil || l.Samples != 101 || l.P50 != 50 || l.P99 != 99 || l.Max != 100 {
+		t.Errorf("Latency percentiles should be computed, received %+v.", l)
+	}
+}
+
+func TestLatencyWindow(t *testing.T) {
+	t.Parallel()
+	st := NewStatus()
+	old := time.Now().Add(-2 * latencyWindow)
+	st.IncrResponseStats(httpRouteV1Info, 200, 0, time.Second, old)
+	if l := st.RouteLatencies(time.Now()); len(l) != 0 {
+		t.Errorf("Responses outside the window should be left out, received %v.", l)
+	}
+
+	// Once full, the oldest samples are replaced.
+	now := time.Now()
+	for i := 0; i < latencySamples; i++ {
+		st.IncrResponseStats(httpRouteV1Info, 200, 0, time.Millisecond, now)
+	}
+	l := st.RouteLatencies(now)[httpRouteV1Info]
+	if l == nil || l.Samples != latencySamples || l.Max != 1 {
+		t.Errorf("The ring should hold the most recent samples, received %+v.", l)
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+// certReloader holds the server certificate and client CAs so they can be replaced while the
+// server is running, such as on SIGHUP after the files are renewed.
+type certReloader struct {
+	mu          sync.RWMutex
+	certFile    string           // PEM certificate file of the server.
+	keyFile     string           // PEM private key file of the server.
+	caFile      string           // Optional PEM file of CAs that sign client certificates.
+	requireCert bool             // Must clients present a certificate?
+	cert        *tls.Certificate // The current server certificate.
+	clientCAs   *x509.CertPool   // The current client CAs or nil if not verifying clients.
+}
+
+// newCertReloader is a factory function that returns a certReloader with the files loaded.
+func newCertReloader(certFile string, keyFile string, caFile string, requireCert bool) (*certReloader, error) {
+	if requireCert && caFile == "" {
+		return nil, errors.New("a client CA file is required to require client certificates")
+	}
+	c := &certReloader{
+		certFile:    certFile,
+		keyFile:     keyFile,
+		caFile:      caFile,
+		requireCert: requireCert,
+	}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload reads the certificate, key and client CA files again. If any file is invalid, the
+// previous certificates remain in use.
+func (c *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	var pool *x509.CertPool
+	if c.caFile != "" {
+		b, err := ioutil.ReadFile(c.caFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return fmt.Errorf("no certificates found in client CA file %s", c.caFile)
+		}
+	}
+	c.mu.Lock()
+	c.cert = &cert
+	c.clientCAs = pool
+	c.mu.Unlock()
+	return nil
+}
+
+// tlsConfig returns the listener configuration. Each handshake uses the current certificates.
+func (c *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetConfigForClient: c.configForClient,
+	}
+}
+
+// configForClient returns the configuration for a client handshake.
+func (c *certReloader) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{*c.cert},
+		NextProtos:   []string{"http/1.1"},
+	}
+	if c.clientCAs != nil {
+		cfg.ClientCAs = c.clientCAs
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		if c.requireCert {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,290 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql/driver"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/composer22/coreos-deploy/db"
+)
+
+// testCert is a generated certificate and its key.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newTestCert returns a certificate for the common name signed by the parent, or self signed as a CA
+// if the parent is nil.
+func newTestCert(t *testing.T, cn string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unable to generate a key: %s", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("Unable to create a certificate: %s", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// certPEM returns the PEM encoded certificate.
+func (c *testCert) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der})
+}
+
+// keyPEM returns the PEM encoded private key.
+func (c *testCert) keyPEM() []byte {
+	b, _ := x509.MarshalECPrivateKey(c.key)
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b})
+}
+
+// write writes the certificate and key into the directory and returns their paths.
+func (c *testCert) write(t *testing.T, dir string, name string) (string, string) {
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err := ioutil.WriteFile(certFile, c.certPEM(), 0600); err != nil {
+		t.Fatalf("Unable to write %s: %s", certFile, err)
+	}
+	if err := ioutil.WriteFile(keyFile, c.keyPEM(), 0600); err != nil {
+		t.Fatalf("Unable to write %s: %s", keyFile, err)
+	}
+	return certFile, keyFile
+}
+
+// tlsPair returns the certificate and key for a client.
+func (c *testCert) tlsPair() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+// newTLSServer starts a server using the certificates of the reloader.
+func newTLSServer(c *certReloader, handler http.HandlerFunc) *httptest.Server {
+	ts := httptest.NewUnstartedServer(handler)
+	ts.TLS = c.tlsConfig()
+	ts.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	ts.StartTLS()
+	return ts
+}
+
+// tlsGet sends a request to the server on a new connection trusting the CA. Any client certificate is
+// presented even if the server does not accept its issuer.
+func tlsGet(url string, ca *testCert, certs ...tls.Certificate) (*http.Response, error) {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	cfg := &tls.Config{RootCAs: pool}
+	cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		if len(certs) == 0 {
+			return &tls.Certificate{}, nil
+		}
+		return &certs[0], nil
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg, DisableKeepAlives: true}}
+	return client.Get(url)
+}
+
+func TestCertReload(t *testing.T) {
+	t.Parallel()
+	dir, _ := ioutil.TempDir("", "coreos-deploy-tls")
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, "deploy-ca", nil)
+	certFile, keyFile := newTestCert(t, "deploy-a", ca).write(t, dir, "server")
+
+	c, err := newCertReloader(certFile, keyFile, "", false)
+	if err != nil {
+		t.Fatalf("The certificates should load, received %s.", err)
+	}
+	ts := newTLSServer(c, func(w http.ResponseWriter, r *http.Request) {})
+	defer ts.Close()
+	served := func() string {
+		resp, err := tlsGet(ts.URL, ca)
+		if err != nil {
+			t.Fatalf("The handshake should succeed, received %s.", err)
+		}
+		resp.Body.Close()
+		return resp.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	if cn := served(); cn != "deploy-a" {
+		t.Fatalf("The server should present deploy-a, received %s.", cn)
+	}
+
+	newTestCert(t, "deploy-b", ca).write(t, dir, "server")
+	if err := c.reload(); err != nil {
+		t.Fatalf("The renewed certificates should load, received %s.", err)
+	}
+	if cn := served(); cn != "deploy-b" {
+		t.Errorf("The server should present the renewed deploy-b, received %s.", cn)
+	}
+
+	ioutil.WriteFile(certFile, []byte("not a certificate"), 0600)
+	if err := c.reload(); err == nil {
+		t.Errorf("An invalid certificate file should not load.")
+	}
+	if cn := served(); cn != "deploy-b" {
+		t.Errorf("The server should keep presenting deploy-b, received %s.", cn)
+	}
+}
+
+func TestClientCAModes(t *testing.T) {
+	t.Parallel()
+	dir, _ := ioutil.TempDir("", "coreos-deploy-tls")
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, "deploy-ca", nil)
+	certFile, keyFile := newTestCert(t, "deploy", ca).write(t, dir, "server")
+	caFile := filepath.Join(dir, "ca.crt")
+	ioutil.WriteFile(caFile, ca.certPEM(), 0600)
+	client := newTestCert(t, "deploy-bot", ca).tlsPair()
+	stranger := newTestCert(t, "deploy-bot", newTestCert(t, "other-ca", nil)).tlsPair()
+
+	if _, err := newCertReloader(certFile, keyFile, "", true); err == nil {
+		t.Errorf("Requiring client certificates without a client CA file should be an error.")
+	}
+
+	tests := []struct {
+		name        string
+		requireCert bool
+		certs       []tls.Certificate
+		ok          bool
+		verified    bool
+	}{
+		{"optional without a certificate", false, nil, true, false},
+		{"optional with a certificate", false, []tls.Certificate{client}, true, true},
+		{"optional with an unknown certificate", false, []tls.Certificate{stranger}, false, false},
+		{"required without a certificate", true, nil, false, false},
+		{"required with a certificate", true, []tls.Certificate{client}, true, true},
+		{"required with an unknown certificate", true, []tls.Certificate{stranger}, false, false},
+	}
+	for _, tc := range tests {
+		c, err := newCertReloader(certFile, keyFile, caFile, tc.requireCert)
+		if err != nil {
+			t.Fatalf("The certificates should load, received %s.", err)
+		}
+		ts := newTLSServer(c, func(w http.ResponseWriter, r *http.Request) {
+			if len(r.TLS.VerifiedChains) == 0 {
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+		})
+		resp, err := tlsGet(ts.URL, ca, tc.certs...)
+		ts.Close()
+		if !tc.ok {
+			if err == nil {
+				resp.Body.Close()
+				t.Errorf("A client %s should be rejected.", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("A client %s should be accepted, received %s.", tc.name, err)
+			continue
+		}
+		resp.Body.Close()
+		if verified := resp.StatusCode == http.StatusOK; verified != tc.verified {
+			t.Errorf("A client %s should have a verified certificate %t, received %t.", tc.name, tc.verified,
+				verified)
+		}
+	}
+}
+
+func TestCertSubjectIdentity(t *testing.T) {
+	t.Parallel()
+	dir, _ := ioutil.TempDir("", "coreos-deploy-tls")
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, "deploy-ca", nil)
+	certFile, keyFile := newTestCert(t, "deploy", ca).write(t, dir, "server")
+	caFile := filepath.Join(dir, "ca.crt")
+	ioutil.WriteFile(caFile, ca.certPEM(), 0600)
+
+	s, f := newFakeServer(t)
+	tokens := map[string]*db.AuthToken{
+		"deploy-bot":  {ID: 7, Name: "deploy-bot", Role: RoleDeploy, ServicePattern: "acme-*"},
+		"retired-bot": {ID: 8, Name: "retired-bot", Role: RoleDeploy, RevokedAt: "2016-01-02 15:04:05"},
+	}
+	// The active query excludes revoked tokens; any other lookup by subject would return them.
+	f.on("cert_subject = ? AND revoked_at IS NULL", func(args []driver.Value) *fakeResult {
+		if tok, ok := tokens[args[0].(string)]; ok && tok.RevokedAt == "" {
+			return tokenRow(tok, int64(0))
+		}
+		return noRows(args)
+	})
+	f.on("cert_subject = ?", func(args []driver.Value) *fakeResult {
+		if tok, ok := tokens[args[0].(string)]; ok {
+			return tokenRow(tok, int64(0))
+		}
+		return noRows(args)
+	})
+
+	c, err := newCertReloader(certFile, keyFile, caFile, false)
+	if err != nil {
+		t.Fatalf("The certificates should load, received %s.", err)
+	}
+	ts := newTLSServer(c, func(w http.ResponseWriter, r *http.Request) {
+		id := requestIdentity(s.authenticate(r))
+		if id == nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("X-Identity", id.Name+" "+id.Role+" "+id.ServicePattern+" "+id.Principal)
+	})
+	defer ts.Close()
+
+	tests := []struct {
+		cn       string
+		identity string
+	}{
+		{"deploy-bot", "deploy-bot " + RoleDeploy + " acme-* token:7"},
+		{"stranger", ""},
+		{"retired-bot", ""},
+	}
+	for _, tc := range tests {
+		resp, err := tlsGet(ts.URL, ca, newTestCert(t, tc.cn, ca).tlsPair())
+		if err != nil {
+			t.Fatalf("The client certificate of %s should be accepted, received %s.", tc.cn, err)
+		}
+		resp.Body.Close()
+		if id := resp.Header.Get("X-Identity"); id != tc.identity {
+			t.Errorf("The certificate of %s should have the identity %q, received %q.", tc.cn, tc.identity, id)
+		}
+	}
+
+	// A client without a certificate has no identity.
+	resp, err := tlsGet(ts.URL, ca)
+	if err != nil {
+		t.Fatalf("A client without a certificate should be accepted, received %s.", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("A client without a certificate should have no identity, received %d.", resp.StatusCode)
+	}
+}
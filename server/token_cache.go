@@ -0,0 +1,125 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/composer22/coreos-deploy/db"
+)
+
+const (
+	tokenCacheStaleTTL = 15 * time.Minute // How long a valid token may be served from cache while the DB is down.
+	tokenCacheMaxSize  = 10000            // Entries held before expired ones are swept.
+)
+
+// tokenCacheEntry is a cached result of a token lookup. A nil token is a negative (invalid) entry.
+type tokenCacheEntry struct {
+	token      *db.AuthToken // The validated token or nil if the token is invalid.
+	freshUntil time.Time     // Until when the entry may be used without asking the DB.
+	staleUntil time.Time     // Until when the entry may be used if the DB cannot be reached.
+}
+
+// tokenCache is an in-memory cache of validated bearer tokens so that authorization does not
+// query the DB on every request.
+type tokenCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration               // How long a valid token is cached.
+	negTTL  time.Duration               // How long an invalid token is cached.
+	entries map[string]*tokenCacheEntry // Keyed by a hash of the bearer token.
+	now     func() time.Time
+}
+
+// newTokenCache is a factory function that returns a new tokenCache instance.
+// A ttl of zero or less disables caching.
+func newTokenCache(ttl time.Duration, negTTL time.Duration) *tokenCache {
+	return &tokenCache{
+		ttl:     ttl,
+		negTTL:  negTTL,
+		entries: make(map[string]*tokenCacheEntry),
+		now:     time.Now,
+	}
+}
+
+// cacheKey returns the key of a bearer token. The raw token is not held in memory.
+func (c *tokenCache) cacheKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// get returns a fresh cache entry for the bearer token or nil if there is none.
+func (c *tokenCache) get(token string) *tokenCacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[c.cacheKey(token)]
+	if !ok || c.now().After(e.freshUntil) {
+		return nil
+	}
+	return e
+}
+
+// getStale returns a valid token for the bearer token that has outlived its ttl, but may still
+// be used while the DB cannot be reached. nil is returned if there is none.
+func (c *tokenCache) getStale(token string) *db.AuthToken {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[c.cacheKey(token)]
+	if !ok || e.token == nil || c.now().After(e.staleUntil) {
+		return nil
+	}
+	return e.token
+}
+
+// set caches the result of a token lookup. expiresIn is the remaining life of the token in
+// seconds; zero or less never expires. A nil token caches a negative result.
+func (c *tokenCache) set(token string, t *db.AuthToken, expiresIn int64) {
+	now := c.now()
+	e := &tokenCacheEntry{token: t}
+	if t == nil {
+		if c.negTTL <= 0 {
+			return
+		}
+		e.freshUntil = now.Add(c.negTTL)
+	} else {
+		if c.ttl <= 0 {
+			return
+		}
+		e.freshUntil = now.Add(c.ttl)
+		e.staleUntil = now.Add(tokenCacheStaleTTL)
+		if expiresIn > 0 {
+			expires := now.Add(time.Duration(expiresIn) * time.Second)
+			if expires.Before(e.freshUntil) {
+				e.freshUntil = expires
+			}
+			if expires.Before(e.staleUntil) {
+				e.staleUntil = expires
+			}
+		}
+	}
+	if e.staleUntil.Before(e.freshUntil) {
+		e.staleUntil = e.freshUntil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= tokenCacheMaxSize {
+		for k, v := range c.entries {
+			if now.After(v.staleUntil) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	c.entries[c.cacheKey(token)] = e
+}
+
+// removeTokenID removes any cached entries of a token, such as when it is rotated or revoked.
+func (c *tokenCache) removeTokenID(id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, v := range c.entries {
+		if v.token != nil && v.token.ID == id {
+			delete(c.entries, k)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/composer22/coreos-deploy/db"
+)
+
+// fakeClock is a time that only moves when told.
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{t: time.Date(2016, 1, 2, 15, 4, 5, 0, time.UTC)}
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) add(d time.Duration) {
+	c.mu.Lock()
+	c.t = c.t.Add(d)
+	c.mu.Unlock()
+}
+
+func TestTokenCache(t *testing.T) {
+	t.Parallel()
+	tok := &db.AuthToken{ID: 7, Name: "ci"}
+	type check struct {
+		at    time.Duration // Since the entry was cached.
+		fresh bool          // Is an entry returned by get?
+		stale bool          // Is the token returned by getStale?
+	}
+	tests := []struct {
+		name      string
+		ttl       time.Duration
+		negTTL    time.Duration
+		token     *db.AuthToken
+		expiresIn int64
+		checks    []check
+	}{
+		{"valid token", time.Minute, 0, tok, 0,
+			[]check{{30 * time.Second, true, true}, {2 * time.Minute, false, true}, {16 * time.Minute, false, false}}},
+		{"caching disabled", 0, time.Minute, tok, 0, []check{{0, false, false}}},
+		{"invalid token", time.Minute, 10 * time.Second, nil, 0,
+			[]check{{5 * time.Second, true, false}, {11 * time.Second, false, false}}},
+		{"negative caching disabled", time.Minute, 0, nil, 0, []check{{0, false, false}}},
+		{"token expiring before the ttl", time.Minute, 0, tok, 30,
+			[]check{{29 * time.Second, true, true}, {31 * time.Second, false, false}}},
+		{"token expiring before the stale window", time.Minute, 0, tok, 300,
+			[]check{{2 * time.Minute, false, true}, {6 * time.Minute, false, false}}},
+	}
+	for _, tc := range tests {
+		clock := newFakeClock()
+		c := newTokenCache(tc.ttl, tc.negTTL)
+		c.now = clock.now
+		c.set("key.secret", tc.token, tc.expiresIn)
+		var elapsed time.Duration
+		for _, ck := range tc.checks {
+			clock.add(ck.at - elapsed)
+			elapsed = ck.at
+			e := c.get("key.secret")
+			if (e != nil) != ck.fresh || (e != nil && e.token != tc.token) {
+				t.Errorf("A cached %s after %s should be fresh (%t), received %+v.", tc.name, ck.at, ck.fresh, e)
+			}
+			if stale := c.getStale("key.secret"); (stale != nil) != ck.stale {
+				t.Errorf("A cached %s after %s should be served stale (%t), received %+v.", tc.name, ck.at, ck.stale,
+					stale)
+			}
+		}
+	}
+}
+
+func TestTokenCacheRemoveTokenID(t *testing.T) {
+	t.Parallel()
+	c := newTokenCache(time.Minute, time.Minute)
+	c.set("a.1", &db.AuthToken{ID: 1}, 0)
+	c.set("a.2", &db.AuthToken{ID: 1}, 0)
+	c.set("b.1", &db.AuthToken{ID: 2}, 0)
+	c.set("c.1", nil, 0)
+	c.removeTokenID(1)
+	if c.get("a.1") != nil || c.get("a.2") != nil || c.getStale("a.1") != nil {
+		t.Errorf("Each entry of the token should be removed.")
+	}
+	if c.get("b.1") == nil || c.get("c.1") == nil {
+		t.Errorf("Entries of other tokens should be kept.")
+	}
+}
+
+// TestLookupTokenStale checks a cached token is served while the DB is down, but only for the stale window.
+func TestLookupTokenStale(t *testing.T) {
+	t.Parallel()
+	s, f := newFakeServer(t)
+	clock := newFakeClock()
+	s.tokens = newTokenCache(time.Minute, 0)
+	s.tokens.now = clock.now
+	key, secret, salt, hash, _ := newTokenSecret()
+	stored := &db.AuthToken{ID: 7, Key: key, Salt: salt, Hash: hash, Name: "ci", Role: RoleDeploy}
+	var mu sync.Mutex
+	down := false
+	f.on("WHERE token_key = ?", func(args []driver.Value) *fakeResult {
+		mu.Lock()
+		defer mu.Unlock()
+		if down {
+			return &fakeResult{err: errors.New("connection refused")}
+		}
+		return tokenRow(stored, int64(0))
+	})
+	r := requestAs(httpGet, httpRouteV1Info, "", nil)
+	bearer := key + "." + secret
+
+	if s.lookupToken(r, bearer) == nil {
+		t.Fatalf("The token should be valid.")
+	}
+	mu.Lock()
+	down = true
+	mu.Unlock()
+	clock.add(2 * time.Minute)
+	if s.lookupToken(r, bearer) == nil {
+		t.Errorf("A cached token should be served while the DB is down.")
+	}
+	if s.lookupToken(r, key+".wrong") != nil {
+		t.Errorf("An uncached token should not be valid while the DB is down.")
+	}
+	clock.add(tokenCacheStaleTTL)
+	if s.lookupToken(r, bearer) != nil {
+		t.Errorf("A cached token should not be served after the stale window.")
+	}
+}
+
+// TestRotateTokenEvicts checks the old secret of a rotated token is rejected at once, though cached.
+func TestRotateTokenEvicts(t *testing.T) {
+	t.Parallel()
+	s, f := newFakeServer(t)
+	s.tokens = newTokenCache(time.Hour, 0)
+	key, secret, salt, hash, _ := newTokenSecret()
+	var mu sync.Mutex
+	stored := &db.AuthToken{ID: 7, Key: key, Salt: salt, Hash: hash, Name: "ci", Role: RoleDeploy}
+	f.on("WHERE token_key = ?", func(args []driver.Value) *fakeResult {
+		mu.Lock()
+		defer mu.Unlock()
+		return tokenRow(stored, int64(0))
+	})
+	f.on("FROM auth_tokens WHERE id = ?", func(args []driver.Value) *fakeResult {
+		mu.Lock()
+		defer mu.Unlock()
+		return tokenRow(stored)
+	})
+	f.on("SET token_salt = ?", func(args []driver.Value) *fakeResult {
+		mu.Lock()
+		defer mu.Unlock()
+		stored.Salt, stored.Hash = args[0].(string), args[1].(string)
+		return &fakeResult{affected: 1}
+	})
+	r := requestAs(httpGet, httpRouteV1Info, "", nil)
+	if s.lookupToken(r, key+"."+secret) == nil {
+		t.Fatalf("The token should be valid.")
+	}
+
+	w := httptest.NewRecorder()
+	s.tokensHandler(w, requestAs(httpPost, httpRouteV1Tokens+"/7/rotate", "", &Identity{Name: "ops", Role: RoleAdmin}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Rotate should succeed, received %d: %s", w.Code, w.Body.String())
+	}
+	if s.lookupToken(r, key+"."+secret) != nil {
+		t.Errorf("The old secret of a rotated token should be rejected, even when cached.")
+	}
+}
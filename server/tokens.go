@@ -0,0 +1,264 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/composer22/coreos-deploy/db"
+)
+
+const (
+	tokenKeySize    = 8  // Random bytes in the public token key.
+	tokenSecretSize = 32 // Random bytes in the token secret.
+	tokenSaltSize   = 16 // Random bytes in the salt for the secret hash.
+)
+
+// tokenRequest is the payload to create or rotate a token.
+type tokenRequest struct {
+	Name           string `json:"name"`           // The name of the user or service.
+	Role           string `json:"role"`           // The role granted: read, deploy or admin.
+	ServicePattern string `json:"servicePattern"` // Optional glob of service names the token may deploy.
+	CertSubject    string `json:"certSubject"`    // Optional client certificate common name of this identity.
+	Notes          string `json:"notes"`          // General comments.
+	ExpiresIn      string `json:"expiresIn"`      // Optional lifetime of the token, ex: "720h".
+}
+
+// tokenResponse returns the token information along with the bearer token, which is only ever
+// shown once on create or rotate.
+type tokenResponse struct {
+	*db.AuthToken
+	Token string `json:"token"`
+}
+
+// newTokenSecret returns a new public token key, secret, salt and salted hash of the secret.
+// The bearer token presented by the client is "<key>.<secret>".
+func newTokenSecret() (key string, secret string, salt string, hash string, err error) {
+	k := make([]byte, tokenKeySize)
+	sc := make([]byte, tokenSecretSize)
+	sl := make([]byte, tokenSaltSize)
+	for _, b := range [][]byte{k, sc, sl} {
+		if _, err = rand.Read(b); err != nil {
+			return
+		}
+	}
+	key = hex.EncodeToString(k)
+	secret = base64.RawURLEncoding.EncodeToString(sc)
+	salt = hex.EncodeToString(sl)
+	hash = hashTokenSecret(salt, secret)
+	return
+}
+
+// hashTokenSecret returns the salted SHA-256 hash of a token secret.
+func hashTokenSecret(salt string, secret string) string {
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte(secret))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// splitToken splits a bearer token into its public key and secret.
+func splitToken(token string) (key string, secret string, ok bool) {
+	i := strings.Index(token, ".")
+	if i <= 0 || i == len(token)-1 {
+		return "", "", false
+	}
+	return token[:i], token[i+1:], true
+}
+
+// validTokenSecret returns true if the secret matches the salted hash of the token. An empty hash,
+// such as that of a migrated plaintext token, matches nothing.
+func validTokenSecret(t *db.AuthToken, secret string) bool {
+	return t.Hash != "" && hmac.Equal([]byte(hashTokenSecret(t.Salt, secret)), []byte(t.Hash))
+}
+
+// parseExpiresIn converts an optional duration string to seconds.
+func parseExpiresIn(expiresIn string) (int64, error) {
+	if expiresIn == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(expiresIn)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, errors.New("duration must be positive")
+	}
+	return int64(d / time.Second), nil
+}
+
+// tokensHandler handles admin requests to create, list, rotate and revoke API tokens.
+//
+//	GET    /v1.0/tokens             - list all tokens.
+//	POST   /v1.0/tokens             - create a token.
+//	POST   /v1.0/tokens/{id}/rotate - replace the secret of a token.
+//	DELETE /v1.0/tokens/{id}        - revoke a token.
+func (s *Server) tokensHandler(w http.ResponseWriter, r *http.Request) {
+	if s.invalidHeader(w, r) || s.invalidAuth(w, r, RoleAdmin) {
+		return
+	}
+
+	params := routeParams(r.URL.Path, httpRouteV1Tokens)
+	switch {
+	case len(params) == 0 && r.Method == httpGet:
+		s.listTokens(w, r)
+	case len(params) == 0 && r.Method == httpPost:
+		setAudit(r, "token.create", "", "")
+		s.createToken(w, r)
+	case len(params) == 2 && params[1] == "rotate" && r.Method == httpPost:
+		setAudit(r, "token.rotate", "", "id="+params[0])
+		s.rotateToken(w, r, params[0])
+	case len(params) == 1 && r.Method == httpDelete:
+		setAudit(r, "token.revoke", "", "id="+params[0])
+		s.revokeToken(w, r, params[0])
+	default:
+		http.Error(w, InvalidMethod, http.StatusMethodNotAllowed)
+	}
+}
+
+// listTokens returns all the tokens without their secrets.
+func (s *Server) listTokens(w http.ResponseWriter, r *http.Request) {
+	tokens, err := s.db.WithContext(r.Context()).QueryAuthTokens()
+	if err != nil {
+		http.Error(w, DatabaseError, http.StatusInternalServerError)
+		return
+	}
+	b, _ := json.Marshal(tokens)
+	w.Write(b)
+}
+
+// createToken creates a new token and returns it along with the bearer token.
+func (s *Server) createToken(w http.ResponseWriter, r *http.Request) {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, InvalidBody, http.StatusBadRequest)
+		return
+	}
+	var q tokenRequest
+	if err := json.Unmarshal(b, &q); err != nil {
+		http.Error(w, InvalidJSONText, http.StatusBadRequest)
+		return
+	}
+	if _, ok := roleRanks[q.Role]; !ok {
+		http.Error(w, InvalidRole, http.StatusBadRequest)
+		return
+	}
+	expiresIn, err := parseExpiresIn(q.ExpiresIn)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s err: %s", InvalidDuration, err), http.StatusBadRequest)
+		return
+	}
+
+	key, secret, salt, hash, err := newTokenSecret()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	id, err := s.db.WithContext(r.Context()).CreateAuthToken(key, salt, hash, q.Name, q.Role, q.ServicePattern,
+		q.CertSubject, q.Notes, expiresIn)
+	if err != nil {
+		http.Error(w, DatabaseError, http.StatusInternalServerError)
+		return
+	}
+	setAudit(r, "", "", fmt.Sprintf("id=%d name=%s role=%s", id, q.Name, q.Role))
+	s.writeToken(w, r, id, key+"."+secret)
+}
+
+// rotateToken replaces the secret of a token and returns the new bearer token.
+func (s *Server) rotateToken(w http.ResponseWriter, r *http.Request, param string) {
+	id, err := strconv.Atoi(param)
+	if err != nil {
+		http.Error(w, NotFound, http.StatusNotFound)
+		return
+	}
+	var q tokenRequest
+	if b, err := ioutil.ReadAll(r.Body); err == nil && len(b) > 0 {
+		if err := json.Unmarshal(b, &q); err != nil {
+			http.Error(w, InvalidJSONText, http.StatusBadRequest)
+			return
+		}
+	}
+	expiresIn, err := parseExpiresIn(q.ExpiresIn)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s err: %s", InvalidDuration, err), http.StatusBadRequest)
+		return
+	}
+
+	t, err := s.db.WithContext(r.Context()).QueryAuthToken(id)
+	if err != nil || t.RevokedAt != "" {
+		http.Error(w, NotFound, http.StatusNotFound)
+		return
+	}
+	_, secret, salt, hash, err := newTokenSecret()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := s.db.WithContext(r.Context()).RotateAuthToken(id, salt, hash, expiresIn); err != nil {
+		http.Error(w, NotFound, http.StatusNotFound)
+		return
+	}
+	s.tokens.removeTokenID(id)
+	s.writeToken(w, r, id, t.Key+"."+secret)
+}
+
+// revokeToken revokes a token so it can no longer be used.
+func (s *Server) revokeToken(w http.ResponseWriter, r *http.Request, param string) {
+	id, err := strconv.Atoi(param)
+	if err != nil {
+		http.Error(w, NotFound, http.StatusNotFound)
+		return
+	}
+	if err := s.db.WithContext(r.Context()).RevokeAuthToken(id); err != nil {
+		http.Error(w, NotFound, http.StatusNotFound)
+		return
+	}
+	s.tokens.removeTokenID(id)
+	w.Write([]byte(fmt.Sprintf(`{"id":%d,"revoked":true}`, id)))
+}
+
+// writeToken writes the token information and bearer token to the response.
+func (s *Server) writeToken(w http.ResponseWriter, r *http.Request, id int, token string) {
+	t, err := s.db.WithContext(r.Context()).QueryAuthToken(id)
+	if err != nil {
+		http.Error(w, DatabaseError, http.StatusInternalServerError)
+		return
+	}
+	b, _ := json.Marshal(&tokenResponse{AuthToken: t, Token: token})
+	w.Write(b)
+}
+
+// PrintNewTokenAndExit creates a token directly in the database, prints the bearer token, then exits.
+// This is used to bootstrap the first admin token.
+func PrintNewTokenAndExit(dsn string, name string, role string) {
+	if _, ok := roleRanks[role]; !ok {
+		fmt.Println(InvalidRole)
+		os.Exit(1)
+	}
+	d, err := db.NewDBConnect(dsn)
+	if err != nil {
+		fmt.Printf("Unable to connect to database: %s\n", err)
+		os.Exit(1)
+	}
+	key, secret, salt, hash, err := newTokenSecret()
+	if err == nil {
+		_, err = d.CreateAuthToken(key, salt, hash, name, role, "", "", "Created from the command line.", 0)
+	}
+	d.Close()
+	if err != nil {
+		fmt.Printf("Unable to create token: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s.%s\n", key, secret)
+	os.Exit(0)
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/composer22/coreos-deploy/db"
+)
+
+// tokenRow returns the columns of db.authTokenColumns for a token, followed by any extra values.
+func tokenRow(t *db.AuthToken, extra ...driver.Value) *fakeResult {
+	var revokedAt driver.Value
+	if t.RevokedAt != "" {
+		revokedAt = t.RevokedAt
+	}
+	row := []driver.Value{int64(t.ID), t.Key, t.Salt, t.Hash, t.Name, t.Role, t.ServicePattern, nil, t.Notes,
+		nil, nil, revokedAt, "2016-01-02 15:04:05", "2016-01-02 15:04:05"}
+	columns := strings.Split("id,token_key,token_salt,token_hash,name,role,service_pattern,cert_subject,notes,"+
+		"expires_at,last_used_at,revoked_at,updated_at,created_at", ",")
+	for i := range extra {
+		columns = append(columns, fmt.Sprintf("extra%d", i))
+	}
+	return &fakeResult{columns: columns, rows: [][]driver.Value{append(row, extra...)}}
+}
+
+func TestSplitToken(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		token  string
+		key    string
+		secret string
+		ok     bool
+	}{
+		{"abc.def", "abc", "def", true},
+		{"abc.def.ghi", "abc", "def.ghi", true},
+		{"abcdef", "", "", false},
+		{".def", "", "", false},
+		{"abc.", "", "", false},
+		{"", "", "", false},
+	}
+	for _, tc := range tests {
+		key, secret, ok := splitToken(tc.token)
+		if key != tc.key || secret != tc.secret || ok != tc.ok {
+			t.Errorf("Token %q should split to %q, %q, %t; received %q, %q, %t.", tc.token, tc.key, tc.secret,
+				tc.ok, key, secret, ok)
+		}
+	}
+}
+
+func TestParseExpiresIn(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		expiresIn string
+		secs      int64
+		ok        bool
+	}{
+		{"", 0, true},
+		{"90s", 90, true},
+		{"720h", 720 * 3600, true},
+		{"0s", 0, false},
+		{"-1h", 0, false},
+		{"soon", 0, false},
+	}
+	for _, tc := range tests {
+		secs, err := parseExpiresIn(tc.expiresIn)
+		if secs != tc.secs || (err == nil) != tc.ok {
+			t.Errorf("%q should be %d seconds (ok %t); received %d, %v.", tc.expiresIn, tc.secs, tc.ok, secs, err)
+		}
+	}
+}
+
+func TestNewTokenSecret(t *testing.T) {
+	t.Parallel()
+	key, secret, salt, hash, err := newTokenSecret()
+	if err != nil {
+		t.Fatalf("Unable to create a token secret: %s", err)
+	}
+	if len(key) != tokenKeySize*2 || len(salt) != tokenSaltSize*2 {
+		t.Errorf("Key %q and salt %q should be %d and %d hex digits.", key, salt, tokenKeySize*2, tokenSaltSize*2)
+	}
+	if strings.Contains(hash, secret) {
+		t.Errorf("Hash %q should not contain the secret.", hash)
+	}
+	tok := &db.AuthToken{Salt: salt, Hash: hash}
+	if !validTokenSecret(tok, secret) {
+		t.Errorf("Secret should match its own hash.")
+	}
+	if validTokenSecret(tok, secret+"x") {
+		t.Errorf("Another secret should not match the hash.")
+	}
+	if validTokenSecret(&db.AuthToken{Salt: salt + "0", Hash: hash}, secret) {
+		t.Errorf("The secret should not match with another salt.")
+	}
+	if validTokenSecret(&db.AuthToken{}, "") {
+		t.Errorf("An empty hash should match nothing.")
+	}
+	_, secret2, salt2, _, _ := newTokenSecret()
+	if secret2 == secret || salt2 == salt {
+		t.Errorf("Each token should have a new secret and salt.")
+	}
+}
+
+// TestTokenLifecycle issues a token through the API, looks it up as a bearer token, then revokes it.
+func TestTokenLifecycle(t *testing.T) {
+	t.Parallel()
+	s, f := newFakeServer(t)
+	s.tokens = newTokenCache(time.Minute, 0)
+	var stored *db.AuthToken
+	f.on("INSERT INTO auth_tokens", func(args []driver.Value) *fakeResult {
+		stored = &db.AuthToken{ID: 7, Key: args[0].(string), Salt: args[1].(string), Hash: args[2].(string),
+			Name: args[3].(string), Role: args[4].(string), ServicePattern: args[5].(string)}
+		return &fakeResult{affected: 1, lastID: 7}
+	})
+	f.on("SET revoked_at", func(args []driver.Value) *fakeResult {
+		if stored.RevokedAt != "" {
+			return &fakeResult{}
+		}
+		stored.RevokedAt = "2016-01-02 15:04:05"
+		return &fakeResult{affected: 1}
+	})
+	f.on("WHERE token_key = ?", func(args []driver.Value) *fakeResult {
+		if stored == nil || stored.RevokedAt != "" || args[0] != stored.Key {
+			return noRows(args)
+		}
+		return tokenRow(stored, int64(0))
+	})
+	f.on("FROM auth_tokens WHERE id = ?", func(args []driver.Value) *fakeResult {
+		return tokenRow(stored)
+	})
+	admin := &Identity{Name: "ops", Role: RoleAdmin}
+
+	// Issue.
+	w := httptest.NewRecorder()
+	s.tokensHandler(w, requestAs(httpPost, httpRouteV1Tokens, `{"name":"ci","role":"bogus"}`, admin))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("An unknown role should return %d, received %d.", http.StatusBadRequest, w.Code)
+	}
+	w = httptest.NewRecorder()
+	s.tokensHandler(w, requestAs(httpPost, httpRouteV1Tokens,
+		`{"name":"ci","role":"deploy","servicePattern":"acme-*"}`, admin))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Create should return %d, received %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var issued struct {
+		ID    int    `json:"id"`
+		Key   string `json:"key"`
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &issued); err != nil {
+		t.Fatalf("Unable to decode the created token: %s", err)
+	}
+	key, secret, ok := splitToken(issued.Token)
+	if !ok || issued.ID != 7 || key != issued.Key || key != stored.Key {
+		t.Fatalf("Created token %+v does not match the stored key %q.", issued, stored.Key)
+	}
+	if stored.Hash == "" || strings.Contains(stored.Hash, secret) || strings.Contains(w.Body.String(), stored.Hash) {
+		t.Errorf("Only a hash of the secret should be stored, and the hash should not be returned.")
+	}
+
+	// Lookup.
+	r := requestAs(httpGet, httpRouteV1Info, "", nil)
+	tok := s.lookupToken(r, issued.Token)
+	if tok == nil {
+		t.Fatalf("The issued token should be valid.")
+	}
+	if id := tokenIdentity(tok); id.Name != "ci" || id.Role != RoleDeploy || id.ServicePattern != "acme-*" {
+		t.Errorf("Unexpected identity of the token: %+v", id)
+	}
+	if s.lookupToken(r, key+".wrong") != nil {
+		t.Errorf("The key with another secret should not be valid.")
+	}
+	if s.lookupToken(r, "unknown."+secret) != nil {
+		t.Errorf("An unknown key should not be valid.")
+	}
+	if len(f.executed("SET last_used_at")) == 0 {
+		t.Errorf("A valid lookup should record the use of the token.")
+	}
+
+	// Revoke.
+	w = httptest.NewRecorder()
+	s.tokensHandler(w, requestAs(httpDelete, httpRouteV1Tokens+"/7", "", admin))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Revoke should return %d, received %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if s.lookupToken(r, issued.Token) != nil {
+		t.Errorf("A revoked token should not be valid, even when cached.")
+	}
+	w = httptest.NewRecorder()
+	s.tokensHandler(w, requestAs(httpDelete, httpRouteV1Tokens+"/7", "", admin))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Revoking again should return %d, received %d.", http.StatusNotFound, w.Code)
+	}
+}
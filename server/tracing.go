@@ -0,0 +1,68 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/composer22/coreos-deploy/trace"
+)
+
+const (
+	traceServiceName  = "coreos-deploy" // The service.name of exported spans.
+	traceparentHeader = "traceparent"   // W3C trace context header of a client continuing its trace.
+)
+
+// newTracer is a factory function that returns a tracer exporting spans to an OTLP/HTTP collector
+// or a file, or nil if tracing is not configured.
+func (s *Server) newTracer() (*trace.Tracer, error) {
+	var exporter trace.Exporter
+	switch {
+	case s.opts.TraceOTLPEndpoint != "" && s.opts.TraceFile != "":
+		return nil, errors.New("Only one of --trace_otlp_endpoint and --trace_file may be set.")
+	case s.opts.TraceOTLPEndpoint != "":
+		exporter = trace.NewOTLPExporter(traceServiceName, s.opts.TraceOTLPEndpoint)
+	case s.opts.TraceFile != "":
+		f, err := trace.NewFileExporter(traceServiceName, s.opts.TraceFile)
+		if err != nil {
+			return nil, err
+		}
+		exporter = f
+	default:
+		return nil, nil
+	}
+	return trace.New(traceServiceName, exporter, func(err error) {
+		s.log.Errorf("Unable to export trace spans: %s", err)
+	}), nil
+}
+
+// startRequestSpan begins the trace of a request to the route and returns the request with the
+// span in its context. A valid traceparent header continues the trace of the client; otherwise the
+// X-Request-ID is used as the trace ID so a deploy ID leads straight to its trace.
+func (s *Server) startRequestSpan(w http.ResponseWriter, r *http.Request, route string) (*http.Request, *trace.Span) {
+	if s.tracer == nil {
+		return r, nil
+	}
+	requestID := w.Header().Get("X-Request-ID")
+	traceID, parent, err := trace.ParseTraceparent(r.Header.Get(traceparentHeader))
+	if err != nil {
+		traceID, _ = trace.ParseTraceID(requestID)
+		parent = trace.SpanID{}
+	}
+	ctx, span := s.tracer.Root(r.Context(), "HTTP "+r.Method+" "+route, traceID, parent)
+	span.SetAttr("http.method", r.Method)
+	span.SetAttr("http.route", route)
+	span.SetAttr("http.target", r.URL.Path)
+	span.SetAttr("request.id", requestID)
+	return r.WithContext(ctx), span
+}
+
+// endRequestSpan records the status code of the response and ends the span. Server errors mark
+// the span as failed.
+func endRequestSpan(span *trace.Span, status int) {
+	span.SetAttr("http.status_code", strconv.Itoa(status))
+	if status >= http.StatusInternalServerError {
+		span.SetError(errors.New(http.StatusText(status)))
+	}
+	span.End()
+}
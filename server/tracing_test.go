@@ -0,0 +1,75 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/composer22/coreos-deploy/trace"
+)
+
+// spanRecorder keeps exported spans for inspection.
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*trace.SpanData
+}
+
+func (sr *spanRecorder) Export(spans []*trace.SpanData) error {
+	sr.mu.Lock()
+	sr.spans = append(sr.spans, spans...)
+	sr.mu.Unlock()
+	return nil
+}
+
+func (sr *spanRecorder) Close() error { return nil }
+
+func TestRequestSpan(t *testing.T) {
+	t.Parallel()
+	rec := &spanRecorder{}
+	s := &Server{tracer: trace.New(traceServiceName, rec, nil)}
+
+	// Without a traceparent the request ID is the trace ID.
+	w := httptest.NewRecorder()
+	w.Header().Set("X-Request-ID", "4BF92F35-77B3-4DA6-A3CE-929D0E0E4736")
+	r, span := s.startRequestSpan(w, httptest.NewRequest("POST", httpRouteV1Deploy, nil), httpRouteV1Deploy)
+	_, child := trace.Start(trace.Detach(r.Context()), "deploy")
+	child.End()
+	endRequestSpan(span, http.StatusInternalServerError)
+
+	// A valid traceparent continues the trace of the client.
+	w = httptest.NewRecorder()
+	w.Header().Set("X-Request-ID", createV4UUID())
+	req := httptest.NewRequest("GET", httpRouteV1Info, nil)
+	req.Header.Set(traceparentHeader, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	_, span = s.startRequestSpan(w, req, httpRouteV1Info)
+	endRequestSpan(span, http.StatusOK)
+	s.tracer.Close()
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if len(rec.spans) != 3 {
+		t.Fatalf("Each span should be exported, received %d.", len(rec.spans))
+	}
+	deploy, post, info := rec.spans[0], rec.spans[1], rec.spans[2]
+	if post.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || deploy.TraceID != post.TraceID ||
+		deploy.ParentID != post.SpanID {
+		t.Errorf("The request ID should be the trace of the request and its deploy, received %s.", post.TraceID)
+	}
+	if post.Name != "HTTP POST "+httpRouteV1Deploy || post.Attributes["http.status_code"] != "500" || post.Error == "" {
+		t.Errorf("A server error should fail the span, received %+v.", post)
+	}
+	if info.TraceID.String() != "0af7651916cd43dd8448eb211c80319c" || info.ParentID.String() != "b7ad6b7169203331" ||
+		info.Error != "" {
+		t.Errorf("The span should continue the trace of the client, received %+v.", info)
+	}
+}
+
+func TestRequestSpanDisabled(t *testing.T) {
+	t.Parallel()
+	s := &Server{}
+	r := httptest.NewRequest("GET", httpRouteV1Info, nil)
+	if r2, span := s.startRequestSpan(httptest.NewRecorder(), r, httpRouteV1Info); r2 != r || span != nil {
+		t.Errorf("Requests should not be traced without a tracer.")
+	}
+}
@@ -2,12 +2,18 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"errors"
 	"fmt"
 	mr "math/rand"
 	"os/exec"
+	"path/filepath"
+	"strings"
 	"time"
+
+	"github.com/composer22/coreos-deploy/logger"
+	"github.com/composer22/coreos-deploy/trace"
 )
 
 // createV4UUID returns a V4 RFC4122 compliant UUID.
@@ -31,18 +37,103 @@ func randomString(n int) string {
 	return string(result)
 }
 
-// execCmd executes an os command and formats any output from stdout/err
-func execCmd(cmd *exec.Cmd) (string, error) {
+// execCmd executes an os command and formats any output from stdout/err. The command is traced as
+// a child of the span in ctx, if any, and logged to log at Debug.
+func execCmd(ctx context.Context, log *logger.Logger, cmd *exec.Cmd) (string, error) {
+	result, err := runCmd(ctx, log, cmd)
+	if result.stderr != "" {
+		return "", err
+	}
+	return result.stdout, err
+}
+
+// cmdResult is the output and exit code of a command.
+type cmdResult struct {
+	stdout   string
+	stderr   string
+	exitCode int // -1 if the command did not start or was killed.
+}
+
+// runCmd executes an os command as execCmd does and returns all of its output. Any output to stderr
+// is also returned as the error.
+func runCmd(ctx context.Context, log *logger.Logger, cmd *exec.Cmd) (*cmdResult, error) {
 	var (
 		stdout bytes.Buffer
 		stderr bytes.Buffer
 	)
 
+	name := filepath.Base(cmd.Path)
+	if len(cmd.Args) > 1 {
+		name += " " + cmd.Args[1]
+	}
+	_, span := trace.Start(ctx, name)
+	span.SetAttr("process.command_args", strings.Join(cmd.Args, " "))
+	defer span.End()
 	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	start := time.Now()
 	err := cmd.Run()
-	result := stdout.String()
-	if err := stderr.String(); err != "" {
-		return "", errors.New(err)
+	result := &cmdResult{stdout: stdout.String(), stderr: stderr.String(), exitCode: -1}
+	if cmd.ProcessState != nil {
+		result.exitCode = cmd.ProcessState.ExitCode()
+	}
+	if result.stderr != "" {
+		err = errors.New(result.stderr)
+	}
+	span.SetError(err)
+	logCall(log, strings.Join(cmd.Args, " "), time.Since(start), err)
+	if len(cmd.Args) > 1 {
+		fleetDuration.Observe(time.Since(start).Seconds(), cmd.Args[1])
+		if err != nil {
+			fleetErrors.Inc(cmd.Args[1])
+		}
 	}
 	return result, err
 }
+
+// splitList returns the trimmed, non-empty values of a comma separated list.
+func splitList(list string) []string {
+	result := make([]string, 0)
+	for _, v := range strings.Split(list, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// routeParams returns the path segments that follow the route prefix.
+// ex: routeParams("/v1.0/tokens/12/rotate", "/v1.0/tokens") returns ["12", "rotate"].
+func routeParams(path string, route string) []string {
+	return splitPath(strings.TrimPrefix(path, route))
+}
+
+// splitPath returns the non-empty segments of a URL path.
+func splitPath(path string) []string {
+	result := make([]string, 0)
+	for _, p := range strings.Split(path, "/") {
+		if p != "" {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// reservedMetadataKeys may not be sent in deploy metadata. The server once recorded facts of its own,
+// such as a freeze override, there, so older deploys would make them look trusted.
+var reservedMetadataKeys = map[string]bool{
+	"freezeOverride": true,
+}
+
+// invalidMetadata returns true if deploy metadata exceeds the allowed number or size of entries, or
+// uses a reserved key.
+func invalidMetadata(metadata map[string]string) bool {
+	if len(metadata) > maxMetadataKeys {
+		return true
+	}
+	for k, v := range metadata {
+		if len(k) > maxMetadataSize || len(v) > maxMetadataSize || reservedMetadataKeys[k] {
+			return true
+		}
+	}
+	return false
+}
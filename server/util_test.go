@@ -0,0 +1,51 @@
+package server
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/composer22/coreos-deploy/logger"
+)
+
+func TestRunCmd(t *testing.T) {
+	t.Parallel()
+	log := logger.New(logger.Info, false)
+	cmd := exec.Command("sh", "-c", "echo started; echo unit does not exist >&2; exit 3")
+	result, err := runCmd(context.Background(), log, cmd)
+	if err == nil || err.Error() != "unit does not exist\n" {
+		t.Errorf("Output to stderr should be the error, received %v.", err)
+	}
+	if result.stdout != "started\n" || result.stderr != "unit does not exist\n" || result.exitCode != 3 {
+		t.Errorf("The output and exit code should be kept, received %+v.", result)
+	}
+
+	// execCmd drops the output of a command that wrote to stderr.
+	if out, err := execCmd(context.Background(), log, exec.Command("sh", "-c", "echo ok")); out != "ok\n" ||
+		err != nil {
+		t.Errorf("Expected the output of the command, received %q %v.", out, err)
+	}
+	if out, _ := execCmd(context.Background(), log, exec.Command("sh", "-c", "echo x; echo y >&2")); out != "" {
+		t.Errorf("Expected no output from a failed command, received %q.", out)
+	}
+}
+
+func TestInvalidMetadata(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		metadata map[string]string
+		invalid  bool
+	}{
+		{nil, false},
+		{map[string]string{"reason": "Fix login timeout", "ticket": "OPS-123"}, false},
+		{map[string]string{"freezeOverride": "forged"}, true},
+		{map[string]string{"reason": strings.Repeat("x", maxMetadataSize+1)}, true},
+		{map[string]string{strings.Repeat("k", maxMetadataSize+1): "v"}, true},
+	}
+	for _, tc := range tests {
+		if invalid := invalidMetadata(tc.metadata); invalid != tc.invalid {
+			t.Errorf("Metadata %.40v should be invalid: %t.", tc.metadata, tc.invalid)
+		}
+	}
+}
@@ -0,0 +1,442 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/composer22/coreos-deploy/db"
+	"github.com/composer22/coreos-deploy/logger"
+)
+
+// Events sent to webhooks.
+const (
+	EventDeployStarted    = "deploy.started"     // A deploy began running.
+	EventDeploySucceeded  = "deploy.succeeded"   // A deploy completed successfully.
+	EventDeployFailed     = "deploy.failed"      // A deploy failed.
+	EventDeployRolledBack = "deploy.rolled_back" // A deploy failed and the previous service was kept.
+	EventPing             = "ping"               // A test event sent on request.
+)
+
+const (
+	eventHeader         = "X-Event"        // The event of a webhook delivery.
+	deliveryIDHeader    = "X-Delivery-ID"  // The id of a webhook delivery, the same on each retry.
+	webhookPollInterval = 10 * time.Second // How often due deliveries are checked.
+	webhookTimeout      = 10 * time.Second // How long a receiver has to respond.
+	webhookLease        = 60               // Seconds an attempt is held before another sender may retry it.
+	webhookRetryBase    = 30 * time.Second // Wait before the first retry, doubled on each attempt.
+	webhookRetryMax     = time.Hour        // Longest wait between retries.
+	webhookMaxAttempts  = 8                // Attempts before a delivery is marked as failed.
+	webhookBatchSize    = 100              // Most deliveries sent in one pass.
+	webhookLogMax       = 255              // Longest error stored with a delivery.
+	webhookDefaultLimit = 50               // Deliveries returned when no limit is requested.
+	webhookMaxLimit     = 1000             // Most deliveries returned.
+)
+
+// webhookEvents are the events a webhook may subscribe to.
+var webhookEvents = []string{EventDeployStarted, EventDeploySucceeded, EventDeployFailed, EventDeployRolledBack}
+
+// DeployEvent is the JSON payload sent to webhooks on a deploy lifecycle event.
+type DeployEvent struct {
+	Event       string  `json:"event"`                     // The event, ex: deploy.succeeded.
+	DeployID    string  `json:"deployID"`                  // The deploy UUID.
+	ServiceName string  `json:"serviceName"`               // The service deployed.
+	Version     string  `json:"version"`                   // The version deployed.
+	Domain      string  `json:"domain"`                    // The domain of the cluster.
+	Environment string  `json:"environment"`               // The environment of the cluster.
+	Status      int     `json:"status"`                    // The status ID of the deploy.
+	Message     string  `json:"message"`                   // A short status message.
+	DeployedBy  string  `json:"deployedBy"`                // The name of the identity that requested the deploy.
+	Duration    float64 `json:"durationSeconds,omitempty"` // How long the deploy ran, once it has completed.
+	Timestamp   string  `json:"timestamp"`                 // When the event occurred (RFC 3339).
+	Log         string  `json:"-"`                         // The deploy log, once it has completed.
+}
+
+// Notifier is informed of deploy lifecycle events.
+type Notifier interface {
+	Notify(e *DeployEvent)
+}
+
+// notifiers informs each of several notifiers in turn.
+type notifiers []Notifier
+
+// Notify passes the event to each notifier.
+func (ns notifiers) Notify(e *DeployEvent) {
+	for _, n := range ns {
+		n.Notify(e)
+	}
+}
+
+// webhookDispatcher queues deploy events for the webhooks subscribed to them and sends them in the
+// background, retrying failed deliveries. Deliveries are kept in the DB so that they survive a
+// restart of the server and are sent once even with several servers.
+type webhookDispatcher struct {
+	db      *db.DBConnect  // The subscriptions and delivery log.
+	secrets *SecretBox     // Decrypts the webhook secrets.
+	log     *logger.Logger // Records delivery errors.
+	client  *http.Client   // Sends the deliveries.
+	wake    chan struct{}  // Signals that new deliveries are queued.
+}
+
+// newWebhookDispatcher is a factory function that returns a new webhookDispatcher instance.
+func newWebhookDispatcher(d *db.DBConnect, box *SecretBox, l *logger.Logger) *webhookDispatcher {
+	return &webhookDispatcher{
+		db:      d,
+		secrets: box,
+		log:     l,
+		client:  &http.Client{Timeout: webhookTimeout},
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// Notify queues the event for each webhook subscribed to it and wakes the sender.
+func (d *webhookDispatcher) Notify(e *DeployEvent) {
+	hooks, err := d.db.QueryWebhooks()
+	if err != nil {
+		d.log.Errorf("Unable to query webhooks for %s of deploy %s: %s", e.Event, e.DeployID, err)
+		return
+	}
+	payload, _ := json.Marshal(e)
+	queued := false
+	for _, h := range hooks {
+		if !webhookWants(h, e.Event, e.ServiceName) {
+			continue
+		}
+		if _, err := d.db.InsertWebhookDelivery(h.ID, e.Event, e.DeployID, payload); err != nil {
+			d.log.Errorf("Unable to queue %s of deploy %s for webhook %d: %s", e.Event, e.DeployID, h.ID, err)
+			continue
+		}
+		queued = true
+	}
+	if queued {
+		d.signal()
+	}
+}
+
+// signal wakes the sender without waiting.
+func (d *webhookDispatcher) signal() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// webhookWants returns true if the webhook is subscribed to the event for the service.
+func webhookWants(h *db.Webhook, event string, serviceName string) bool {
+	if h.ServicePattern != "" {
+		if ok, _ := path.Match(h.ServicePattern, serviceName); !ok {
+			return false
+		}
+	}
+	if h.Events == "" {
+		return true
+	}
+	for _, e := range splitList(h.Events) {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// run sends due deliveries when woken or polled until the server is shut down.
+func (d *webhookDispatcher) run(done <-chan struct{}) {
+	t := time.NewTicker(webhookPollInterval)
+	defer t.Stop()
+	for {
+		d.sendDue()
+		select {
+		case <-done:
+			return
+		case <-d.wake:
+		case <-t.C:
+		}
+	}
+}
+
+// sendDue makes an attempt at each delivery that is due and records the result.
+func (d *webhookDispatcher) sendDue() {
+	due, err := d.db.QueryDueWebhookDeliveries(webhookBatchSize)
+	if err != nil {
+		d.log.Errorf("Unable to query webhook deliveries: %s", err)
+		return
+	}
+	for _, dl := range due {
+		if err := d.db.ClaimWebhookDelivery(dl.ID, dl.Attempts, webhookLease); err != nil {
+			continue // Sent by another server.
+		}
+		attempts := dl.Attempts + 1
+		code, err := d.send(dl)
+		status, retryIn, lastError := db.DeliveryDelivered, time.Duration(0), ""
+		if err != nil {
+			status, retryIn, lastError = db.DeliveryPending, webhookBackoff(attempts), err.Error()
+			if attempts >= webhookMaxAttempts {
+				status = db.DeliveryFailed
+				d.log.Warningf("Webhook %d delivery %d failed after %d attempts: %s", dl.WebhookID, dl.ID,
+					attempts, err)
+			}
+		}
+		if len(lastError) > webhookLogMax {
+			lastError = lastError[:webhookLogMax]
+		}
+		if err := d.db.UpdateWebhookDelivery(dl.ID, status, code, lastError,
+			int64(retryIn/time.Second)); err != nil {
+			d.log.Errorf("Unable to update webhook delivery %d: %s", dl.ID, err)
+		}
+	}
+}
+
+// send posts a delivery to its webhook and returns the HTTP status of the response.
+func (d *webhookDispatcher) send(dl *db.WebhookDelivery) (int, error) {
+	h, err := d.db.QueryWebhook(dl.WebhookID)
+	if err != nil {
+		return 0, errors.New("webhook not found")
+	}
+	if d.secrets == nil {
+		return 0, errors.New("no secret key to decrypt the webhook secret")
+	}
+	secret, err := d.secrets.Open(h.Secret)
+	if err != nil {
+		return 0, err
+	}
+	return postWebhook(d.client, h.URL, secret, dl.Event, strconv.Itoa(dl.ID), dl.Payload)
+}
+
+// postWebhook posts a signed payload to a receiver. The signature is the same as for signed deploy
+// requests: X-Signature is "sha256=" + hex HMAC-SHA256 of "<X-Timestamp>.<body>" with the secret.
+// An error is returned unless the receiver responds with a 2xx status.
+func postWebhook(client *http.Client, target string, secret string, event string, deliveryID string,
+	payload []byte) (int, error) {
+	req, err := http.NewRequest(httpPost, target, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "coreos-deploy/"+version)
+	req.Header.Set(eventHeader, event)
+	req.Header.Set(deliveryIDHeader, deliveryID)
+	req.Header.Set(timestampHeader, ts)
+	req.Header.Set(signatureHeader, signBody(secret, ts, payload))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver responded %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// webhookBackoff returns the wait before the next attempt after the number of attempts made.
+func webhookBackoff(attempts int) time.Duration {
+	wait := webhookRetryBase
+	for i := 1; i < attempts && wait < webhookRetryMax; i++ {
+		wait *= 2
+	}
+	if wait > webhookRetryMax {
+		wait = webhookRetryMax
+	}
+	return wait
+}
+
+// webhookRequest is the payload to create a webhook.
+type webhookRequest struct {
+	URL            string   `json:"url"`            // Where the events are posted (http or https).
+	Events         []string `json:"events"`         // The events to send. Defaults to all events.
+	ServicePattern string   `json:"servicePattern"` // Optional glob of the service names to send.
+	Secret         string   `json:"secret"`         // The secret used to sign payloads. Generated if empty.
+}
+
+// validate checks the webhook request.
+func (q *webhookRequest) validate() error {
+	u, err := url.Parse(q.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an absolute http or https URL")
+	}
+	for _, e := range q.Events {
+		if !validWebhookEvent(e) {
+			return fmt.Errorf("unknown event %s", e)
+		}
+	}
+	if q.ServicePattern != "" {
+		if _, err := path.Match(q.ServicePattern, ""); err != nil {
+			return errors.New("invalid service pattern")
+		}
+	}
+	return nil
+}
+
+// validWebhookEvent returns true if a webhook may subscribe to the event.
+func validWebhookEvent(event string) bool {
+	for _, e := range webhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// webhooksHandler handles admin requests to manage webhooks and inspect their deliveries.
+//
+//	GET    /v1.0/webhooks                 - list all webhooks.
+//	POST   /v1.0/webhooks                 - create a webhook and return its secret once.
+//	DELETE /v1.0/webhooks/{id}            - remove a webhook.
+//	GET    /v1.0/webhooks/{id}/deliveries - list the most recent deliveries of a webhook.
+//	POST   /v1.0/webhooks/{id}/test       - send a ping event to a webhook.
+func (s *Server) webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	if s.invalidHeader(w, r) || s.invalidAuth(w, r, RoleAdmin) {
+		return
+	}
+
+	params := routeParams(r.URL.Path, httpRouteV1Webhooks)
+	switch {
+	case len(params) == 0 && r.Method == httpGet:
+		hooks, err := s.db.WithContext(r.Context()).QueryWebhooks()
+		if err != nil {
+			http.Error(w, DatabaseError, http.StatusInternalServerError)
+			return
+		}
+		b, _ := json.Marshal(hooks)
+		w.Write(b)
+	case len(params) == 0 && r.Method == httpPost:
+		setAudit(r, "webhook.create", "", "")
+		s.createWebhook(w, r)
+	case len(params) == 1 && r.Method == httpDelete:
+		setAudit(r, "webhook.delete", "", "id="+params[0])
+		id, err := strconv.Atoi(params[0])
+		if err != nil || s.db.WithContext(r.Context()).DeleteWebhook(id) != nil {
+			http.Error(w, NotFound, http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(fmt.Sprintf(`{"id":%d,"deleted":true}`, id)))
+	case len(params) == 2 && params[1] == "deliveries" && r.Method == httpGet:
+		s.listWebhookDeliveries(w, r, params[0])
+	case len(params) == 2 && params[1] == "test" && r.Method == httpPost:
+		setAudit(r, "webhook.test", "", "id="+params[0])
+		s.testWebhook(w, r, params[0])
+	default:
+		http.Error(w, InvalidMethod, http.StatusMethodNotAllowed)
+	}
+}
+
+// createWebhook creates a new webhook. The secret is returned once and stored encrypted.
+func (s *Server) createWebhook(w http.ResponseWriter, r *http.Request) {
+	if s.secrets == nil {
+		http.Error(w, SecretKeyRequired, http.StatusConflict)
+		return
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, InvalidBody, http.StatusBadRequest)
+		return
+	}
+	var q webhookRequest
+	if err := json.Unmarshal(b, &q); err != nil {
+		http.Error(w, InvalidJSONText, http.StatusBadRequest)
+		return
+	}
+	if err := q.validate(); err != nil {
+		http.Error(w, fmt.Sprintf("%s err: %s", InvalidWebhook, err), http.StatusBadRequest)
+		return
+	}
+
+	if q.Secret == "" {
+		raw := make([]byte, signingSecretSize)
+		if _, err := rand.Read(raw); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		q.Secret = base64.RawURLEncoding.EncodeToString(raw)
+	}
+	sealed, err := s.secrets.Seal(q.Secret)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	events := strings.Join(q.Events, ",")
+	id, err := s.db.WithContext(r.Context()).CreateWebhook(q.URL, events, q.ServicePattern, sealed,
+		requestIdentity(r).Name)
+	if err != nil {
+		http.Error(w, DatabaseError, http.StatusInternalServerError)
+		return
+	}
+	setAudit(r, "", "", fmt.Sprintf("id=%d url=%s", id, q.URL))
+	b, _ = json.Marshal(&struct {
+		ID     int    `json:"id"`
+		URL    string `json:"url"`
+		Events string `json:"events"`
+		Secret string `json:"secret"`
+	}{
+		ID:     id,
+		URL:    q.URL,
+		Events: events,
+		Secret: q.Secret,
+	})
+	w.Write(b)
+}
+
+// listWebhookDeliveries returns the most recent deliveries of a webhook, newest first. The query
+// parameter limit sets how many are returned.
+func (s *Server) listWebhookDeliveries(w http.ResponseWriter, r *http.Request, webhookID string) {
+	id, err := strconv.Atoi(webhookID)
+	if err != nil {
+		http.Error(w, NotFound, http.StatusNotFound)
+		return
+	}
+	limit := webhookDefaultLimit
+	if l := r.URL.Query().Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 || limit > webhookMaxLimit {
+			http.Error(w, InvalidQueryString, http.StatusBadRequest)
+			return
+		}
+	}
+	deliveries, err := s.db.WithContext(r.Context()).QueryWebhookDeliveries(id, limit)
+	if err != nil {
+		http.Error(w, DatabaseError, http.StatusInternalServerError)
+		return
+	}
+	b, _ := json.Marshal(deliveries)
+	w.Write(b)
+}
+
+// testWebhook queues a ping event for a webhook so a receiver can be checked.
+func (s *Server) testWebhook(w http.ResponseWriter, r *http.Request, webhookID string) {
+	id, err := strconv.Atoi(webhookID)
+	if err != nil {
+		http.Error(w, NotFound, http.StatusNotFound)
+		return
+	}
+	if _, err := s.db.WithContext(r.Context()).QueryWebhook(id); err != nil {
+		http.Error(w, NotFound, http.StatusNotFound)
+		return
+	}
+	payload, _ := json.Marshal(&DeployEvent{
+		Event:       EventPing,
+		Domain:      s.opts.Domain,
+		Environment: s.opts.Environment,
+		Message:     "Test event.",
+		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+	})
+	deliveryID, err := s.db.WithContext(r.Context()).InsertWebhookDelivery(id, EventPing, "", payload)
+	if err != nil {
+		http.Error(w, DatabaseError, http.StatusInternalServerError)
+		return
+	}
+	s.webhooks.signal()
+	w.Write([]byte(fmt.Sprintf(`{"id":%d,"deliveryID":%d}`, id, deliveryID)))
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"crypto/hmac"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/composer22/coreos-deploy/db"
+)
+
+func TestPostWebhookSigned(t *testing.T) {
+	t.Parallel()
+	secret := "s3cr3t"
+	payload := []byte(`{"event":"deploy.succeeded","deployID":"abc"}`)
+	var received *http.Request
+	var body []byte
+	rcv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer rcv.Close()
+
+	code, err := postWebhook(rcv.Client(), rcv.URL, secret, EventDeploySucceeded, "42", payload)
+	if err != nil || code != http.StatusNoContent {
+		t.Fatalf("Delivery should succeed, received %d %v.", code, err)
+	}
+	if string(body) != string(payload) {
+		t.Errorf("Receiver should get the payload, received %s.", body)
+	}
+	if received.Header.Get(eventHeader) != EventDeploySucceeded || received.Header.Get(deliveryIDHeader) != "42" {
+		t.Errorf("Receiver should get the event and delivery headers, received %v.", received.Header)
+	}
+	want := signBody(secret, received.Header.Get(timestampHeader), body)
+	if !hmac.Equal([]byte(received.Header.Get(signatureHeader)), []byte(want)) {
+		t.Errorf("Signature should verify with the secret, received %s.", received.Header.Get(signatureHeader))
+	}
+}
+
+func TestPostWebhookRejected(t *testing.T) {
+	t.Parallel()
+	rcv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer rcv.Close()
+
+	code, err := postWebhook(rcv.Client(), rcv.URL, "s", EventPing, "1", []byte(`{}`))
+	if err == nil || code != http.StatusServiceUnavailable {
+		t.Errorf("Delivery should fail with the receiver status, received %d %v.", code, err)
+	}
+}
+
+func TestWebhookWants(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		events  string
+		pattern string
+		event   string
+		service string
+		want    bool
+	}{
+		{"", "", EventDeployFailed, "acme-video", true},
+		{"deploy.failed,deploy.rolled_back", "", EventDeployRolledBack, "acme-video", true},
+		{"deploy.failed", "", EventDeploySucceeded, "acme-video", false},
+		{"", "acme-*", EventDeployStarted, "acme-video", true},
+		{"", "acme-*", EventDeployStarted, "other", false},
+	}
+	for _, tc := range tests {
+		h := &db.Webhook{Events: tc.events, ServicePattern: tc.pattern}
+		if got := webhookWants(h, tc.event, tc.service); got != tc.want {
+			t.Errorf("Webhook %q %q for %s of %s should be %t.", tc.events, tc.pattern, tc.event, tc.service, tc.want)
+		}
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{4, 4 * time.Minute},
+		{8, time.Hour},
+		{20, time.Hour},
+	}
+	for _, tc := range tests {
+		if got := webhookBackoff(tc.attempts); got != tc.want {
+			t.Errorf("Backoff after %d attempts should be %s, received %s.", tc.attempts, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OTLP/JSON span kinds and status codes.
+const (
+	otlpKindInternal = 1
+	otlpKindServer   = 2
+	otlpStatusError  = 2
+)
+
+// otlpRequest is an OTLP ExportTraceServiceRequest in the JSON encoding.
+type otlpRequest struct {
+	ResourceSpans []*otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource      `json:"resource"`
+	ScopeSpans []*otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []*otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope   `json:"scope"`
+	Spans []*otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string           `json:"traceId"`
+	SpanID            string           `json:"spanId"`
+	ParentSpanID      string           `json:"parentSpanId,omitempty"`
+	Name              string           `json:"name"`
+	Kind              int              `json:"kind"`
+	StartTimeUnixNano string           `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string           `json:"endTimeUnixNano"`
+	Attributes        []*otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus      `json:"status,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// otlpSpans converts finished spans to the OTLP JSON encoding.
+func otlpSpans(spans []*SpanData) []*otlpSpan {
+	result := make([]*otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		o := &otlpSpan{
+			TraceID:           s.TraceID.String(),
+			SpanID:            s.SpanID.String(),
+			Name:              s.Name,
+			Kind:              otlpKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.Attributes),
+		}
+		if !s.ParentID.IsZero() {
+			o.ParentSpanID = s.ParentID.String()
+		}
+		if s.Server {
+			o.Kind = otlpKindServer
+		}
+		if s.Error != "" {
+			o.Status = &otlpStatus{Code: otlpStatusError, Message: s.Error}
+		}
+		result = append(result, o)
+	}
+	return result
+}
+
+// otlpAttributes converts attributes to the OTLP JSON encoding, sorted by key.
+func otlpAttributes(attrs map[string]string) []*otlpAttribute {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	result := make([]*otlpAttribute, 0, len(keys))
+	for _, k := range keys {
+		result = append(result, &otlpAttribute{Key: k, Value: otlpValue{StringValue: attrs[k]}})
+	}
+	return result
+}
+
+// newOTLPRequest returns the export request of the spans of a service.
+func newOTLPRequest(service string, spans []*SpanData) *otlpRequest {
+	return &otlpRequest{ResourceSpans: []*otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []*otlpAttribute{
+			{Key: "service.name", Value: otlpValue{StringValue: service}},
+		}},
+		ScopeSpans: []*otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/composer22/coreos-deploy/trace"},
+			Spans: otlpSpans(spans),
+		}},
+	}}}
+}
+
+// OTLPExporter posts spans to an OpenTelemetry collector with the OTLP/HTTP JSON protocol.
+type OTLPExporter struct {
+	service  string
+	endpoint string // ex: http://localhost:4318/v1/traces
+	client   *http.Client
+}
+
+// NewOTLPExporter is a factory function that returns an OTLPExporter for the service posting to the
+// endpoint. An endpoint without a path posts to /v1/traces.
+func NewOTLPExporter(service string, endpoint string) *OTLPExporter {
+	if u, err := url.Parse(endpoint); err == nil && strings.Trim(u.Path, "/") == "" {
+		u.Path = "/v1/traces"
+		endpoint = u.String()
+	}
+	return &OTLPExporter{
+		service:  service,
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Export posts the spans to the collector.
+func (e *OTLPExporter) Export(spans []*SpanData) error {
+	b, _ := json.Marshal(newOTLPRequest(e.service, spans))
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("trace: collector responded %s", resp.Status)
+	}
+	return nil
+}
+
+// Close does nothing as the exporter holds no resources.
+func (e *OTLPExporter) Close() error {
+	return nil
+}
+
+// FileExporter appends spans to a file, one OTLP JSON export request per line, for offline use.
+type FileExporter struct {
+	service string
+	mu      sync.Mutex
+	w       io.WriteCloser
+}
+
+// NewFileExporter is a factory function that returns a FileExporter appending to the file at path.
+func NewFileExporter(service string, path string) (*FileExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{service: service, w: f}, nil
+}
+
+// Export writes the spans to the file.
+func (e *FileExporter) Export(spans []*SpanData) error {
+	b, _ := json.Marshal(newOTLPRequest(e.service, spans))
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err := e.w.Write(append(b, '\n'))
+	return err
+}
+
+// Close closes the file.
+func (e *FileExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.w.Close()
+}
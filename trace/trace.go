@@ -0,0 +1,327 @@
+// Package trace records spans of work with W3C trace context identifiers and exports them in
+// batches, either to an OpenTelemetry collector with OTLP/HTTP JSON or to a local file.
+//
+// A trace is begun with Tracer.Root. Work done under it starts child spans with Start, which is
+// a no-op when the context holds no span, so libraries can be traced without a tracer of their own.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	batchSize     = 512             // Spans exported together.
+	batchInterval = 5 * time.Second // Longest a finished span waits to be exported.
+	queueSize     = 4096            // Finished spans waiting to be exported before new ones are dropped.
+)
+
+// TraceID identifies a trace.
+type TraceID [16]byte
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+// String returns the ID as lower case hex.
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+
+// String returns the ID as lower case hex.
+func (s SpanID) String() string { return hex.EncodeToString(s[:]) }
+
+// IsZero returns true if the ID is not set.
+func (t TraceID) IsZero() bool { return t == TraceID{} }
+
+// IsZero returns true if the ID is not set.
+func (s SpanID) IsZero() bool { return s == SpanID{} }
+
+// ParseTraceID returns the trace ID of 32 hex characters. Dashes are ignored so that a UUID may be
+// used as a trace ID.
+func ParseTraceID(value string) (TraceID, error) {
+	var t TraceID
+	b, err := hex.DecodeString(strings.Replace(value, "-", "", -1))
+	if err != nil || len(b) != len(t) {
+		return t, errors.New("trace: invalid trace id")
+	}
+	copy(t[:], b)
+	if t.IsZero() {
+		return t, errors.New("trace: invalid trace id")
+	}
+	return t, nil
+}
+
+// ParseTraceparent returns the trace and parent span of a W3C traceparent header,
+// ex: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func ParseTraceparent(value string) (TraceID, SpanID, error) {
+	var t TraceID
+	var s SpanID
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return t, s, errors.New("trace: invalid traceparent")
+	}
+	t, err := ParseTraceID(parts[1])
+	if err != nil || len(parts[1]) != 32 {
+		return t, s, errors.New("trace: invalid traceparent")
+	}
+	b, err := hex.DecodeString(parts[2])
+	if err != nil || len(b) != len(s) {
+		return t, s, errors.New("trace: invalid traceparent")
+	}
+	copy(s[:], b)
+	if s.IsZero() {
+		return t, s, errors.New("trace: invalid traceparent")
+	}
+	return t, s, nil
+}
+
+// SpanData is a finished span as given to an exporter.
+type SpanData struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	ParentID   SpanID // Zero for the root of a trace.
+	Name       string
+	Server     bool // Was the span begun by a request from a client?
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+	Error      string // The error of the work, if any.
+}
+
+// Span is work being timed. The methods of a nil Span do nothing.
+type Span struct {
+	tracer *Tracer
+	mu     sync.Mutex
+	data   SpanData
+	ended  bool
+}
+
+// SetAttr records a key and value describing the work.
+func (s *Span) SetAttr(key string, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.data.Attributes[key] = value
+	s.mu.Unlock()
+}
+
+// SetError records that the work failed. A nil error is ignored.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.data.Error = err.Error()
+	s.mu.Unlock()
+}
+
+// End finishes the span and queues it to be exported. Only the first call has effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mu.Unlock()
+	s.tracer.queue(&data)
+}
+
+// TraceID returns the trace of the span, or the zero ID for a nil span.
+func (s *Span) TraceID() TraceID {
+	if s == nil {
+		return TraceID{}
+	}
+	return s.data.TraceID
+}
+
+// Traceparent returns the W3C traceparent header value to continue the trace in another service.
+func (s *Span) Traceparent() string {
+	if s == nil {
+		return ""
+	}
+	return "00-" + s.data.TraceID.String() + "-" + s.data.SpanID.String() + "-01"
+}
+
+type spanKey struct{}
+
+// FromContext returns the span of the context or nil.
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// ContextWithSpan returns a copy of the context holding the span.
+func ContextWithSpan(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// Detach returns a background context holding the span of ctx, for work that continues after the
+// request that began it, such as a deploy run in a go routine.
+func Detach(ctx context.Context) context.Context {
+	return ContextWithSpan(context.Background(), FromContext(ctx))
+}
+
+// Start begins a child of the span in ctx and returns a context holding it. If ctx holds no span,
+// the returned span is nil and ctx is returned unchanged.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	parent := FromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	s := parent.tracer.newSpan(name, parent.data.TraceID, parent.data.SpanID, false)
+	return ContextWithSpan(ctx, s), s
+}
+
+// Exporter sends finished spans to a tracing backend.
+type Exporter interface {
+	Export(spans []*SpanData) error
+	Close() error
+}
+
+// Tracer begins traces and exports their spans in the background.
+type Tracer struct {
+	service  string         // The service.name of the spans.
+	exporter Exporter       // Where spans are sent.
+	spans    chan *SpanData // Finished spans waiting to be exported.
+	flush    chan chan struct{}
+	done     chan struct{}
+	wg       sync.WaitGroup
+	onError  func(error) // Told when an export fails.
+}
+
+// New is a factory function that returns a Tracer for the service sending spans to the exporter.
+// onError, if not nil, is told of failed exports. Close the tracer to export the remaining spans.
+func New(service string, exporter Exporter, onError func(error)) *Tracer {
+	t := &Tracer{
+		service:  service,
+		exporter: exporter,
+		spans:    make(chan *SpanData, queueSize),
+		flush:    make(chan chan struct{}),
+		done:     make(chan struct{}),
+		onError:  onError,
+	}
+	t.wg.Add(1)
+	go t.run()
+	return t
+}
+
+// Service returns the service name of the tracer.
+func (t *Tracer) Service() string {
+	return t.service
+}
+
+// Root begins a trace for a request from a client and returns a context holding its span. The
+// trace and parent are used when the request continues a trace; a zero trace ID begins a new one.
+// A nil tracer returns a nil span.
+func (t *Tracer) Root(ctx context.Context, name string, traceID TraceID, parent SpanID) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	if traceID.IsZero() {
+		rand.Read(traceID[:])
+	}
+	s := t.newSpan(name, traceID, parent, true)
+	return ContextWithSpan(ctx, s), s
+}
+
+func (t *Tracer) newSpan(name string, traceID TraceID, parent SpanID, server bool) *Span {
+	s := &Span{tracer: t}
+	s.data.TraceID = traceID
+	s.data.ParentID = parent
+	s.data.Name = name
+	s.data.Server = server
+	s.data.Start = time.Now()
+	s.data.Attributes = make(map[string]string)
+	rand.Read(s.data.SpanID[:])
+	return s
+}
+
+// queue adds a finished span to be exported, dropping it if the queue is full.
+func (t *Tracer) queue(s *SpanData) {
+	select {
+	case t.spans <- s:
+	default:
+	}
+}
+
+// run exports spans in batches until the tracer is closed.
+func (t *Tracer) run() {
+	defer t.wg.Done()
+	tick := time.NewTicker(batchInterval)
+	defer tick.Stop()
+	batch := make([]*SpanData, 0, batchSize)
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.Export(batch); err != nil && t.onError != nil {
+			t.onError(err)
+		}
+		batch = make([]*SpanData, 0, batchSize)
+	}
+	drain := func() {
+		for {
+			select {
+			case s := <-t.spans:
+				batch = append(batch, s)
+				if len(batch) == batchSize {
+					export()
+				}
+			default:
+				return
+			}
+		}
+	}
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) == batchSize {
+				export()
+			}
+		case <-tick.C:
+			export()
+		case c := <-t.flush:
+			drain()
+			export()
+			close(c)
+		case <-t.done:
+			drain()
+			export()
+			return
+		}
+	}
+}
+
+// Flush exports the spans that have finished and waits for the export.
+func (t *Tracer) Flush() {
+	if t == nil {
+		return
+	}
+	c := make(chan struct{})
+	select {
+	case t.flush <- c:
+		<-c
+	case <-t.done:
+	}
+}
+
+// Close exports the remaining spans and closes the exporter.
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	close(t.done)
+	t.wg.Wait()
+	return t.exporter.Close()
+}
@@ -0,0 +1,181 @@
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// memoryExporter keeps exported spans for inspection.
+type memoryExporter struct {
+	mu    sync.Mutex
+	spans []*SpanData
+}
+
+func (m *memoryExporter) Export(spans []*SpanData) error {
+	m.mu.Lock()
+	m.spans = append(m.spans, spans...)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memoryExporter) Close() error { return nil }
+
+func TestParseTraceparent(t *testing.T) {
+	t.Parallel()
+	tid, sid, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if err != nil || tid.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sid.String() != "00f067aa0ba902b7" {
+		t.Errorf("A valid traceparent should be parsed, received %s %s %v.", tid, sid, err)
+	}
+	for _, v := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f35-77b3-4da6-a3ce-929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01",
+	} {
+		if _, _, err := ParseTraceparent(v); err == nil {
+			t.Errorf("Traceparent %q should be invalid.", v)
+		}
+	}
+}
+
+func TestParseTraceID(t *testing.T) {
+	t.Parallel()
+	tid, err := ParseTraceID("4BF92F35-77B3-4DA6-A3CE-929D0E0E4736")
+	if err != nil || tid.String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("A UUID should be a valid trace id, received %s %v.", tid, err)
+	}
+	if _, err := ParseTraceID("4BF92F35"); err == nil {
+		t.Errorf("A short id should be invalid.")
+	}
+}
+
+func TestSpans(t *testing.T) {
+	t.Parallel()
+	exp := &memoryExporter{}
+	tr := New("deploy", exp, nil)
+	tid, _ := ParseTraceID("4bf92f3577b34da6a3ce929d0e0e4736")
+
+	ctx, root := tr.Root(context.Background(), "HTTP POST /v1.0/deploy", tid, SpanID{})
+	ctx, child := Start(Detach(ctx), "fleetctl start")
+	child.SetAttr("unit", "web@1.service")
+	child.SetError(errors.New("exit status 1"))
+	child.End()
+	child.End()
+	root.End()
+	tr.Flush()
+
+	exp.mu.Lock()
+	defer exp.mu.Unlock()
+	if len(exp.spans) != 2 {
+		t.Fatalf("Each span should be exported once, received %d.", len(exp.spans))
+	}
+	c, r := exp.spans[0], exp.spans[1]
+	if c.TraceID != tid || r.TraceID != tid || c.ParentID != r.SpanID || !r.ParentID.IsZero() {
+		t.Errorf("The child should belong to the root span of the trace, received %+v %+v.", c, r)
+	}
+	if !r.Server || c.Server || c.Attributes["unit"] != "web@1.service" || c.Error != "exit status 1" {
+		t.Errorf("Span details should be exported, received %+v.", c)
+	}
+	if FromContext(ctx).Traceparent() != "00-"+tid.String()+"-"+c.SpanID.String()+"-01" {
+		t.Errorf("The traceparent should name the span, received %s.", FromContext(ctx).Traceparent())
+	}
+	if err := tr.Close(); err != nil {
+		t.Errorf("Close should succeed, received %s.", err)
+	}
+}
+
+func TestStartWithoutSpan(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	c, s := Start(ctx, "db.query")
+	if s != nil || c != ctx {
+		t.Errorf("Start should do nothing without a span in the context.")
+	}
+	s.SetAttr("k", "v")
+	s.SetError(errors.New("ignored"))
+	s.End()
+
+	var tr *Tracer
+	if _, s := tr.Root(ctx, "HTTP GET", TraceID{}, SpanID{}); s != nil {
+		t.Errorf("A nil tracer should not begin a trace.")
+	}
+	tr.Flush()
+	if tr.Close() != nil {
+		t.Errorf("Closing a nil tracer should succeed.")
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	t.Parallel()
+	var received otlpRequest
+	var path string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		b, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(b, &received)
+	}))
+	defer ts.Close()
+
+	tr := New("coreos-deploy", NewOTLPExporter("coreos-deploy", ts.URL), nil)
+	_, s := tr.Root(context.Background(), "HTTP GET /v1.0/info", TraceID{}, SpanID{})
+	s.SetError(errors.New("boom"))
+	s.End()
+	tr.Close()
+
+	if path != "/v1/traces" {
+		t.Errorf("Spans should be posted to /v1/traces, received %s.", path)
+	}
+	if len(received.ResourceSpans) != 1 || received.ResourceSpans[0].Resource.Attributes[0].Value.StringValue != "coreos-deploy" {
+		t.Fatalf("The service should be named in the resource, received %+v.", received)
+	}
+	spans := received.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 1 || spans[0].Name != "HTTP GET /v1.0/info" || spans[0].Kind != otlpKindServer ||
+		spans[0].Status == nil || spans[0].Status.Code != otlpStatusError || len(spans[0].TraceID) != 32 {
+		t.Errorf("The span should be encoded as OTLP JSON, received %+v.", spans)
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spans.json")
+	exp, err := NewFileExporter("coreos-deploy", path)
+	if err != nil {
+		t.Fatalf("The file should be opened, received %s.", err)
+	}
+	tr := New("coreos-deploy", exp, nil)
+	for i := 0; i < 2; i++ {
+		_, s := tr.Root(context.Background(), "HTTP GET", TraceID{}, SpanID{})
+		s.End()
+		tr.Flush()
+	}
+	tr.Close()
+
+	b, _ := ioutil.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Each export should be a line, received %q.", b)
+	}
+	for _, l := range lines {
+		var req otlpRequest
+		if err := json.Unmarshal([]byte(l), &req); err != nil || len(req.ResourceSpans) != 1 {
+			t.Errorf("Each line should be an OTLP export request, received %s.", l)
+		}
+	}
+}